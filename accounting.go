@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jrjsb4/tumblebus/client/db"
+	"io"
+	"strings"
+)
+
+// balanceSheetAccounts are the ledger accounts that QIF treats as accounts rather than categories, with
+// their QIF account type.
+var balanceSheetAccounts = map[string]string{
+	db.CashAccount:               "Bank",
+	db.CardClearingAccount:       "Bank",
+	db.AccountsReceivableAccount: "Oth A",
+}
+
+// qifCategory returns how the account is referred to from a QIF transaction, transfers to other accounts
+// are written in brackets.
+func qifCategory(account string) string {
+	if _, ok := balanceSheetAccounts[account]; ok {
+		return "[" + account + "]"
+	}
+	return account
+}
+
+// amount returns the signed amount of a posting, debits are positive.
+func amount(p db.Posting) float64 {
+	return p.Debit - p.Credit
+}
+
+// WriteQIF writes the journal in Quicken Interchange Format. Each entry is filed under the account of its
+// first posting, with the other postings as its categories or transfers.
+func WriteQIF(out io.Writer, entries []db.JournalEntry) error {
+	w := bufio.NewWriter(out)
+	var accounts []string
+	byAccount := make(map[string][]db.JournalEntry)
+	for _, e := range entries {
+		if len(e.Postings) == 0 {
+			continue
+		}
+		account := e.Postings[0].Account
+		if _, ok := byAccount[account]; !ok {
+			accounts = append(accounts, account)
+		}
+		byAccount[account] = append(byAccount[account], e)
+	}
+
+	for _, account := range accounts {
+		kind, ok := balanceSheetAccounts[account]
+		if !ok {
+			kind = "Oth A"
+		}
+		fmt.Fprintf(w, "!Account\nN%s\nT%s\n^\n!Type:%s\n", account, kind, kind)
+		for _, e := range byAccount[account] {
+			fmt.Fprintf(w, "D%s\nT%s\n", e.Date.Format("01/02/2006"), money(amount(e.Postings[0])))
+			if e.Name != "" {
+				fmt.Fprintf(w, "P%s\n", e.Name)
+			}
+			if e.Memo != "" {
+				fmt.Fprintf(w, "M%s\n", e.Memo)
+			}
+			if len(e.Postings) == 2 {
+				fmt.Fprintf(w, "L%s\n", qifCategory(e.Postings[1].Account))
+			} else {
+				for _, p := range e.Postings[1:] {
+					fmt.Fprintf(w, "S%s\n$%s\n", qifCategory(p.Account), money(-amount(p)))
+				}
+			}
+			w.WriteString("^\n")
+		}
+	}
+	return w.Flush()
+}
+
+// iifField keeps tabs and line breaks out of a field of a tab separated IIF file.
+func iifField(s string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+// WriteIIF writes the journal as QuickBooks general journal transactions in Intuit Interchange Format.
+func WriteIIF(out io.Writer, entries []db.JournalEntry) error {
+	w := bufio.NewWriter(out)
+	w.WriteString("!TRNS\tTRNSID\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tMEMO\n")
+	w.WriteString("!SPL\tSPLID\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tMEMO\n")
+	w.WriteString("!ENDTRNS\n")
+	for _, e := range entries {
+		for i, p := range e.Postings {
+			kind := "SPL"
+			if i == 0 {
+				kind = "TRNS"
+			}
+			fmt.Fprintf(w, "%s\t\tGENERAL JOURNAL\t%s\t%s\t%s\t%s\t%s\n", kind, e.Date.Format("01/02/2006"),
+				iifField(p.Account), iifField(e.Name), money(amount(p)), iifField(e.Memo))
+		}
+		w.WriteString("ENDTRNS\n")
+	}
+	return w.Flush()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Role is the level of access a caller has to the restricted parts of the API.
+type Role int
+
+const (
+	NoRole Role = iota
+	InstructorRole
+	AdminRole
+)
+
+// loadTokens reads the access tokens of each role from the environment. A role without a token can't be used.
+func loadTokens() map[Role]string {
+	return map[Role]string{
+		InstructorRole: os.Getenv("TUMBLEBUS_INSTRUCTOR_TOKEN"),
+		AdminRole:      os.Getenv("TUMBLEBUS_ADMIN_TOKEN"),
+	}
+}
+
+// role returns the role granted by the bearer token of the request.
+func (Tb *TumbleBusAPI) role(r *http.Request) Role {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return NoRole
+	}
+	for _, role := range []Role{AdminRole, InstructorRole} {
+		expected := Tb.tokens[role]
+		if expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return role
+		}
+	}
+	return NoRole
+}
+
+// restricted only lets callers holding at least the given role through to the handler.
+func (Tb *TumbleBusAPI) restricted(role Role, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if Tb.role(r) < role {
+			writeError(w, http.StatusForbidden, errors.New("You are not allowed to access this information"))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// feedToken returns the token that lets the calendar feed of the client be read without a role, so calendar
+// applications can subscribe to it. It is empty when no feed secret is configured.
+func (Tb *TumbleBusAPI) feedToken(clientId string) string {
+	if Tb.feedSecret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(Tb.feedSecret))
+	mac.Write([]byte(clientId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// feedAllowed reports whether the request may read the calendar feed of the client: staff always may, and
+// anyone else with the feed token of the client as the token query parameter.
+func (Tb *TumbleBusAPI) feedAllowed(r *http.Request, clientId string) bool {
+	if Tb.role(r) >= InstructorRole {
+		return true
+	}
+	expected := Tb.feedToken(clientId)
+	return expected != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(expected)) == 1
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"encoding/json"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// AgeGroup is a band of ages that classes are organised by.
+type AgeGroup struct {
+	Name   string `json:"name"`
+	MinAge int    `json:"minage"`
+	MaxAge int    `json:"maxage"`
+}
+
+// AgeGroups are the class levels children are placed in by age.
+var AgeGroups = []AgeGroup{
+	{"Under 3", 0, 2},
+	{"3-4 yrs", 3, 4},
+	{"5-6 yrs", 5, 6},
+	{"7-8 yrs", 7, 8},
+	{"9+ yrs", 9, 200},
+}
+
+// AgeOn returns the age of the child in whole years on the given day.
+func (c *Child) AgeOn(day time.Time) int {
+	return yearsBetween(c.DOB, day)
+}
+
+// AgeGroupOn returns the name of the age group the child belongs to on the given day.
+func (c *Child) AgeGroupOn(day time.Time) string {
+	age := c.AgeOn(day)
+	for _, group := range AgeGroups {
+		if age >= group.MinAge && age <= group.MaxAge {
+			return group.Name
+		}
+	}
+	return ""
+}
+
+// AgeBetween reports whether the child is between minAge and maxAge years old, inclusive, on the given day.
+func (c *Child) AgeBetween(minAge, maxAge int, day time.Time) bool {
+	age := c.AgeOn(day)
+	return age >= minAge && age <= maxAge
+}
+
+// MarshalJSON adds the current age and age group of the child, derived from the date of birth.
+func (c Child) MarshalJSON() ([]byte, error) {
+	type child Child
+	now := time.Now()
+	return json.Marshal(struct {
+		child
+		Age      int    `json:"age"`
+		AgeGroup string `json:"agegroup"`
+	}{child(c), c.AgeOn(now), c.AgeGroupOn(now)})
+}
+
+// AgeReference returns the day ages are measured on for a season: the start of the season, or today
+// when there is no season.
+func AgeReference(season *Season) time.Time {
+	if season != nil && !season.Start.IsZero() {
+		return season.Start
+	}
+	return time.Now()
+}
+
+// yearsBetween returns the number of whole years from birth to day. A child born on the 29th of February
+// turns a year older on the 1st of March in common years.
+func yearsBetween(birth, day time.Time) int {
+	if birth.IsZero() || day.Before(birth) {
+		return 0
+	}
+	birth = birth.In(day.Location())
+	years := day.Year() - birth.Year()
+	if day.Month() < birth.Month() || (day.Month() == birth.Month() && day.Day() < birth.Day()) {
+		years--
+	}
+	return years
+}
+
+// bornBetween returns the range of birth dates of children aged minAge to maxAge years on the given day.
+// Children born after the earliest date and on or before the latest date qualify.
+func bornBetween(minAge, maxAge int, day time.Time) (earliest, latest time.Time) {
+	day = time.Date(day.Year(), day.Month(), day.Day(), 23, 59, 59, 0, day.Location())
+	return day.AddDate(-(maxAge + 1), 0, 0), day.AddDate(-minAge, 0, 0)
+}
+
+// ClientsWithChildAged returns the clients with at least one child aged minAge to maxAge years on the given day.
+func ClientsWithChildAged(clients []Client, minAge, maxAge int, day time.Time) (matching []Client) {
+	for _, client := range clients {
+		for _, child := range client.Children {
+			if child.AgeBetween(minAge, maxAge, day) {
+				matching = append(matching, client)
+				break
+			}
+		}
+	}
+	return
+}
+
+// FindClientsByAge returns the clients with at least one child aged minAge to maxAge years on the given day.
+func (c *MongoConnection) FindClientsByAge(minAge, maxAge int, asOf time.Time) (clients []Client, err error) {
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	earliest, latest := bornBetween(minAge, maxAge, asOf)
+	err = clientCollection.Find(bson.M{
+		"children": bson.M{"$elemMatch": bson.M{"dob": bson.M{"$gt": earliest, "$lte": latest}}},
+	}).All(&clients)
+	return
+}
+
+// RemoveStoredAges removes the ages that used to be stored with each child, since they went stale on every
+// birthday. Ages are now derived from the date of birth.
+func (c *MongoConnection) RemoveStoredAges() (updated int, err error) {
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	type childrenDoc struct {
+		Id       bson.ObjectId `bson:"_id"`
+		Children []bson.M      `bson:"children"`
+	}
+	iter := clientCollection.Find(bson.M{"children.age": bson.M{"$exists": true}}).Iter()
+	for {
+		doc := childrenDoc{}
+		if !iter.Next(&doc) {
+			break
+		}
+		for _, child := range doc.Children {
+			delete(child, "age")
+		}
+		if err = clientCollection.UpdateId(doc.Id, bson.M{"$set": bson.M{"children": doc.Children}}); err != nil {
+			iter.Close()
+			return
+		}
+		updated++
+	}
+	err = iter.Close()
+	return
+}
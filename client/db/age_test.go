@@ -0,0 +1,62 @@
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAge(t *testing.T) {
+	child := Child{FirstName: "Leap", LastName: "Day", DOB: time.Date(2012, time.February, 29, 0, 0, 0, 0, time.Local)}
+	ages := []struct {
+		day   time.Time
+		age   int
+		group string
+	}{
+		{time.Date(2012, time.January, 1, 0, 0, 0, 0, time.Local), 0, "Under 3"},
+		{time.Date(2015, time.February, 28, 0, 0, 0, 0, time.Local), 2, "Under 3"},
+		{time.Date(2015, time.March, 1, 0, 0, 0, 0, time.Local), 3, "3-4 yrs"},
+		{time.Date(2016, time.February, 29, 0, 0, 0, 0, time.Local), 4, "3-4 yrs"},
+		{time.Date(2017, time.September, 1, 0, 0, 0, 0, time.Local), 5, "5-6 yrs"},
+		{time.Date(2022, time.March, 1, 0, 0, 0, 0, time.Local), 10, "9+ yrs"},
+	}
+	for _, a := range ages {
+		if age := child.AgeOn(a.day); age != a.age {
+			t.Errorf("Expected age %d on %s, got %d", a.age, a.day.Format("2006-01-02"), age)
+		}
+		if group := child.AgeGroupOn(a.day); group != a.group {
+			t.Errorf("Expected age group %s on %s, got %s", a.group, a.day.Format("2006-01-02"), group)
+		}
+	}
+
+	// The age of a child in a season is measured on its first day
+	season := &Season{Name: "Fall", Start: time.Date(2017, time.September, 1, 0, 0, 0, 0, time.Local)}
+	if !AgeReference(season).Equal(season.Start) {
+		t.Error("Ages should be measured at the start of the season")
+	}
+
+	day := time.Date(2017, time.September, 1, 0, 0, 0, 0, time.Local)
+	clients := []Client{
+		Client{Children: []*Child{&child}},
+		Client{Children: []*Child{&Child{DOB: time.Date(2014, time.September, 2, 0, 0, 0, 0, time.Local)}}},
+	}
+	if matching := ClientsWithChildAged(clients, 3, 5, day); len(matching) != 1 {
+		t.Error("Expected only the client with a five year old, got ", matching)
+	}
+	earliest, latest := bornBetween(3, 5, day)
+	if !child.DOB.After(earliest) || child.DOB.After(latest) {
+		t.Error("A five year old should be born in the range ", earliest, latest)
+	}
+	if dob := clients[1].Children[0].DOB; !dob.After(latest) {
+		t.Error("A child turning three tomorrow should be born after the range ", latest)
+	}
+
+	raw, err := json.Marshal(child)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(raw), `"age":`) || !strings.Contains(string(raw), `"agegroup":`) {
+		t.Error("Expected the age and age group in the JSON of a child: ", string(raw))
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Attendance records which children were present at a session of a class.
+type Attendance struct {
+	Key      string    `bson:"_id" json:"key"`
+	SchoolId string    `bson:"schoolid" json:"schoolid"`
+	Season   string    `bson:"season" json:"season"`
+	Class    string    `bson:"class" json:"class"`
+	Date     time.Time `bson:"date" json:"date"`
+	Present  []string  `bson:"present" json:"present"`
+	Recorded time.Time `bson:"recorded" json:"recorded"`
+}
+
+// attendanceKey identifies the attendance of a session of a class.
+func attendanceKey(schoolId, season, class string, day time.Time) string {
+	return seatKey(schoolId, season, class) + "/" + day.Format("2006-01-02")
+}
+
+// seatedPresent returns the children present once each, in the order first given, and an error naming any
+// child that does not hold a seat in the class.
+func seatedPresent(present, seated []string) (children []string, err error) {
+	holders := make(map[string]bool, len(seated))
+	for _, childId := range seated {
+		holders[childId] = true
+	}
+	seen := make(map[string]bool, len(present))
+	for _, childId := range present {
+		if seen[childId] {
+			continue
+		}
+		if !holders[childId] {
+			return nil, fmt.Errorf("Child %s does not hold a seat in the class", childId)
+		}
+		seen[childId] = true
+		children = append(children, childId)
+	}
+	return
+}
+
+// seatedChildren returns the children holding a seat in the class.
+func (c *MongoConnection) seatedChildren(schoolId, season, class string) (children []string, err error) {
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = enrollmentCollection.Find(bson.M{
+		"schoolid": schoolId, "season": season, "class": class,
+		"state": bson.M{"$in": seatHoldingStates}, "waitlisted": bson.M{"$ne": true},
+	}).Distinct("childid", &children)
+	return
+}
+
+// RecordAttendance records the children present at the session of a class on the given day, replacing
+// anything recorded for that session before. Each child is counted once and must hold a seat in the class.
+func (c *MongoConnection) RecordAttendance(schoolName, season, class string, day time.Time, present []string) (attendance *Attendance, err error) {
+	if day.IsZero() {
+		return nil, errors.New("Attendance requires the date of the session")
+	}
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	sessions, err := school.classSessions(season, class, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return
+	}
+	held := false
+	for _, session := range sessions {
+		held = held || (!session.Cancelled && sameDay(session.Start, day))
+	}
+	if !held {
+		return nil, fmt.Errorf("%s has no session at %s on %s", class, schoolName, day.Format("January 2, 2006"))
+	}
+	seated, err := c.seatedChildren(school.Id.Hex(), season, class)
+	if err != nil {
+		return
+	}
+	if present, err = seatedPresent(present, seated); err != nil {
+		return
+	}
+
+	session, attendanceCollection, err := c.getCollection(attendanceCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	date := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	attendance = &Attendance{
+		Key:      attendanceKey(school.Id.Hex(), season, class, date),
+		SchoolId: school.Id.Hex(),
+		Season:   season,
+		Class:    class,
+		Date:     date,
+		Present:  present,
+		Recorded: time.Now(),
+	}
+	_, err = attendanceCollection.UpsertId(attendance.Key, attendance)
+	return
+}
+
+// ListAttendance returns the attendance recorded at the school between from and to.
+func (c *MongoConnection) ListAttendance(schoolName string, from, to time.Time) (attendance []Attendance, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	session, attendanceCollection, err := c.getCollection(attendanceCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = attendanceCollection.Find(bson.M{
+		"schoolid": school.Id.Hex(),
+		"date":     bson.M{"$gte": from, "$lte": to},
+	}).Sort("date", "class").All(&attendance)
+	return
+}
@@ -0,0 +1,20 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeatedPresent(t *testing.T) {
+	seated := []string{"ann", "bob", "cy"}
+	present, err := seatedPresent([]string{"bob", "ann", "bob"}, seated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(present, []string{"bob", "ann"}) {
+		t.Errorf("Expected each child to be counted once, got %v", present)
+	}
+	if _, err := seatedPresent([]string{"ann", "dee"}, seated); err == nil {
+		t.Error("Expected a child without a seat in the class to be rejected")
+	}
+}
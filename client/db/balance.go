@@ -0,0 +1,55 @@
+package db
+
+import (
+	"time"
+)
+
+// nextPeriod returns the start of the billing period after the one starting on the day.
+func (f PaymentFrequency) nextPeriod(day time.Time) time.Time {
+	switch f {
+	case Weekly:
+		return day.AddDate(0, 0, 7)
+	case BiWeekly:
+		return day.AddDate(0, 0, 14)
+	case Quarterly:
+		return day.AddDate(0, 3, 0)
+	}
+	return day.AddDate(0, 1, 0)
+}
+
+// billingPeriods returns the start of every billing period of the payment method that has started by the
+// day, up to its end date.
+func (m *PaymentMethod) billingPeriods(day time.Time) (starts []time.Time) {
+	if m.StartDate.IsZero() || m.UnitCost <= 0 {
+		return
+	}
+	last := day
+	if !m.EndDate.IsZero() && m.EndDate.Before(last) {
+		last = m.EndDate
+	}
+	for start := m.StartDate; !start.After(last); start = m.Frequency.nextPeriod(start) {
+		starts = append(starts, start)
+	}
+	return
+}
+
+// Billed returns what the client has been billed by the day: the unit cost for every billing period that
+// has started between the start and end dates of the payment method.
+func (c *Client) Billed(day time.Time) float64 {
+	return roundCents(float64(len(c.PaymentMethod.billingPeriods(day))) * c.PaymentMethod.UnitCost)
+}
+
+// Paid returns the total of the payments of the client.
+func (c *Client) Paid() (paid float64) {
+	for _, p := range c.Payments {
+		if p != nil {
+			paid += p.Amount
+		}
+	}
+	return roundCents(paid)
+}
+
+// BalanceOwed returns what the client owes on the day, negative when the family has paid ahead.
+func (c *Client) BalanceOwed(day time.Time) float64 {
+	return roundCents(c.Billed(day) - c.Paid())
+}
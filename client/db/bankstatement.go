@@ -0,0 +1,238 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BankTransaction is a line of a bank statement. Deposits are positive and withdrawals negative.
+type BankTransaction struct {
+	Id          string    `bson:"_id" json:"id"`
+	Date        time.Time `bson:"date" json:"date"`
+	Amount      float64   `bson:"amount" json:"amount"`
+	Description string    `bson:"description" json:"description"`
+	Reference   string    `bson:"reference" json:"reference"`
+	Imported    time.Time `bson:"imported" json:"imported"`
+	Status      BankMatch `bson:"status" json:"status"`
+	EntryId     string    `bson:"entryid,omitempty" json:"entryid,omitempty"`
+	Confidence  float64   `bson:"confidence" json:"confidence"`
+	Suggestions []Match   `bson:"suggestions,omitempty" json:"suggestions,omitempty"`
+}
+
+// dateFormats are the date formats banks and spreadsheets write in CSV files.
+var dateFormats = []string{"2006-01-02", "01/02/2006", "1/2/2006", "01/02/06", "1/2/06", "20060102"}
+
+// parseDate reads a date in any of the formats banks and spreadsheets use.
+func parseDate(s string) (day time.Time, err error) {
+	s = strings.TrimSpace(s)
+	for _, format := range dateFormats {
+		if day, err = time.ParseInLocation(format, s, time.Local); err == nil {
+			return
+		}
+	}
+	return day, fmt.Errorf("Unrecognised date %q", s)
+}
+
+// parseBankAmount reads an amount such as -1,250.00, $40 or (40.00).
+func parseBankAmount(s string) (amount float64, err error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")")
+	s = strings.NewReplacer("(", "", ")", "", "$", "", ",", "", " ", "").Replace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if amount, err = strconv.ParseFloat(s, 64); err != nil {
+		return 0, fmt.Errorf("Unrecognised amount %q", s)
+	}
+	if negative {
+		amount = -amount
+	}
+	return roundCents(amount), nil
+}
+
+// transactionId identifies a transaction the bank gave no id for by its contents and how many identical
+// transactions came before it in the statement, counted in repeats. Importing the same statement twice
+// doesn't duplicate it, and two identical deposits on the same day are both kept.
+func transactionId(t *BankTransaction, repeats map[string]int) string {
+	contents := fmt.Sprintf("%s|%.2f|%s|%s", t.Date.Format("2006-01-02"), t.Amount, t.Description, t.Reference)
+	key := contents
+	if n := repeats[contents]; n > 0 {
+		key = fmt.Sprintf("%s|%d", contents, n)
+	}
+	repeats[contents]++
+	sum := sha1.Sum([]byte(key))
+	return "bank-" + hex.EncodeToString(sum[:10])
+}
+
+// bankColumns maps the column headings banks use onto the fields of a transaction.
+var bankColumns = map[string]string{
+	"date": "date", "posted": "date", "posting date": "date", "transaction date": "date",
+	"amount": "amount",
+	"debit":  "debit", "withdrawal": "debit", "withdrawals": "debit",
+	"credit": "credit", "deposit": "credit", "deposits": "credit",
+	"description": "description", "memo": "description", "payee": "description", "name": "description",
+	"reference": "reference", "check": "reference", "check number": "reference", "check #": "reference", "ref": "reference",
+	"id": "id", "fitid": "id", "transaction id": "id",
+}
+
+// ParseBankCSV reads a bank statement exported as CSV. The first row must name the columns, which may be a
+// signed amount or separate debit and credit columns.
+func ParseBankCSV(in io.Reader) (transactions []BankTransaction, err error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the statement heading: %s", err.Error())
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		if field, ok := bankColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			if _, seen := columns[field]; !seen {
+				columns[field] = i
+			}
+		}
+	}
+	_, hasAmount := columns["amount"]
+	_, hasCredit := columns["credit"]
+	if _, ok := columns["date"]; !ok || (!hasAmount && !hasCredit) {
+		return nil, errors.New("A bank statement needs a date column and an amount or debit and credit columns")
+	}
+	get := func(record []string, field string) string {
+		if i, ok := columns[field]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	repeats := make(map[string]int)
+	for line := 2; ; line++ {
+		record, readErr := r.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, readErr.Error())
+		}
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		t := BankTransaction{Description: get(record, "description"), Reference: get(record, "reference")}
+		if t.Date, err = parseDate(get(record, "date")); err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err.Error())
+		}
+		if hasAmount {
+			t.Amount, err = parseBankAmount(get(record, "amount"))
+		} else {
+			var debit, credit float64
+			if debit, err = parseBankAmount(get(record, "debit")); err == nil {
+				credit, err = parseBankAmount(get(record, "credit"))
+			}
+			t.Amount = roundCents(credit - debit)
+			if debit < 0 {
+				t.Amount = roundCents(credit + debit)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err.Error())
+		}
+		if t.Id = get(record, "id"); t.Id == "" {
+			t.Id = transactionId(&t, repeats)
+		} else {
+			t.Id = "csv-" + t.Id
+		}
+		transactions = append(transactions, t)
+	}
+	return
+}
+
+// ParseOFX reads the transactions of a bank statement in OFX, either the SGML 1.x form banks still send or
+// the XML 2.x form.
+func ParseOFX(in io.Reader) (transactions []BankTransaction, err error) {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	scanner.Split(splitOFX)
+
+	var current *BankTransaction
+	repeats := make(map[string]int)
+	for scanner.Scan() {
+		token := scanner.Text()
+		end := strings.Index(token, ">")
+		if end < 0 {
+			continue
+		}
+		tag := strings.ToUpper(strings.TrimSpace(token[:end]))
+		value := ofxText.Replace(strings.TrimSpace(token[end+1:]))
+		switch {
+		case tag == "STMTTRN":
+			current = &BankTransaction{}
+		case tag == "/STMTTRN" && current != nil:
+			if current.Date.IsZero() {
+				return nil, errors.New("A transaction in the statement has no date")
+			}
+			if current.Id == "" {
+				current.Id = transactionId(current, repeats)
+			} else {
+				current.Id = "ofx-" + current.Id
+			}
+			transactions = append(transactions, *current)
+			current = nil
+		case current == nil:
+		case tag == "DTPOSTED":
+			if len(value) < 8 {
+				return nil, fmt.Errorf("Unrecognised date %q", value)
+			}
+			if current.Date, err = time.ParseInLocation("20060102", value[:8], time.Local); err != nil {
+				return
+			}
+		case tag == "TRNAMT":
+			if current.Amount, err = parseBankAmount(value); err != nil {
+				return
+			}
+		case tag == "FITID":
+			current.Id = value
+		case tag == "CHECKNUM" || (tag == "REFNUM" && current.Reference == ""):
+			current.Reference = value
+		case tag == "NAME":
+			current.Description = strings.TrimSpace(value + " " + current.Description)
+		case tag == "MEMO":
+			current.Description = strings.TrimSpace(current.Description + " " + value)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if current != nil {
+		return nil, errors.New("The statement ends part way through a transaction")
+	}
+	return
+}
+
+// ofxText unescapes the character entities OFX text may hold.
+var ofxText = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", "\"", "&apos;", "'")
+
+// splitOFX splits an OFX file into its elements, each token being a tag name, a '>' and any text up to the
+// next tag.
+func splitOFX(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := bytes.IndexByte(data, '<')
+	if start < 0 {
+		return len(data), nil, nil
+	}
+	next := bytes.IndexByte(data[start+1:], '<')
+	if next < 0 {
+		if !atEOF {
+			return 0, nil, nil
+		}
+		return len(data), data[start+1:], nil
+	}
+	return start + 1 + next, data[start+1 : start+1+next], nil
+}
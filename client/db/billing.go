@@ -0,0 +1,404 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// ChargeStatus is the outcome of an attempt to charge a card.
+type ChargeStatus string
+
+const (
+	ChargePending   ChargeStatus = "pending"
+	ChargeSucceeded ChargeStatus = "succeeded"
+	ChargeDeclined  ChargeStatus = "declined"
+	ChargeFailed    ChargeStatus = "failed"
+)
+
+// ChargeAttempt records charging the card of a client. Its id is the idempotency key of the charge, so
+// asking for the same charge again returns the attempt rather than charging the card twice.
+type ChargeAttempt struct {
+	Id              string           `bson:"_id" json:"id"`
+	ClientId        string           `bson:"clientid" json:"clientid"`
+	Amount          float64          `bson:"amount" json:"amount"`
+	Description     string           `bson:"description" json:"description"`
+	Card            string           `bson:"card" json:"card"`
+	Status          ChargeStatus     `bson:"status" json:"status"`
+	AuthorizationId string           `bson:"authorizationid,omitempty" json:"authorizationid,omitempty"`
+	ChargeId        string           `bson:"chargeid,omitempty" json:"chargeid,omitempty"`
+	Error           string           `bson:"error,omitempty" json:"error,omitempty"`
+	Tries           int              `bson:"tries" json:"tries"`
+	Refunded        float64          `bson:"refunded" json:"refunded"`
+	Refunds         []*RefundAttempt `bson:"refunds,omitempty" json:"refunds,omitempty"`
+	Recorded        bool             `bson:"recorded" json:"recorded"`
+	Created         time.Time        `bson:"created" json:"created"`
+	Updated         time.Time        `bson:"updated" json:"updated"`
+}
+
+// RefundAttempt records refunding some of a charge. Its key is the idempotency key of the refund, and its
+// amount is held against the charge unless the processor declined it.
+type RefundAttempt struct {
+	Key      string       `bson:"key" json:"key"`
+	Amount   float64      `bson:"amount" json:"amount"`
+	Status   ChargeStatus `bson:"status" json:"status"`
+	RefundId string       `bson:"refundid,omitempty" json:"refundid,omitempty"`
+	Error    string       `bson:"error,omitempty" json:"error,omitempty"`
+	Recorded bool         `bson:"recorded" json:"recorded"`
+	Updated  time.Time    `bson:"updated" json:"updated"`
+}
+
+// findRefund returns the refund of the charge made under the key, nil when there is none.
+func (a *ChargeAttempt) findRefund(key string) *RefundAttempt {
+	for _, refund := range a.Refunds {
+		if refund.Key == key {
+			return refund
+		}
+	}
+	return nil
+}
+
+// chargeGateway returns the gateway cards are charged through.
+func (c *MongoConnection) chargeGateway() (gateway Gateway, err error) {
+	if c.gateway == nil {
+		return nil, errors.New("No payment gateway is configured")
+	}
+	return c.gateway, nil
+}
+
+// cardToken returns the gateway token for the card of the client, exchanging the card number for one the
+// first time. Once the card has a token only its last four digits are kept.
+func (c *MongoConnection) cardToken(client *Client) (token string, err error) {
+	method := &client.PaymentMethod
+	if method.Method != CreditCard {
+		return "", errors.New("The client doesn't pay by credit card")
+	}
+	if method.Token != "" {
+		return method.Token, nil
+	}
+	gateway, err := c.chargeGateway()
+	if err != nil {
+		return
+	}
+	token, err = gateway.Tokenize(&Card{
+		Number:       method.CcNumber,
+		Expiration:   method.ExpirationDate,
+		SecurityCode: method.SecurityCode,
+		Name:         method.CcName,
+	})
+	if err != nil {
+		return
+	}
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	method.Token = token
+	method.CcNumber = maskCard(method.CcNumber)
+	method.SecurityCode = ""
+	err = clientCollection.UpdateId(client.Id, bson.M{"$set": bson.M{
+		"paymentmethod.token":        method.Token,
+		"paymentmethod.ccnumber":     method.CcNumber,
+		"paymentmethod.securitycode": "",
+	}})
+	return
+}
+
+// ChargeClient charges the card of the client. The key identifies the charge, such as the client and billing
+// period, and makes charging idempotent: a charge that succeeded or was declined is returned as it was, and one
+// that failed on a temporary error, such as a timeout, is tried again under the same key so the processor
+// doesn't charge twice. A successful charge is recorded as a credit card payment.
+func (c *MongoConnection) ChargeClient(clientId string, amount float64, key, description string) (attempt *ChargeAttempt, err error) {
+	if amount <= 0 {
+		return nil, errors.New("A charge must be for a positive amount")
+	}
+	if key == "" {
+		return nil, errors.New("A charge requires an idempotency key")
+	}
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+	// Dead cards are never sent to the processor
+	if method := client.PaymentMethod; method.Method == CreditCard && cardExpired(method.ExpirationDate, time.Now()) {
+		return nil, fmt.Errorf("The card ending %s expired in %s", maskCard(method.CcNumber), method.ExpirationDate.Format("January 2006"))
+	}
+
+	session, chargeCollection, err := c.getCollection(chargeCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	now := time.Now()
+	attempt = &ChargeAttempt{
+		Id:          key,
+		ClientId:    clientId,
+		Amount:      roundCents(amount),
+		Description: description,
+		Card:        maskCard(client.PaymentMethod.CcNumber),
+		Status:      ChargePending,
+		Created:     now,
+	}
+	if err = chargeCollection.Insert(attempt); err != nil {
+		if !mgo.IsDup(err) {
+			return nil, err
+		}
+		if err = chargeCollection.FindId(key).One(attempt); err != nil {
+			return nil, err
+		}
+		if attempt.ClientId != clientId || attempt.Amount != roundCents(amount) {
+			return nil, fmt.Errorf("Charge %s was for a different client or amount", key)
+		}
+		if attempt.Status == ChargeSucceeded && !attempt.Recorded {
+			return attempt, c.recordCharge(attempt)
+		}
+		if attempt.Status == ChargeSucceeded || attempt.Status == ChargeDeclined {
+			return attempt, nil
+		}
+	}
+
+	// Only one request works on an attempt at a time
+	claim := mgo.Change{
+		Update:    bson.M{"$set": bson.M{"status": ChargePending, "updated": now}, "$inc": bson.M{"tries": 1}},
+		ReturnNew: true,
+	}
+	claimed := bson.M{"_id": key, "$or": []bson.M{
+		{"status": ChargeFailed},
+		{"status": ChargePending, "tries": 0},
+		{"status": ChargePending, "updated": bson.M{"$lt": now.Add(-time.Minute)}},
+	}}
+	if _, err = chargeCollection.Find(claimed).Apply(claim, attempt); err != nil {
+		if err == mgo.ErrNotFound {
+			err = fmt.Errorf("Charge %s is already in progress", key)
+		}
+		return nil, err
+	}
+
+	chargeErr := c.charge(client, attempt)
+	attempt.Updated = time.Now()
+	switch gatewayErr, ok := chargeErr.(*GatewayError); {
+	case chargeErr == nil:
+		attempt.Status = ChargeSucceeded
+		attempt.Error = ""
+	case ok && !gatewayErr.Temporary:
+		attempt.Status = ChargeDeclined
+		attempt.Error = chargeErr.Error()
+	default:
+		attempt.Status = ChargeFailed
+		attempt.Error = chargeErr.Error()
+	}
+	if err = chargeCollection.UpdateId(key, attempt); err != nil {
+		return
+	}
+	if attempt.Status == ChargeSucceeded {
+		err = c.recordCharge(attempt)
+	}
+	return
+}
+
+// recordCardPayment adds the payment to the client unless a payment with its reference has already been
+// added, and posts it to the journal.
+func (c *MongoConnection) recordCardPayment(clientId string, payment *Payment) (err error) {
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	unrecorded := bson.M{"_id": bson.ObjectIdHex(clientId), "payments.reference": bson.M{"$ne": payment.Reference}}
+	err = clientCollection.Update(unrecorded, bson.M{"$push": bson.M{"payments": bson.M{
+		"method": payment.Method, "date": payment.Date, "amount": payment.Amount, "reference": payment.Reference,
+	}}})
+	if err != nil && err != mgo.ErrNotFound {
+		return
+	}
+	// The journal entry is keyed by the payment as stored, so posting it again when only posting failed is
+	// harmless
+	return c.postFamilyPayment(clientId, payment)
+}
+
+// recordCharge records a successful charge as a credit card payment of the client, unless the payment has
+// already been recorded, and marks the attempt recorded. A charge whose payment couldn't be recorded is
+// recorded when the charge is asked for again.
+func (c *MongoConnection) recordCharge(attempt *ChargeAttempt) (err error) {
+	payment := &Payment{Method: CreditCard, Date: attempt.Updated, Amount: attempt.Amount, Reference: attempt.ChargeId}
+	if err = c.recordCardPayment(attempt.ClientId, payment); err != nil {
+		return
+	}
+	session, chargeCollection, err := c.getCollection(chargeCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	attempt.Recorded = true
+	err = chargeCollection.UpdateId(attempt.Id, bson.M{"$set": bson.M{"recorded": true}})
+	return
+}
+
+// charge authorizes and captures the amount of the attempt on the card of the client.
+func (c *MongoConnection) charge(client *Client, attempt *ChargeAttempt) (err error) {
+	token, err := c.cardToken(client)
+	if err != nil {
+		return
+	}
+	attempt.Card = client.PaymentMethod.CcNumber
+	gateway, err := c.chargeGateway()
+	if err != nil {
+		return
+	}
+	if attempt.AuthorizationId == "" {
+		authorization, authErr := gateway.Authorize(token, attempt.Amount, attempt.Id)
+		if authErr != nil {
+			return authErr
+		}
+		attempt.AuthorizationId = authorization.Id
+	}
+	attempt.ChargeId, err = gateway.Capture(attempt.AuthorizationId, attempt.Amount)
+	return
+}
+
+// GetChargeAttempt returns the charge attempt with the given key.
+func (c *MongoConnection) GetChargeAttempt(key string) (attempt *ChargeAttempt, err error) {
+	session, chargeCollection, err := c.getCollection(chargeCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	if err = chargeCollection.FindId(key).One(&attempt); err == mgo.ErrNotFound {
+		err = fmt.Errorf("Charge %s not found", key)
+	}
+	return
+}
+
+// ListChargeAttempts returns the charge attempts of a client, newest first.
+func (c *MongoConnection) ListChargeAttempts(clientId string) (attempts []ChargeAttempt, err error) {
+	session, chargeCollection, err := c.getCollection(chargeCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = chargeCollection.Find(bson.M{"clientid": clientId}).Sort("-created").All(&attempts)
+	return
+}
+
+// RefundCharge refunds some or all of a successful charge to the card, and records the refund as a negative
+// credit card payment. The refund key makes refunding idempotent like the key of a charge: a refund that failed
+// on a temporary error, such as a timeout, keeps its amount held against the charge and is tried again under
+// the same key, and one that succeeded is returned as it was, recording its payment if that failed before.
+func (c *MongoConnection) RefundCharge(key string, amount float64, refundKey string) (attempt *ChargeAttempt, err error) {
+	if refundKey == "" {
+		return nil, errors.New("A refund requires an idempotency key")
+	}
+	attempt, err = c.GetChargeAttempt(key)
+	if err != nil {
+		return
+	}
+	if attempt.Status != ChargeSucceeded {
+		return nil, fmt.Errorf("Charge %s did not succeed and can't be refunded", key)
+	}
+	amount = roundCents(amount)
+	gateway, err := c.chargeGateway()
+	if err != nil {
+		return
+	}
+
+	session, chargeCollection, err := c.getCollection(chargeCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	refund := attempt.findRefund(refundKey)
+	switch {
+	case refund != nil && refund.Amount != amount:
+		return nil, fmt.Errorf("Refund %s was for a different amount", refundKey)
+	case refund != nil && refund.Status == ChargeSucceeded:
+		if !refund.Recorded {
+			err = c.recordRefund(attempt, refund)
+		}
+		return
+	case refund != nil && refund.Status == ChargeDeclined:
+		return nil, fmt.Errorf("Refund %s was declined: %s", refundKey, refund.Error)
+	case refund == nil:
+		if amount <= 0 || roundCents(attempt.Refunded+amount) > attempt.Amount {
+			return nil, fmt.Errorf("Only %.2f of charge %s can be refunded", attempt.Amount-attempt.Refunded, key)
+		}
+		// Hold the amount first, so refunds made at the same time can't add up to more than was charged
+		refund = &RefundAttempt{Key: refundKey, Amount: amount, Status: ChargePending, Updated: time.Now()}
+		reserve := mgo.Change{
+			Update:    bson.M{"$inc": bson.M{"refunded": amount}, "$push": bson.M{"refunds": refund}},
+			ReturnNew: true,
+		}
+		available := bson.M{
+			"_id":         key,
+			"status":      ChargeSucceeded,
+			"refunded":    bson.M{"$lte": attempt.Amount - amount + 0.001},
+			"refunds.key": bson.M{"$ne": refundKey},
+		}
+		if _, err = chargeCollection.Find(available).Apply(reserve, attempt); err != nil {
+			if err == mgo.ErrNotFound {
+				err = fmt.Errorf("Charge %s has been refunded in the meantime, please try again", key)
+			}
+			return nil, err
+		}
+		refund = attempt.findRefund(refundKey)
+	}
+
+	refundId, refundErr := gateway.Refund(attempt.ChargeId, amount, refundKey)
+	refund.Updated = time.Now()
+	update := bson.M{"refunds.$.updated": refund.Updated}
+	change := bson.M{"$set": update}
+	switch gatewayErr, ok := refundErr.(*GatewayError); {
+	case refundErr == nil:
+		refund.Status, refund.RefundId, refund.Error = ChargeSucceeded, refundId, ""
+		update["refunds.$.refundid"] = refundId
+	case ok && !gatewayErr.Temporary:
+		// The processor refused the refund, so the amount is no longer held
+		refund.Status, refund.Error = ChargeDeclined, refundErr.Error()
+		attempt.Refunded = roundCents(attempt.Refunded - amount)
+		change["$inc"] = bson.M{"refunded": -amount}
+	default:
+		// The processor may have acted before failing, so the amount stays held until the refund is retried
+		refund.Status, refund.Error = ChargeFailed, refundErr.Error()
+	}
+	update["refunds.$.status"], update["refunds.$.error"] = refund.Status, refund.Error
+	if err = chargeCollection.Update(bson.M{"_id": key, "refunds.key": refundKey}, change); err != nil {
+		return
+	}
+	switch refund.Status {
+	case ChargeSucceeded:
+		err = c.recordRefund(attempt, refund)
+	case ChargeDeclined:
+		err = fmt.Errorf("Refund %s was declined: %s", refundKey, refund.Error)
+	default:
+		err = fmt.Errorf("Refund %s failed, try again with the same key: %s", refundKey, refund.Error)
+	}
+	return
+}
+
+// recordRefund records a successful refund as a negative credit card payment of the client, unless it has
+// already been recorded, and marks the refund recorded.
+func (c *MongoConnection) recordRefund(attempt *ChargeAttempt, refund *RefundAttempt) (err error) {
+	payment := &Payment{Method: CreditCard, Date: refund.Updated, Amount: -refund.Amount, Reference: refund.RefundId}
+	if err = c.recordCardPayment(attempt.ClientId, payment); err != nil {
+		return
+	}
+	session, chargeCollection, err := c.getCollection(chargeCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	refund.Recorded = true
+	unmarked := bson.M{"_id": attempt.Id, "refunds.key": refund.Key}
+	err = chargeCollection.Update(unmarked, bson.M{"$set": bson.M{"refunds.$.recorded": true}})
+	return
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExpiringCard is a client whose credit card has expired or is about to.
+type ExpiringCard struct {
+	ClientId        string    `json:"clientid"`
+	Name            string    `json:"name"`
+	EmailAddress    string    `json:"emailaddress"`
+	Card            string    `json:"card"`
+	Expiration      time.Time `json:"expiration"`
+	Expired         bool      `json:"expired"`
+	DaysLeft        int       `json:"daysleft"`
+	UpdateRequested time.Time `json:"updaterequested"`
+}
+
+// ExpiringCards returns the clients paying by a card that expires within the given number of days of the day,
+// or already has, soonest first.
+func ExpiringCards(clients []Client, days int, day time.Time) (expiring []ExpiringCard) {
+	horizon := day.AddDate(0, 0, days)
+	for _, client := range clients {
+		method := client.PaymentMethod
+		if method.Method != CreditCard || method.ExpirationDate.IsZero() {
+			continue
+		}
+		end := cardExpiry(method.ExpirationDate)
+		if end.After(horizon) {
+			continue
+		}
+		card := ExpiringCard{
+			ClientId:        client.Id.Hex(),
+			Card:            maskCard(method.CcNumber),
+			Expiration:      method.ExpirationDate,
+			Expired:         cardExpired(method.ExpirationDate, day),
+			DaysLeft:        int(end.Sub(day).Hours() / 24),
+			UpdateRequested: method.UpdateRequested,
+		}
+		if card.DaysLeft < 0 {
+			card.DaysLeft = 0
+		}
+		if g := client.PrimaryGuardian(); g != nil {
+			card.Name = strings.TrimSpace(g.FirstName + " " + g.LastName)
+			card.EmailAddress = g.EmailAddress
+		}
+		expiring = append(expiring, card)
+	}
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return expiring[i].Expiration.Before(expiring[j].Expiration)
+	})
+	return
+}
+
+// ListExpiringCards returns the clients whose cards expire within the given number of days or already have.
+func (c *MongoConnection) ListExpiringCards(days int) (expiring []ExpiringCard, err error) {
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	// Cards are stored with a day in their expiry month, so anything up to the horizon may have expired by then
+	var clients []Client
+	err = clientCollection.Find(bson.M{
+		"paymentmethod.method":         CreditCard,
+		"paymentmethod.expirationdate": bson.M{"$gt": time.Time{}, "$lte": time.Now().AddDate(0, 0, days)},
+	}).All(&clients)
+	if err != nil {
+		return
+	}
+	return ExpiringCards(clients, days, time.Now()), nil
+}
+
+// needsUpdateRequest reports whether the family should be asked to update their card. They are asked once
+// when the card is about to expire and again once it has, unless they were asked after it expired.
+func (e *ExpiringCard) needsUpdateRequest() bool {
+	if e.UpdateRequested.IsZero() {
+		return true
+	}
+	return e.Expired && e.UpdateRequested.Before(cardExpiry(e.Expiration))
+}
+
+// SendCardUpdateRequests asks the families whose cards expire within the given number of days, or already
+// have, to update their card, and flags them as asked. Updating the payment method clears the flag.
+func (c *MongoConnection) SendCardUpdateRequests(days int) (requested []ExpiringCard, err error) {
+	expiring, err := c.ListExpiringCards(days)
+	if err != nil {
+		return
+	}
+
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	for _, card := range expiring {
+		if !card.needsUpdateRequest() {
+			continue
+		}
+		subject := "Your card on file is about to expire"
+		verb := "expires at the end of"
+		if card.Expired {
+			subject = "Your card on file has expired"
+			verb = "expired at the end of"
+		}
+		last4 := card.Card
+		if len(last4) > 4 {
+			last4 = last4[len(last4)-4:]
+		}
+		err = c.notify(card.ClientId, subject,
+			fmt.Sprintf("The card ending %s that you pay TumbleBus with %s %s. Please update your card so "+
+				"your child's classes aren't interrupted.", last4, verb, card.Expiration.Format("January 2006")))
+		if err != nil {
+			return
+		}
+		card.UpdateRequested = time.Now()
+		if err = clientCollection.UpdateId(bson.ObjectIdHex(card.ClientId), bson.M{"$set": bson.M{"paymentmethod.updaterequested": card.UpdateRequested}}); err != nil {
+			return
+		}
+		requested = append(requested, card)
+	}
+	return
+}
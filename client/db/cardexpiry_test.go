@@ -0,0 +1,41 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestExpiringCards(t *testing.T) {
+	today := time.Date(2017, time.March, 20, 0, 0, 0, 0, time.Local)
+	card := func(expiration time.Time, requested time.Time) Client {
+		return Client{Id: bson.NewObjectId(), PaymentMethod: PaymentMethod{
+			Method: CreditCard, CcNumber: "4111111111111111", ExpirationDate: expiration, UpdateRequested: requested}}
+	}
+	clients := []Client{
+		card(time.Date(2017, time.April, 1, 0, 0, 0, 0, time.Local), time.Time{}),
+		card(time.Date(2017, time.February, 1, 0, 0, 0, 0, time.Local), time.Date(2017, time.February, 10, 0, 0, 0, 0, time.Local)),
+		card(time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local), time.Time{}),
+		card(time.Date(2018, time.March, 1, 0, 0, 0, 0, time.Local), time.Time{}),
+		Client{Id: bson.NewObjectId(), PaymentMethod: PaymentMethod{Method: Check}},
+	}
+
+	expiring := ExpiringCards(clients, 45, today)
+	if len(expiring) != 3 {
+		t.Fatal("Expected three cards expiring within 45 days, got ", expiring)
+	}
+	february, march, april := expiring[0], expiring[1], expiring[2]
+	if !february.Expired || march.Expired || april.Expired {
+		t.Error("Expected only the February card to have expired by March 20")
+	}
+	if march.DaysLeft != 12 || march.Card != "************1111" {
+		t.Error("Expected the March card to have 12 days left, got ", march.DaysLeft, march.Card)
+	}
+	if !february.needsUpdateRequest() || !march.needsUpdateRequest() {
+		t.Error("Expected a request once a card expires after the family was asked before it did")
+	}
+	april.UpdateRequested = today
+	if april.needsUpdateRequest() {
+		t.Error("Expected a family not to be asked twice before the card expires")
+	}
+}
@@ -1,10 +1,12 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"io"
 	"time"
 )
 
@@ -17,6 +19,19 @@ const (
 	Other
 )
 
+// String returns the name of the payment type.
+func (t PaymentType) String() string {
+	switch t {
+	case Cash:
+		return "Cash"
+	case Check:
+		return "Check"
+	case CreditCard:
+		return "Credit card"
+	}
+	return "Other"
+}
+
 type PaymentFrequency int
 
 const (
@@ -36,6 +51,7 @@ type DB interface {
 	GetSchoolById(id bson.ObjectId) (school *School, err error)
 	FindClient(firstName, lastName string) (client *Client)
 	GetClientId(firstName, lastName string) (string, err error)
+	GetClientById(id string) (client *Client, err error)
 	ListClients() (clients []Client, err error)
 	FindClinentBySchool(school string) (clients []Client)
 	FindClientByDob(dob string) ([]Client, error)
@@ -49,27 +65,160 @@ type DB interface {
 	AddPayment(id string, payment *Payment) (err error)
 	DeleteSchool(school *School) (err error)
 	DeleteClient(client *Client) (err error)
+	AddSeason(schoolName string, season *Season) (err error)
+	AddSchedule(schoolName, seasonName string, schedule *Schedule) (err error)
+	AddScheduleException(schoolName, seasonName, class string, exception *ScheduleException) (err error)
+	ListSessions(schoolName string, from, to time.Time) (sessions []Session, err error)
+	ListClientSessions(clientId string, from, to time.Time) (sessions []Session, err error)
+	PlanDayRoute(day time.Time, opts RouteOptions) (itinerary *Itinerary, err error)
+	Enroll(clientId, childId, schoolName, season, class string) (enrollment *Enrollment, err error)
+	GetEnrollment(id string) (enrollment *Enrollment, err error)
+	WithdrawEnrollment(id string) (err error)
+	ListWaitlist(schoolName, season, class string) (enrollments []Enrollment, err error)
+	SetCapacity(schoolName, season, class string, capacity int) (err error)
+	ListNotifications(clientId string) (notifications []Notification, err error)
+	AddInquiry(clientId, childId, schoolName, season, class string) (enrollment *Enrollment, err error)
+	TransitionEnrollment(id string, to EnrollmentState, note string) (enrollment *Enrollment, err error)
+	ListEnrollments(filter EnrollmentFilter) (enrollments []Enrollment, err error)
+	ListClientsByState(state EnrollmentState) (clients []Client, err error)
+	FindClientsByGuardian(name, phone, email string) (clients []Client, err error)
+	AddGuardian(clientId string, guardian *Guardian) (err error)
+	UpdateGuardian(clientId string, guardian *Guardian) (err error)
+	RemoveGuardian(clientId, guardianId string) (err error)
+	AddEmergencyContact(clientId string, contact *EmergencyContact) (err error)
+	UpdateEmergencyContact(clientId string, contact *EmergencyContact) (err error)
+	RemoveEmergencyContact(clientId, contactId string) (err error)
+	MigrateParents() (migrated int, err error)
+	SetHealthRecord(clientId, childId string, record *HealthRecord) (err error)
+	GetHealthRecord(clientId, childId string) (record *HealthRecord, err error)
+	ListRoster(schoolName, season, class string) (roster []RosterEntry, err error)
+	ListExpiringConsents(days int) (records []HealthRecord, err error)
+	SendConsentReminders(days int) (reminded []HealthRecord, err error)
+	FindClientsByAge(minAge, maxAge int, asOf time.Time) (clients []Client, err error)
+	RemoveStoredAges() (updated int, err error)
+	SetSchoolLocation(schoolName string, location *Coordinates) (err error)
+	SetProgram(schoolName string, program *Program) (err error)
+	RemoveProgram(schoolName, programName string) (err error)
+	ListAgeOuts(schoolName, seasonName string) (ageOuts []AgeOut, err error)
+	RolloverSeason(schoolName, seasonName string, next *Season, deadline time.Time) (summary *RolloverSummary, err error)
+	ReenrollmentSummary(schoolName, seasonName string) (summary *ReenrollmentSummary, err error)
+	LapseReenrollments(schoolName, seasonName string, day time.Time) (lapsed []Enrollment, err error)
+	SetSkillLevel(level *SkillLevel) (err error)
+	ListSkillLevels() (levels []SkillLevel, err error)
+	AddAssessment(clientId, childId string, assessment *Assessment) (certificate *Certificate, err error)
+	ListAssessments(childId string) (assessments []Assessment, err error)
+	ListCertificates(clientId, childId string) (certificates []Certificate, err error)
+	GetCertificate(id string) (certificate *Certificate, err error)
+	ChildProgress(clientId, childId string) (report *ProgressReport, err error)
+	ClassProgress(schoolName, season, class string) (reports []ProgressReport, err error)
+	AddInstructor(instructor *Instructor) (err error)
+	UpdateInstructor(instructor *Instructor) (err error)
+	GetInstructor(id string) (instructor *Instructor, err error)
+	ListInstructors() (instructors []Instructor, err error)
+	AssignInstructor(instructorId, schoolName, seasonName, class string) (assignment *Assignment, err error)
+	UnassignInstructor(assignmentId string) (err error)
+	ListAssignments(instructorId string) (assignments []Assignment, err error)
+	InstructorSessions(instructorId string, from, to time.Time) (sessions []Session, err error)
+	WeeklySchedule(instructorId string, day time.Time) (sessions []Session, err error)
+	ListConflicts(from, to time.Time) (conflicts []Conflict, err error)
+	ListExpiringCertifications(days int) (expiring []ExpiringCertification, err error)
+	SetPayRate(instructorId string, rate *PayRate) (err error)
+	InstructorEarnings(instructorId string, from, to time.Time, opts RouteOptions) (earnings *Earnings, err error)
+	Payroll(from, to time.Time, opts RouteOptions) (payroll []Earnings, err error)
+	SetContract(schoolName string, contract *Contract) (err error)
+	RecordAttendance(schoolName, season, class string, day time.Time, present []string) (attendance *Attendance, err error)
+	ListAttendance(schoolName string, from, to time.Time) (attendance []Attendance, err error)
+	GenerateSchoolInvoice(schoolName string, from, to time.Time) (invoice *SchoolInvoice, err error)
+	GetSchoolInvoice(id string) (invoice *SchoolInvoice, err error)
+	ListSchoolInvoices(schoolName string) (invoices []SchoolInvoice, err error)
+	AddSchoolPayment(invoiceId string, payment *Payment) (invoice *SchoolInvoice, err error)
+	VoidSchoolInvoice(invoiceId string) (err error)
+	SchoolStatement(schoolName string, from, to time.Time) (statement *SchoolStatement, err error)
+	PreviewPayout(schoolName string, from, to time.Time) (payout *Payout, err error)
+	CreatePayout(schoolName string, from, to time.Time) (payout *Payout, err error)
+	GetPayout(id string) (payout *Payout, err error)
+	ListPayouts(schoolName string, status PayoutStatus) (payouts []Payout, err error)
+	SetPayoutStatus(id string, status PayoutStatus, reference string) (payout *Payout, err error)
+	PayoutStatement(id string) (pdf []byte, err error)
+	PostCardSettlement(reference string, date time.Time, amount float64) (entry *JournalEntry, err error)
+	RebuildLedger() (posted int, err error)
+	ListJournal(from, to time.Time) (entries []JournalEntry, err error)
+	TrialBalance(asOf time.Time) (trial *TrialBalance, err error)
+	ImportBankTransactions(transactions []BankTransaction) (summary *ImportSummary, err error)
+	AutoReconcile() (matched int, err error)
+	MatchBankTransaction(transactionId, entryId string) (err error)
+	UnmatchBankTransaction(transactionId string) (err error)
+	IgnoreBankTransaction(transactionId string) (err error)
+	ListBankTransactions(from, to time.Time, status BankMatch) (transactions []BankTransaction, err error)
+	Unreconciled(from, to time.Time) (report *UnreconciledReport, err error)
+	ChargeClient(clientId string, amount float64, key, description string) (attempt *ChargeAttempt, err error)
+	GetChargeAttempt(key string) (attempt *ChargeAttempt, err error)
+	ListChargeAttempts(clientId string) (attempts []ChargeAttempt, err error)
+	RefundCharge(key string, amount float64, refundKey string) (attempt *ChargeAttempt, err error)
+	ListExpiringCards(days int) (expiring []ExpiringCard, err error)
+	SendCardUpdateRequests(days int) (requested []ExpiringCard, err error)
+	ImportSchools(in io.Reader, dryRun bool) (result *ImportResult, err error)
+	ImportFamilies(in io.Reader, dryRun bool) (result *ImportResult, err error)
+	Import(kind string, in io.Reader, dryRun bool) (result *ImportResult, err error)
+	Export(kind string, filter ExportFilter, out ExportWriter) (err error)
+	ListDuplicates(threshold float64) (pairs []DuplicatePair, err error)
+	MergeClients(keptId, mergedId string) (record *MergeRecord, err error)
+	GetMerge(id string) (record *MergeRecord, err error)
+	ListMerges(since time.Time) (records []MergeRecord, err error)
+	UndoMerge(id string) (record *MergeRecord, err error)
+	Search(query string, limit int) (results []SearchResult, err error)
+	ListClientsPage(opts ListOptions) (page *ClientPage, err error)
+	ListSchoolsPage(opts ListOptions) (page *SchoolPage, err error)
+	ListAllClients(opts ListOptions) (clients []Client, err error)
+	ListAllSchools(opts ListOptions) (schools []School, err error)
+	NormalizeContacts(dryRun bool) (result *NormalizeResult, err error)
+	SchoolsNear(zipCode string, miles float64) (nearby []NearbySchool, err error)
+	FamiliesNear(schoolName string, miles float64) (nearby []NearbyFamily, err error)
+	GeocodeAddresses() (result *GeocodeResult, err error)
 }
 
 // Store master mgo Session
 type MongoConnection struct {
-	session *mgo.Session
+	session  *mgo.Session
+	notifier Notifier
+	gateway  Gateway
+	geocoder Geocoder
 }
 
 // Hardcoded Database, Collection, and Hostname variables
 var (
-	databaseName         = "test"
-	clientCollectionName = "clients"
-	schoolCollectionName = "schools"
-	hostname             = "mongodb://localhost"
-	isDrop               = true
+	databaseName               = "test"
+	clientCollectionName       = "clients"
+	schoolCollectionName       = "schools"
+	enrollmentCollectionName   = "enrollments"
+	seatCollectionName         = "seats"
+	notificationCollectionName = "notifications"
+	healthCollectionName       = "health"
+	skillCollectionName        = "skills"
+	assessmentCollectionName   = "assessments"
+	certificateCollectionName  = "certificates"
+	instructorCollectionName   = "instructors"
+	assignmentCollectionName   = "assignments"
+	attendanceCollectionName   = "attendance"
+	invoiceCollectionName      = "invoices"
+	payoutCollectionName       = "payouts"
+	journalCollectionName      = "journal"
+	bankCollectionName         = "banktransactions"
+	chargeCollectionName       = "charges"
+	mergeCollectionName        = "merges"
+	hostname                   = "mongodb://localhost"
+	isDrop                     = true
 )
 
 // Season contains infomation that relates to a school year season
 type Season struct {
-	Start           time.Time `bson:"start" json:"start"`
-	End             time.Time `bson:"end" json:"end"`
-	YearToDateTotal float64   `bson:"yeartodatetotal" json:"yeartodatetotal"`
+	Name            string      `bson:"name" json:"name"`
+	Start           time.Time   `bson:"start" json:"start"`
+	End             time.Time   `bson:"end" json:"end"`
+	YearToDateTotal float64     `bson:"yeartodatetotal" json:"yeartodatetotal"`
+	Holidays        []time.Time `bson:"holidays" json:"holidays"`
+	Schedules       []*Schedule `bson:"schedules" json:"schedules"`
+	Closed          bool        `bson:"closed" json:"closed"`
 }
 
 // Schoool contains name, address and contact information for the school administrator
@@ -84,28 +233,46 @@ type School struct {
 	ContactName string        `json:"contactname" bson:"contactname"`
 	Url         string        `json:"url" bson:"url"`
 	Seasons     []*Season     `json:"seasons" bson:"seasons"`
+	Location    *Coordinates  `json:"location" bson:"location,omitempty"`
+	Capacity    int           `json:"capacity" bson:"capacity"`
+	Programs    []*Program    `json:"programs" bson:"programs"`
+	Contract    *Contract     `json:"-" bson:"contract,omitempty"`
+	// Original holds the address and phone as they were entered, for those normalized on write
+	Original map[string]string `json:"original,omitempty" bson:"original,omitempty"`
+	// Problems lists the address and phone values that couldn't be normalized and are kept as entered
+	Problems []string `json:"problems,omitempty" bson:"problems,omitempty"`
 }
 
 // PaymentMethod contains the information about how a client intends to pay for a Season
 type PaymentMethod struct {
 	//Id             bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	Method         PaymentType      `bson:"method" json:"method"`
-	Frequency      PaymentFrequency `bson:"frequency" json:"frequency"`
-	UnitCost       float64          `bson:"unitcost" json:"unitcost"`
-	StartDate      time.Time        `bson:"startdate" json:"startdate"`
-	EndDate        time.Time        `bson:"enddate" json:"enddate"`
-	CcNumber       string           `bson:"ccnumber" json:"ccnumber"`
-	ExpirationDate time.Time        `bson:"expirationdate" json:"expirationdate"`
-	SecurityCode   string           `bson:"securitycode" json:"securitycode"`
-	CcName         string           `bson:"ccname" json:"ccname"`
+	Method          PaymentType      `bson:"method" json:"method"`
+	Frequency       PaymentFrequency `bson:"frequency" json:"frequency"`
+	UnitCost        float64          `bson:"unitcost" json:"unitcost"`
+	StartDate       time.Time        `bson:"startdate" json:"startdate"`
+	EndDate         time.Time        `bson:"enddate" json:"enddate"`
+	CcNumber        string           `bson:"ccnumber" json:"ccnumber"`
+	ExpirationDate  time.Time        `bson:"expirationdate" json:"expirationdate"`
+	SecurityCode    string           `bson:"securitycode" json:"-"`
+	CcName          string           `bson:"ccname" json:"ccname"`
+	Token           string           `bson:"token" json:"-"`
+	UpdateRequested time.Time        `bson:"updaterequested,omitempty" json:"updaterequested,omitempty"`
+}
+
+// MarshalJSON masks all but the last four digits of the card number, so the API never returns a whole card.
+func (m PaymentMethod) MarshalJSON() ([]byte, error) {
+	type paymentMethod PaymentMethod
+	m.CcNumber = maskCard(m.CcNumber)
+	return json.Marshal(paymentMethod(m))
 }
 
 // Payment contains information about an individual payment
 type Payment struct {
 	//Id     bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	Method PaymentType `bson:"method" json:"method"`
-	Date   time.Time   `bson:"date" json:"date"`
-	Amount float64     `bson:"amount" json:"amount"`
+	Method    PaymentType `bson:"method" json:"method"`
+	Date      time.Time   `bson:"date" json:"date"`
+	Amount    float64     `bson:"amount" json:"amount"`
+	Reference string      `bson:"reference,omitempty" json:"reference,omitempty"`
 }
 
 // Parent contains name, address and contact information of the parent of the student
@@ -118,33 +285,53 @@ type Parent struct {
 	ZipCode      string `bson:"zipcode" json:"zipcode"`
 	HomePhone    string `bson:"homephone" json:"homephone"`
 	MobilePhone  string `bson:"mobilephone" json:"mobilephone"`
-	EmailAddress string `bson:"emailladdress" json:"emailaddress"`
+	EmailAddress string `bson:"emailaddress" json:"emailaddress"`
+	// Location is where the address was geocoded, nil when it couldn't be placed
+	Location *Coordinates `bson:"location,omitempty" json:"location,omitempty"`
+	// Original holds the values of the fields above as they were entered, for those normalized on write
+	Original map[string]string `bson:"original,omitempty" json:"original,omitempty"`
+	// Problems lists the values of the fields above that couldn't be normalized and are kept as entered
+	Problems []string `bson:"problems,omitempty" json:"problems,omitempty"`
 }
 
 // Child contains name and date of birth of the children of the parent
 type Child struct {
-	//Id        bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	FirstName string    `bson:"firstname" json:"firstname"`
-	LastName  string    `bson:"lastname" json:"lastname"`
-	DOB       time.Time `bson:"dob" json:"dob"`
-	Age       int       `bson:"age" json:"age"`
+	Id           bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	FirstName    string        `bson:"firstname" json:"firstname"`
+	LastName     string        `bson:"lastname" json:"lastname"`
+	DOB          time.Time     `bson:"dob" json:"dob"`
+	Certificates []string      `bson:"certificates,omitempty" json:"certificates,omitempty"`
 }
 
 // Client structure represents the Method that pertains to a single client.
 type Client struct {
-	Id            bson.ObjectId `bson:"_id,omitempty" json:"id"`
-	ParentInfo    Parent        `bson:"parent" json:"parent"`
-	Children      []*Child      `bson:"children" json:"children"`
-	PaymentMethod PaymentMethod `bson:"paymentmethod" json:"paymentmethod"`
-	Payments      []*Payment    `bson:"payments" json:"payments"`
-	School        string        `bson:"schoolid" json:"schoolid"`
+	Id                bson.ObjectId       `bson:"_id,omitempty" json:"id"`
+	Guardians         []*Guardian         `bson:"guardians" json:"guardians"`
+	EmergencyContacts []*EmergencyContact `bson:"emergencycontacts" json:"emergencycontacts"`
+	Children          []*Child            `bson:"children" json:"children"`
+	PaymentMethod     PaymentMethod       `bson:"paymentmethod" json:"paymentmethod"`
+	Payments          []*Payment          `bson:"payments" json:"payments"`
+	School            string              `bson:"schoolid" json:"schoolid"`
 }
 
 // NewConnection creates a new connection to the mongoDB backend and returns the connection if successful.
 func NewConnection() (c *MongoConnection) {
+	return newConnection(isDrop)
+}
+
+// OpenConnection connects to the mongoDB backend like NewConnection, but never drops the database, so the
+// data already stored is kept. Command line tools working on a live database use it.
+func OpenConnection() (c *MongoConnection) {
+	return newConnection(false)
+}
+
+// newConnection creates the connection, dropping the database first when drop is set.
+func newConnection(drop bool) (c *MongoConnection) {
 	c = new(MongoConnection)
 	if c != nil {
-		err := c.createConnection()
+		c.notifier = LogNotifier{}
+		c.geocoder = DefaultZipCentroids
+		err := c.createConnection(drop)
 		if err != nil {
 			panic(err)
 		}
@@ -152,15 +339,16 @@ func NewConnection() (c *MongoConnection) {
 	return
 }
 
-// createConnection attemps to connect to a mongoDB backend and create the collections.
-func (c *MongoConnection) createConnection() (err error) {
+// createConnection attemps to connect to a mongoDB backend and create the collections, dropping the
+// database first when drop is set.
+func (c *MongoConnection) createConnection(drop bool) (err error) {
 	// create a new mongo database session
 
 	c.session, err = mgo.Dial(hostname)
 	if err == nil {
 		c.session.SetMode(mgo.Monotonic, true)
 		// Drop Database
-		if isDrop {
+		if drop {
 
 			err = c.session.DB(databaseName).DropDatabase()
 			if err != nil {
@@ -200,6 +388,70 @@ func (c *MongoConnection) createConnection() (err error) {
 			err = errors.New(errStr)
 			return
 		}
+
+		// A child can only be enrolled once in each class
+		enrollmentCollection := dbs.C(enrollmentCollectionName)
+		err = enrollmentCollection.EnsureIndex(mgo.Index{
+			Key:    []string{"childid", "schoolid", "season", "class"},
+			Unique: true,
+		})
+		if err != nil {
+			errStr := fmt.Sprintf("Collection (%s) could not be indexed properly", enrollmentCollectionName)
+			err = errors.New(errStr)
+			return
+		}
+
+		// A child is only awarded one certificate per skill level
+		certificateCollection := dbs.C(certificateCollectionName)
+		err = certificateCollection.EnsureIndex(mgo.Index{
+			Key:    []string{"childid", "level"},
+			Unique: true,
+		})
+		if err != nil {
+			errStr := fmt.Sprintf("Collection (%s) could not be indexed properly", certificateCollectionName)
+			err = errors.New(errStr)
+			return
+		}
+
+		// An instructor only has one running assignment to each class, ended assignments are kept. The index
+		// without the end of the assignment is replaced.
+		assignmentCollection := dbs.C(assignmentCollectionName)
+		assignmentCollection.DropIndex("instructorid", "schoolid", "season", "class")
+		err = assignmentCollection.EnsureIndex(mgo.Index{
+			Key:    []string{"instructorid", "schoolid", "season", "class", "until"},
+			Unique: true,
+		})
+		if err != nil {
+			errStr := fmt.Sprintf("Collection (%s) could not be indexed properly", assignmentCollectionName)
+			err = errors.New(errStr)
+			return
+		}
+
+		// A school is only invoiced once for each period, voided invoices release their period
+		invoiceCollection := dbs.C(invoiceCollectionName)
+		err = invoiceCollection.EnsureIndex(mgo.Index{
+			Key:    []string{"period"},
+			Unique: true,
+			Sparse: true,
+		})
+		if err != nil {
+			errStr := fmt.Sprintf("Collection (%s) could not be indexed properly", invoiceCollectionName)
+			err = errors.New(errStr)
+			return
+		}
+
+		// A school is only paid its revenue share once for each period
+		payoutCollection := dbs.C(payoutCollectionName)
+		err = payoutCollection.EnsureIndex(mgo.Index{
+			Key:    []string{"period"},
+			Unique: true,
+			Sparse: true,
+		})
+		if err != nil {
+			errStr := fmt.Sprintf("Collection (%s) could not be indexed properly", payoutCollectionName)
+			err = errors.New(errStr)
+			return
+		}
 	}
 	return
 }
@@ -223,6 +475,17 @@ func (c *MongoConnection) getSessionAndCollection() (session *mgo.Session, clien
 	return
 }
 
+// getCollection returns a copy of the session along with the named collection.
+func (c *MongoConnection) getCollection(name string) (session *mgo.Session, collection *mgo.Collection, err error) {
+	if c.session != nil {
+		session = c.session.Copy()
+		collection = session.DB(databaseName).C(name)
+	} else {
+		err = errors.New("No session found")
+	}
+	return
+}
+
 // getSchoolId returns the School associated with the Id.
 func (c *MongoConnection) getSchoolId(name string) (id bson.ObjectId, err error) {
 	session, _, schoolCollection, err := c.getSessionAndCollection()
@@ -277,8 +540,32 @@ func (c *MongoConnection) ListSchools() (schools []School, err error) {
 	return
 }
 
-// AddSchool to the School collection.
+// schoolDocument returns the document a new school is stored as.
+func schoolDocument(school *School) bson.M {
+	return bson.M{
+		"name":        school.Name,
+		"address":     school.Address,
+		"city":        school.City,
+		"state":       school.State,
+		"zipcode":     school.ZipCode,
+		"contactname": school.ContactName,
+		"mainphone":   school.MainPhone,
+		"url":         school.Url,
+		"seasons":     school.Seasons,
+		"location":    school.Location,
+		"capacity":    school.Capacity,
+		"programs":    school.Programs,
+		"contract":    school.Contract,
+		"original":    school.Original,
+		"problems":    school.Problems,
+	}
+}
+
+// AddSchool to the School collection. The address and phone are normalized first, keeping any value
+// that can't be normalized as entered and listing it in the problems of the school.
 func (c *MongoConnection) AddSchool(school *School) (err error) {
+	school.Normalize()
+	c.locateSchool(school)
 	session, _, schoolCollection, err := c.getSessionAndCollection()
 	if err != nil {
 		return
@@ -286,18 +573,7 @@ func (c *MongoConnection) AddSchool(school *School) (err error) {
 
 	defer session.Close()
 
-	err = schoolCollection.Insert(
-		bson.M{
-			"name":        school.Name,
-			"address":     school.Address,
-			"city":        school.City,
-			"state":       school.State,
-			"zipcode":     school.ZipCode,
-			"contactname": school.ContactName,
-			"mainphone":   school.MainPhone,
-			"url":         school.Url,
-		},
-	)
+	err = schoolCollection.Insert(schoolDocument(school))
 
 	if err != nil {
 		if mgo.IsDup(err) {
@@ -307,7 +583,9 @@ func (c *MongoConnection) AddSchool(school *School) (err error) {
 	return
 }
 
-// UpdateSchool updates an existing School collection with new informaion.
+// UpdateSchool updates an existing School collection with new informaion. The address and phone are
+// normalized first, keeping any value that can't be normalized as entered and listing it in the problems of
+// the school.
 func (c *MongoConnection) UpdateSchool(school *School) (err error) {
 	session, _, schoolCollection, err := c.getSessionAndCollection()
 	if err != nil {
@@ -321,9 +599,19 @@ func (c *MongoConnection) UpdateSchool(school *School) (err error) {
 		return
 	}
 
+	// Keep the original of the fields the update leaves as they were
+	if school.Original == nil {
+		if stored, storedErr := c.GetSchoolById(id); storedErr == nil {
+			school.Original = stored.Original
+		}
+	}
+	school.Normalize()
+	c.locateSchool(school)
+
+	// Use $set so the seasons and schedules stored with the school are preserved
 	err = schoolCollection.Update(
 		bson.M{"_id": id},
-		bson.M{
+		bson.M{"$set": bson.M{
 			"name":        school.Name,
 			"address":     school.Address,
 			"city":        school.City,
@@ -332,10 +620,22 @@ func (c *MongoConnection) UpdateSchool(school *School) (err error) {
 			"contactname": school.ContactName,
 			"mainphone":   school.MainPhone,
 			"url":         school.Url,
-		},
+			"location":    school.Location,
+			"capacity":    school.Capacity,
+			"original":    school.Original,
+			"problems":    school.Problems,
+		}},
 	)
+	if err != nil {
+		return
+	}
 
-	return
+	// The capacity of the school is that of its classes without their own
+	stored, err := c.GetSchoolById(id)
+	if err != nil {
+		return
+	}
+	return c.resizeSeats(stored)
 }
 
 // DeleteSchool removes a School from the collection
@@ -365,9 +665,7 @@ func (c *MongoConnection) ClientExist(FirstName, LastName string) (bool, string)
 
 	client := Client{}
 
-	bsonSelect := bson.M{"parent": bson.M{"$elemMatch": bson.M{"firstname": FirstName, "lastname": LastName}}}
-
-	err = clientCollection.Find(nil).Select(bsonSelect).One(&client)
+	err = clientCollection.Find(guardianNameQuery(FirstName, LastName)).One(&client)
 	if err != nil {
 		return false, string("")
 	}
@@ -385,8 +683,11 @@ func (c *MongoConnection) CreateClient() (id string, err error) {
 
 	clientId := bson.NewObjectId()
 
-	// Empty Parent
-	parent := Parent{}
+	// No guardians
+	guardians := []Guardian{}
+
+	// No emergency contacts
+	contacts := []EmergencyContact{}
 
 	// Empty child
 	children := []Child{}
@@ -400,83 +701,81 @@ func (c *MongoConnection) CreateClient() (id string, err error) {
 	// school
 	err = clientCollection.Insert(
 		bson.M{
-			"_id":           clientId,
-			"parent":        parent,
-			"children":      children,
-			"paymentmethod": paymentInfo,
-			"payments":      payments,
-			"schoolid":      bson.ObjectIdHex("0"),
+			"_id":               clientId,
+			"guardians":         guardians,
+			"emergencycontacts": contacts,
+			"children":          children,
+			"paymentmethod":     paymentInfo,
+			"payments":          payments,
+			"schoolid":          "",
 		},
 	)
 
 	return clientId.Hex(), err
 }
 
+// AddParent adds the parent as a guardian of the client. A guardian with the same name has their contact
+// information updated instead. The first guardian of a client becomes the primary guardian.
 func (c *MongoConnection) AddParent(ClientId, FirstName, LastName, Address, City, State, ZipCode, HomePhone, MobilePhone, EmailAddress string) (err error) {
-	session, clientCollection, _, sessionErr := c.getSessionAndCollection()
-	if sessionErr != nil {
-		err = sessionErr
+	client, err := c.GetClientById(ClientId)
+	if err != nil {
 		return
 	}
-	defer session.Close()
 
-	bsonParent := bson.M{
-		"firstname":    FirstName,
-		"lastname":     LastName,
-		"address":      Address,
-		"city":         City,
-		"state":        State,
-		"zipcode":      ZipCode,
-		"homephone":    HomePhone,
-		"mobilephone":  MobilePhone,
-		"emailaddress": EmailAddress,
+	parent := Parent{
+		FirstName:    FirstName,
+		LastName:     LastName,
+		Address:      Address,
+		City:         City,
+		State:        State,
+		ZipCode:      ZipCode,
+		HomePhone:    HomePhone,
+		MobilePhone:  MobilePhone,
+		EmailAddress: EmailAddress,
 	}
 
-	err = clientCollection.Update(bson.M{"_id": bson.ObjectIdHex(ClientId)}, bsonParent)
-
-	return
-}
-
-// AddCient to the Client collection.
-func (c *MongoConnection) AddClient(schoolName string, parent *Parent, children []Child, paymentInfo *PaymentMethod) (err error) {
-	school := School{}
-	//school, err = c.FindSchoolByName(schoolName)
-	//if err != nil {
-	session, clientCollection, schoolCollection, sessionErr := c.getSessionAndCollection()
-	if sessionErr != nil {
-		err = sessionErr
-		return
-	}
-	defer session.Close()
-
-	err = schoolCollection.Find(bson.M{"name": schoolName}).One(&school)
-	if err != nil {
-		fmt.Println("Unable to find school")
-		return
+	for _, g := range client.Guardians {
+		if g.FirstName == FirstName && g.LastName == LastName {
+			parent.Original = g.Original
+			g.Parent = parent
+			return c.UpdateGuardian(ClientId, g)
+		}
 	}
+	return c.AddGuardian(ClientId, &Guardian{Parent: parent, PickupAuthorized: true})
+}
 
-	bsonParent := bson.M{
-		"firstname":    parent.FirstName,
-		"lastname":     parent.LastName,
-		"address":      parent.Address,
-		"city":         parent.City,
-		"state":        parent.State,
-		"zipcode":      parent.ZipCode,
-		"homephone":    parent.HomePhone,
-		"mobilephone":  parent.MobilePhone,
-		"emailaddress": parent.EmailAddress,
+// clientDocument returns the document a new client is stored as, with the ids given to the children.
+func clientDocument(schoolId string, parent *Parent, children []Child, paymentInfo *PaymentMethod) (doc bson.M, childIds []bson.ObjectId) {
+	bsonGuardian := bson.M{
+		"_id":              bson.NewObjectId(),
+		"firstname":        parent.FirstName,
+		"lastname":         parent.LastName,
+		"address":          parent.Address,
+		"city":             parent.City,
+		"state":            parent.State,
+		"zipcode":          parent.ZipCode,
+		"homephone":        parent.HomePhone,
+		"mobilephone":      parent.MobilePhone,
+		"emailaddress":     parent.EmailAddress,
+		"original":         parent.Original,
+		"problems":         parent.Problems,
+		"location":         parent.Location,
+		"role":             PrimaryGuardian,
+		"pickupauthorized": true,
 	}
 
 	bsonChildren := make([]bson.M, len(children))
 
 	for index, child := range children {
+		childId := bson.NewObjectId()
 		bsonChild := bson.M{
+			"_id":       childId,
 			"firstname": child.FirstName,
 			"lastname":  child.LastName,
 			"dob":       child.DOB,
-			"age":       child.Age,
 		}
 		bsonChildren[index] = bsonChild
+		childIds = append(childIds, childId)
 	}
 
 	bsonPaymentInfo := bson.M{
@@ -494,19 +793,79 @@ func (c *MongoConnection) AddClient(schoolName string, parent *Parent, children
 	// Enter a empty payment
 	bsonPayment := []Payment{}
 
-	err = clientCollection.Insert(
-		bson.M{
-			"parent":        bsonParent,
-			"children":      bsonChildren,
-			"paymentmethod": bsonPaymentInfo,
-			"payments":      bsonPayment,
-			"schoolid":      school.Id.Hex(),
-		},
-	)
+	doc = bson.M{
+		"_id":               bson.NewObjectId(),
+		"guardians":         []bson.M{bsonGuardian},
+		"emergencycontacts": []EmergencyContact{},
+		"children":          bsonChildren,
+		"paymentmethod":     bsonPaymentInfo,
+		"payments":          bsonPayment,
+		"schoolid":          schoolId,
+	}
+	return
+}
+
+// AddCient to the Client collection and enrolls the children with the school. The contact information of the
+// parent is normalized first, keeping any value that can't be normalized as entered and listing it in the
+// problems of the parent. The client is removed again if the children can't be enrolled.
+func (c *MongoConnection) AddClient(schoolName string, parent *Parent, children []Child, paymentInfo *PaymentMethod) (err error) {
+	parent.Normalize()
+	c.locateParent(parent)
+	school := School{}
+	//school, err = c.FindSchoolByName(schoolName)
+	//if err != nil {
+	session, clientCollection, schoolCollection, sessionErr := c.getSessionAndCollection()
+	if sessionErr != nil {
+		err = sessionErr
+		return
+	}
+	defer session.Close()
+
+	err = schoolCollection.Find(bson.M{"name": schoolName}).One(&school)
+	if err != nil {
+		fmt.Println("Unable to find school")
+		return
+	}
+
+	doc, childIds := clientDocument(school.Id.Hex(), parent, children, paymentInfo)
+	if err = clientCollection.Insert(doc); err != nil {
+		return
+	}
+
+	// Enroll the children with the school, children beyond the capacity of the school are waitlisted. A
+	// client whose children can't all be enrolled isn't kept.
+	clientId := doc["_id"].(bson.ObjectId)
+	var enrolled []*Enrollment
+	for _, childId := range childIds {
+		var enrollment *Enrollment
+		if enrollment, err = c.Enroll(clientId.Hex(), childId.Hex(), schoolName, "", ""); err != nil {
+			c.removeNewClient(clientId, enrolled)
+			return
+		}
+		enrolled = append(enrolled, enrollment)
+	}
 
 	return
 }
 
+// removeNewClient takes back a client that couldn't be added, with the enrollments made for it, giving the
+// seats they took back to their classes.
+func (c *MongoConnection) removeNewClient(clientId bson.ObjectId, enrollments []*Enrollment) {
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	enrollmentCollection := clientCollection.Database.C(enrollmentCollectionName)
+	for _, e := range enrollments {
+		if enrollmentCollection.RemoveId(e.Id) == nil && e.State.holdsSeat() && !e.Waitlisted {
+			c.releaseSeat(e.SchoolId, e.Season, e.Class)
+		}
+	}
+	clientCollection.RemoveId(clientId)
+}
+
 // ListClients provides an entire list of all clients in the collection
 func (c *MongoConnection) ListClients() (clients []Client, err error) {
 	session, clientCollection, _, err := c.getSessionAndCollection()
@@ -519,6 +878,22 @@ func (c *MongoConnection) ListClients() (clients []Client, err error) {
 	return
 }
 
+// GetClientById returns the Client stored under the hex encoded id.
+func (c *MongoConnection) GetClientById(id string) (client *Client, err error) {
+	if !bson.IsObjectIdHex(id) {
+		err = fmt.Errorf("Invalid client id %q", id)
+		return
+	}
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = clientCollection.Find(bson.M{"_id": bson.ObjectIdHex(id)}).One(&client)
+	return
+}
+
 // FindClient returns a list of clients associated by first and last name.
 func (c *MongoConnection) GetClientId(firstName, lastName string) (id string, err error) {
 	session, clientCollection, _, err := c.getSessionAndCollection()
@@ -529,9 +904,7 @@ func (c *MongoConnection) GetClientId(firstName, lastName string) (id string, er
 
 	tmp := Client{}
 
-	bsonSelect := bson.M{"parent": bson.M{"$elemMatch": bson.M{"firstname": firstName, "lastname": lastName}}}
-
-	err = clientCollection.Find(nil).Select(bsonSelect).One(&tmp)
+	err = clientCollection.Find(guardianNameQuery(firstName, lastName)).One(&tmp)
 	if err != nil {
 		return "", err
 	}
@@ -549,13 +922,7 @@ func (c *MongoConnection) FindClient(firstName, lastName string) (client *Client
 	}
 	defer session.Close()
 
-	tmp := Client{}
-
-	bsonSelect := bson.M{"parent": bson.M{"$elemMatch": bson.M{"firstname": firstName, "lastname": lastName}}}
-
-	err = clientCollection.Find(nil).Select(bsonSelect).One(&tmp)
-
-	err = clientCollection.Find(bson.M{"_id": tmp.Id}).One(&client)
+	err = clientCollection.Find(guardianNameQuery(firstName, lastName)).One(&client)
 
 	return
 }
@@ -574,7 +941,7 @@ func (c *MongoConnection) FindClinentBySchool(name string) (clients []Client, er
 	if err != nil {
 		return
 	}
-	bsonQuery = bson.M{"schoolid": school.Id}
+	bsonQuery = bson.M{"schoolid": school.Id.Hex()}
 	err = clientCollection.Find(bsonQuery).All(&clients)
 
 	return
@@ -625,16 +992,19 @@ func (c *MongoConnection) UpdatePaymentMethod(id string, paymentInfo *PaymentMet
 	}
 	defer session.Close()
 
-	bsonPaymentInfo := bson.M{"paymentmethod": bson.M{
+	// A new card has to be tokenized again before it is charged
+	bsonPaymentInfo := bson.M{"$set": bson.M{"paymentmethod": bson.M{
 		"method":         paymentInfo.Method,
 		"frequency":      paymentInfo.Frequency,
+		"unitcost":       paymentInfo.UnitCost,
 		"startdate":      paymentInfo.StartDate,
 		"enddate":        paymentInfo.EndDate,
 		"ccnumber":       paymentInfo.CcNumber,
 		"expirationdate": paymentInfo.ExpirationDate,
 		"securitycode":   paymentInfo.SecurityCode,
-		"ccname":         paymentInfo.CcName},
-	}
+		"ccname":         paymentInfo.CcName,
+		"token":          ""},
+	}}
 
 	err = clientCollection.Update(bson.M{"_id": bson.ObjectIdHex(id)}, bsonPaymentInfo)
 	return
@@ -648,9 +1018,13 @@ func (c *MongoConnection) AddPayment(id string, payment *Payment) (err error) {
 	}
 	defer session.Close()
 
-	bsonPayment := bson.M{"$push": bson.M{"payments": bson.M{"method": payment.Method, "date": payment.Date, "amount": payment.Amount}}}
+	bsonPayment := bson.M{"$push": bson.M{"payments": bson.M{"method": payment.Method, "date": payment.Date, "amount": payment.Amount, "reference": payment.Reference}}}
 
 	err = clientCollection.Update(bson.M{"_id": bson.ObjectIdHex(id)}, bsonPayment)
+	if err != nil {
+		return
+	}
+	err = c.postFamilyPayment(id, payment)
 	return
 }
 
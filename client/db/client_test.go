@@ -162,12 +162,10 @@ func TestAddClient(t *testing.T) {
 	children[0].FirstName = "Jacob"
 	children[0].LastName = "Bling"
 	children[0].DOB = time.Date(1996, time.September, 13, 0, 0, 0, 0, time.Local)
-	children[0].Age = 19
 
 	children[1].FirstName = "Samuel"
 	children[1].LastName = "Blind"
 	children[1].DOB = time.Date(1999, time.April, 6, 0, 0, 0, 0, time.Local)
-	children[1].Age = 16
 
 	paymentInfo := PaymentMethod{
 		Method:       CreditCard,
@@ -206,12 +204,10 @@ func TestAddClient(t *testing.T) {
 	children[0].FirstName = "Simon"
 	children[0].LastName = "Keys"
 	children[0].DOB = time.Date(1999, time.April, 13, 0, 0, 0, 0, time.Local)
-	children[0].Age = 19
 
 	children[1].FirstName = "Matt"
 	children[1].LastName = "Keys"
 	children[1].DOB = time.Date(2001, time.November, 30, 0, 0, 0, 0, time.Local)
-	children[1].Age = 16
 
 	paymentInfo = PaymentMethod{
 		Method:       Cash,
@@ -294,7 +290,7 @@ func TestAddClient(t *testing.T) {
 		t.Error("Failed to add payment #3")
 	}
 
-	client, err = c.FindClient("Jaosn", "Blind")
+	client, err = c.FindClient("Joe", "Blind")
 	if err != nil {
 		t.Error("Unable to find client")
 	}
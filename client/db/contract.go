@@ -0,0 +1,486 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"time"
+)
+
+// ContractType is how a host school and TumbleBus share the cost of the program.
+type ContractType string
+
+const (
+	// PerChild schools pay a fee for each child they send.
+	PerChild ContractType = "perchild"
+	// FlatFee schools pay a fixed fee each billing period.
+	FlatFee ContractType = "flatfee"
+	// RevenueShare schools don't pay, families do, and the school receives a share of what they pay.
+	RevenueShare ContractType = "revenueshare"
+)
+
+// BillingBasis is what per child fees are counted from.
+type BillingBasis string
+
+const (
+	// EnrollmentBasis charges once for each child enrolled in a season overlapping the invoice period.
+	EnrollmentBasis BillingBasis = "enrollment"
+	// AttendanceBasis charges for each session a child attended during the invoice period.
+	AttendanceBasis BillingBasis = "attendance"
+)
+
+// InvoiceStatus is where a school invoice is in its life.
+type InvoiceStatus string
+
+const (
+	InvoiceOpen InvoiceStatus = "open"
+	InvoicePaid InvoiceStatus = "paid"
+	InvoiceVoid InvoiceStatus = "void"
+)
+
+// Contract holds the billing terms agreed with a school.
+type Contract struct {
+	Type                ContractType `bson:"type" json:"type"`
+	Basis               BillingBasis `bson:"basis" json:"basis"`
+	PerChildFee         float64      `bson:"perchildfee" json:"perchildfee"`
+	FlatFee             float64      `bson:"flatfee" json:"flatfee"`
+	RevenueSharePercent float64      `bson:"revenuesharepercent" json:"revenuesharepercent"`
+	PaymentTermsDays    int          `bson:"paymenttermsdays" json:"paymenttermsdays"`
+	Start               time.Time    `bson:"start" json:"start"`
+	End                 time.Time    `bson:"end" json:"end"`
+	BillingContact      string       `bson:"billingcontact" json:"billingcontact"`
+	BillingEmail        string       `bson:"billingemail" json:"billingemail"`
+}
+
+// InvoiceLine is a charge on an invoice.
+type InvoiceLine struct {
+	Description string  `bson:"description" json:"description"`
+	Quantity    int     `bson:"quantity" json:"quantity"`
+	UnitPrice   float64 `bson:"unitprice" json:"unitprice"`
+	Amount      float64 `bson:"amount" json:"amount"`
+}
+
+// SchoolInvoice bills a school under its contract for a period.
+type SchoolInvoice struct {
+	Id       bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Number   string        `bson:"number" json:"number"`
+	Period   string        `bson:"period,omitempty" json:"-"`
+	SchoolId string        `bson:"schoolid" json:"schoolid"`
+	School   string        `bson:"school" json:"school"`
+	From     time.Time     `bson:"from" json:"from"`
+	To       time.Time     `bson:"to" json:"to"`
+	Issued   time.Time     `bson:"issued" json:"issued"`
+	Due      time.Time     `bson:"due" json:"due"`
+	Lines    []InvoiceLine `bson:"lines" json:"lines"`
+	Total    float64       `bson:"total" json:"total"`
+	Paid     float64       `bson:"paid" json:"paid"`
+	Payments []Payment     `bson:"payments" json:"payments"`
+	Status   InvoiceStatus `bson:"status" json:"status"`
+	Billed   []string      `bson:"billed,omitempty" json:"-"`
+	Voided   time.Time     `bson:"voided,omitempty" json:"voided,omitempty"`
+}
+
+// StatementLine is an invoice or payment on a school statement with the running balance.
+type StatementLine struct {
+	Date        time.Time `json:"date"`
+	Description string    `json:"description"`
+	Charge      float64   `json:"charge"`
+	Payment     float64   `json:"payment"`
+	Balance     float64   `json:"balance"`
+}
+
+// SchoolStatement is the account of a school over a period.
+type SchoolStatement struct {
+	School         string          `json:"school"`
+	From           time.Time       `json:"from"`
+	To             time.Time       `json:"to"`
+	OpeningBalance float64         `json:"openingbalance"`
+	Lines          []StatementLine `json:"lines"`
+	ClosingBalance float64         `json:"closingbalance"`
+	Overdue        float64         `json:"overdue"`
+}
+
+// Validate checks that the contract has the terms its type needs.
+func (c *Contract) Validate() (err error) {
+	switch c.Type {
+	case PerChild:
+		if c.PerChildFee <= 0 {
+			return errors.New("A per child contract requires a per child fee")
+		}
+		if c.Basis != EnrollmentBasis && c.Basis != AttendanceBasis {
+			return fmt.Errorf("A per child contract is billed on %s or %s", EnrollmentBasis, AttendanceBasis)
+		}
+	case FlatFee:
+		if c.FlatFee <= 0 {
+			return errors.New("A flat fee contract requires a fee")
+		}
+	case RevenueShare:
+		if c.RevenueSharePercent <= 0 || c.RevenueSharePercent > 100 {
+			return errors.New("A revenue share contract requires a percentage between 0 and 100")
+		}
+	default:
+		return fmt.Errorf("Unknown contract type %q", c.Type)
+	}
+	if c.PaymentTermsDays < 0 {
+		return errors.New("Payment terms can't be negative")
+	}
+	if !c.End.IsZero() && c.End.Before(c.Start) {
+		return errors.New("A contract can't end before it starts")
+	}
+	return
+}
+
+// Covers reports whether the contract is in force on the given day.
+func (c *Contract) Covers(day time.Time) bool {
+	return !day.Before(c.Start) && (c.End.IsZero() || !day.After(c.End))
+}
+
+// Balance returns what is left to pay on the invoice.
+func (i *SchoolInvoice) Balance() float64 {
+	if i.Status == InvoiceVoid {
+		return 0
+	}
+	return roundCents(i.Total - i.Paid)
+}
+
+// SetContract records the billing terms agreed with a school.
+func (c *MongoConnection) SetContract(schoolName string, contract *Contract) (err error) {
+	if err = contract.Validate(); err != nil {
+		return
+	}
+	session, _, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = schoolCollection.Update(bson.M{"name": schoolName}, bson.M{"$set": bson.M{"contract": contract}})
+	if err == mgo.ErrNotFound {
+		err = fmt.Errorf("School %s not found", schoolName)
+	}
+	return
+}
+
+// billingKey identifies a child billed for a season on an enrollment basis.
+func billingKey(season, childId string) string {
+	return season + "/" + childId
+}
+
+// unbilledChildren returns the billing keys of the children whose enrollments in the season count towards
+// a per child fee and who haven't already been billed for the season.
+func unbilledChildren(season string, enrollments []Enrollment, billed map[string]bool) (keys []string) {
+	for _, e := range enrollments {
+		key := billingKey(season, e.ChildId)
+		if !e.Waitlisted && (e.State.holdsSeat() || e.State == Graduated) && e.State != PendingReenrollment && !billed[key] {
+			billed[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// invoiceLines works out the charges for the school over the period under its contract. Billed holds the
+// children already billed for each season on an enrollment basis, and the children billed by these lines
+// are added to it and returned.
+func (c *MongoConnection) invoiceLines(school *School, from, to time.Time, billed map[string]bool) (lines []InvoiceLine, keys []string, err error) {
+	contract := school.Contract
+	switch {
+	case contract.Type == FlatFee:
+		lines = append(lines, InvoiceLine{
+			Description: fmt.Sprintf("Flat fee %s to %s", from.Format("Jan 2, 2006"), to.Format("Jan 2, 2006")),
+			Quantity:    1,
+			UnitPrice:   contract.FlatFee,
+		})
+
+	case contract.Type == PerChild && contract.Basis == AttendanceBasis:
+		attendance, listErr := c.ListAttendance(school.Name, from, to)
+		if listErr != nil {
+			return nil, nil, listErr
+		}
+		byClass := make(map[string]int)
+		var classes []string
+		for _, a := range attendance {
+			if _, ok := byClass[a.Class]; !ok {
+				classes = append(classes, a.Class)
+			}
+			byClass[a.Class] += len(a.Present)
+		}
+		for _, class := range classes {
+			lines = append(lines, InvoiceLine{
+				Description: fmt.Sprintf("%s attendance", class),
+				Quantity:    byClass[class],
+				UnitPrice:   contract.PerChildFee,
+			})
+		}
+
+	case contract.Type == PerChild:
+		for _, season := range school.Seasons {
+			if season.End.Before(from) || season.Start.After(to) {
+				continue
+			}
+			enrollments, listErr := c.ListEnrollments(EnrollmentFilter{School: school.Name, Season: season.Name})
+			if listErr != nil {
+				return nil, nil, listErr
+			}
+			children := unbilledChildren(season.Name, enrollments, billed)
+			keys = append(keys, children...)
+			if len(children) > 0 {
+				lines = append(lines, InvoiceLine{
+					Description: fmt.Sprintf("%s enrollment", season.Name),
+					Quantity:    len(children),
+					UnitPrice:   contract.PerChildFee,
+				})
+			}
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("%s is on a %s contract and is not invoiced", school.Name, contract.Type)
+	}
+
+	for i := range lines {
+		lines[i].Amount = roundCents(float64(lines[i].Quantity) * lines[i].UnitPrice)
+	}
+	return
+}
+
+// GenerateSchoolInvoice invoices a school under its contract for the period. Per child contracts count the
+// children enrolled in seasons overlapping the period, or the sessions children attended, depending on the
+// basis of the contract, and a child is only charged once for each season. A period that overlaps one
+// already invoiced is refused.
+func (c *MongoConnection) GenerateSchoolInvoice(schoolName string, from, to time.Time) (invoice *SchoolInvoice, err error) {
+	if !to.After(from) {
+		return nil, errors.New("The invoice period must end after it starts")
+	}
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	if school.Contract == nil {
+		return nil, fmt.Errorf("%s has no contract", schoolName)
+	}
+	if !school.Contract.Covers(from) {
+		return nil, fmt.Errorf("The contract of %s is not in force on %s", schoolName, from.Format("January 2, 2006"))
+	}
+	session, invoiceCollection, err := c.getCollection(invoiceCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var invoiced []SchoolInvoice
+	err = invoiceCollection.Find(bson.M{"schoolid": school.Id.Hex(), "status": bson.M{"$ne": InvoiceVoid}}).Select(bson.M{"from": 1, "to": 1, "number": 1, "billed": 1}).All(&invoiced)
+	if err != nil {
+		return
+	}
+	billed := make(map[string]bool)
+	for _, other := range invoiced {
+		if from.Before(other.To) && to.After(other.From) {
+			return nil, fmt.Errorf("%s has already been invoiced from %s to %s on invoice %s", schoolName,
+				other.From.Format("January 2, 2006"), other.To.Format("January 2, 2006"), other.Number)
+		}
+		for _, key := range other.Billed {
+			billed[key] = true
+		}
+	}
+	lines, keys, err := c.invoiceLines(school, from, to, billed)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	invoice = &SchoolInvoice{
+		Id:       bson.NewObjectId(),
+		SchoolId: school.Id.Hex(),
+		School:   school.Name,
+		From:     from,
+		To:       to,
+		Issued:   now,
+		Due:      now.AddDate(0, 0, school.Contract.PaymentTermsDays),
+		Lines:    lines,
+		Status:   InvoiceOpen,
+		Billed:   keys,
+	}
+	invoice.Period = fmt.Sprintf("%s/%s/%s", invoice.SchoolId, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	invoice.Number = fmt.Sprintf("%s-%s", from.Format("200601"), invoice.Id.Hex()[18:])
+	for _, line := range lines {
+		invoice.Total = roundCents(invoice.Total + line.Amount)
+	}
+	if invoice.Total == 0 {
+		invoice.Status = InvoicePaid
+	}
+	if err = invoiceCollection.Insert(invoice); err != nil {
+		if mgo.IsDup(err) {
+			err = fmt.Errorf("%s has already been invoiced for this period", schoolName)
+		}
+		return nil, err
+	}
+	err = c.post(schoolInvoiceEntry(invoice))
+	return
+}
+
+// GetSchoolInvoice returns the school invoice with the given id.
+func (c *MongoConnection) GetSchoolInvoice(id string) (invoice *SchoolInvoice, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, fmt.Errorf("Invalid invoice id %q", id)
+	}
+	session, invoiceCollection, err := c.getCollection(invoiceCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = invoiceCollection.FindId(bson.ObjectIdHex(id)).One(&invoice)
+	return
+}
+
+// ListSchoolInvoices returns the invoices of a school, oldest first.
+func (c *MongoConnection) ListSchoolInvoices(schoolName string) (invoices []SchoolInvoice, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	session, invoiceCollection, err := c.getCollection(invoiceCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = invoiceCollection.Find(bson.M{"schoolid": school.Id.Hex()}).Sort("from", "issued").All(&invoices)
+	return
+}
+
+// listAllSchoolInvoices returns the invoices of every school.
+func (c *MongoConnection) listAllSchoolInvoices() (invoices []SchoolInvoice, err error) {
+	session, invoiceCollection, err := c.getCollection(invoiceCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = invoiceCollection.Find(nil).Sort("issued").All(&invoices)
+	return
+}
+
+// AddSchoolPayment records a payment from a school against one of its invoices. The invoice is marked paid
+// once it has been paid in full.
+func (c *MongoConnection) AddSchoolPayment(invoiceId string, payment *Payment) (invoice *SchoolInvoice, err error) {
+	if payment.Amount <= 0 {
+		return nil, errors.New("A payment must be for a positive amount")
+	}
+	invoice, err = c.GetSchoolInvoice(invoiceId)
+	if err != nil {
+		return
+	}
+	if invoice.Status == InvoiceVoid {
+		return nil, fmt.Errorf("Invoice %s is void", invoice.Number)
+	}
+	if payment.Date.IsZero() {
+		payment.Date = time.Now()
+	}
+
+	session, invoiceCollection, err := c.getCollection(invoiceCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	change := mgo.Change{
+		Update:    bson.M{"$push": bson.M{"payments": payment}, "$inc": bson.M{"paid": payment.Amount}},
+		ReturnNew: true,
+	}
+	if _, err = invoiceCollection.FindId(invoice.Id).Apply(change, invoice); err != nil {
+		return nil, err
+	}
+	if invoice.Balance() <= 0 && invoice.Status != InvoicePaid {
+		invoice.Status = InvoicePaid
+		if err = invoiceCollection.UpdateId(invoice.Id, bson.M{"$set": bson.M{"status": InvoicePaid}}); err != nil {
+			return
+		}
+	}
+	err = c.post(schoolPaymentEntry(invoice, payment))
+	return
+}
+
+// VoidSchoolInvoice cancels an invoice that was issued in error. Invoices with payments can't be voided.
+func (c *MongoConnection) VoidSchoolInvoice(invoiceId string) (err error) {
+	invoice, err := c.GetSchoolInvoice(invoiceId)
+	if err != nil {
+		return
+	}
+	if invoice.Paid > 0 {
+		return fmt.Errorf("Invoice %s has payments and can't be voided", invoice.Number)
+	}
+	session, invoiceCollection, err := c.getCollection(invoiceCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	// Release the period so the school can be invoiced for it again
+	invoice.Voided = time.Now()
+	err = invoiceCollection.UpdateId(invoice.Id, bson.M{"$set": bson.M{"status": InvoiceVoid, "voided": invoice.Voided}, "$unset": bson.M{"period": ""}})
+	if err != nil {
+		return
+	}
+	err = c.post(voidInvoiceEntry(invoice))
+	return
+}
+
+// Statement lays out the invoices and payments of a school between from and to with a running balance.
+// Everything before from is carried in the opening balance.
+func Statement(schoolName string, invoices []SchoolInvoice, from, to time.Time) *SchoolStatement {
+	statement := &SchoolStatement{School: schoolName, From: from, To: to}
+	now := time.Now()
+	for _, invoice := range invoices {
+		if invoice.Status == InvoiceVoid {
+			continue
+		}
+		if invoice.Issued.Before(from) {
+			statement.OpeningBalance += invoice.Total
+		} else if !invoice.Issued.After(to) {
+			statement.Lines = append(statement.Lines, StatementLine{
+				Date:        invoice.Issued,
+				Description: fmt.Sprintf("Invoice %s, %s to %s", invoice.Number, invoice.From.Format("Jan 2"), invoice.To.Format("Jan 2, 2006")),
+				Charge:      invoice.Total,
+			})
+		}
+		for _, payment := range invoice.Payments {
+			if payment.Date.Before(from) {
+				statement.OpeningBalance -= payment.Amount
+			} else if !payment.Date.After(to) {
+				statement.Lines = append(statement.Lines, StatementLine{
+					Date:        payment.Date,
+					Description: fmt.Sprintf("Payment on invoice %s", invoice.Number),
+					Payment:     payment.Amount,
+				})
+			}
+		}
+		if invoice.Due.Before(now) {
+			statement.Overdue += invoice.Balance()
+		}
+	}
+
+	sort.SliceStable(statement.Lines, func(i, j int) bool {
+		return statement.Lines[i].Date.Before(statement.Lines[j].Date)
+	})
+	statement.OpeningBalance = roundCents(statement.OpeningBalance)
+	balance := statement.OpeningBalance
+	for i := range statement.Lines {
+		balance = roundCents(balance + statement.Lines[i].Charge - statement.Lines[i].Payment)
+		statement.Lines[i].Balance = balance
+	}
+	statement.ClosingBalance = balance
+	statement.Overdue = roundCents(statement.Overdue)
+	return statement
+}
+
+// SchoolStatement returns the statement of account of a school between from and to.
+func (c *MongoConnection) SchoolStatement(schoolName string, from, to time.Time) (statement *SchoolStatement, err error) {
+	invoices, err := c.ListSchoolInvoices(schoolName)
+	if err != nil {
+		return
+	}
+	return Statement(schoolName, invoices, from, to), nil
+}
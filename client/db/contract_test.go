@@ -0,0 +1,76 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestContractValidate(t *testing.T) {
+	contracts := []struct {
+		contract Contract
+		valid    bool
+	}{
+		{Contract{Type: PerChild, PerChildFee: 20, Basis: EnrollmentBasis}, true},
+		{Contract{Type: PerChild, PerChildFee: 20}, false},
+		{Contract{Type: PerChild, Basis: AttendanceBasis}, false},
+		{Contract{Type: FlatFee, FlatFee: 500}, true},
+		{Contract{Type: RevenueShare, RevenueSharePercent: 15}, true},
+		{Contract{Type: RevenueShare, RevenueSharePercent: 150}, false},
+		{Contract{Type: "barter"}, false},
+	}
+	for _, c := range contracts {
+		if err := c.contract.Validate(); (err == nil) != c.valid {
+			t.Errorf("Expected %v to be valid %v, got %v", c.contract, c.valid, err)
+		}
+	}
+}
+
+func TestSchoolStatement(t *testing.T) {
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2017, month, d, 0, 0, 0, 0, time.Local)
+	}
+	invoices := []SchoolInvoice{
+		SchoolInvoice{Number: "201701-1", Issued: day(time.January, 31), Due: day(time.February, 28), Total: 400,
+			Paid: 400, Status: InvoicePaid, Payments: []Payment{Payment{Date: day(time.February, 10), Amount: 400}}},
+		SchoolInvoice{Number: "201702-2", Issued: day(time.February, 28), Due: day(time.March, 30), Total: 300,
+			Paid: 100, Status: InvoiceOpen, Payments: []Payment{Payment{Date: day(time.March, 15), Amount: 100}}},
+		SchoolInvoice{Number: "201702-3", Issued: day(time.March, 1), Total: 999, Status: InvoiceVoid},
+	}
+
+	statement := Statement("Acton", invoices, day(time.February, 1), day(time.March, 31))
+	if statement.OpeningBalance != 400 {
+		t.Error("Expected the January invoice in the opening balance, got ", statement.OpeningBalance)
+	}
+	if len(statement.Lines) != 3 {
+		t.Fatal("Expected two payments and an invoice on the statement, got ", statement.Lines)
+	}
+	balances := []float64{0, 300, 200}
+	for i, line := range statement.Lines {
+		if line.Balance != balances[i] {
+			t.Errorf("Expected a balance of %v after %s, got %v", balances[i], line.Description, line.Balance)
+		}
+	}
+	if statement.ClosingBalance != 200 || statement.Overdue != 200 {
+		t.Error("Expected 200 outstanding and overdue, got ", statement.ClosingBalance, statement.Overdue)
+	}
+}
+
+func TestUnbilledChildren(t *testing.T) {
+	enrollments := []Enrollment{
+		{ChildId: "a", State: Active},
+		{ChildId: "a", Class: "Advanced", State: Active},
+		{ChildId: "b", State: Registered, Waitlisted: true},
+		{ChildId: "c", State: Withdrawn},
+		{ChildId: "d", State: Graduated},
+	}
+	billed := make(map[string]bool)
+	if keys := unbilledChildren("Fall", enrollments, billed); len(keys) != 2 || keys[0] != "Fall/a" || keys[1] != "Fall/d" {
+		t.Error("Expected each enrolled child billed once, got ", keys)
+	}
+	if keys := unbilledChildren("Fall", enrollments, billed); len(keys) != 0 {
+		t.Error("Expected children already billed for the season not billed again, got ", keys)
+	}
+	if keys := unbilledChildren("Spring", enrollments, billed); len(keys) != 2 {
+		t.Error("Expected the children billed again for another season, got ", keys)
+	}
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// duplicateThreshold is the score from which two clients are listed as likely the same family.
+const duplicateThreshold = 0.6
+
+// DuplicatePair is two clients that are likely the same family, with what makes them alike.
+type DuplicatePair struct {
+	ClientId      string   `json:"clientid"`
+	Name          string   `json:"name"`
+	OtherClientId string   `json:"otherclientid"`
+	OtherName     string   `json:"othername"`
+	Score         float64  `json:"score"`
+	Reasons       []string `json:"reasons"`
+}
+
+// levenshtein returns the number of single letter insertions, deletions and substitutions that turn a into b.
+func levenshtein(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	previous := make([]int, len(t)+1)
+	current := make([]int, len(t)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		current[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+	return previous[len(t)]
+}
+
+// nameSimilarity scores how alike two names are from 0 to 1, ignoring case, punctuation and spaces.
+func nameSimilarity(a, b string) float64 {
+	a, b = letters(a), letters(b)
+	if a == "" || b == "" {
+		return 0
+	}
+	longest := len([]rune(a))
+	if n := len([]rune(b)); n > longest {
+		longest = n
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+// letters lower cases the string and keeps only its letters and digits.
+func letters(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+// phoneDigits keeps the last ten digits of a phone number, so +1 (555) 010-0000 and 555.010.0000 agree.
+func phoneDigits(phone string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, phone)
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	if len(digits) < 7 {
+		return ""
+	}
+	return digits
+}
+
+// addressKey reduces a street address and ZIP code to something two spellings of the same address share:
+// the house number, the first letters of the street name and the five digit ZIP code.
+func addressKey(address, zipCode string) string {
+	fields := strings.Fields(strings.ToLower(address))
+	if len(fields) < 2 || len(zipCode) < 5 {
+		return ""
+	}
+	street := letters(fields[1])
+	if len(street) > 4 {
+		street = street[:4]
+	}
+	return letters(fields[0]) + " " + street + " " + zipCode[:5]
+}
+
+// contacts gathers the emails, phones and addresses of every guardian of the client.
+func contacts(client *Client) (emails, phones, addresses map[string]bool) {
+	emails, phones, addresses = make(map[string]bool), make(map[string]bool), make(map[string]bool)
+	for _, g := range client.Guardians {
+		if email := strings.ToLower(strings.TrimSpace(g.EmailAddress)); email != "" {
+			emails[email] = true
+		}
+		for _, phone := range []string{g.HomePhone, g.MobilePhone} {
+			if digits := phoneDigits(phone); digits != "" {
+				phones[digits] = true
+			}
+		}
+		if key := addressKey(g.Address, g.ZipCode); key != "" {
+			addresses[key] = true
+		}
+	}
+	return
+}
+
+// shares reports whether the two sets have a member in common.
+func shares(a, b map[string]bool) bool {
+	for k := range a {
+		if b[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// DuplicateScore scores how likely two clients are the same family, from 0 to 1, and says why. The closest
+// pair of guardian names counts for up to half, and a shared email, phone, address or child adds to it.
+func DuplicateScore(a, b *Client) (score float64, reasons []string) {
+	best := 0.0
+	for _, ga := range a.Guardians {
+		for _, gb := range b.Guardians {
+			last := nameSimilarity(ga.LastName, gb.LastName)
+			first := nameSimilarity(ga.FirstName, gb.FirstName)
+			// Nicknames and initials make first names less telling than last names
+			if similarity := 0.7*last + 0.3*first; similarity > best {
+				best = similarity
+			}
+		}
+	}
+	if best >= 0.6 {
+		score += 0.5 * best
+		if best == 1 {
+			reasons = append(reasons, "same guardian name")
+		} else {
+			reasons = append(reasons, "similar guardian name")
+		}
+	}
+
+	emailsA, phonesA, addressesA := contacts(a)
+	emailsB, phonesB, addressesB := contacts(b)
+	if shares(emailsA, emailsB) {
+		score += 0.4
+		reasons = append(reasons, "same email")
+	}
+	if shares(phonesA, phonesB) {
+		score += 0.3
+		reasons = append(reasons, "same phone")
+	}
+	if shares(addressesA, addressesB) {
+		score += 0.2
+		reasons = append(reasons, "same address")
+	}
+	for _, ca := range a.Children {
+		if matchingChild(b, ca) != nil {
+			score += 0.2
+			reasons = append(reasons, "same child")
+			break
+		}
+	}
+	if score > 1 {
+		score = 1
+	}
+	return float64(int(score*100+0.5)) / 100, reasons
+}
+
+// matchingChild returns the child of the client that is the given child: the same first name and, when both
+// are known, the same date of birth.
+func matchingChild(client *Client, child *Child) *Child {
+	for _, other := range client.Children {
+		if letters(other.FirstName) != letters(child.FirstName) || letters(child.FirstName) == "" {
+			continue
+		}
+		if other.DOB.IsZero() || child.DOB.IsZero() || other.DOB.Equal(child.DOB) {
+			return other
+		}
+	}
+	return nil
+}
+
+// duplicateKeys are the values a client is grouped by so that only clients sharing one are compared: the
+// first letters of each guardian's last name, and every email and phone.
+func duplicateKeys(client *Client) (keys []string) {
+	for _, g := range client.Guardians {
+		if last := letters(g.LastName); last != "" {
+			if len(last) > 2 {
+				last = last[:2]
+			}
+			keys = append(keys, "name:"+last)
+		}
+	}
+	emails, phones, _ := contacts(client)
+	for email := range emails {
+		keys = append(keys, "email:"+email)
+	}
+	for phone := range phones {
+		keys = append(keys, "phone:"+phone)
+	}
+	return
+}
+
+// FindDuplicates returns the pairs of clients scoring at least the threshold, most likely first.
+func FindDuplicates(clients []Client, threshold float64) (pairs []DuplicatePair) {
+	groups := make(map[string][]int)
+	for i := range clients {
+		for _, key := range duplicateKeys(&clients[i]) {
+			groups[key] = append(groups[key], i)
+		}
+	}
+	compared := make(map[[2]int]bool)
+	for _, group := range groups {
+		for x := 0; x < len(group); x++ {
+			for y := x + 1; y < len(group); y++ {
+				i, j := group[x], group[y]
+				if i > j {
+					i, j = j, i
+				}
+				if i == j || compared[[2]int{i, j}] {
+					continue
+				}
+				compared[[2]int{i, j}] = true
+				a, b := &clients[i], &clients[j]
+				score, reasons := DuplicateScore(a, b)
+				if score < threshold {
+					continue
+				}
+				pairs = append(pairs, DuplicatePair{
+					ClientId:      a.Id.Hex(),
+					Name:          clientName(a),
+					OtherClientId: b.Id.Hex(),
+					OtherName:     clientName(b),
+					Score:         score,
+					Reasons:       reasons,
+				})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].Score != pairs[j].Score {
+			return pairs[i].Score > pairs[j].Score
+		}
+		return pairs[i].ClientId+pairs[i].OtherClientId < pairs[j].ClientId+pairs[j].OtherClientId
+	})
+	return
+}
+
+// clientName is the name of the primary guardian of the client.
+func clientName(client *Client) string {
+	if g := client.PrimaryGuardian(); g != nil {
+		return strings.TrimSpace(g.FirstName + " " + g.LastName)
+	}
+	return ""
+}
+
+// ListDuplicates returns the pairs of clients that are likely the same family, scoring at least the
+// threshold, or the default threshold when it is zero.
+func (c *MongoConnection) ListDuplicates(threshold float64) (pairs []DuplicatePair, err error) {
+	if threshold <= 0 {
+		threshold = duplicateThreshold
+	}
+	clients, err := c.ListClients()
+	if err != nil {
+		return
+	}
+	return FindDuplicates(clients, threshold), nil
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func family(first, last, email, phone string, children ...*Child) Client {
+	return Client{
+		Id: bson.NewObjectId(),
+		Guardians: []*Guardian{{Id: bson.NewObjectId(), Role: PrimaryGuardian,
+			Parent: Parent{FirstName: first, LastName: last, EmailAddress: email, MobilePhone: phone}}},
+		Children: children,
+	}
+}
+
+func TestFindDuplicates(t *testing.T) {
+	if levenshtein("kitten", "sitting") != 3 || levenshtein("", "abc") != 3 {
+		t.Error("Expected the edit distance of kitten and sitting to be 3")
+	}
+	tom := func() *Child {
+		return &Child{Id: bson.NewObjectId(), FirstName: "Tom", DOB: time.Date(2011, time.April, 2, 0, 0, 0, 0, time.Local)}
+	}
+	clients := []Client{
+		family("Ann", "Smith", "ann@example.com", "555-010-1234", tom()),
+		family("Anne", "Smyth", "", "+1 (555) 010 1234"),
+		family("Ann", "Smith", "", "", tom()),
+		family("Bob", "Brown", "bob@example.com", "555-020-0000"),
+		family("Carl", "Jones", "ANN@example.com", ""),
+	}
+
+	pairs := FindDuplicates(clients, duplicateThreshold)
+	if len(pairs) != 2 {
+		t.Fatal("Expected two likely duplicates, got ", pairs)
+	}
+	if pairs[0].Score != 0.7 || pairs[0].ClientId != clients[0].Id.Hex() || pairs[0].OtherClientId != clients[2].Id.Hex() {
+		t.Error("Expected the same name and child to score highest, got ", pairs[0])
+	}
+	for _, pair := range pairs {
+		if pair.ClientId == clients[3].Id.Hex() || pair.OtherClientId == clients[3].Id.Hex() {
+			t.Error("Expected the Browns to have no duplicate, got ", pair)
+		}
+	}
+	if score, reasons := DuplicateScore(&clients[0], &clients[1]); score < duplicateThreshold || reasons[0] != "similar guardian name" || reasons[1] != "same phone" {
+		t.Error("Expected a misspelt name with the same phone to be a likely duplicate, got ", score, reasons)
+	}
+	if pairs = FindDuplicates(clients, 0.4); len(pairs) != 3 || pairs[2].Reasons[0] != "same email" {
+		t.Error("Expected a shared email alone to score below the default threshold, got ", pairs)
+	}
+	if score, _ := DuplicateScore(&clients[3], &clients[4]); score != 0 {
+		t.Error("Expected unrelated families to score nothing, got ", score)
+	}
+}
+
+func TestMergeClientRecords(t *testing.T) {
+	tom := &Child{Id: bson.NewObjectId(), FirstName: "Tom"}
+	kept := family("Ann", "Smith", "ann@example.com", "", tom)
+	kept.Payments = []*Payment{{Date: time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local), Amount: 40}}
+	tomAgain := &Child{Id: bson.NewObjectId(), FirstName: "tom", DOB: time.Date(2011, time.April, 2, 0, 0, 0, 0, time.Local)}
+	tia := &Child{Id: bson.NewObjectId(), FirstName: "Tia"}
+	merged := family("Anne", "Smith", "ann@example.com", "", tomAgain, tia)
+	merged.Guardians = append(merged.Guardians, &Guardian{Role: SecondaryGuardian, Parent: Parent{FirstName: "Dan", LastName: "Smith"}})
+	merged.Payments = []*Payment{nil, {Date: time.Date(2017, time.January, 1, 0, 0, 0, 0, time.Local), Amount: 25}}
+	merged.PaymentMethod = PaymentMethod{Method: Check}
+
+	result, childIds := MergeClientRecords(&kept, &merged)
+	if result.Id != kept.Id || len(result.Guardians) != 2 || result.Guardians[1].FirstName != "Dan" || result.Guardians[1].Role != SecondaryGuardian {
+		t.Error("Expected Dan added as a secondary guardian and Anne recognised by email, got ", result.Guardians)
+	}
+	if len(result.Children) != 2 || result.Children[1].Id != tia.Id || childIds[tomAgain.Id.Hex()] != tom.Id.Hex() {
+		t.Error("Expected Tom recognised and Tia added, got ", result.Children, childIds)
+	}
+	if !result.Children[0].DOB.Equal(tomAgain.DOB) || !tom.DOB.IsZero() {
+		t.Error("Expected the merged client to fill in Tom's birth date without changing the kept client")
+	}
+	if len(result.Payments) != 2 || result.Payments[0].Amount != 25 || len(kept.Payments) != 1 {
+		t.Error("Expected every payment kept in date order, got ", result.Payments)
+	}
+	if result.PaymentMethod.Method != Check {
+		t.Error("Expected the payment method of the merged client when the kept client has none")
+	}
+}
@@ -0,0 +1,469 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Enrollment places a child of a client in a class of a school for a season.
+// An enrollment that arrives once the class is full is waitlisted and promoted in the order it was made.
+type Enrollment struct {
+	Id         bson.ObjectId   `bson:"_id,omitempty" json:"id"`
+	ClientId   string          `bson:"clientid" json:"clientid"`
+	ChildId    string          `bson:"childid" json:"childid"`
+	ChildName  string          `bson:"childname" json:"childname"`
+	SchoolId   string          `bson:"schoolid" json:"schoolid"`
+	Season     string          `bson:"season" json:"season"`
+	Class      string          `bson:"class" json:"class"`
+	State      EnrollmentState `bson:"state" json:"state"`
+	History    []*StateChange  `bson:"history" json:"history"`
+	Waitlisted bool            `bson:"waitlisted" json:"waitlisted"`
+	Created    time.Time       `bson:"created" json:"created"`
+	Queued     time.Time       `bson:"queued" json:"queued"`
+	Updated    time.Time       `bson:"updated" json:"updated"`
+	Promoted   time.Time       `bson:"promoted" json:"promoted"`
+	Previous   string          `bson:"previous,omitempty" json:"previous,omitempty"`
+	ReenrollBy time.Time       `bson:"reenrollby,omitempty" json:"reenrollby,omitempty"`
+	Invited    time.Time       `bson:"invited,omitempty" json:"invited,omitempty"`
+}
+
+// Seats tracks the number of open places left in a class. Enrolling takes a seat atomically so two
+// simultaneous enrollments can never both take the last place.
+type Seats struct {
+	Key       string `bson:"_id" json:"key"`
+	SchoolId  string `bson:"schoolid" json:"schoolid"`
+	Season    string `bson:"season" json:"season"`
+	Class     string `bson:"class" json:"class"`
+	Capacity  int    `bson:"capacity" json:"capacity"`
+	Available int    `bson:"available" json:"available"`
+}
+
+// seatKey identifies the seats of a class.
+func seatKey(schoolId, season, class string) string {
+	return schoolId + "/" + season + "/" + class
+}
+
+// CurrentSeason returns the season that is running or the next one to start on the given day. Closed seasons
+// are skipped.
+func (s *School) CurrentSeason(day time.Time) (current *Season) {
+	for _, season := range s.Seasons {
+		if season.Closed || season.End.Before(day) {
+			continue
+		}
+		if current == nil || season.Start.Before(current.Start) {
+			current = season
+		}
+	}
+	return
+}
+
+// ClassCapacity returns the number of children allowed in a class. A class without its own capacity
+// uses the capacity of the school. Zero means the class is unlimited.
+func (s *School) ClassCapacity(seasonName, class string) int {
+	if season := s.FindSeason(seasonName); season != nil {
+		if schedule := season.FindSchedule(class); schedule != nil && schedule.Capacity > 0 {
+			return schedule.Capacity
+		}
+	}
+	return s.Capacity
+}
+
+// Enroll registers a child of a client in a class of the school, waitlisting the child when the class is full.
+// The class may be empty to enroll the child with the school as a whole.
+func (c *MongoConnection) Enroll(clientId, childId, schoolName, season, class string) (enrollment *Enrollment, err error) {
+	return c.enroll(clientId, childId, schoolName, season, class, Registered)
+}
+
+// AddInquiry records that a family is interested in a class. An inquiry does not hold a place in the class
+// until it is registered.
+func (c *MongoConnection) AddInquiry(clientId, childId, schoolName, season, class string) (enrollment *Enrollment, err error) {
+	return c.enroll(clientId, childId, schoolName, season, class, Inquiry)
+}
+
+// enroll creates an enrollment in the given starting state, taking a seat in the class unless it is an inquiry.
+func (c *MongoConnection) enroll(clientId, childId, schoolName, season, class string, state EnrollmentState) (enrollment *Enrollment, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	if season == "" {
+		if current := school.CurrentSeason(time.Now()); current != nil {
+			season = current.Name
+		}
+	} else if s := school.FindSeason(season); s == nil {
+		return nil, fmt.Errorf("Season %s not found for %s", season, schoolName)
+	} else if s.Closed {
+		return nil, fmt.Errorf("Season %s of %s is closed", season, schoolName)
+	}
+	if class != "" {
+		if s := school.FindSeason(season); s == nil || s.FindSchedule(class) == nil {
+			return nil, fmt.Errorf("Class %s is not scheduled at %s in %s", class, schoolName, season)
+		}
+	}
+
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+	var child *Child
+	for _, ch := range client.Children {
+		if ch.Id.Hex() == childId {
+			child = ch
+		}
+	}
+	if child == nil {
+		return nil, fmt.Errorf("Child %s not found for client %s", childId, clientId)
+	}
+	if program := school.ClassProgram(season, class); program != nil {
+		if err = program.Eligible(child, school.FindSeason(season)); err != nil {
+			return nil, err
+		}
+	}
+
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	now := time.Now()
+	enrollment = &Enrollment{
+		Id:        bson.NewObjectId(),
+		ClientId:  clientId,
+		ChildId:   childId,
+		ChildName: child.FirstName + " " + child.LastName,
+		SchoolId:  school.Id.Hex(),
+		Season:    season,
+		Class:     class,
+		State:     state,
+		History:   []*StateChange{&StateChange{To: state, At: now}},
+		Created:   now,
+		Queued:    now,
+		Updated:   now,
+	}
+
+	capacity := 0
+	if state.holdsSeat() {
+		capacity = school.ClassCapacity(season, class)
+	}
+	if capacity > 0 {
+		var taken bool
+		if taken, err = c.takeSeat(enrollment.SchoolId, season, class, capacity); err != nil {
+			return nil, err
+		}
+		enrollment.Waitlisted = !taken
+	}
+
+	if err = enrollmentCollection.Insert(enrollment); err != nil {
+		if capacity > 0 && !enrollment.Waitlisted {
+			c.releaseSeat(enrollment.SchoolId, season, class)
+		}
+		if mgo.IsDup(err) {
+			err = fmt.Errorf("%s is already enrolled in this class", enrollment.ChildName)
+		}
+		return nil, err
+	}
+	if enrollment.Waitlisted {
+		// A seat may have been released between taking a seat and joining the waitlist
+		if err = c.promote(enrollment.SchoolId, season, class); err != nil {
+			return
+		}
+		err = enrollmentCollection.FindId(enrollment.Id).One(enrollment)
+	}
+	return
+}
+
+// seatHolders counts the enrollments holding a seat in the class.
+func (c *MongoConnection) seatHolders(schoolId, season, class string) (held int, err error) {
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	return enrollmentCollection.Find(bson.M{
+		"schoolid": schoolId, "season": season, "class": class,
+		"state": bson.M{"$in": seatHoldingStates}, "waitlisted": bson.M{"$ne": true},
+	}).Count()
+}
+
+// takeSeat atomically takes an open seat in the class, creating the seats of the class on first use with
+// the seats not already held by children enrolled before the class had seats.
+func (c *MongoConnection) takeSeat(schoolId, season, class string, capacity int) (taken bool, err error) {
+	held, err := c.seatHolders(schoolId, season, class)
+	if err != nil {
+		return
+	}
+	session, seatCollection, err := c.getCollection(seatCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	_, err = seatCollection.UpsertId(seatKey(schoolId, season, class), bson.M{"$setOnInsert": bson.M{
+		"schoolid": schoolId, "season": season, "class": class, "capacity": capacity, "available": capacity - held,
+	}})
+	if err != nil {
+		return
+	}
+	return c.takeOpenSeat(schoolId, season, class)
+}
+
+// takeOpenSeat atomically takes a seat of the class if one is available.
+func (c *MongoConnection) takeOpenSeat(schoolId, season, class string) (taken bool, err error) {
+	session, seatCollection, err := c.getCollection(seatCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	seats := Seats{}
+	_, err = seatCollection.Find(bson.M{"_id": seatKey(schoolId, season, class), "available": bson.M{"$gt": 0}}).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"available": -1}},
+		ReturnNew: true,
+	}, &seats)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseSeat gives a seat back to the class and promotes the next waitlisted child into it.
+func (c *MongoConnection) releaseSeat(schoolId, season, class string) (err error) {
+	session, seatCollection, err := c.getCollection(seatCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = seatCollection.UpdateId(seatKey(schoolId, season, class), bson.M{"$inc": bson.M{"available": 1}})
+	if err == mgo.ErrNotFound {
+		// The class is unlimited so there is nothing to release
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	return c.promote(schoolId, season, class)
+}
+
+// promote moves waitlisted children into open seats of the class in the order they joined the waitlist
+// and lets their families know.
+func (c *MongoConnection) promote(schoolId, season, class string) (err error) {
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	for {
+		next := Enrollment{}
+		err = enrollmentCollection.Find(bson.M{
+			"schoolid": schoolId, "season": season, "class": class, "waitlisted": true,
+		}).Sort("queued", "_id").One(&next)
+		if err == mgo.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return
+		}
+
+		var taken bool
+		if taken, err = c.takeOpenSeat(schoolId, season, class); err != nil || !taken {
+			return
+		}
+
+		err = enrollmentCollection.Update(
+			bson.M{"_id": next.Id, "waitlisted": true},
+			bson.M{"$set": bson.M{"waitlisted": false, "promoted": time.Now()}},
+		)
+		if err == mgo.ErrNotFound {
+			// Someone else promoted or removed the enrollment first, hand the seat back and try again
+			if err = c.returnSeat(schoolId, season, class); err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		c.notifyPromoted(&next)
+	}
+}
+
+// notifyPromoted lets the family know their child has been moved off the waitlist.
+func (c *MongoConnection) notifyPromoted(e *Enrollment) {
+	class := e.Class
+	if class == "" {
+		class = "TumbleBus"
+	}
+	c.notify(e.ClientId, "A place has opened up for "+e.ChildName,
+		fmt.Sprintf("Good news! %s has been moved off the waitlist and is now enrolled in %s for %s.",
+			e.ChildName, class, e.Season))
+}
+
+// returnSeat hands a seat back without promoting anyone.
+func (c *MongoConnection) returnSeat(schoolId, season, class string) (err error) {
+	session, seatCollection, err := c.getCollection(seatCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = seatCollection.UpdateId(seatKey(schoolId, season, class), bson.M{"$inc": bson.M{"available": 1}})
+	return
+}
+
+// WithdrawEnrollment withdraws an enrollment. The seat it held is offered to the waitlist.
+func (c *MongoConnection) WithdrawEnrollment(id string) (err error) {
+	_, err = c.TransitionEnrollment(id, Withdrawn, "")
+	return
+}
+
+// GetEnrollment returns the enrollment stored under the hex encoded id.
+func (c *MongoConnection) GetEnrollment(id string) (enrollment *Enrollment, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, fmt.Errorf("Invalid enrollment id %q", id)
+	}
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = enrollmentCollection.FindId(bson.ObjectIdHex(id)).One(&enrollment)
+	return
+}
+
+// ListWaitlist returns the waitlisted enrollments of a class in the order they will be promoted.
+func (c *MongoConnection) ListWaitlist(schoolName, season, class string) (enrollments []Enrollment, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = enrollmentCollection.Find(bson.M{
+		"schoolid": school.Id.Hex(), "season": season, "class": class, "waitlisted": true,
+	}).Sort("queued", "_id").All(&enrollments)
+	return
+}
+
+// SetCapacity changes the capacity of a class, or of the school when class is empty. Raising the capacity
+// promotes waitlisted children into the new places.
+func (c *MongoConnection) SetCapacity(schoolName, season, class string, capacity int) (err error) {
+	if capacity < 0 {
+		return errors.New("Capacity can't be negative")
+	}
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+
+	if class == "" {
+		school.Capacity = capacity
+		session, _, schoolCollection, sessionErr := c.getSessionAndCollection()
+		if sessionErr != nil {
+			return sessionErr
+		}
+		err = schoolCollection.UpdateId(school.Id, bson.M{"$set": bson.M{"capacity": capacity}})
+		session.Close()
+	} else {
+		s := school.FindSeason(season)
+		if s == nil {
+			return fmt.Errorf("Season %s not found for %s", season, schoolName)
+		}
+		schedule := s.FindSchedule(class)
+		if schedule == nil {
+			return fmt.Errorf("Class %s is not scheduled in %s", class, season)
+		}
+		schedule.Capacity = capacity
+		err = c.setSeasons(school)
+	}
+	if err != nil {
+		return
+	}
+
+	return c.resizeSeats(school)
+}
+
+// resizeSeats brings the seats already handed out for the classes of the school in line with their
+// capacity, counting the seats held again, and promotes waitlisted children into places that opened up.
+func (c *MongoConnection) resizeSeats(school *School) (err error) {
+	session, seatCollection, err := c.getCollection(seatCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	seats := []Seats{}
+	if err = seatCollection.Find(bson.M{"schoolid": school.Id.Hex()}).All(&seats); err != nil {
+		return
+	}
+	for _, s := range seats {
+		newCapacity := school.ClassCapacity(s.Season, s.Class)
+		if newCapacity == 0 {
+			// The class is now unlimited, everyone waiting can join
+			if err = seatCollection.RemoveId(s.Key); err != nil {
+				return
+			}
+			if err = c.promoteAll(school.Id.Hex(), s.Season, s.Class); err != nil {
+				return
+			}
+			continue
+		}
+		held, countErr := c.seatHolders(school.Id.Hex(), s.Season, s.Class)
+		if countErr != nil {
+			return countErr
+		}
+		if newCapacity == s.Capacity && newCapacity-held == s.Available {
+			continue
+		}
+		err = seatCollection.UpdateId(s.Key, bson.M{"$set": bson.M{"capacity": newCapacity, "available": newCapacity - held}})
+		if err != nil {
+			return
+		}
+		if err = c.promote(school.Id.Hex(), s.Season, s.Class); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// promoteAll promotes every waitlisted child of an unlimited class.
+func (c *MongoConnection) promoteAll(schoolId, season, class string) (err error) {
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	waiting := []Enrollment{}
+	err = enrollmentCollection.Find(bson.M{
+		"schoolid": schoolId, "season": season, "class": class, "waitlisted": true,
+	}).Sort("queued", "_id").All(&waiting)
+	if err != nil {
+		return
+	}
+	for _, e := range waiting {
+		err = enrollmentCollection.Update(
+			bson.M{"_id": e.Id, "waitlisted": true},
+			bson.M{"$set": bson.M{"waitlisted": false, "promoted": time.Now()}},
+		)
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		c.notifyPromoted(&e)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClassCapacity(t *testing.T) {
+	school := School{
+		Capacity: 20,
+		Seasons: []*Season{
+			&Season{
+				Name:      "Fall",
+				Start:     time.Date(2016, time.September, 1, 0, 0, 0, 0, time.Local),
+				End:       time.Date(2016, time.December, 15, 0, 0, 0, 0, time.Local),
+				Schedules: []*Schedule{&Schedule{Class: "Ninja", Capacity: 8}, &Schedule{Class: "Tumble"}},
+			},
+			&Season{
+				Name:  "Spring",
+				Start: time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local),
+				End:   time.Date(2017, time.June, 15, 0, 0, 0, 0, time.Local),
+			},
+		},
+	}
+	if school.ClassCapacity("Fall", "Ninja") != 8 {
+		t.Error("Class capacity should override the school capacity")
+	}
+	if school.ClassCapacity("Fall", "Tumble") != 20 || school.ClassCapacity("Fall", "") != 20 {
+		t.Error("Classes without a capacity should use the school capacity")
+	}
+
+	if s := school.CurrentSeason(time.Date(2016, time.October, 1, 0, 0, 0, 0, time.Local)); s == nil || s.Name != "Fall" {
+		t.Error("Expected the Fall season to be current: ", s)
+	}
+	if s := school.CurrentSeason(time.Date(2017, time.January, 1, 0, 0, 0, 0, time.Local)); s == nil || s.Name != "Spring" {
+		t.Error("Expected the Spring season to be next: ", s)
+	}
+	if s := school.CurrentSeason(time.Date(2017, time.July, 1, 0, 0, 0, 0, time.Local)); s != nil {
+		t.Error("Expected no season after Spring: ", s)
+	}
+}
+
+func TestEnrollmentWaitlist(t *testing.T) {
+	isDrop = false
+	t.Log("Connecting to mongodb...")
+	c := NewConnection()
+
+	defer c.CloseConnection()
+
+	school := School{
+		Name:     "Capacity Academy",
+		Address:  "1 Full Street",
+		City:     "Acton",
+		State:    "MA",
+		ZipCode:  "01720",
+		Capacity: 1,
+	}
+	if err := c.AddSchool(&school); err != nil {
+		t.Fatal("Failed to add school: ", err.Error())
+	}
+
+	parent := Parent{FirstName: "Wait", LastName: "Listed", EmailAddress: "waitlisted@someemail.com"}
+	children := make([]Child, 3)
+	for i, name := range []string{"Anna", "Ben", "Cara"} {
+		children[i].FirstName = name
+		children[i].LastName = "Listed"
+		children[i].DOB = time.Date(2012, time.May, 1+i, 0, 0, 0, 0, time.Local)
+	}
+
+	// Three children joining a class of one place leaves two on the waitlist
+	if err := c.AddClient("Capacity Academy", &parent, children, &PaymentMethod{}); err != nil {
+		t.Fatal("Failed to insert client info: ", err.Error())
+	}
+	waitlist, err := c.ListWaitlist("Capacity Academy", "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(waitlist) != 2 {
+		t.Fatal("Expected two waitlisted children, found ", len(waitlist))
+	}
+	if waitlist[0].ChildName != "Ben Listed" {
+		t.Error("Waitlist should be in enrollment order: ", waitlist)
+	}
+
+	// Raising the capacity promotes the first waitlisted child
+	if err = c.SetCapacity("Capacity Academy", "", "", 2); err != nil {
+		t.Fatal(err.Error())
+	}
+	waitlist, err = c.ListWaitlist("Capacity Academy", "", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(waitlist) != 1 || waitlist[0].ChildName != "Cara Listed" {
+		t.Error("Expected only Cara to remain on the waitlist: ", waitlist)
+	}
+	notifications, err := c.ListNotifications(waitlist[0].ClientId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(notifications) != 1 {
+		t.Error("Expected the family of Ben to be notified of the promotion: ", notifications)
+	}
+
+	// Two families racing for the last place of a new class
+	if err = c.AddSeason("Capacity Academy", &Season{
+		Name:  "Race",
+		Start: time.Now(),
+		End:   time.Now().AddDate(0, 3, 0),
+		Schedules: []*Schedule{
+			&Schedule{Class: "Solo", Weekday: time.Monday, StartTime: "09:00", Duration: 30, Capacity: 1},
+		},
+	}); err != nil {
+		t.Fatal(err.Error())
+	}
+	client, err := c.GetClientById(waitlist[0].ClientId)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var wg sync.WaitGroup
+	results := make([]*Enrollment, len(client.Children))
+	for i, child := range client.Children {
+		wg.Add(1)
+		go func(i int, childId string) {
+			defer wg.Done()
+			results[i], _ = c.Enroll(client.Id.Hex(), childId, "Capacity Academy", "Race", "Solo")
+		}(i, child.Id.Hex())
+	}
+	wg.Wait()
+	enrolled := 0
+	for _, e := range results {
+		if e != nil && !e.Waitlisted {
+			enrolled++
+		}
+	}
+	if enrolled != 1 {
+		t.Error("Exactly one child should get the only place, got ", enrolled)
+	}
+}
+
+func TestEnrollmentTransitions(t *testing.T) {
+	allowed := []struct{ from, to EnrollmentState }{
+		{Inquiry, Registered},
+		{Registered, Active},
+		{Active, Paused},
+		{Paused, Active},
+		{Active, Graduated},
+		{Active, Withdrawn},
+		{Withdrawn, Registered},
+	}
+	for _, tr := range allowed {
+		if !tr.from.CanTransition(tr.to) {
+			t.Errorf("Expected %s to %s to be allowed", tr.from, tr.to)
+		}
+	}
+
+	denied := []struct{ from, to EnrollmentState }{
+		{Inquiry, Active},
+		{Registered, Paused},
+		{Graduated, Active},
+		{Withdrawn, Active},
+		{Active, Inquiry},
+		{Active, Active},
+	}
+	for _, tr := range denied {
+		if tr.from.CanTransition(tr.to) {
+			t.Errorf("Expected %s to %s to be rejected", tr.from, tr.to)
+		}
+	}
+
+	if EnrollmentState("expelled").Valid() {
+		t.Error("Unknown states should not be valid")
+	}
+}
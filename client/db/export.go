@@ -0,0 +1,298 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportDateFormat is how dates are written in exports.
+const exportDateFormat = "2006-01-02"
+
+// ExportFilter narrows an export. School is a school name; Season and State select enrollments, and clients
+// with an enrollment matching them; From and To bound the dates of enrollments and payments. Empty fields
+// don't filter.
+type ExportFilter struct {
+	School string
+	Season string
+	State  EnrollmentState
+	From   time.Time
+	To     time.Time
+}
+
+// The ExportWriter interface receives an export a row at a time, so exports of any size are written as they
+// are read. Columns is called once before the rows, and every row lines up with the columns.
+type ExportWriter interface {
+	Columns(columns []string) error
+	Row(values []string) error
+}
+
+// Export kinds and their columns. Every format writes the same columns in the same order.
+var exportColumns = map[string][]string{
+	"schools": {"schoolid", "name", "address", "city", "state", "zipcode", "mainphone", "contactname", "url",
+		"capacity", "seasons"},
+	"clients": {"clientid", "school", "firstname", "lastname", "emailaddress", "homephone", "mobilephone",
+		"address", "city", "state", "zipcode", "children", "paymentmethod", "paid"},
+	"roster": {"enrollmentid", "school", "season", "class", "childid", "child", "state", "waitlisted",
+		"created", "clientid", "parent", "emailaddress", "mobilephone"},
+	"payments": {"clientid", "school", "parent", "date", "method", "amount", "reference"},
+}
+
+// ExportKinds returns the kinds of export there are.
+func ExportKinds() []string {
+	return []string{"schools", "clients", "roster", "payments"}
+}
+
+// exportDate writes a date, or nothing for a date that isn't set.
+func exportDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(exportDateFormat)
+}
+
+// inRange reports whether the time is within the filter's dates.
+func (f *ExportFilter) inRange(t time.Time) bool {
+	return (f.From.IsZero() || !t.Before(f.From)) && (f.To.IsZero() || !t.After(f.To))
+}
+
+// schoolRow maps a school onto the schools columns.
+func schoolRow(school *School) []string {
+	var seasons []string
+	for _, season := range school.Seasons {
+		seasons = append(seasons, season.Name)
+	}
+	return []string{
+		school.Id.Hex(),
+		school.Name,
+		school.Address,
+		school.City,
+		school.State,
+		school.ZipCode,
+		school.MainPhone,
+		school.ContactName,
+		school.Url,
+		strconv.Itoa(school.Capacity),
+		strings.Join(seasons, "; "),
+	}
+}
+
+// guardianContact returns the primary guardian of the client, or an empty one.
+func guardianContact(client *Client) *Guardian {
+	if g := client.PrimaryGuardian(); g != nil {
+		return g
+	}
+	return &Guardian{}
+}
+
+// clientRow maps a client onto the clients columns.
+func clientRow(client *Client, schoolName string) []string {
+	g := guardianContact(client)
+	var children []string
+	for _, child := range client.Children {
+		children = append(children, strings.TrimSpace(child.FirstName+" "+child.LastName))
+	}
+	paid := 0.0
+	for _, p := range client.Payments {
+		if p != nil {
+			paid += p.Amount
+		}
+	}
+	return []string{
+		client.Id.Hex(),
+		schoolName,
+		g.FirstName,
+		g.LastName,
+		g.EmailAddress,
+		g.HomePhone,
+		g.MobilePhone,
+		g.Address,
+		g.City,
+		g.State,
+		g.ZipCode,
+		strings.Join(children, "; "),
+		client.PaymentMethod.Method.String(),
+		strconv.FormatFloat(roundCents(paid), 'f', 2, 64),
+	}
+}
+
+// rosterRow maps an enrollment and the family it belongs to onto the roster columns.
+func rosterRow(enrollment *Enrollment, schoolName string, client *Client) []string {
+	g := &Guardian{}
+	if client != nil {
+		g = guardianContact(client)
+	}
+	return []string{
+		enrollment.Id.Hex(),
+		schoolName,
+		enrollment.Season,
+		enrollment.Class,
+		enrollment.ChildId,
+		enrollment.ChildName,
+		string(enrollment.State),
+		strconv.FormatBool(enrollment.Waitlisted),
+		exportDate(enrollment.Created),
+		enrollment.ClientId,
+		strings.TrimSpace(g.FirstName + " " + g.LastName),
+		g.EmailAddress,
+		g.MobilePhone,
+	}
+}
+
+// paymentRows maps the payments of a client within the filter's dates onto the payments columns.
+func paymentRows(client *Client, schoolName string, filter *ExportFilter) (rows [][]string) {
+	g := guardianContact(client)
+	for _, p := range client.Payments {
+		if p == nil || !filter.inRange(p.Date) {
+			continue
+		}
+		rows = append(rows, []string{
+			client.Id.Hex(),
+			schoolName,
+			strings.TrimSpace(g.FirstName + " " + g.LastName),
+			exportDate(p.Date),
+			p.Method.String(),
+			strconv.FormatFloat(p.Amount, 'f', 2, 64),
+			p.Reference,
+		})
+	}
+	return
+}
+
+// enrollmentQuery selects the enrollments matching the filter.
+func enrollmentQuery(filter *ExportFilter, schoolId string) bson.M {
+	query := bson.M{}
+	if schoolId != "" {
+		query["schoolid"] = schoolId
+	}
+	if filter.Season != "" {
+		query["season"] = filter.Season
+	}
+	if filter.State != "" {
+		query["state"] = filter.State
+	}
+	if !filter.From.IsZero() || !filter.To.IsZero() {
+		created := bson.M{}
+		if !filter.From.IsZero() {
+			created["$gte"] = filter.From
+		}
+		if !filter.To.IsZero() {
+			created["$lte"] = filter.To
+		}
+		query["created"] = created
+	}
+	return query
+}
+
+// Export writes every school, client, enrollment or payment matching the filter, depending on kind. Documents
+// are read from the database one at a time as they are written.
+func (c *MongoConnection) Export(kind string, filter ExportFilter, out ExportWriter) (err error) {
+	columns, ok := exportColumns[kind]
+	if !ok {
+		return fmt.Errorf("Unknown export %q, choose one of %s", kind, strings.Join(ExportKinds(), ", "))
+	}
+	schools, err := c.ListSchools()
+	if err != nil {
+		return
+	}
+	names := make(map[string]string)
+	schoolId := ""
+	for _, school := range schools {
+		names[school.Id.Hex()] = school.Name
+		if filter.School != "" && strings.EqualFold(school.Name, filter.School) {
+			schoolId = school.Id.Hex()
+		}
+	}
+	if filter.School != "" && schoolId == "" {
+		return fmt.Errorf("School %s not found", filter.School)
+	}
+	if err = out.Columns(columns); err != nil {
+		return
+	}
+
+	session, clientCollection, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	enrollmentCollection := session.DB(databaseName).C(enrollmentCollectionName)
+
+	var iter *mgo.Iter
+	switch kind {
+	case "schools":
+		query := bson.M{}
+		if schoolId != "" {
+			query["_id"] = bson.ObjectIdHex(schoolId)
+		}
+		iter = schoolCollection.Find(query).Sort("name").Iter()
+		var school School
+		for iter.Next(&school) && err == nil {
+			err = out.Row(schoolRow(&school))
+			school = School{}
+		}
+
+	case "roster":
+		iter = enrollmentCollection.Find(enrollmentQuery(&filter, schoolId)).Sort("schoolid", "season", "class", "childname").Iter()
+		var enrollment Enrollment
+		var client *Client
+		for iter.Next(&enrollment) && err == nil {
+			// Rosters are sorted by class rather than family, so only the last family is kept
+			if client == nil || client.Id.Hex() != enrollment.ClientId {
+				client = nil
+				if bson.IsObjectIdHex(enrollment.ClientId) {
+					client = new(Client)
+					if clientCollection.FindId(bson.ObjectIdHex(enrollment.ClientId)).One(client) != nil {
+						client = nil
+					}
+				}
+			}
+			err = out.Row(rosterRow(&enrollment, names[enrollment.SchoolId], client))
+			enrollment = Enrollment{}
+		}
+
+	case "clients", "payments":
+		query := bson.M{}
+		if schoolId != "" {
+			query["schoolid"] = schoolId
+		}
+		if filter.Season != "" || filter.State != "" {
+			enrolled := ExportFilter{Season: filter.Season, State: filter.State}
+			var ids []string
+			if err = enrollmentCollection.Find(enrollmentQuery(&enrolled, schoolId)).Distinct("clientid", &ids); err != nil {
+				return
+			}
+			var objectIds []bson.ObjectId
+			for _, id := range ids {
+				if bson.IsObjectIdHex(id) {
+					objectIds = append(objectIds, bson.ObjectIdHex(id))
+				}
+			}
+			query["_id"] = bson.M{"$in": objectIds}
+		}
+		iter = clientCollection.Find(query).Sort("_id").Iter()
+		var client Client
+		for iter.Next(&client) && err == nil {
+			if kind == "clients" {
+				err = out.Row(clientRow(&client, names[client.School]))
+			} else {
+				for _, row := range paymentRows(&client, names[client.School], &filter) {
+					if err = out.Row(row); err != nil {
+						break
+					}
+				}
+			}
+			client = Client{}
+		}
+
+	default:
+		return errors.New("Unknown export")
+	}
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestExportRows(t *testing.T) {
+	client := &Client{
+		Id: bson.NewObjectId(),
+		Guardians: []*Guardian{{Parent: Parent{FirstName: "Ann", LastName: "Smith", EmailAddress: "ann@example.com"},
+			Role: PrimaryGuardian}},
+		Children:      []*Child{{FirstName: "Tom", LastName: "Smith"}, {FirstName: "Tia", LastName: "Jones"}},
+		PaymentMethod: PaymentMethod{Method: Check},
+		Payments: []*Payment{
+			{Method: Check, Date: time.Date(2017, time.January, 5, 0, 0, 0, 0, time.Local), Amount: 40, Reference: "1001"},
+			nil,
+			{Method: Cash, Date: time.Date(2017, time.February, 5, 0, 0, 0, 0, time.Local), Amount: 25.5},
+		},
+	}
+
+	row := clientRow(client, "Maple Elementary")
+	if len(row) != len(exportColumns["clients"]) {
+		t.Fatal("Expected a value for every client column, got ", row)
+	}
+	if row[1] != "Maple Elementary" || row[2] != "Ann" || row[11] != "Tom Smith; Tia Jones" || row[12] != "Check" || row[13] != "65.50" {
+		t.Error("Expected the client mapped onto its columns, got ", row)
+	}
+
+	filter := &ExportFilter{From: time.Date(2017, time.February, 1, 0, 0, 0, 0, time.Local)}
+	payments := paymentRows(client, "Maple Elementary", filter)
+	if len(payments) != 1 || len(payments[0]) != len(exportColumns["payments"]) {
+		t.Fatal("Expected only the February payment, got ", payments)
+	}
+	if payments[0][2] != "Ann Smith" || payments[0][3] != "2017-02-05" || payments[0][4] != "Cash" || payments[0][5] != "25.50" {
+		t.Error("Expected the payment mapped onto its columns, got ", payments[0])
+	}
+
+	enrollment := &Enrollment{Id: bson.NewObjectId(), ClientId: client.Id.Hex(), ChildName: "Tom Smith", Season: "Fall",
+		State: Active, Created: time.Date(2017, time.August, 20, 9, 0, 0, 0, time.Local)}
+	roster := rosterRow(enrollment, "Maple Elementary", nil)
+	if len(roster) != len(exportColumns["roster"]) || roster[8] != "2017-08-20" || roster[10] != "" {
+		t.Error("Expected a roster row without a family to leave the family blank, got ", roster)
+	}
+	if roster = rosterRow(enrollment, "Maple Elementary", client); roster[10] != "Ann Smith" || roster[11] != "ann@example.com" {
+		t.Error("Expected the roster row to name the parent, got ", roster)
+	}
+
+	school := &School{Id: bson.NewObjectId(), Name: "Maple Elementary", Capacity: 40, Seasons: []*Season{{Name: "Fall"}, {Name: "Spring"}}}
+	if row = schoolRow(school); len(row) != len(exportColumns["schools"]) || row[9] != "40" || row[10] != "Fall; Spring" {
+		t.Error("Expected the school mapped onto its columns, got ", row)
+	}
+
+	query := enrollmentQuery(&ExportFilter{Season: "Fall", State: Active, To: time.Now()}, "abc")
+	if query["schoolid"] != "abc" || query["season"] != "Fall" || query["state"] != Active || query["created"].(bson.M)["$lte"] == nil {
+		t.Error("Expected every filter in the enrollment query, got ", query)
+	}
+}
@@ -0,0 +1,207 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Card numbers the FakeGateway treats specially, all of which pass the Luhn check.
+const (
+	FakeDeclinedCard          = "4000000000000002"
+	FakeInsufficientFundsCard = "4000000000009995"
+	FakeTimeoutCard           = "4000000000000119"
+)
+
+// FakeCharge is a charge the FakeGateway has captured.
+type FakeCharge struct {
+	Id       string
+	Token    string
+	Amount   float64
+	Refunded float64
+}
+
+type fakeAuthorization struct {
+	Authorization
+	ChargeId string
+}
+
+// FakeGateway is a Gateway that keeps everything in memory and never contacts a processor. It is for
+// development and tests only, set with SetGateway, and its tokens are lost on restart. Cards are declined or
+// time out depending on their number, see the Fake card constants, and TimeoutNext makes the next requests
+// time out after the processor has acted on them, which is how duplicate charges happen in real life. With
+// IgnoreIdempotency set it behaves like a processor without idempotency keys, charging again when a request
+// is retried.
+type FakeGateway struct {
+	TimeoutNext       int
+	IgnoreIdempotency bool
+
+	mu             sync.Mutex
+	next           int
+	cards          map[string]Card
+	authorizations map[string]*fakeAuthorization
+	keys           map[string]string
+	refunds        map[string]string
+	charges        map[string]*FakeCharge
+	order          []string
+}
+
+// NewFakeGateway returns a FakeGateway with no cards or charges.
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		cards:          make(map[string]Card),
+		authorizations: make(map[string]*fakeAuthorization),
+		keys:           make(map[string]string),
+		refunds:        make(map[string]string),
+		charges:        make(map[string]*FakeCharge),
+	}
+}
+
+// id returns a new id with the prefix. The caller holds the lock.
+func (g *FakeGateway) id(prefix string) string {
+	g.next++
+	return fmt.Sprintf("%s_fake_%06d", prefix, g.next)
+}
+
+// timedOut reports whether the request should time out, using up one of TimeoutNext. The caller holds the
+// lock.
+func (g *FakeGateway) timedOut() bool {
+	if g.TimeoutNext > 0 {
+		g.TimeoutNext--
+		return true
+	}
+	return false
+}
+
+// timeout is the error returned when a request times out.
+func timeout() error {
+	return &GatewayError{Code: GatewayTimeout, Message: "The payment processor did not respond in time", Temporary: true}
+}
+
+// Tokenize checks the card and returns a token for it.
+func (g *FakeGateway) Tokenize(card *Card) (token string, err error) {
+	number := cardDigits(card.Number)
+	if !luhnValid(number) {
+		return "", &GatewayError{Code: InvalidCard, Message: "The card number is not valid"}
+	}
+	if cardExpired(card.Expiration, time.Now()) {
+		return "", &GatewayError{Code: ExpiredCard, Message: "The card has expired"}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	token = g.id("tok")
+	stored := *card
+	stored.Number = number
+	g.cards[token] = stored
+	return
+}
+
+// Authorize places a hold on the card. A key that has been used before returns the original authorization
+// instead of placing another hold.
+func (g *FakeGateway) Authorize(token string, amount float64, idempotencyKey string) (authorization *Authorization, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if id, ok := g.keys[idempotencyKey]; ok && idempotencyKey != "" && !g.IgnoreIdempotency {
+		if g.timedOut() {
+			return nil, timeout()
+		}
+		a := g.authorizations[id].Authorization
+		return &a, nil
+	}
+	card, ok := g.cards[token]
+	if !ok {
+		return nil, &GatewayError{Code: InvalidCard, Message: "Unknown card token"}
+	}
+	if amount <= 0 {
+		return nil, &GatewayError{Code: Declined, Message: "The amount must be positive"}
+	}
+	switch {
+	case card.Number == FakeDeclinedCard:
+		return nil, &GatewayError{Code: Declined, Message: "The card was declined"}
+	case card.Number == FakeInsufficientFundsCard:
+		return nil, &GatewayError{Code: InsufficientFunds, Message: "The card has insufficient funds"}
+	case card.Number == FakeTimeoutCard:
+		return nil, timeout()
+	case cardExpired(card.Expiration, time.Now()):
+		return nil, &GatewayError{Code: ExpiredCard, Message: "The card has expired"}
+	}
+
+	a := &fakeAuthorization{Authorization: Authorization{Id: g.id("auth"), Token: token, Amount: roundCents(amount), Time: time.Now()}}
+	g.authorizations[a.Id] = a
+	g.keys[idempotencyKey] = a.Id
+	if g.timedOut() {
+		return nil, timeout()
+	}
+	result := a.Authorization
+	return &result, nil
+}
+
+// Capture charges an authorization for up to its amount. Capturing it again returns the same charge.
+func (g *FakeGateway) Capture(authorizationId string, amount float64) (chargeId string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	a, ok := g.authorizations[authorizationId]
+	if !ok {
+		return "", &GatewayError{Code: UnknownCharge, Message: "Unknown authorization " + authorizationId}
+	}
+	if a.ChargeId == "" {
+		if roundCents(amount) > a.Amount {
+			return "", &GatewayError{Code: Declined, Message: "The capture is more than was authorized"}
+		}
+		charge := &FakeCharge{Id: g.id("ch"), Token: a.Token, Amount: roundCents(amount)}
+		g.charges[charge.Id] = charge
+		g.order = append(g.order, charge.Id)
+		a.ChargeId = charge.Id
+	} else if g.charges[a.ChargeId].Amount != roundCents(amount) {
+		return "", &GatewayError{Code: AlreadyCaptured, Message: "The authorization has already been captured"}
+	}
+	if g.timedOut() {
+		return "", timeout()
+	}
+	return a.ChargeId, nil
+}
+
+// Refund returns up to the amount charged to the card. A key that has been used before returns the original
+// refund instead of refunding again.
+func (g *FakeGateway) Refund(chargeId string, amount float64, idempotencyKey string) (refundId string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if id, ok := g.refunds[idempotencyKey]; ok && idempotencyKey != "" && !g.IgnoreIdempotency {
+		if g.timedOut() {
+			return "", timeout()
+		}
+		return id, nil
+	}
+	charge, ok := g.charges[chargeId]
+	if !ok {
+		return "", &GatewayError{Code: UnknownCharge, Message: "Unknown charge " + chargeId}
+	}
+	if amount <= 0 || roundCents(charge.Refunded+amount) > charge.Amount {
+		return "", &GatewayError{Code: RefundTooLarge, Message: fmt.Sprintf("Only %.2f of the charge can be refunded", charge.Amount-charge.Refunded)}
+	}
+	charge.Refunded = roundCents(charge.Refunded + amount)
+	refundId = g.id("re")
+	g.refunds[idempotencyKey] = refundId
+	if g.timedOut() {
+		return "", timeout()
+	}
+	return refundId, nil
+}
+
+// Charges returns every charge captured against the card token, so tests can see whether a card was charged
+// more than once.
+func (g *FakeGateway) Charges(token string) (charges []FakeCharge) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, id := range g.order {
+		if charge := g.charges[id]; charge.Token == token {
+			charges = append(charges, *charge)
+		}
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Card holds the details of a credit card long enough to exchange them for a token.
+type Card struct {
+	Number       string    `json:"number"`
+	Expiration   time.Time `json:"expiration"`
+	SecurityCode string    `json:"securitycode"`
+	Name         string    `json:"name"`
+}
+
+// Authorization is a hold placed on a card for an amount, to be captured later.
+type Authorization struct {
+	Id     string    `json:"id"`
+	Token  string    `json:"token"`
+	Amount float64   `json:"amount"`
+	Time   time.Time `json:"time"`
+}
+
+// Gateway error codes.
+const (
+	Declined          = "declined"
+	InsufficientFunds = "insufficient_funds"
+	ExpiredCard       = "expired_card"
+	InvalidCard       = "invalid_card"
+	GatewayTimeout    = "timeout"
+	UnknownCharge     = "not_found"
+	AlreadyCaptured   = "already_captured"
+	RefundTooLarge    = "refund_too_large"
+)
+
+// GatewayError is an error reported by a payment gateway. Temporary errors may succeed if the request is made
+// again with the same idempotency key, the others will not.
+type GatewayError struct {
+	Code      string
+	Message   string
+	Temporary bool
+}
+
+func (e *GatewayError) Error() string {
+	return fmt.Sprintf("Payment %s: %s", strings.Replace(e.Code, "_", " ", -1), e.Message)
+}
+
+// The Gateway interface charges cards through a payment processor. Card numbers are exchanged for tokens once
+// and only tokens are kept. Authorize and Refund take an idempotency key so a request retried after a timeout
+// doesn't charge or refund the card twice.
+type Gateway interface {
+	Tokenize(card *Card) (token string, err error)
+	Authorize(token string, amount float64, idempotencyKey string) (authorization *Authorization, err error)
+	Capture(authorizationId string, amount float64) (chargeId string, err error)
+	Refund(chargeId string, amount float64, idempotencyKey string) (refundId string, err error)
+}
+
+// SetGateway replaces the Gateway used to charge cards.
+func (c *MongoConnection) SetGateway(gateway Gateway) {
+	c.gateway = gateway
+}
+
+// luhnValid reports whether the card number passes the Luhn checksum every card number carries.
+func luhnValid(number string) bool {
+	if len(number) < 12 || len(number) > 19 {
+		return false
+	}
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// cardDigits strips the spaces and dashes people type into card numbers.
+func cardDigits(number string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(number)
+}
+
+// maskCard keeps only the last four digits of a card number.
+func maskCard(number string) string {
+	number = cardDigits(number)
+	if len(number) <= 4 {
+		return number
+	}
+	return strings.Repeat("*", len(number)-4) + number[len(number)-4:]
+}
+
+// cardExpired reports whether a card expiring on the date can no longer be charged on the day. Cards are good
+// to the end of their expiry month.
+func cardExpired(expiration, day time.Time) bool {
+	if expiration.IsZero() {
+		return false
+	}
+	return !day.Before(cardExpiry(expiration))
+}
+
+// cardExpiry returns the first day a card expiring on the date can no longer be charged.
+func cardExpiry(expiration time.Time) time.Time {
+	return time.Date(expiration.Year(), expiration.Month()+1, 1, 0, 0, 0, 0, expiration.Location())
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFakeGateway(t *testing.T) {
+	gateway := NewFakeGateway()
+	expires := time.Now().AddDate(2, 0, 0)
+
+	if _, err := gateway.Tokenize(&Card{Number: "4111 1111 1111 1112", Expiration: expires}); err == nil {
+		t.Error("Expected a card number failing the Luhn check to be rejected")
+	}
+	if _, err := gateway.Tokenize(&Card{Number: "4111111111111111", Expiration: time.Now().AddDate(0, -2, 0)}); err == nil {
+		t.Error("Expected an expired card to be rejected")
+	}
+	token, err := gateway.Tokenize(&Card{Number: "4111-1111-1111-1111", Expiration: expires})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// A retry after a timeout with the same key finds the original authorization
+	gateway.TimeoutNext = 1
+	if _, err = gateway.Authorize(token, 45, "fall-2017"); err == nil || !err.(*GatewayError).Temporary {
+		t.Fatal("Expected a temporary timeout, got ", err)
+	}
+	auth, err := gateway.Authorize(token, 45, "fall-2017")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	charge, err := gateway.Capture(auth.Id, 45)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if again, _ := gateway.Capture(auth.Id, 45); again != charge {
+		t.Error("Expected capturing twice to return the same charge")
+	}
+	if charges := gateway.Charges(token); len(charges) != 1 {
+		t.Error("Expected one charge despite the retries, got ", charges)
+	}
+
+	// Without idempotency the retry charges the card again
+	gateway.IgnoreIdempotency = true
+	auth, _ = gateway.Authorize(token, 45, "fall-2017")
+	gateway.Capture(auth.Id, 45)
+	if charges := gateway.Charges(token); len(charges) != 2 {
+		t.Error("Expected a duplicate charge, got ", charges)
+	}
+
+	if _, err = gateway.Refund(charge, 50, "refund-1"); err == nil {
+		t.Error("Expected a refund of more than was charged to be refused")
+	}
+
+	// A refund retried after a timeout with the same key finds the original refund
+	gateway.IgnoreIdempotency = false
+	gateway.TimeoutNext = 1
+	if _, err = gateway.Refund(charge, 20, "refund-2"); err == nil || !err.(*GatewayError).Temporary {
+		t.Fatal("Expected a temporary timeout, got ", err)
+	}
+	refund, err := gateway.Refund(charge, 20, "refund-2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if again, _ := gateway.Refund(charge, 20, "refund-2"); again != refund {
+		t.Error("Expected refunding twice with a key to return the same refund")
+	}
+	if charges := gateway.Charges(token); charges[0].Refunded != 20 {
+		t.Error("Expected 20 refunded once despite the retries, got ", charges[0].Refunded)
+	}
+
+	for number, code := range map[string]string{FakeDeclinedCard: Declined, FakeInsufficientFundsCard: InsufficientFunds, FakeTimeoutCard: GatewayTimeout} {
+		token, _ := gateway.Tokenize(&Card{Number: number, Expiration: expires})
+		if _, err := gateway.Authorize(token, 10, number); err == nil || err.(*GatewayError).Code != code {
+			t.Errorf("Expected card %s to fail with %s, got %v", number, code, err)
+		}
+	}
+}
+
+func TestCardExpired(t *testing.T) {
+	expiration := time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local)
+	if cardExpired(expiration, time.Date(2017, time.March, 31, 23, 0, 0, 0, time.Local)) {
+		t.Error("Expected a card to be good to the end of its expiry month")
+	}
+	if !cardExpired(expiration, time.Date(2017, time.April, 1, 0, 0, 0, 0, time.Local)) {
+		t.Error("Expected a card to expire after its expiry month")
+	}
+	if maskCard("4111 1111 1111 1111") != "************1111" {
+		t.Error("Expected only the last four digits to be kept, got ", maskCard("4111 1111 1111 1111"))
+	}
+}
+
+func TestPaymentMethodJSON(t *testing.T) {
+	encoded, err := json.Marshal(&Client{PaymentMethod: PaymentMethod{CcNumber: "4111 1111 1111 1111", SecurityCode: "123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(encoded); !strings.Contains(s, `"ccnumber":"************1111"`) || strings.Contains(s, "123") {
+		t.Error("Expected the card masked and the security code left out, got ", s)
+	}
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// earthRadiusMiles is the mean radius of the earth used for great circle distances.
+const earthRadiusMiles = 3958.8
+
+// Coordinates is a latitude and longitude in decimal degrees.
+type Coordinates struct {
+	Latitude  float64 `bson:"latitude" json:"latitude"`
+	Longitude float64 `bson:"longitude" json:"longitude"`
+}
+
+// IsZero reports whether the coordinates have not been set.
+func (c Coordinates) IsZero() bool {
+	return c.Latitude == 0 && c.Longitude == 0
+}
+
+// Distance returns the great circle distance in miles between a and b.
+func Distance(a, b Coordinates) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Latitude - a.Latitude)
+	dLon := toRad(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Latitude))*math.Cos(toRad(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMiles * math.Asin(math.Sqrt(h))
+}
+
+// ZipCentroids maps five digit ZIP codes to the centroid of the ZIP code area.
+type ZipCentroids map[string]Coordinates
+
+// DefaultZipCentroids is a small bundled table of approximate ZIP centroids for the area TumbleBus serves.
+// A complete table can be loaded with LoadZipCentroids.
+var DefaultZipCentroids = ZipCentroids{
+	"01450": {42.61, -71.57}, // Groton
+	"01460": {42.54, -71.49}, // Littleton
+	"01701": {42.32, -71.44}, // Framingham
+	"01719": {42.49, -71.52}, // Boxborough
+	"01720": {42.48, -71.45}, // Acton
+	"01730": {42.49, -71.28}, // Bedford
+	"01742": {42.46, -71.36}, // Concord
+	"01749": {42.39, -71.56}, // Hudson
+	"01752": {42.35, -71.55}, // Marlborough
+	"01754": {42.43, -71.45}, // Maynard
+	"01760": {42.28, -71.35}, // Natick
+	"01776": {42.38, -71.42}, // Sudbury
+	"01778": {42.36, -71.36}, // Wayland
+	"01803": {42.50, -71.20}, // Burlington
+	"01824": {42.60, -71.36}, // Chelmsford
+	"01886": {42.59, -71.44}, // Westford
+	"02138": {42.38, -71.13}, // Cambridge
+	"02139": {42.36, -71.10}, // Cambridge
+	"02420": {42.45, -71.23}, // Lexington
+	"02421": {42.44, -71.24}, // Lexington
+	"02451": {42.39, -71.25}, // Waltham
+	"02453": {42.37, -71.24}, // Waltham
+	"02474": {42.42, -71.16}, // Arlington
+	"02478": {42.39, -71.18}, // Belmont
+	"02493": {42.36, -71.30}, // Weston
+}
+
+// LoadZipCentroids reads a CSV table of zip,latitude,longitude rows. A header row is skipped.
+func LoadZipCentroids(r io.Reader) (zips ZipCentroids, err error) {
+	zips = ZipCentroids{}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	for line := 1; ; line++ {
+		record, readErr := reader.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		lat, latErr := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		lon, lonErr := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if latErr != nil || lonErr != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("Invalid coordinates on line %d of the ZIP table", line)
+		}
+		zips[strings.TrimSpace(record[0])] = Coordinates{Latitude: lat, Longitude: lon}
+	}
+	return
+}
+
+// Lookup returns the centroid of the ZIP code. ZIP+4 codes are looked up by their first five digits.
+func (z ZipCentroids) Lookup(zip string) (Coordinates, bool) {
+	zip = strings.TrimSpace(zip)
+	if len(zip) > 5 {
+		zip = zip[:5]
+	}
+	c, ok := z[zip]
+	return c, ok
+}
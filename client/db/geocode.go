@@ -0,0 +1,265 @@
+package db
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"strings"
+)
+
+// The Geocoder interface finds the coordinates of a street address. A nil location without an error means
+// the address couldn't be placed.
+type Geocoder interface {
+	Geocode(address, city, state, zipCode string) (location *Coordinates, err error)
+}
+
+// Geocode places the address at the centroid of its ZIP code, so it works offline. The bundled
+// DefaultZipCentroids is the default Geocoder.
+func (z ZipCentroids) Geocode(address, city, state, zipCode string) (location *Coordinates, err error) {
+	if c, ok := z.Lookup(zipCode); ok {
+		location = &c
+	}
+	return
+}
+
+// SetGeocoder replaces the Geocoder used to place schools and families.
+func (c *MongoConnection) SetGeocoder(geocoder Geocoder) {
+	c.geocoder = geocoder
+}
+
+// routeOptions returns the options with the Geocoder of the connection, unless they give their own, so
+// routes place schools the same way schools and families are placed when they are stored.
+func (c *MongoConnection) routeOptions(opts RouteOptions) RouteOptions {
+	if opts.Geocoder == nil && c.geocoder != nil {
+		opts.Geocoder = c.geocoder
+	}
+	opts.defaults()
+	return opts
+}
+
+// geocode returns the coordinates of the address, nil when it can't be placed. Addresses are stored whether
+// or not they can be placed, so a failing geocoder is taken as an address it couldn't place.
+func (c *MongoConnection) geocode(address, city, state, zipCode string) *Coordinates {
+	geocoder := c.geocoder
+	if geocoder == nil {
+		geocoder = DefaultZipCentroids
+	}
+	location, err := geocoder.Geocode(address, city, state, zipCode)
+	if err != nil {
+		return nil
+	}
+	return location
+}
+
+// locateSchool geocodes the school unless its coordinates have been configured.
+func (c *MongoConnection) locateSchool(school *School) {
+	if school.Location == nil || school.Location.IsZero() {
+		school.Location = c.geocode(school.Address, school.City, school.State, school.ZipCode)
+	}
+}
+
+// locateParent geocodes the address of the parent.
+func (c *MongoConnection) locateParent(parent *Parent) {
+	parent.Location = c.geocode(parent.Address, parent.City, parent.State, parent.ZipCode)
+}
+
+// NearbySchool is a school and how far it is in a straight line, in miles.
+type NearbySchool struct {
+	School School  `json:"school"`
+	Miles  float64 `json:"miles"`
+}
+
+// NearbyFamily is a client, named after its primary guardian, with the contact details of its nearest
+// guardian and how far that guardian lives in a straight line, in miles.
+type NearbyFamily struct {
+	ClientId     string  `json:"clientid"`
+	Name         string  `json:"name"`
+	GuardianId   string  `json:"guardianid"`
+	Guardian     string  `json:"guardian"`
+	HomePhone    string  `json:"homephone"`
+	MobilePhone  string  `json:"mobilephone"`
+	EmailAddress string  `json:"emailaddress"`
+	Miles        float64 `json:"miles"`
+}
+
+// roundMiles rounds a distance to a tenth of a mile.
+func roundMiles(miles float64) float64 {
+	return math.Floor(miles*10+0.5) / 10
+}
+
+// SchoolsWithin returns the schools with coordinates no more than miles from the origin, nearest first.
+func SchoolsWithin(origin Coordinates, schools []School, miles float64) (nearby []NearbySchool) {
+	nearby = []NearbySchool{}
+	for _, school := range schools {
+		if school.Location == nil || school.Location.IsZero() {
+			continue
+		}
+		if d := Distance(origin, *school.Location); d <= miles {
+			nearby = append(nearby, NearbySchool{School: school, Miles: roundMiles(d)})
+		}
+	}
+	sort.SliceStable(nearby, func(i, j int) bool { return nearby[i].Miles < nearby[j].Miles })
+	return
+}
+
+// FamiliesWithin returns the clients with a guardian living no more than miles from the origin, nearest
+// first, measured to their nearest guardian.
+func FamiliesWithin(origin Coordinates, clients []Client, miles float64) (nearby []NearbyFamily) {
+	nearby = []NearbyFamily{}
+	for i := range clients {
+		var nearest *Guardian
+		var nearestMiles float64
+		for _, g := range clients[i].Guardians {
+			if g.Location == nil || g.Location.IsZero() {
+				continue
+			}
+			if d := Distance(origin, *g.Location); d <= miles && (nearest == nil || d < nearestMiles) {
+				nearest, nearestMiles = g, d
+			}
+		}
+		if nearest != nil {
+			nearby = append(nearby, NearbyFamily{
+				ClientId:     clients[i].Id.Hex(),
+				Name:         clientName(&clients[i]),
+				GuardianId:   nearest.Id.Hex(),
+				Guardian:     strings.TrimSpace(nearest.FirstName + " " + nearest.LastName),
+				HomePhone:    nearest.HomePhone,
+				MobilePhone:  nearest.MobilePhone,
+				EmailAddress: nearest.EmailAddress,
+				Miles:        roundMiles(nearestMiles),
+			})
+		}
+	}
+	sort.SliceStable(nearby, func(i, j int) bool { return nearby[i].Miles < nearby[j].Miles })
+	return
+}
+
+// withinBox selects the documents with coordinates under the field inside the box bounding the circle of
+// miles around the origin, so only those need their distance measured. It is meant for the areas TumbleBus
+// serves, away from the poles and the date line.
+func withinBox(field string, origin Coordinates, miles float64) bson.M {
+	lat := miles / earthRadiusMiles * 180 / math.Pi
+	lon := lat / math.Cos(origin.Latitude*math.Pi/180)
+	return bson.M{
+		field + ".latitude":  bson.M{"$gte": origin.Latitude - lat, "$lte": origin.Latitude + lat},
+		field + ".longitude": bson.M{"$gte": origin.Longitude - lon, "$lte": origin.Longitude + lon},
+	}
+}
+
+// SchoolsNear returns the schools no more than miles from the centroid of the ZIP code, nearest first.
+func (c *MongoConnection) SchoolsNear(zipCode string, miles float64) (nearby []NearbySchool, err error) {
+	origin := c.geocode("", "", "", zipCode)
+	if origin == nil {
+		return nil, fmt.Errorf("No coordinates known for ZIP %s", zipCode)
+	}
+	session, _, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var schools []School
+	if err = schoolCollection.Find(withinBox("location", *origin, miles)).All(&schools); err != nil {
+		return
+	}
+	return SchoolsWithin(*origin, schools, miles), nil
+}
+
+// FamiliesNear returns the clients with a guardian living no more than miles from the school, nearest first.
+func (c *MongoConnection) FamiliesNear(schoolName string, miles float64) (nearby []NearbyFamily, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return nil, fmt.Errorf("School %s not found", schoolName)
+	}
+	c.locateSchool(school)
+	if school.Location == nil {
+		return nil, fmt.Errorf("No coordinates known for %s (ZIP %s)", school.Name, school.ZipCode)
+	}
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	// Only the guardians are needed to measure and contact the family
+	var clients []Client
+	query := bson.M{"guardians": bson.M{"$elemMatch": withinBox("location", *school.Location, miles)}}
+	if err = clientCollection.Find(query).Select(bson.M{"guardians": 1}).All(&clients); err != nil {
+		return
+	}
+	return FamiliesWithin(*school.Location, clients, miles), nil
+}
+
+// GeocodeResult reports how many schools and guardians geocoding placed or moved, and how many it couldn't
+// place.
+type GeocodeResult struct {
+	Schools   int `json:"schools"`
+	Guardians int `json:"guardians"`
+	Unlocated int `json:"unlocated"`
+}
+
+// sameLocation reports whether two locations are both unknown or at the same coordinates.
+func sameLocation(a, b *Coordinates) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// GeocodeAddresses places the stored schools without coordinates and re-places the guardians of every client,
+// for documents stored before addresses were geocoded on write or after a better Geocoder has been set.
+// Schools that have coordinates keep them, as geocoded ones can't be told from configured ones. It is safe
+// to run more than once.
+func (c *MongoConnection) GeocodeAddresses() (result *GeocodeResult, err error) {
+	session, clientCollection, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	result = &GeocodeResult{}
+	iter := schoolCollection.Find(bson.M{"location": nil}).Iter()
+	var school School
+	for iter.Next(&school) {
+		if c.locateSchool(&school); school.Location == nil {
+			result.Unlocated++
+		} else {
+			if err = schoolCollection.UpdateId(school.Id, bson.M{"$set": bson.M{"location": school.Location}}); err != nil {
+				iter.Close()
+				return
+			}
+			result.Schools++
+		}
+		school = School{}
+	}
+	if err = iter.Close(); err != nil {
+		return
+	}
+
+	iter = clientCollection.Find(nil).Iter()
+	var client Client
+	for iter.Next(&client) {
+		changed := false
+		for _, g := range client.Guardians {
+			located := g.Location
+			c.locateParent(&g.Parent)
+			if g.Location == nil {
+				result.Unlocated++
+			}
+			if !sameLocation(located, g.Location) {
+				result.Guardians++
+				changed = true
+			}
+		}
+		if changed {
+			if err = clientCollection.UpdateId(client.Id, bson.M{"$set": bson.M{"guardians": client.Guardians}}); err != nil {
+				iter.Close()
+				return
+			}
+		}
+		client = Client{}
+	}
+	err = iter.Close()
+	return
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestProximity(t *testing.T) {
+	acton, err := DefaultZipCentroids.Geocode("1 Main St", "Acton", "MA", "01720-1234")
+	if err != nil || acton == nil || *acton != DefaultZipCentroids["01720"] {
+		t.Fatal("Expected a ZIP+4 code placed at the centroid of its ZIP code, got ", acton, err)
+	}
+	if unknown, err := DefaultZipCentroids.Geocode("", "", "", "99999"); unknown != nil || err != nil {
+		t.Error("Expected an unknown ZIP code left unplaced, got ", unknown, err)
+	}
+
+	at := func(zip string) *Coordinates {
+		c := DefaultZipCentroids[zip]
+		return &c
+	}
+	schools := []School{
+		{Name: "Cambridge", Location: at("02138")},
+		{Name: "Concord", Location: at("01742")},
+		{Name: "Acton", Location: at("01720")},
+		{Name: "Nowhere"},
+	}
+	nearby := SchoolsWithin(*acton, schools, 10)
+	if len(nearby) != 2 || nearby[0].School.Name != "Acton" || nearby[0].Miles != 0 || nearby[1].School.Name != "Concord" {
+		t.Fatal("Expected Acton then Concord within 10 miles, got ", nearby)
+	}
+	if nearby[1].Miles < 4 || nearby[1].Miles > 6 {
+		t.Error("Expected Concord about 5 miles from Acton, got ", nearby[1].Miles)
+	}
+
+	near := family("Ann", "Smith", "", "")
+	near.Guardians[0].Location = at("02138")
+	near.Guardians = append(near.Guardians, &Guardian{Id: bson.NewObjectId(), Parent: Parent{FirstName: "Dan", Location: at("01754")}})
+	far := family("Bob", "Brown", "", "")
+	far.Guardians[0].Location = at("02138")
+	unplaced := family("Cal", "Green", "", "")
+	families := FamiliesWithin(*acton, []Client{far, unplaced, near}, 10)
+	if len(families) != 1 || families[0].ClientId != near.Id.Hex() || families[0].GuardianId != near.Guardians[1].Id.Hex() ||
+		families[0].Name != "Ann Smith" || families[0].Guardian != "Dan" {
+		t.Error("Expected the Smiths found by the guardian living in Maynard, got ", families)
+	}
+
+	box := withinBox("location", *acton, 10)
+	latitude := box["location.latitude"].(bson.M)
+	longitude := box["location.longitude"].(bson.M)
+	concord := at("01742")
+	if concord.Latitude < latitude["$gte"].(float64) || concord.Latitude > latitude["$lte"].(float64) ||
+		concord.Longitude < longitude["$gte"].(float64) || concord.Longitude > longitude["$lte"].(float64) {
+		t.Error("Expected Concord inside the box around Acton, got ", box)
+	}
+	if cambridge := at("02138"); cambridge.Longitude <= longitude["$lte"].(float64) {
+		t.Error("Expected Cambridge outside the box around Acton, got ", box)
+	}
+}
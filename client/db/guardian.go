@@ -0,0 +1,337 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strings"
+)
+
+// GuardianRole distinguishes the primary guardian, who is contacted first and billed, from the others.
+type GuardianRole string
+
+const (
+	PrimaryGuardian   GuardianRole = "primary"
+	SecondaryGuardian GuardianRole = "secondary"
+)
+
+// Guardian is a parent or other adult responsible for the children of a client.
+type Guardian struct {
+	Id               bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Parent           `bson:",inline"`
+	Role             GuardianRole `bson:"role" json:"role"`
+	Relationship     string       `bson:"relationship" json:"relationship"`
+	CustodyNotes     string       `bson:"custodynotes" json:"custodynotes"`
+	PickupAuthorized bool         `bson:"pickupauthorized" json:"pickupauthorized"`
+}
+
+// EmergencyContact is someone to call when none of the guardians can be reached.
+type EmergencyContact struct {
+	Id           bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Name         string        `bson:"name" json:"name"`
+	Relationship string        `bson:"relationship" json:"relationship"`
+	Phone        string        `bson:"phone" json:"phone"`
+	AltPhone     string        `bson:"altphone" json:"altphone"`
+	Notes        string        `bson:"notes" json:"notes"`
+}
+
+// PrimaryGuardian returns the primary guardian of the client, or the first guardian if none is marked primary.
+func (c *Client) PrimaryGuardian() *Guardian {
+	for _, g := range c.Guardians {
+		if g.Role == PrimaryGuardian {
+			return g
+		}
+	}
+	if len(c.Guardians) > 0 {
+		return c.Guardians[0]
+	}
+	return nil
+}
+
+// findChild returns the child of the client with the given id.
+func (c *Client) findChild(childId string) *Child {
+	for _, child := range c.Children {
+		if child.Id.Hex() == childId {
+			return child
+		}
+	}
+	return nil
+}
+
+// guardianNameQuery matches clients with a guardian of the given first and last name.
+func guardianNameQuery(firstName, lastName string) bson.M {
+	return bson.M{"guardians": bson.M{"$elemMatch": bson.M{"firstname": firstName, "lastname": lastName}}}
+}
+
+// exactly matches a whole string ignoring case.
+func exactly(s string) bson.RegEx {
+	return bson.RegEx{Pattern: "^" + regexp.QuoteMeta(strings.TrimSpace(s)) + "$", Options: "i"}
+}
+
+// FindClientsByGuardian returns the clients with a guardian matching every criteria given. The name may be
+// a full name or a single first or last name, the phone matches home or mobile phones as entered or
+// normalized, and the email is compared ignoring case.
+func (c *MongoConnection) FindClientsByGuardian(name, phone, email string) (clients []Client, err error) {
+	var match []bson.M
+	if name = strings.TrimSpace(name); name != "" {
+		if parts := strings.Fields(name); len(parts) > 1 {
+			match = append(match, bson.M{
+				"firstname": exactly(strings.Join(parts[:len(parts)-1], " ")),
+				"lastname":  exactly(parts[len(parts)-1]),
+			})
+		} else {
+			match = append(match, bson.M{"$or": []bson.M{
+				bson.M{"firstname": exactly(name)},
+				bson.M{"lastname": exactly(name)},
+			}})
+		}
+	}
+	if phone = strings.TrimSpace(phone); phone != "" {
+		// Guardians stored before phones were normalized have them as entered
+		phones := []string{phone}
+		if normal, ok := NormalizePhone(phone); ok && normal != phone {
+			phones = append(phones, normal)
+		}
+		match = append(match, bson.M{"$or": []bson.M{
+			bson.M{"homephone": bson.M{"$in": phones}},
+			bson.M{"mobilephone": bson.M{"$in": phones}},
+		}})
+	}
+	if email = strings.TrimSpace(email); email != "" {
+		match = append(match, bson.M{"emailaddress": exactly(email)})
+	}
+	if len(match) == 0 {
+		return nil, errors.New("A name, phone or email is required to look up a guardian")
+	}
+
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = clientCollection.Find(bson.M{"guardians": bson.M{"$elemMatch": bson.M{"$and": match}}}).All(&clients)
+	return
+}
+
+// updateClient applies the update to the client matching the query, for changes to a single guardian or
+// emergency contact that leave the rest of the client as it is.
+func (c *MongoConnection) updateClient(query, update bson.M) (err error) {
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = clientCollection.Update(query, update)
+	return
+}
+
+// demoteOthers makes every primary guardian of the client other than the given one secondary.
+func (c *MongoConnection) demoteOthers(clientId, primaryId bson.ObjectId) (err error) {
+	query := bson.M{"_id": clientId, "guardians": bson.M{"$elemMatch": bson.M{"role": PrimaryGuardian, "_id": bson.M{"$ne": primaryId}}}}
+	for err == nil {
+		err = c.updateClient(query, bson.M{"$set": bson.M{"guardians.$.role": SecondaryGuardian}})
+	}
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// makePrimary marks the guardian as the only primary guardian of the client.
+func (c *Client) makePrimary(guardian *Guardian) {
+	for _, g := range c.Guardians {
+		if g == guardian {
+			g.Role = PrimaryGuardian
+		} else if g.Role == PrimaryGuardian {
+			g.Role = SecondaryGuardian
+		}
+	}
+}
+
+// AddGuardian adds a guardian to the client. The first guardian is always the primary guardian and
+// adding a new primary guardian makes the previous one secondary. The contact information of the guardian
+// is normalized first.
+func (c *MongoConnection) AddGuardian(clientId string, guardian *Guardian) (err error) {
+	if guardian.FirstName == "" || guardian.LastName == "" {
+		return errors.New("A guardian requires a first and last name")
+	}
+	guardian.Normalize()
+	c.locateParent(&guardian.Parent)
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+
+	guardian.Id = bson.NewObjectId()
+	if len(client.Guardians) == 0 {
+		guardian.Role = PrimaryGuardian
+	} else if guardian.Role != PrimaryGuardian {
+		guardian.Role = SecondaryGuardian
+	}
+	if err = c.updateClient(bson.M{"_id": client.Id}, bson.M{"$push": bson.M{"guardians": guardian}}); err != nil {
+		return
+	}
+	if guardian.Role == PrimaryGuardian {
+		err = c.demoteOthers(client.Id, guardian.Id)
+	}
+	return
+}
+
+// UpdateGuardian replaces the guardian of the client with the same id, normalizing its contact information.
+func (c *MongoConnection) UpdateGuardian(clientId string, guardian *Guardian) (err error) {
+	if guardian.FirstName == "" || guardian.LastName == "" {
+		return errors.New("A guardian requires a first and last name")
+	}
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+
+	var stored *Guardian
+	for _, g := range client.Guardians {
+		if g.Id == guardian.Id {
+			stored = g
+		}
+	}
+	if stored == nil {
+		return fmt.Errorf("Guardian %s not found for client %s", guardian.Id.Hex(), clientId)
+	}
+	if guardian.Original == nil {
+		guardian.Original = stored.Original
+	}
+	guardian.Normalize()
+	c.locateParent(&guardian.Parent)
+	// Keep the client with a primary guardian
+	if guardian.Role != PrimaryGuardian && stored.Role == PrimaryGuardian {
+		guardian.Role = PrimaryGuardian
+	}
+	if guardian.Role != PrimaryGuardian {
+		guardian.Role = SecondaryGuardian
+	}
+	err = c.updateClient(bson.M{"_id": client.Id, "guardians._id": guardian.Id}, bson.M{"$set": bson.M{"guardians.$": guardian}})
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("Guardian %s not found for client %s", guardian.Id.Hex(), clientId)
+	}
+	if err == nil && guardian.Role == PrimaryGuardian {
+		err = c.demoteOthers(client.Id, guardian.Id)
+	}
+	return
+}
+
+// RemoveGuardian removes a guardian from the client. When the primary guardian is removed the next
+// guardian becomes primary.
+func (c *MongoConnection) RemoveGuardian(clientId, guardianId string) (err error) {
+	if !bson.IsObjectIdHex(clientId) || !bson.IsObjectIdHex(guardianId) {
+		return fmt.Errorf("Guardian %s not found for client %s", guardianId, clientId)
+	}
+	id := bson.ObjectIdHex(clientId)
+	err = c.updateClient(bson.M{"_id": id, "guardians._id": bson.ObjectIdHex(guardianId)},
+		bson.M{"$pull": bson.M{"guardians": bson.M{"_id": bson.ObjectIdHex(guardianId)}}})
+	if err == mgo.ErrNotFound {
+		return fmt.Errorf("Guardian %s not found for client %s", guardianId, clientId)
+	} else if err != nil {
+		return
+	}
+	// Without a primary guardian left, the first guardian becomes primary
+	err = c.updateClient(bson.M{"_id": id, "guardians.role": bson.M{"$ne": PrimaryGuardian}, "guardians.0": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{"guardians.0.role": PrimaryGuardian}})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// AddEmergencyContact adds an emergency contact to the client.
+func (c *MongoConnection) AddEmergencyContact(clientId string, contact *EmergencyContact) (err error) {
+	if contact.Name == "" || contact.Phone == "" {
+		return errors.New("An emergency contact requires a name and phone number")
+	}
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+
+	contact.Id = bson.NewObjectId()
+	return c.updateClient(bson.M{"_id": client.Id}, bson.M{"$push": bson.M{"emergencycontacts": contact}})
+}
+
+// UpdateEmergencyContact replaces the emergency contact of the client with the same id.
+func (c *MongoConnection) UpdateEmergencyContact(clientId string, contact *EmergencyContact) (err error) {
+	if contact.Name == "" || contact.Phone == "" {
+		return errors.New("An emergency contact requires a name and phone number")
+	}
+	if !bson.IsObjectIdHex(clientId) {
+		return fmt.Errorf("Emergency contact %s not found for client %s", contact.Id.Hex(), clientId)
+	}
+	err = c.updateClient(bson.M{"_id": bson.ObjectIdHex(clientId), "emergencycontacts._id": contact.Id},
+		bson.M{"$set": bson.M{"emergencycontacts.$": contact}})
+	if err == mgo.ErrNotFound {
+		err = fmt.Errorf("Emergency contact %s not found for client %s", contact.Id.Hex(), clientId)
+	}
+	return
+}
+
+// RemoveEmergencyContact removes an emergency contact from the client.
+func (c *MongoConnection) RemoveEmergencyContact(clientId, contactId string) (err error) {
+	if !bson.IsObjectIdHex(clientId) || !bson.IsObjectIdHex(contactId) {
+		return fmt.Errorf("Emergency contact %s not found for client %s", contactId, clientId)
+	}
+	id := bson.ObjectIdHex(contactId)
+	err = c.updateClient(bson.M{"_id": bson.ObjectIdHex(clientId), "emergencycontacts._id": id},
+		bson.M{"$pull": bson.M{"emergencycontacts": bson.M{"_id": id}}})
+	if err == mgo.ErrNotFound {
+		err = fmt.Errorf("Emergency contact %s not found for client %s", contactId, clientId)
+	}
+	return
+}
+
+// MigrateParents converts clients stored with a single parent into clients with a primary guardian.
+func (c *MongoConnection) MigrateParents() (migrated int, err error) {
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	type parentDoc struct {
+		Id        bson.ObjectId `bson:"_id"`
+		Parent    bson.M        `bson:"parent"`
+		Guardians []bson.M      `bson:"guardians"`
+	}
+	iter := clientCollection.Find(bson.M{"parent": bson.M{"$exists": true}}).Iter()
+	for {
+		doc := parentDoc{}
+		if !iter.Next(&doc) {
+			break
+		}
+		update := bson.M{"$unset": bson.M{"parent": ""}}
+		if first, _ := doc.Parent["firstname"].(string); first != "" && len(doc.Guardians) == 0 {
+			guardian := Guardian{Id: bson.NewObjectId(), Role: PrimaryGuardian, PickupAuthorized: true}
+			// Documents written before the email field was fixed stored it as emailladdress
+			if email, _ := doc.Parent["emailladdress"].(string); email != "" {
+				doc.Parent["emailaddress"] = email
+			}
+			raw, marshalErr := bson.Marshal(doc.Parent)
+			if marshalErr != nil {
+				iter.Close()
+				return migrated, marshalErr
+			}
+			if err = bson.Unmarshal(raw, &guardian.Parent); err != nil {
+				iter.Close()
+				return
+			}
+			update["$set"] = bson.M{"guardians": []*Guardian{&guardian}}
+		}
+		if err = clientCollection.UpdateId(doc.Id, update); err != nil {
+			iter.Close()
+			return
+		}
+		migrated++
+	}
+	err = iter.Close()
+	return
+}
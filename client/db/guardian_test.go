@@ -0,0 +1,89 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestPrimaryGuardian(t *testing.T) {
+	mom := &Guardian{Parent: Parent{FirstName: "Mary", LastName: "Keys"}, Role: PrimaryGuardian}
+	dad := &Guardian{Parent: Parent{FirstName: "Tom", LastName: "Keys"}, Role: SecondaryGuardian}
+	client := Client{Guardians: []*Guardian{dad, mom}}
+
+	if client.PrimaryGuardian() != mom {
+		t.Error("Expected Mary to be the primary guardian")
+	}
+
+	client.makePrimary(dad)
+	if client.PrimaryGuardian() != dad || mom.Role != SecondaryGuardian {
+		t.Error("Expected Tom to replace Mary as the primary guardian")
+	}
+
+	if (&Client{}).PrimaryGuardian() != nil {
+		t.Error("A client without guardians has no primary guardian")
+	}
+}
+
+func TestGuardianLookup(t *testing.T) {
+	isDrop = false
+	t.Log("Connecting to mongodb...")
+	c := NewConnection()
+
+	defer c.CloseConnection()
+
+	id, err := c.GetClientId("Mary", "Keys")
+	if err != nil {
+		t.Fatal("Failed to get id: ", err.Error())
+	}
+
+	err = c.AddGuardian(id, &Guardian{
+		Parent:           Parent{FirstName: "Tom", LastName: "Keys", MobilePhone: "856-212-9999", EmailAddress: "TKeys@someemail.com"},
+		Relationship:     "Father",
+		CustodyNotes:     "Weekends only",
+		PickupAuthorized: true,
+	})
+	if err != nil {
+		t.Fatal("Failed to add guardian: ", err.Error())
+	}
+	err = c.AddEmergencyContact(id, &EmergencyContact{Name: "Grandma Keys", Relationship: "Grandmother", Phone: "856-212-0000"})
+	if err != nil {
+		t.Fatal("Failed to add emergency contact: ", err.Error())
+	}
+
+	for _, lookup := range [][]string{
+		{"Tom Keys", "", ""},
+		{"tom", "", ""},
+		{"", "856-212-9999", ""},
+		{"", "", "tkeys@someemail.com"},
+		{"Mary", "856-212-3232", ""},
+	} {
+		clients, err := c.FindClientsByGuardian(lookup[0], lookup[1], lookup[2])
+		if err != nil {
+			t.Error(err.Error())
+		}
+		if len(clients) != 1 || clients[0].Id.Hex() != id {
+			t.Error("Lookup failed to find the Keys family: ", lookup)
+		}
+	}
+
+	client, err := c.GetClientById(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(client.Guardians) != 2 || client.PrimaryGuardian().FirstName != "Mary" {
+		t.Error("Mary should remain the primary guardian: ", client.Guardians)
+	}
+	if len(client.EmergencyContacts) != 1 {
+		t.Error("Expected one emergency contact: ", client.EmergencyContacts)
+	}
+
+	if err = c.RemoveGuardian(id, client.PrimaryGuardian().Id.Hex()); err != nil {
+		t.Fatal(err.Error())
+	}
+	client, err = c.GetClientById(id)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if client.PrimaryGuardian().FirstName != "Tom" || client.PrimaryGuardian().Role != PrimaryGuardian {
+		t.Error("Tom should become the primary guardian: ", client.Guardians)
+	}
+}
@@ -0,0 +1,291 @@
+package db
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"time"
+)
+
+// HealthRecord holds the medical, allergy and photo consent information of a child. It is kept in its own
+// collection, apart from the client, so it is only ever returned to callers allowed to see it.
+type HealthRecord struct {
+	ChildId           string    `bson:"_id" json:"childid"`
+	ClientId          string    `bson:"clientid" json:"clientid"`
+	Allergies         []string  `bson:"allergies" json:"allergies"`
+	MedicalConditions []string  `bson:"medicalconditions" json:"medicalconditions"`
+	Medications       []string  `bson:"medications" json:"medications"`
+	Notes             string    `bson:"notes" json:"notes"`
+	PhotoConsent      bool      `bson:"photoconsent" json:"photoconsent"`
+	ConsentSignedBy   string    `bson:"consentsignedby" json:"consentsignedby"`
+	ConsentSigned     time.Time `bson:"consentsigned" json:"consentsigned"`
+	ConsentExpires    time.Time `bson:"consentexpires" json:"consentexpires"`
+	Reminded          bool      `bson:"reminded" json:"reminded"`
+	Updated           time.Time `bson:"updated" json:"updated"`
+}
+
+// ConsentValid reports whether a signed consent form is on file and has not expired on the given day.
+func (h *HealthRecord) ConsentValid(day time.Time) bool {
+	return !h.ConsentSigned.IsZero() && (h.ConsentExpires.IsZero() || h.ConsentExpires.After(day))
+}
+
+// PhotosAllowed reports whether photos of the child may be taken on the given day.
+func (h *HealthRecord) PhotosAllowed(day time.Time) bool {
+	return h.PhotoConsent && h.ConsentValid(day)
+}
+
+// MergeHealthRecords combines the health records of two records of the same child, so nothing an instructor
+// needs to know is lost when duplicate clients are merged. The allergies, conditions and medications of both
+// are kept, and the consent is taken from the form signed last.
+func MergeHealthRecords(kept, merged *HealthRecord) (result HealthRecord) {
+	result = *kept
+	result.Allergies = unionFold(kept.Allergies, merged.Allergies)
+	result.MedicalConditions = unionFold(kept.MedicalConditions, merged.MedicalConditions)
+	result.Medications = unionFold(kept.Medications, merged.Medications)
+	if merged.Notes != "" && !strings.EqualFold(strings.TrimSpace(kept.Notes), strings.TrimSpace(merged.Notes)) {
+		if kept.Notes == "" {
+			result.Notes = merged.Notes
+		} else {
+			result.Notes = kept.Notes + "\n" + merged.Notes
+		}
+	}
+	if merged.ConsentSigned.After(kept.ConsentSigned) {
+		result.PhotoConsent = merged.PhotoConsent
+		result.ConsentSignedBy = merged.ConsentSignedBy
+		result.ConsentSigned = merged.ConsentSigned
+		result.ConsentExpires = merged.ConsentExpires
+		result.Reminded = merged.Reminded
+	}
+	if merged.Updated.After(kept.Updated) {
+		result.Updated = merged.Updated
+	}
+	return
+}
+
+// unionFold returns the values of a followed by those of b not already in a, ignoring case.
+func unionFold(a, b []string) (union []string) {
+	seen := make(map[string]bool)
+	for _, value := range append(append([]string{}, a...), b...) {
+		key := strings.ToLower(strings.TrimSpace(value))
+		if key != "" && !seen[key] {
+			seen[key] = true
+			union = append(union, value)
+		}
+	}
+	return
+}
+
+// RosterEntry is a child on the roster of a class along with what the instructor needs to know about them.
+type RosterEntry struct {
+	EnrollmentId      string              `json:"enrollmentid"`
+	ClientId          string              `json:"clientid"`
+	ChildId           string              `json:"childid"`
+	FirstName         string              `json:"firstname"`
+	LastName          string              `json:"lastname"`
+	DOB               time.Time           `json:"dob"`
+	Age               int                 `json:"age"`
+	AgeGroup          string              `json:"agegroup"`
+	Class             string              `json:"class"`
+	State             EnrollmentState     `json:"state"`
+	Allergies         []string            `json:"allergies"`
+	MedicalConditions []string            `json:"medicalconditions"`
+	Medications       []string            `json:"medications"`
+	PhotosAllowed     bool                `json:"photosallowed"`
+	ConsentExpired    bool                `json:"consentexpired"`
+	Guardians         []*Guardian         `json:"guardians"`
+	EmergencyContacts []*EmergencyContact `json:"emergencycontacts"`
+}
+
+// SetHealthRecord stores the health and consent record of a child of the client. Signing a new consent
+// form resets the renewal reminder.
+func (c *MongoConnection) SetHealthRecord(clientId, childId string, record *HealthRecord) (err error) {
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+	found := false
+	for _, child := range client.Children {
+		if child.Id.Hex() == childId {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Child %s not found for client %s", childId, clientId)
+	}
+	if !record.ConsentExpires.IsZero() && record.ConsentExpires.Before(record.ConsentSigned) {
+		return fmt.Errorf("Consent can't expire before it is signed")
+	}
+
+	session, healthCollection, err := c.getCollection(healthCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	record.ChildId = childId
+	record.ClientId = clientId
+	record.Updated = time.Now()
+
+	previous := HealthRecord{}
+	if findErr := healthCollection.FindId(childId).One(&previous); findErr == nil {
+		record.Reminded = previous.Reminded && previous.ConsentSigned.Equal(record.ConsentSigned)
+	} else {
+		record.Reminded = false
+	}
+
+	_, err = healthCollection.UpsertId(childId, record)
+	return
+}
+
+// GetHealthRecord returns the health and consent record of a child of the client.
+func (c *MongoConnection) GetHealthRecord(clientId, childId string) (record *HealthRecord, err error) {
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+	if client.findChild(childId) == nil {
+		return nil, fmt.Errorf("Child %s not found for client %s", childId, clientId)
+	}
+	session, healthCollection, err := c.getCollection(healthCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = healthCollection.FindId(childId).One(&record)
+	return
+}
+
+// ListRoster returns the children taking part in a class of a school during a season together with their
+// allergies, medical conditions, photo consent and contacts. An empty class lists every class of the season.
+// Waitlisted, withdrawn and graduated children are left off the roster. Ages are given as of the start of the
+// season.
+func (c *MongoConnection) ListRoster(schoolName, season, class string) (roster []RosterEntry, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	ageDay := AgeReference(school.FindSeason(season))
+
+	filter := EnrollmentFilter{School: schoolName, Season: season, Class: class}
+	enrollments, err := c.ListEnrollments(filter)
+	if err != nil {
+		return
+	}
+
+	session, healthCollection, err := c.getCollection(healthCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	now := time.Now()
+	clients := make(map[string]*Client)
+	for _, e := range enrollments {
+		if e.Waitlisted || !e.State.holdsSeat() {
+			continue
+		}
+		client, ok := clients[e.ClientId]
+		if !ok {
+			if client, err = c.GetClientById(e.ClientId); err != nil {
+				return nil, err
+			}
+			clients[e.ClientId] = client
+		}
+
+		entry := RosterEntry{
+			EnrollmentId:      e.Id.Hex(),
+			ClientId:          e.ClientId,
+			ChildId:           e.ChildId,
+			Class:             e.Class,
+			State:             e.State,
+			Guardians:         client.Guardians,
+			EmergencyContacts: client.EmergencyContacts,
+		}
+		for _, child := range client.Children {
+			if child.Id.Hex() == e.ChildId {
+				entry.FirstName = child.FirstName
+				entry.LastName = child.LastName
+				entry.DOB = child.DOB
+				entry.Age = child.AgeOn(ageDay)
+				entry.AgeGroup = child.AgeGroupOn(ageDay)
+			}
+		}
+
+		record := HealthRecord{}
+		err = healthCollection.FindId(e.ChildId).One(&record)
+		if err != nil && err != mgo.ErrNotFound {
+			return nil, err
+		}
+		entry.Allergies = record.Allergies
+		entry.MedicalConditions = record.MedicalConditions
+		entry.Medications = record.Medications
+		entry.PhotosAllowed = record.PhotosAllowed(now)
+		entry.ConsentExpired = !record.ConsentValid(now)
+		roster = append(roster, entry)
+	}
+	return roster, nil
+}
+
+// ListExpiringConsents returns the health records whose consent form expires within the given number of
+// days, including those that have already expired.
+func (c *MongoConnection) ListExpiringConsents(days int) (records []HealthRecord, err error) {
+	session, healthCollection, err := c.getCollection(healthCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = healthCollection.Find(bson.M{
+		"consentsigned":  bson.M{"$gt": time.Time{}},
+		"consentexpires": bson.M{"$gt": time.Time{}, "$lte": time.Now().AddDate(0, 0, days)},
+	}).Sort("consentexpires").All(&records)
+	return
+}
+
+// SendConsentReminders asks the families whose consent forms expire within the given number of days to
+// renew them. Each signed form is only reminded about once.
+func (c *MongoConnection) SendConsentReminders(days int) (reminded []HealthRecord, err error) {
+	records, err := c.ListExpiringConsents(days)
+	if err != nil {
+		return
+	}
+
+	session, healthCollection, err := c.getCollection(healthCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	for _, record := range records {
+		if record.Reminded {
+			continue
+		}
+		name := "your child"
+		if client, clientErr := c.GetClientById(record.ClientId); clientErr == nil {
+			for _, child := range client.Children {
+				if child.Id.Hex() == record.ChildId {
+					name = child.FirstName
+				}
+			}
+		}
+
+		verb := "expires"
+		if record.ConsentExpires.Before(time.Now()) {
+			verb = "expired"
+		}
+		err = c.notify(record.ClientId, "Please renew the consent form for "+name,
+			fmt.Sprintf("The medical and photo consent form for %s %s on %s. Please sign a new form so we "+
+				"can keep %s's information up to date.", name, verb, record.ConsentExpires.Format("January 2, 2006"), name))
+		if err != nil {
+			return
+		}
+		if err = healthCollection.UpdateId(record.ChildId, bson.M{"$set": bson.M{"reminded": true}}); err != nil {
+			return
+		}
+		record.Reminded = true
+		reminded = append(reminded, record)
+	}
+	return
+}
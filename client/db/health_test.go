@@ -0,0 +1,49 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConsent(t *testing.T) {
+	day := time.Date(2016, time.October, 1, 0, 0, 0, 0, time.Local)
+	record := HealthRecord{PhotoConsent: true}
+	if record.ConsentValid(day) || record.PhotosAllowed(day) {
+		t.Error("Consent without a signed form should not be valid")
+	}
+
+	record.ConsentSigned = day.AddDate(-1, 0, 0)
+	record.ConsentExpires = day.AddDate(0, 1, 0)
+	if !record.PhotosAllowed(day) {
+		t.Error("Photos should be allowed while the consent is valid")
+	}
+	if record.PhotosAllowed(day.AddDate(0, 2, 0)) {
+		t.Error("Photos should not be allowed once the consent expires")
+	}
+
+	record.PhotoConsent = false
+	if record.PhotosAllowed(day) || !record.ConsentValid(day) {
+		t.Error("A valid form can still refuse photos")
+	}
+}
+
+func TestMergeHealthRecords(t *testing.T) {
+	day := time.Date(2016, time.October, 1, 0, 0, 0, 0, time.Local)
+	kept := HealthRecord{ChildId: "a", Allergies: []string{"Peanuts"}, Notes: "Wears glasses", PhotoConsent: true, ConsentSigned: day}
+	merged := HealthRecord{ChildId: "b", Allergies: []string{"peanuts", "Bee stings"}, Medications: []string{"EpiPen"},
+		Notes: "Asthma inhaler in bag", ConsentSigned: day.AddDate(0, 1, 0), ConsentSignedBy: "Ann Smith"}
+
+	result := MergeHealthRecords(&kept, &merged)
+	if result.ChildId != "a" || len(result.Allergies) != 2 || result.Allergies[1] != "Bee stings" || len(result.Medications) != 1 {
+		t.Error("Expected the allergies and medications of both kept under the kept child, got ", result)
+	}
+	if result.Notes != "Wears glasses\nAsthma inhaler in bag" {
+		t.Error("Expected the notes of both, got ", result.Notes)
+	}
+	if result.PhotoConsent || result.ConsentSignedBy != "Ann Smith" || !result.ConsentSigned.Equal(merged.ConsentSigned) {
+		t.Error("Expected the consent of the form signed last, got ", result)
+	}
+	if result = MergeHealthRecords(&merged, &kept); result.ConsentSignedBy != "Ann Smith" {
+		t.Error("Expected an older consent not to replace a newer one, got ", result)
+	}
+}
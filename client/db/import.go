@@ -0,0 +1,463 @@
+package db
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importBatchSize is how many documents an import inserts at a time.
+const importBatchSize = 100
+
+// ImportStatus is what an import did, or would do, with a row.
+type ImportStatus string
+
+const (
+	ImportInserted    ImportStatus = "inserted"
+	ImportWouldInsert ImportStatus = "would insert"
+	ImportExisting    ImportStatus = "existing"
+	ImportInvalid     ImportStatus = "invalid"
+)
+
+// ImportRow reports what happened to one row of an imported file. Line is the line of the file, counting the
+// heading as line 1. Errors keep the row from being imported; Warnings name the values that couldn't be
+// normalized and are imported as entered.
+type ImportRow struct {
+	Line     int          `json:"line"`
+	Name     string       `json:"name"`
+	Status   ImportStatus `json:"status"`
+	Id       string       `json:"id,omitempty"`
+	Errors   []string     `json:"errors,omitempty"`
+	Warnings []string     `json:"warnings,omitempty"`
+}
+
+// ImportResult reports what an import did with every row of the file. A dry run validates the file and
+// reports what would be inserted without changing anything.
+type ImportResult struct {
+	Kind     string      `json:"kind"`
+	DryRun   bool        `json:"dryrun"`
+	Inserted int         `json:"inserted"`
+	Existing int         `json:"existing"`
+	Invalid  int         `json:"invalid"`
+	Rows     []ImportRow `json:"rows"`
+}
+
+// count tallies the statuses of the rows.
+func (r *ImportResult) count() {
+	r.Inserted, r.Existing, r.Invalid = 0, 0, 0
+	for _, row := range r.Rows {
+		switch row.Status {
+		case ImportInserted, ImportWouldInsert:
+			r.Inserted++
+		case ImportExisting:
+			r.Existing++
+		case ImportInvalid:
+			r.Invalid++
+		}
+	}
+}
+
+// schoolColumns maps the column headings of a school roster onto the fields of a school. Headings are
+// compared lower cased with everything but letters and digits removed.
+var schoolColumns = map[string]string{
+	"name": "name", "school": "name", "schoolname": "name",
+	"address": "address", "street": "address", "streetaddress": "address",
+	"city": "city", "state": "state",
+	"zip": "zipcode", "zipcode": "zipcode", "postalcode": "zipcode",
+	"phone": "mainphone", "mainphone": "mainphone", "phonenumber": "mainphone",
+	"contact": "contactname", "contactname": "contactname",
+	"url": "url", "website": "url",
+	"capacity": "capacity",
+}
+
+// familyColumns maps the column headings of a family roster onto the fields of a parent and child. Each row
+// is one child; rows with the same parent name and email are one family.
+var familyColumns = map[string]string{
+	"parentfirstname": "firstname", "guardianfirstname": "firstname", "firstname": "firstname",
+	"parentlastname": "lastname", "guardianlastname": "lastname", "lastname": "lastname",
+	"address": "address", "street": "address", "streetaddress": "address",
+	"city": "city", "state": "state",
+	"zip": "zipcode", "zipcode": "zipcode", "postalcode": "zipcode",
+	"phone": "homephone", "homephone": "homephone",
+	"mobile": "mobilephone", "mobilephone": "mobilephone", "cell": "mobilephone", "cellphone": "mobilephone",
+	"email": "emailaddress", "emailaddress": "emailaddress",
+	"school": "school", "schoolname": "school",
+	"childfirstname": "childfirstname", "studentfirstname": "childfirstname",
+	"childlastname": "childlastname", "studentlastname": "childlastname",
+	"childdob": "childdob", "dob": "childdob", "birthdate": "childdob", "dateofbirth": "childdob",
+}
+
+// importRecord is a row of an imported file with its cells keyed by field.
+type importRecord struct {
+	line   int
+	fields map[string]string
+}
+
+// columnKey reduces a column heading to lower case letters and digits.
+func columnKey(heading string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return -1
+	}, heading)
+}
+
+// readImportCSV reads a CSV file whose first row names the columns, keeping the columns it knows.
+func readImportCSV(in io.Reader, columns map[string]string, required ...string) (records []importRecord, err error) {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the heading: %s", err.Error())
+	}
+	index := make(map[string]int)
+	for i, heading := range header {
+		if field, ok := columns[columnKey(heading)]; ok {
+			if _, seen := index[field]; !seen {
+				index[field] = i
+			}
+		}
+	}
+	for _, field := range required {
+		if _, ok := index[field]; !ok {
+			return nil, fmt.Errorf("The file needs a %s column", field)
+		}
+	}
+
+	for {
+		record, readErr := r.Read()
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+		// Blank lines are skipped by the reader, so the line is asked for rather than counted
+		line, _ := r.FieldPos(0)
+		if strings.TrimSpace(strings.Join(record, "")) == "" {
+			continue
+		}
+		fields := make(map[string]string)
+		for field, i := range index {
+			if i < len(record) {
+				fields[field] = strings.TrimSpace(record[i])
+			}
+		}
+		records = append(records, importRecord{line: line, fields: fields})
+	}
+	return
+}
+
+// ParseSchoolImport validates the schools of a roster and normalizes their addresses and phones, warning of
+// values that can't be normalized. Schools named in existing, a map of lower cased names to ids, are
+// reported as existing. The schools returned line up with the rows, nil for rows that won't be inserted.
+func ParseSchoolImport(in io.Reader, existing map[string]string) (schools []*School, rows []ImportRow, err error) {
+	records, err := readImportCSV(in, schoolColumns, "name")
+	if err != nil {
+		return
+	}
+	seen := make(map[string]int)
+	for _, record := range records {
+		f := record.fields
+		row := ImportRow{Line: record.line, Name: f["name"]}
+		school := &School{
+			Name:        f["name"],
+			Address:     f["address"],
+			City:        f["city"],
+			State:       f["state"],
+			ZipCode:     f["zipcode"],
+			MainPhone:   f["mainphone"],
+			ContactName: f["contactname"],
+			Url:         f["url"],
+		}
+		row.Warnings = school.Normalize()
+		key := strings.ToLower(school.Name)
+		if school.Name == "" {
+			row.Errors = append(row.Errors, "School name is required")
+		} else if line, ok := seen[key]; ok {
+			row.Errors = append(row.Errors, fmt.Sprintf("School %s is already on line %d", school.Name, line))
+		}
+		seen[key] = record.line
+		if s := f["capacity"]; s != "" {
+			if school.Capacity, err = strconv.Atoi(s); err != nil || school.Capacity < 0 {
+				row.Errors = append(row.Errors, fmt.Sprintf("Capacity %q is not a number", s))
+			}
+			err = nil
+		}
+		switch id, ok := existing[key]; {
+		case len(row.Errors) > 0:
+			row.Status = ImportInvalid
+			school = nil
+		case ok:
+			row.Status = ImportExisting
+			row.Id = id
+			school = nil
+		}
+		schools = append(schools, school)
+		rows = append(rows, row)
+	}
+	return
+}
+
+// FamilyImport is a family read from a roster with the rows it came from.
+type FamilyImport struct {
+	Parent   Parent
+	School   string
+	Children []Child
+	Rows     []int
+}
+
+// ParseFamilyImport validates the families of a roster and normalizes the contact information of the
+// parents, warning of values that can't be normalized. Each row is a child, and rows naming the same parent
+// and email are gathered into one family, which is only imported if all its rows are valid. Schools maps
+// lower cased school names to their names as stored. The families returned are the valid ones; Rows holds
+// the indexes of their rows.
+func ParseFamilyImport(in io.Reader, schools map[string]string, now time.Time) (families []FamilyImport, rows []ImportRow, err error) {
+	records, err := readImportCSV(in, familyColumns, "firstname", "lastname", "school", "childfirstname")
+	if err != nil {
+		return
+	}
+	index := make(map[string]int)
+	var all []*FamilyImport
+	for _, record := range records {
+		f := record.fields
+		row := ImportRow{Line: record.line, Name: strings.TrimSpace(f["firstname"] + " " + f["lastname"])}
+		if f["firstname"] == "" || f["lastname"] == "" {
+			row.Errors = append(row.Errors, "Parent first and last name are required")
+		}
+		parent := Parent{
+			FirstName:    f["firstname"],
+			LastName:     f["lastname"],
+			Address:      f["address"],
+			City:         f["city"],
+			State:        f["state"],
+			ZipCode:      f["zipcode"],
+			HomePhone:    f["homephone"],
+			MobilePhone:  f["mobilephone"],
+			EmailAddress: f["emailaddress"],
+		}
+		row.Warnings = parent.Normalize()
+		school, ok := schools[strings.ToLower(f["school"])]
+		if f["school"] == "" {
+			row.Errors = append(row.Errors, "School is required")
+		} else if !ok {
+			row.Errors = append(row.Errors, fmt.Sprintf("School %s not found", f["school"]))
+		}
+		child := Child{FirstName: f["childfirstname"], LastName: f["childlastname"]}
+		if child.LastName == "" {
+			child.LastName = f["lastname"]
+		}
+		if child.FirstName == "" {
+			row.Errors = append(row.Errors, "Child first name is required")
+		}
+		if dob := f["childdob"]; dob != "" {
+			if child.DOB, err = parseDate(dob); err != nil {
+				row.Errors = append(row.Errors, err.Error())
+			} else if child.DOB.After(now) {
+				row.Errors = append(row.Errors, fmt.Sprintf("Date of birth %s is in the future", dob))
+			}
+			err = nil
+		}
+
+		key := strings.ToLower(f["firstname"] + "|" + f["lastname"] + "|" + f["emailaddress"])
+		i, ok := index[key]
+		if !ok {
+			i = len(all)
+			index[key] = i
+			all = append(all, &FamilyImport{Parent: parent, School: school})
+		}
+		family := all[i]
+		if school != "" && family.School != school {
+			row.Errors = append(row.Errors, fmt.Sprintf("A family can only be imported into one school, not %s and %s", family.School, school))
+		}
+		family.Children = append(family.Children, child)
+		family.Rows = append(family.Rows, len(rows))
+		if len(row.Errors) > 0 {
+			row.Status = ImportInvalid
+		}
+		rows = append(rows, row)
+	}
+
+	for _, family := range all {
+		valid := true
+		for _, i := range family.Rows {
+			valid = valid && rows[i].Status != ImportInvalid
+		}
+		if valid {
+			families = append(families, *family)
+			continue
+		}
+		for _, i := range family.Rows {
+			if rows[i].Status != ImportInvalid {
+				rows[i].Status = ImportInvalid
+				rows[i].Errors = append(rows[i].Errors, "Another row of this family has errors")
+			}
+		}
+	}
+	return
+}
+
+// ImportSchools adds the schools of a CSV roster, skipping schools that already exist. Nothing is inserted
+// on a dry run.
+func (c *MongoConnection) ImportSchools(in io.Reader, dryRun bool) (result *ImportResult, err error) {
+	stored, err := c.ListSchools()
+	if err != nil {
+		return
+	}
+	existing := make(map[string]string)
+	for _, school := range stored {
+		existing[strings.ToLower(school.Name)] = school.Id.Hex()
+	}
+	schools, rows, err := ParseSchoolImport(in, existing)
+	if err != nil {
+		return
+	}
+	result = &ImportResult{Kind: "schools", DryRun: dryRun, Rows: rows}
+	defer result.count()
+
+	session, _, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var batch []interface{}
+	var batchRows []int
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := schoolCollection.Insert(batch...); err != nil {
+				return err
+			}
+			for j, i := range batchRows {
+				rows[i].Status = ImportInserted
+				rows[i].Id = batch[j].(bson.M)["_id"].(bson.ObjectId).Hex()
+			}
+		}
+		batch, batchRows = nil, nil
+		return nil
+	}
+	for i, school := range schools {
+		if school == nil {
+			continue
+		}
+		if dryRun {
+			rows[i].Status = ImportWouldInsert
+			continue
+		}
+		c.locateSchool(school)
+		doc := schoolDocument(school)
+		doc["_id"] = bson.NewObjectId()
+		batch = append(batch, doc)
+		batchRows = append(batchRows, i)
+		if len(batch) == importBatchSize {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+	err = flush()
+	return
+}
+
+// ImportFamilies adds the families of a CSV roster and enrolls their children with their school. Families
+// already stored, found by parent name with ClientExist, are skipped. Nothing is inserted on a dry run.
+func (c *MongoConnection) ImportFamilies(in io.Reader, dryRun bool) (result *ImportResult, err error) {
+	stored, err := c.ListSchools()
+	if err != nil {
+		return
+	}
+	schools := make(map[string]string)
+	ids := make(map[string]string)
+	for _, school := range stored {
+		schools[strings.ToLower(school.Name)] = school.Name
+		ids[school.Name] = school.Id.Hex()
+	}
+	families, rows, err := ParseFamilyImport(in, schools, time.Now())
+	if err != nil {
+		return
+	}
+	result = &ImportResult{Kind: "families", DryRun: dryRun, Rows: rows}
+	defer result.count()
+
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	type pending struct {
+		family   *FamilyImport
+		clientId bson.ObjectId
+		childIds []bson.ObjectId
+	}
+	var batch []interface{}
+	var inserted []pending
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := clientCollection.Insert(batch...); err != nil {
+				return err
+			}
+		}
+		// Children beyond the capacity of the school are waitlisted, as when clients are added one at a time
+		for _, p := range inserted {
+			for j, childId := range p.childIds {
+				row := &rows[p.family.Rows[j]]
+				row.Status = ImportInserted
+				row.Id = p.clientId.Hex()
+				if _, err := c.Enroll(p.clientId.Hex(), childId.Hex(), p.family.School, "", ""); err != nil {
+					row.Errors = append(row.Errors, "Added but not enrolled: "+err.Error())
+				}
+			}
+		}
+		batch, inserted = nil, nil
+		return nil
+	}
+	for i := range families {
+		family := &families[i]
+		if exists, id := c.ClientExist(family.Parent.FirstName, family.Parent.LastName); exists {
+			for _, r := range family.Rows {
+				rows[r].Status = ImportExisting
+				rows[r].Id = id
+			}
+			continue
+		}
+		if dryRun {
+			for _, r := range family.Rows {
+				rows[r].Status = ImportWouldInsert
+			}
+			continue
+		}
+		c.locateParent(&family.Parent)
+		doc, childIds := clientDocument(ids[family.School], &family.Parent, family.Children, &PaymentMethod{})
+		batch = append(batch, doc)
+		inserted = append(inserted, pending{family: family, clientId: doc["_id"].(bson.ObjectId), childIds: childIds})
+		if len(batch) == importBatchSize {
+			if err = flush(); err != nil {
+				return
+			}
+		}
+	}
+	err = flush()
+	return
+}
+
+// Import adds the schools or families of a CSV roster, depending on kind.
+func (c *MongoConnection) Import(kind string, in io.Reader, dryRun bool) (result *ImportResult, err error) {
+	switch strings.ToLower(kind) {
+	case "schools", "school":
+		return c.ImportSchools(in, dryRun)
+	case "families", "family", "clients", "client":
+		return c.ImportFamilies(in, dryRun)
+	}
+	return nil, errors.New("Only schools and families can be imported")
+}
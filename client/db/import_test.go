@@ -0,0 +1,100 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportSchoolRows(t *testing.T) {
+	roster := "School Name,Street,City,State,Zip Code,Capacity\n" +
+		"Maple Elementary,1 Maple St,Springfield,MO,65801,40\n" +
+		"Oak Primary,2 Oak Ave,Springfield,MO,65802,lots\n" +
+		"maple elementary,1 Maple St,Springfield,MO,65801,40\n" +
+		",3 Elm St,Springfield,MO,65803,\n" +
+		"\n" +
+		"Pine Academy,4 Pine Rd,Springfield,MO,65804,\n"
+
+	schools, rows, err := ParseSchoolImport(strings.NewReader(roster), map[string]string{"pine academy": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 || len(schools) != 5 {
+		t.Fatal("Expected five rows, the blank line skipped, got ", rows)
+	}
+	if schools[0] == nil || schools[0].Capacity != 40 || schools[0].ZipCode != "65801" || rows[0].Status != "" {
+		t.Error("Expected Maple Elementary to be imported, got ", rows[0])
+	}
+	if rows[1].Status != ImportInvalid || schools[1] != nil {
+		t.Error("Expected a capacity that isn't a number to be rejected, got ", rows[1])
+	}
+	if rows[2].Status != ImportInvalid || rows[2].Line != 4 {
+		t.Error("Expected a school named twice in the file to be rejected on line 4, got ", rows[2])
+	}
+	if rows[3].Status != ImportInvalid || rows[3].Errors[0] != "School name is required" {
+		t.Error("Expected a row without a name to be rejected, got ", rows[3])
+	}
+	if rows[4].Status != ImportExisting || rows[4].Id != "abc" || rows[4].Line != 7 || schools[4] != nil {
+		t.Error("Expected an existing school to be skipped, got ", rows[4])
+	}
+
+	if _, _, err = ParseSchoolImport(strings.NewReader("City,State\nSpringfield,MO\n"), nil); err == nil {
+		t.Error("Expected a roster without a name column to be refused")
+	}
+}
+
+func TestImportFamilyRows(t *testing.T) {
+	now := time.Date(2017, time.August, 1, 0, 0, 0, 0, time.Local)
+	schools := map[string]string{"maple elementary": "Maple Elementary", "oak primary": "Oak Primary"}
+	roster := "Parent First Name,Parent Last Name,Email,School,Child First Name,Child Last Name,DOB\n" +
+		"Ann,Smith,ann@example.com,maple elementary,Tom,,2011-04-02\n" +
+		"Ann,Smith,ann@example.com,Maple Elementary,Tia,Jones,3/9/2013\n" +
+		"Bob,Brown,bob-example.com,Oak Primary,Ben,,2012-01-01\n" +
+		"Bob,Brown,bob-example.com,Oak Primary,Bea,,2014-01-01\n" +
+		"Cal,Green,cal@example.com,Birch School,Cat,,2012-01-01\n" +
+		"Dee,White,dee@example.com,Oak Primary,Dan,,2019-01-01\n" +
+		"Eve,Black,eve@example.com,Oak Primary,Eli,,\n" +
+		"Eve,Black,eve@example.com,Maple Elementary,Emma,,\n"
+
+	families, rows, err := ParseFamilyImport(strings.NewReader(roster), schools, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 8 {
+		t.Fatal("Expected eight rows, got ", rows)
+	}
+	if len(families) != 2 {
+		t.Fatal("Expected the Smith and Brown families to be valid, got ", families)
+	}
+	smith := families[0]
+	if smith.School != "Maple Elementary" || len(smith.Children) != 2 || len(smith.Rows) != 2 {
+		t.Fatal("Expected the Smiths to have two children at Maple Elementary, got ", smith)
+	}
+	if smith.Children[0].LastName != "Smith" || smith.Children[1].LastName != "Jones" {
+		t.Error("Expected a child's last name to default to the parent's, got ", smith.Children)
+	}
+	if smith.Children[1].DOB != time.Date(2013, time.March, 9, 0, 0, 0, 0, time.Local) {
+		t.Error("Expected US dates of birth to be read, got ", smith.Children[1].DOB)
+	}
+	brown := families[1]
+	if brown.Parent.EmailAddress != "bob-example.com" || len(brown.Parent.Problems) != 1 {
+		t.Error("Expected an email that can't be normalized kept as entered, got ", brown.Parent)
+	}
+	for _, row := range rows[2:4] {
+		if row.Status == ImportInvalid || len(row.Errors) != 0 || len(row.Warnings) != 1 ||
+			row.Warnings[0] != "Email \"bob-example.com\" is not an email address" {
+			t.Errorf("Expected line %d to be imported with a warning, got %v", row.Line, row)
+		}
+	}
+	for i, expected := range []string{
+		"School Birch School not found",
+		"Date of birth 2019-01-01 is in the future",
+		"Another row of this family has errors",
+		"A family can only be imported into one school, not Oak Primary and Maple Elementary",
+	} {
+		row := rows[i+4]
+		if row.Status != ImportInvalid || len(row.Errors) != 1 || row.Errors[0] != expected {
+			t.Errorf("Expected line %d to be rejected with %q, got %v", row.Line, expected, row)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"time"
+)
+
+// Instructor is a member of staff who teaches classes at the schools.
+type Instructor struct {
+	Id             bson.ObjectId    `bson:"_id,omitempty" json:"id"`
+	FirstName      string           `bson:"firstname" json:"firstname"`
+	LastName       string           `bson:"lastname" json:"lastname"`
+	Address        string           `bson:"address" json:"address"`
+	City           string           `bson:"city" json:"city"`
+	State          string           `bson:"state" json:"state"`
+	ZipCode        string           `bson:"zipcode" json:"zipcode"`
+	MobilePhone    string           `bson:"mobilephone" json:"mobilephone"`
+	EmailAddress   string           `bson:"emailaddress" json:"emailaddress"`
+	Certifications []*Certification `bson:"certifications" json:"certifications"`
+	Availability   []*Availability  `bson:"availability" json:"availability"`
+	Active         bool             `bson:"active" json:"active"`
+	PayRate        PayRate          `bson:"payrate" json:"payrate"`
+	// Bookings counts the assignments made, so an assignment can tell another was made while it was checked
+	Bookings int `bson:"bookings" json:"-"`
+}
+
+// Certification is a qualification an instructor holds, for example first aid or a coaching license.
+// A zero Expires never expires.
+type Certification struct {
+	Name    string    `bson:"name" json:"name"`
+	Issuer  string    `bson:"issuer" json:"issuer"`
+	Number  string    `bson:"number" json:"number"`
+	Issued  time.Time `bson:"issued" json:"issued"`
+	Expires time.Time `bson:"expires" json:"expires"`
+}
+
+// Availability is a weekly window, in 24 hour "15:04" times, during which an instructor can teach.
+type Availability struct {
+	Weekday time.Weekday `bson:"weekday" json:"weekday"`
+	From    string       `bson:"from" json:"from"`
+	To      string       `bson:"to" json:"to"`
+}
+
+// Assignment puts an instructor in charge of the sessions of a class starting from From until Until. A zero
+// From or Until leaves that end open. Assignments are ended rather than removed, so the sessions taught before
+// stay with the instructor who taught them.
+type Assignment struct {
+	Id           bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	InstructorId string        `bson:"instructorid" json:"instructorid"`
+	SchoolId     string        `bson:"schoolid" json:"schoolid"`
+	School       string        `bson:"school" json:"school"`
+	Season       string        `bson:"season" json:"season"`
+	Class        string        `bson:"class" json:"class"`
+	Assigned     time.Time     `bson:"assigned" json:"assigned"`
+	From         time.Time     `bson:"from,omitempty" json:"from,omitempty"`
+	Until        time.Time     `bson:"until,omitempty" json:"until,omitempty"`
+}
+
+// covers reports whether the session starts while the assignment runs.
+func (a *Assignment) covers(session Session) bool {
+	return (a.From.IsZero() || !session.Start.Before(a.From)) && (a.Until.IsZero() || session.Start.Before(a.Until))
+}
+
+// Conflict is a pair of overlapping sessions the same instructor is assigned to.
+type Conflict struct {
+	InstructorId string  `json:"instructorid"`
+	First        Session `json:"first"`
+	Second       Session `json:"second"`
+}
+
+// ExpiringCertification is a certification of an instructor that expires soon or has expired.
+type ExpiringCertification struct {
+	InstructorId   string        `json:"instructorid"`
+	InstructorName string        `json:"instructorname"`
+	Certification  Certification `json:"certification"`
+	Expired        bool          `json:"expired"`
+}
+
+// minutes parses a "15:04" time of day into minutes after midnight.
+func minutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %q, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate checks that the instructor has a name and well formed availability.
+func (i *Instructor) Validate() (err error) {
+	if i.FirstName == "" || i.LastName == "" {
+		return errors.New("An instructor requires a first and last name")
+	}
+	for _, a := range i.Availability {
+		from, fromErr := minutes(a.From)
+		if fromErr != nil {
+			return fromErr
+		}
+		to, toErr := minutes(a.To)
+		if toErr != nil {
+			return toErr
+		}
+		if to <= from {
+			return fmt.Errorf("Availability on %s must end after it starts", a.Weekday)
+		}
+	}
+	return
+}
+
+// Available reports whether the session falls within the availability of the instructor. Instructors without
+// any availability recorded are taken to be available at all times.
+func (i *Instructor) Available(session Session) bool {
+	if len(i.Availability) == 0 {
+		return true
+	}
+	start := session.Start.Hour()*60 + session.Start.Minute()
+	end := start + int(session.End.Sub(session.Start)/time.Minute)
+	for _, a := range i.Availability {
+		from, _ := minutes(a.From)
+		to, _ := minutes(a.To)
+		if a.Weekday == session.Start.Weekday() && from <= start && end <= to {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether two sessions take place at the same time.
+func overlaps(a, b Session) bool {
+	return a.Start.Before(b.End) && b.Start.Before(a.End)
+}
+
+// findConflicts returns every pair of overlapping sessions. Cancelled sessions never conflict.
+func findConflicts(sessions []Session) (conflicts [][2]Session) {
+	sortSessions(sessions)
+	for i := range sessions {
+		if sessions[i].Cancelled {
+			continue
+		}
+		for j := i + 1; j < len(sessions) && sessions[j].Start.Before(sessions[i].End); j++ {
+			if !sessions[j].Cancelled && overlaps(sessions[i], sessions[j]) {
+				conflicts = append(conflicts, [2]Session{sessions[i], sessions[j]})
+			}
+		}
+	}
+	return
+}
+
+// AddInstructor adds an instructor to the staff.
+func (c *MongoConnection) AddInstructor(instructor *Instructor) (err error) {
+	if err = instructor.Validate(); err != nil {
+		return
+	}
+	session, instructorCollection, err := c.getCollection(instructorCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	instructor.Id = bson.NewObjectId()
+	err = instructorCollection.Insert(instructor)
+	return
+}
+
+// UpdateInstructor replaces the contact details, certifications and availability of an instructor. The pay
+// rate is only changed by SetPayRate.
+func (c *MongoConnection) UpdateInstructor(instructor *Instructor) (err error) {
+	if err = instructor.Validate(); err != nil {
+		return
+	}
+	session, instructorCollection, err := c.getCollection(instructorCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = instructorCollection.UpdateId(instructor.Id, bson.M{"$set": bson.M{
+		"firstname":      instructor.FirstName,
+		"lastname":       instructor.LastName,
+		"address":        instructor.Address,
+		"city":           instructor.City,
+		"state":          instructor.State,
+		"zipcode":        instructor.ZipCode,
+		"mobilephone":    instructor.MobilePhone,
+		"emailaddress":   instructor.EmailAddress,
+		"certifications": instructor.Certifications,
+		"availability":   instructor.Availability,
+		"active":         instructor.Active,
+	}})
+	return
+}
+
+// GetInstructor returns the instructor with the given id.
+func (c *MongoConnection) GetInstructor(id string) (instructor *Instructor, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, fmt.Errorf("Invalid instructor id %q", id)
+	}
+	session, instructorCollection, err := c.getCollection(instructorCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = instructorCollection.FindId(bson.ObjectIdHex(id)).One(&instructor)
+	return
+}
+
+// ListInstructors returns the staff ordered by name.
+func (c *MongoConnection) ListInstructors() (instructors []Instructor, err error) {
+	session, instructorCollection, err := c.getCollection(instructorCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = instructorCollection.Find(nil).Sort("lastname", "firstname").All(&instructors)
+	return
+}
+
+// ListAssignments returns the classes an instructor is or was assigned to. Ended assignments have an Until.
+func (c *MongoConnection) ListAssignments(instructorId string) (assignments []Assignment, err error) {
+	session, assignmentCollection, err := c.getCollection(assignmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = assignmentCollection.Find(bson.M{"instructorid": instructorId}).Sort("assigned").All(&assignments)
+	return
+}
+
+// InstructorSessions returns the sessions an instructor teaches between from and to, those of each class
+// while the instructor was assigned to it.
+func (c *MongoConnection) InstructorSessions(instructorId string, from, to time.Time) (sessions []Session, err error) {
+	assignments, err := c.ListAssignments(instructorId)
+	if err != nil {
+		return
+	}
+	schools := make(map[string]*School)
+	for _, a := range assignments {
+		school, ok := schools[a.SchoolId]
+		if !ok {
+			if school, err = c.GetSchoolById(bson.ObjectIdHex(a.SchoolId)); err != nil {
+				return nil, err
+			}
+			schools[a.SchoolId] = school
+		}
+		classSessions, sessionErr := school.classSessions(a.Season, a.Class, from, to)
+		if sessionErr != nil {
+			return nil, sessionErr
+		}
+		for _, session := range classSessions {
+			if a.covers(session) {
+				sessions = append(sessions, session)
+			}
+		}
+	}
+	sortSessions(sessions)
+	return
+}
+
+// classSessions returns the sessions of a class of the school between from and to.
+func (s *School) classSessions(seasonName, class string, from, to time.Time) (sessions []Session, err error) {
+	season := s.FindSeason(seasonName)
+	if season == nil {
+		return nil, fmt.Errorf("Season %s not found for %s", seasonName, s.Name)
+	}
+	seasonSessions, err := season.Sessions(from, to)
+	if err != nil {
+		return
+	}
+	for _, session := range seasonSessions {
+		if session.Class == class {
+			session.SchoolId = s.Id.Hex()
+			session.School = s.Name
+			sessions = append(sessions, session)
+		}
+	}
+	return
+}
+
+// AssignInstructor puts an instructor in charge of a class for the rest of a season. The assignment is
+// refused when a session of the class still to come falls outside the availability of the instructor or
+// overlaps a session the instructor already teaches. Two classes assigned to the same instructor at the same time can't both pass the check:
+// the assignment is only kept if no other was booked for the instructor since the check began.
+func (c *MongoConnection) AssignInstructor(instructorId, schoolName, seasonName, class string) (assignment *Assignment, err error) {
+	instructor, err := c.GetInstructor(instructorId)
+	if err != nil {
+		return
+	}
+	if !instructor.Active {
+		return nil, fmt.Errorf("%s %s is not an active instructor", instructor.FirstName, instructor.LastName)
+	}
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	season := school.FindSeason(seasonName)
+	if season == nil {
+		return nil, fmt.Errorf("Season %s not found for %s", seasonName, schoolName)
+	}
+	if season.FindSchedule(class) == nil {
+		return nil, fmt.Errorf("Class %s is not scheduled at %s in %s", class, schoolName, seasonName)
+	}
+
+	now := time.Now()
+	classSessions, err := school.classSessions(seasonName, class, time.Time{}, time.Time{})
+	if err != nil {
+		return
+	}
+	var sessions []Session
+	for _, session := range classSessions {
+		if !session.Start.Before(now) {
+			sessions = append(sessions, session)
+		}
+	}
+	for _, session := range sessions {
+		if !session.Cancelled && !instructor.Available(session) {
+			return nil, fmt.Errorf("%s %s is not available for %s on %s", instructor.FirstName, instructor.LastName,
+				class, session.Start.Format("Monday January 2 at 15:04"))
+		}
+	}
+	taught, err := c.InstructorSessions(instructorId, season.Start, season.End.AddDate(0, 0, 1))
+	if err != nil {
+		return
+	}
+	for _, session := range sessions {
+		for _, other := range taught {
+			if !session.Cancelled && !other.Cancelled && overlaps(session, other) {
+				return nil, fmt.Errorf("%s %s is already teaching %s at %s on %s", instructor.FirstName, instructor.LastName,
+					other.Class, other.School, other.Start.Format("Monday January 2 at 15:04"))
+			}
+		}
+	}
+
+	dbSession, assignmentCollection, err := c.getCollection(assignmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer dbSession.Close()
+
+	assignment = &Assignment{
+		Id:           bson.NewObjectId(),
+		InstructorId: instructorId,
+		SchoolId:     school.Id.Hex(),
+		School:       school.Name,
+		Season:       seasonName,
+		Class:        class,
+		Assigned:     now,
+		From:         now,
+	}
+	if err = assignmentCollection.Insert(assignment); err != nil {
+		if mgo.IsDup(err) {
+			err = fmt.Errorf("%s %s is already assigned to %s", instructor.FirstName, instructor.LastName, class)
+		}
+		return nil, err
+	}
+	booked := bson.M{"_id": instructor.Id, "bookings": instructor.Bookings}
+	if instructor.Bookings == 0 {
+		// Instructors stored before bookings were counted have none
+		booked["bookings"] = bson.M{"$in": []interface{}{0, nil}}
+	}
+	err = assignmentCollection.Database.C(instructorCollectionName).Update(booked, bson.M{"$inc": bson.M{"bookings": 1}})
+	if err != nil {
+		assignmentCollection.RemoveId(assignment.Id)
+		if err == mgo.ErrNotFound {
+			err = fmt.Errorf("%s %s was assigned another class at the same time, please try again", instructor.FirstName, instructor.LastName)
+		}
+		return nil, err
+	}
+	return
+}
+
+// UnassignInstructor ends an assignment. The sessions of the class that have started stay with the
+// instructor, so they are still paid for.
+func (c *MongoConnection) UnassignInstructor(assignmentId string) (err error) {
+	if !bson.IsObjectIdHex(assignmentId) {
+		return fmt.Errorf("Invalid assignment id %q", assignmentId)
+	}
+	session, assignmentCollection, err := c.getCollection(assignmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	running := bson.M{"_id": bson.ObjectIdHex(assignmentId), "until": bson.M{"$exists": false}}
+	if err = assignmentCollection.Update(running, bson.M{"$set": bson.M{"until": time.Now()}}); err == mgo.ErrNotFound {
+		err = fmt.Errorf("Assignment %s not found or already ended", assignmentId)
+	}
+	return
+}
+
+// ListConflicts returns the sessions between from and to where an instructor is double booked. Assignments
+// are checked when they are made, so conflicts only appear when a session is rescheduled afterwards.
+func (c *MongoConnection) ListConflicts(from, to time.Time) (conflicts []Conflict, err error) {
+	instructors, err := c.ListInstructors()
+	if err != nil {
+		return
+	}
+	for _, instructor := range instructors {
+		sessions, sessionErr := c.InstructorSessions(instructor.Id.Hex(), from, to)
+		if sessionErr != nil {
+			return nil, sessionErr
+		}
+		for _, pair := range findConflicts(sessions) {
+			conflicts = append(conflicts, Conflict{InstructorId: instructor.Id.Hex(), First: pair[0], Second: pair[1]})
+		}
+	}
+	return
+}
+
+// WeeklySchedule returns the sessions an instructor teaches during the week starting on the Monday on or
+// before the given day.
+func (c *MongoConnection) WeeklySchedule(instructorId string, day time.Time) (sessions []Session, err error) {
+	if _, err = c.GetInstructor(instructorId); err != nil {
+		return
+	}
+	monday := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	monday = monday.AddDate(0, 0, -(int(monday.Weekday())+6)%7)
+	return c.InstructorSessions(instructorId, monday, monday.AddDate(0, 0, 7).Add(-time.Second))
+}
+
+// ListExpiringCertifications returns the certifications of active instructors that expire within the given
+// number of days, including those that have already expired, soonest first.
+func (c *MongoConnection) ListExpiringCertifications(days int) (expiring []ExpiringCertification, err error) {
+	instructors, err := c.ListInstructors()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	limit := now.AddDate(0, 0, days)
+	for _, instructor := range instructors {
+		if !instructor.Active {
+			continue
+		}
+		for _, certification := range instructor.Certifications {
+			if certification.Expires.IsZero() || certification.Expires.After(limit) {
+				continue
+			}
+			expiring = append(expiring, ExpiringCertification{
+				InstructorId:   instructor.Id.Hex(),
+				InstructorName: instructor.FirstName + " " + instructor.LastName,
+				Certification:  *certification,
+				Expired:        certification.Expires.Before(now),
+			})
+		}
+	}
+	sort.SliceStable(expiring, func(i, j int) bool {
+		return expiring[i].Certification.Expires.Before(expiring[j].Certification.Expires)
+	})
+	return
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInstructorAvailability(t *testing.T) {
+	instructor := Instructor{
+		FirstName: "Ivy",
+		LastName:  "Coach",
+		Availability: []*Availability{
+			&Availability{Weekday: time.Tuesday, From: "14:00", To: "18:00"},
+		},
+	}
+	if err := instructor.Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tuesday := time.Date(2017, time.March, 7, 15, 30, 0, 0, time.Local)
+	if !instructor.Available(Session{Start: tuesday, End: tuesday.Add(45 * time.Minute)}) {
+		t.Error("Expected the instructor to be available on Tuesday afternoon")
+	}
+	late := tuesday.Add(2 * time.Hour)
+	if instructor.Available(Session{Start: late, End: late.Add(45 * time.Minute)}) {
+		t.Error("A session running past the end of the availability should not fit")
+	}
+	wednesday := tuesday.AddDate(0, 0, 1)
+	if instructor.Available(Session{Start: wednesday, End: wednesday.Add(45 * time.Minute)}) {
+		t.Error("The instructor is not available on Wednesdays")
+	}
+
+	backwards := Instructor{FirstName: "Back", LastName: "Wards", Availability: []*Availability{
+		&Availability{Weekday: time.Monday, From: "18:00", To: "09:00"},
+	}}
+	if err := backwards.Validate(); err == nil {
+		t.Error("Availability ending before it starts should be rejected")
+	}
+}
+
+func TestInstructorConflicts(t *testing.T) {
+	school := School{
+		Name: "Booked Elementary",
+		Seasons: []*Season{&Season{
+			Name:  "Spring",
+			Start: time.Date(2017, time.March, 6, 0, 0, 0, 0, time.Local),
+			End:   time.Date(2017, time.March, 20, 0, 0, 0, 0, time.Local),
+			Schedules: []*Schedule{
+				&Schedule{Class: "Tumble", Weekday: time.Tuesday, StartTime: "15:30", Duration: 45},
+				&Schedule{Class: "Ninja", Weekday: time.Tuesday, StartTime: "16:00", Duration: 45,
+					Exceptions: []*ScheduleException{&ScheduleException{
+						Date: time.Date(2017, time.March, 7, 0, 0, 0, 0, time.Local), Cancelled: true,
+					}}},
+				&Schedule{Class: "Flip", Weekday: time.Tuesday, StartTime: "16:15", Duration: 30},
+			},
+		}},
+	}
+
+	tumble, err := school.classSessions("Spring", "Tumble", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(tumble) != 2 || tumble[0].School != "Booked Elementary" {
+		t.Fatal("Expected two Tumble sessions at the school: ", tumble)
+	}
+	ninja, _ := school.classSessions("Spring", "Ninja", time.Time{}, time.Time{})
+	flip, _ := school.classSessions("Spring", "Flip", time.Time{}, time.Time{})
+
+	// Ninja overlaps Tumble and Flip but its first session is cancelled, and Flip starts as Tumble ends
+	conflicts := findConflicts(append(append(append([]Session{}, tumble...), ninja...), flip...))
+	if len(conflicts) != 2 {
+		t.Fatal("Expected two conflicts in the second week, got ", conflicts)
+	}
+	for _, pair := range conflicts {
+		if pair[0].Class == "Tumble" && pair[1].Class == "Flip" {
+			t.Error("Back to back sessions should not conflict")
+		}
+	}
+}
+
+func TestAssignmentCovers(t *testing.T) {
+	start := time.Date(2017, time.March, 7, 15, 30, 0, 0, time.Local)
+	session := func(days int) Session {
+		return Session{Start: start.AddDate(0, 0, days), End: start.AddDate(0, 0, days).Add(45 * time.Minute)}
+	}
+	substitute := Assignment{From: start.AddDate(0, 0, 7), Until: start.AddDate(0, 0, 14)}
+	for days, expected := range map[int]bool{0: false, 7: true, 13: true, 14: false} {
+		if substitute.covers(session(days)) != expected {
+			t.Errorf("Expected the session %d days in to be covered %v", days, expected)
+		}
+	}
+	if open := (Assignment{}); !open.covers(session(-100)) || !open.covers(session(100)) {
+		t.Error("Expected an assignment without a period to cover every session")
+	}
+}
@@ -0,0 +1,411 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Accounts of the general ledger. Revenue is kept per school under revenueAccountPrefix.
+const (
+	CashAccount               = "Cash"
+	CardClearingAccount       = "Card Clearing"
+	AccountsReceivableAccount = "Accounts Receivable"
+	RefundsAccount            = "Refunds"
+	RevenueShareAccount       = "Revenue Share Expense"
+	revenueAccountPrefix      = "Revenue:"
+)
+
+// Sources of journal entries.
+const (
+	FamilyPaymentSource = "family-payment"
+	FamilyBillingSource = "family-billing"
+	SchoolInvoiceSource = "school-invoice"
+	SchoolPaymentSource = "school-payment"
+	VoidInvoiceSource   = "void-invoice"
+	PayoutSource        = "payout"
+	CardSettlement      = "card-settlement"
+)
+
+// Posting is one side of a journal entry. Only one of Debit and Credit is set.
+type Posting struct {
+	Account string  `bson:"account" json:"account"`
+	Debit   float64 `bson:"debit" json:"debit"`
+	Credit  float64 `bson:"credit" json:"credit"`
+}
+
+// JournalEntry is a balanced set of postings to the general ledger. Its id is derived from the event that
+// caused it so that posting the same event twice leaves the ledger unchanged.
+type JournalEntry struct {
+	Id        string    `bson:"_id" json:"id"`
+	Date      time.Time `bson:"date" json:"date"`
+	Source    string    `bson:"source" json:"source"`
+	Memo      string    `bson:"memo" json:"memo"`
+	Name      string    `bson:"name" json:"name"`
+	Reference string    `bson:"reference,omitempty" json:"reference,omitempty"`
+	Postings  []Posting `bson:"postings" json:"postings"`
+}
+
+// AccountBalance is the total of the debits and credits posted to an account.
+type AccountBalance struct {
+	Account string  `json:"account"`
+	Debit   float64 `json:"debit"`
+	Credit  float64 `json:"credit"`
+	Balance float64 `json:"balance"`
+}
+
+// TrialBalance lists the balance of every account as of a date. The ledger is in balance when the debits
+// equal the credits.
+type TrialBalance struct {
+	AsOf     time.Time        `json:"asof"`
+	Accounts []AccountBalance `json:"accounts"`
+	Debit    float64          `json:"debit"`
+	Credit   float64          `json:"credit"`
+	Balanced bool             `json:"balanced"`
+}
+
+// RevenueAccount returns the revenue account of a school.
+func RevenueAccount(schoolName string) string {
+	if schoolName == "" {
+		schoolName = "Unassigned"
+	}
+	return revenueAccountPrefix + schoolName
+}
+
+// Validate checks that the entry has postings and that its debits equal its credits.
+func (e *JournalEntry) Validate() error {
+	if len(e.Postings) < 2 {
+		return errors.New("A journal entry needs at least two postings")
+	}
+	var debit, credit float64
+	for _, p := range e.Postings {
+		if p.Debit < 0 || p.Credit < 0 || (p.Debit == 0) == (p.Credit == 0) {
+			return fmt.Errorf("A posting to %s must be either a positive debit or a positive credit", p.Account)
+		}
+		debit += p.Debit
+		credit += p.Credit
+	}
+	if roundCents(debit) != roundCents(credit) {
+		return fmt.Errorf("Journal entry %s is out of balance by %.2f", e.Id, debit-credit)
+	}
+	return nil
+}
+
+// depositAccount is where a payment made by the method lands before it reaches the bank.
+func depositAccount(method PaymentType) string {
+	if method == CreditCard {
+		return CardClearingAccount
+	}
+	return CashAccount
+}
+
+// transfer returns the two postings that move an amount from one account to another.
+func transfer(debit, credit string, amount float64) []Posting {
+	amount = roundCents(amount)
+	return []Posting{{Account: debit, Debit: amount}, {Account: credit, Credit: amount}}
+}
+
+// familyName returns the name journal entries of the client are filed under, that of its primary guardian.
+func familyName(client *Client) string {
+	if guardian := client.PrimaryGuardian(); guardian != nil {
+		return strings.TrimSpace(guardian.FirstName + " " + guardian.LastName)
+	}
+	return ""
+}
+
+// familyBillingEntry books what a family is billed for the period starting on the day as revenue of their
+// school, owed by the family until they pay.
+func familyBillingEntry(client *Client, schoolName string, start time.Time, amount float64) JournalEntry {
+	return JournalEntry{
+		Id:       fmt.Sprintf("%s/%s/%s", FamilyBillingSource, client.Id.Hex(), start.UTC().Format("2006-01-02")),
+		Date:     start,
+		Source:   FamilyBillingSource,
+		Memo:     "Billing from " + start.Format("01/02/2006"),
+		Name:     familyName(client),
+		Postings: transfer(AccountsReceivableAccount, RevenueAccount(schoolName), amount),
+	}
+}
+
+// paymentStamp writes the date of a payment for the id of its journal entry. The database keeps times to the
+// millisecond, so the date is cut to the millisecond for a payment posted as it is made to get the same id
+// when it is read back to rebuild the ledger.
+func paymentStamp(date time.Time) string {
+	return date.UTC().Truncate(time.Millisecond).Format(time.RFC3339Nano)
+}
+
+// familyPaymentEntry books a payment made by a family against what they owe. A negative payment is a refund
+// and is booked against the refunds account.
+func familyPaymentEntry(client *Client, schoolName string, payment *Payment) JournalEntry {
+	entry := JournalEntry{
+		Id:        fmt.Sprintf("%s/%s/%s/%.2f", FamilyPaymentSource, client.Id.Hex(), paymentStamp(payment.Date), payment.Amount),
+		Date:      payment.Date,
+		Source:    FamilyPaymentSource,
+		Memo:      payment.Method.String(),
+		Name:      familyName(client),
+		Reference: payment.Reference,
+	}
+	if payment.Amount < 0 {
+		entry.Memo = "Refund " + payment.Method.String()
+		entry.Postings = transfer(RefundsAccount, depositAccount(payment.Method), -payment.Amount)
+		// Keep the cash side first, the QIF export files each entry under its first account
+		entry.Postings[0], entry.Postings[1] = entry.Postings[1], entry.Postings[0]
+	} else {
+		entry.Postings = transfer(depositAccount(payment.Method), AccountsReceivableAccount, payment.Amount)
+	}
+	return entry
+}
+
+// schoolInvoiceEntry books an invoice to a school as revenue owed by the school.
+func schoolInvoiceEntry(invoice *SchoolInvoice) JournalEntry {
+	return JournalEntry{
+		Id:       fmt.Sprintf("%s/%s", SchoolInvoiceSource, invoice.Id.Hex()),
+		Date:     invoice.Issued,
+		Source:   SchoolInvoiceSource,
+		Memo:     "Invoice " + invoice.Number,
+		Name:     invoice.School,
+		Postings: transfer(AccountsReceivableAccount, RevenueAccount(invoice.School), invoice.Total),
+	}
+}
+
+// schoolPaymentEntry books a payment from a school against what it owes.
+func schoolPaymentEntry(invoice *SchoolInvoice, payment *Payment) JournalEntry {
+	return JournalEntry{
+		Id:        fmt.Sprintf("%s/%s/%s/%.2f", SchoolPaymentSource, invoice.Id.Hex(), paymentStamp(payment.Date), payment.Amount),
+		Date:      payment.Date,
+		Source:    SchoolPaymentSource,
+		Memo:      "Payment on invoice " + invoice.Number,
+		Name:      invoice.School,
+		Reference: payment.Reference,
+		Postings:  transfer(depositAccount(payment.Method), AccountsReceivableAccount, payment.Amount),
+	}
+}
+
+// voidInvoiceEntry reverses the entry of a voided invoice.
+func voidInvoiceEntry(invoice *SchoolInvoice) JournalEntry {
+	entry := JournalEntry{
+		Id:       fmt.Sprintf("%s/%s", VoidInvoiceSource, invoice.Id.Hex()),
+		Date:     invoice.Voided,
+		Source:   VoidInvoiceSource,
+		Memo:     "Void invoice " + invoice.Number,
+		Name:     invoice.School,
+		Postings: transfer(RevenueAccount(invoice.School), AccountsReceivableAccount, invoice.Total),
+	}
+	entry.Postings[0], entry.Postings[1] = entry.Postings[1], entry.Postings[0]
+	return entry
+}
+
+// payoutEntry books a revenue share paid out to a school.
+func payoutEntry(payout *Payout) JournalEntry {
+	entry := JournalEntry{
+		Id:        fmt.Sprintf("%s/%s", PayoutSource, payout.Id.Hex()),
+		Date:      payout.Updated,
+		Source:    PayoutSource,
+		Memo:      fmt.Sprintf("Revenue share %s to %s", payout.From.Format("01/02/2006"), payout.To.Format("01/02/2006")),
+		Name:      payout.School,
+		Reference: payout.Reference,
+		Postings:  transfer(RevenueShareAccount, CashAccount, payout.Amount),
+	}
+	entry.Postings[0], entry.Postings[1] = entry.Postings[1], entry.Postings[0]
+	return entry
+}
+
+// post records the entry in the journal. Entries with nothing to post are skipped, and an entry already in
+// the journal is left as it was posted.
+func (c *MongoConnection) post(entry JournalEntry) (err error) {
+	if len(entry.Postings) > 0 && entry.Postings[0].Debit == 0 && entry.Postings[0].Credit == 0 {
+		return
+	}
+	if err = entry.Validate(); err != nil {
+		return
+	}
+	session, journalCollection, err := c.getCollection(journalCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	if err = journalCollection.Insert(entry); mgo.IsDup(err) {
+		err = nil
+	}
+	return
+}
+
+// postFamilyBilling records in the journal what the client has been billed up to the day, for the periods
+// not yet posted.
+func (c *MongoConnection) postFamilyBilling(client *Client, schoolName string, day time.Time) (posted int, err error) {
+	for _, start := range client.PaymentMethod.billingPeriods(day) {
+		if err = c.post(familyBillingEntry(client, schoolName, start, client.PaymentMethod.UnitCost)); err != nil {
+			return
+		}
+		posted++
+	}
+	return
+}
+
+// postFamilyPayment records a payment made by a client in the journal, along with what the client has been
+// billed so far, so the payment settles what they owe.
+func (c *MongoConnection) postFamilyPayment(clientId string, payment *Payment) (err error) {
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+	schoolName := ""
+	if bson.IsObjectIdHex(client.School) {
+		if school, schoolErr := c.GetSchoolById(bson.ObjectIdHex(client.School)); schoolErr == nil {
+			schoolName = school.Name
+		}
+	}
+	if _, err = c.postFamilyBilling(client, schoolName, time.Now()); err != nil {
+		return
+	}
+	return c.post(familyPaymentEntry(client, schoolName, payment))
+}
+
+// PostCardSettlement records a batch of card payments reaching the bank, moving the amount deposited out of
+// card clearing and into cash. The reference identifies the batch so it is only posted once.
+func (c *MongoConnection) PostCardSettlement(reference string, date time.Time, amount float64) (entry *JournalEntry, err error) {
+	if amount <= 0 {
+		return nil, errors.New("A settlement must be for a positive amount")
+	}
+	entry = &JournalEntry{
+		Id:        fmt.Sprintf("%s/%s", CardSettlement, reference),
+		Date:      date,
+		Source:    CardSettlement,
+		Memo:      "Card settlement " + reference,
+		Reference: reference,
+		Postings:  transfer(CashAccount, CardClearingAccount, amount),
+	}
+	err = c.post(*entry)
+	return
+}
+
+// RebuildLedger posts what families have been billed up to today and every payment, school invoice and paid
+// payout already recorded to the journal. Entries already in the journal are left as they are, so it is
+// safe to run more than once, and running it regularly keeps family billing up to date.
+func (c *MongoConnection) RebuildLedger() (posted int, err error) {
+	clients, err := c.ListClients()
+	if err != nil {
+		return
+	}
+	schools := make(map[string]string)
+	for _, client := range clients {
+		schoolName, ok := schools[client.School]
+		if !ok && bson.IsObjectIdHex(client.School) {
+			if school, schoolErr := c.GetSchoolById(bson.ObjectIdHex(client.School)); schoolErr == nil {
+				schoolName = school.Name
+			}
+			schools[client.School] = schoolName
+		}
+		billed, billingErr := c.postFamilyBilling(&client, schoolName, time.Now())
+		if posted += billed; billingErr != nil {
+			return posted, billingErr
+		}
+		for _, payment := range client.Payments {
+			if payment == nil {
+				continue
+			}
+			if err = c.post(familyPaymentEntry(&client, schoolName, payment)); err != nil {
+				return
+			}
+			posted++
+		}
+	}
+
+	invoices, err := c.listAllSchoolInvoices()
+	if err != nil {
+		return
+	}
+	payouts, err := c.ListPayouts("", PayoutPaid)
+	if err != nil {
+		return
+	}
+
+	for i := range invoices {
+		invoice := &invoices[i]
+		entries := []JournalEntry{schoolInvoiceEntry(invoice)}
+		for j := range invoice.Payments {
+			entries = append(entries, schoolPaymentEntry(invoice, &invoice.Payments[j]))
+		}
+		if invoice.Status == InvoiceVoid {
+			entries = append(entries, voidInvoiceEntry(invoice))
+		}
+		for _, entry := range entries {
+			if err = c.post(entry); err != nil {
+				return
+			}
+			posted++
+		}
+	}
+	for i := range payouts {
+		if err = c.post(payoutEntry(&payouts[i])); err != nil {
+			return
+		}
+		posted++
+	}
+	return
+}
+
+// ListJournal returns the journal entries dated between from and to, oldest first. A zero from or to leaves
+// that end of the range open.
+func (c *MongoConnection) ListJournal(from, to time.Time) (entries []JournalEntry, err error) {
+	session, journalCollection, err := c.getCollection(journalCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	date := bson.M{}
+	if !from.IsZero() {
+		date["$gte"] = from
+	}
+	if !to.IsZero() {
+		date["$lte"] = to
+	}
+	query := bson.M{}
+	if len(date) > 0 {
+		query["date"] = date
+	}
+	err = journalCollection.Find(query).Sort("date", "_id").All(&entries)
+	return
+}
+
+// Balances adds up the postings of the entries into a trial balance. Debit balances are positive.
+func Balances(entries []JournalEntry, asOf time.Time) *TrialBalance {
+	trial := &TrialBalance{AsOf: asOf}
+	accounts := make(map[string]*AccountBalance)
+	for _, entry := range entries {
+		for _, p := range entry.Postings {
+			account, ok := accounts[p.Account]
+			if !ok {
+				account = &AccountBalance{Account: p.Account}
+				accounts[p.Account] = account
+			}
+			account.Debit = roundCents(account.Debit + p.Debit)
+			account.Credit = roundCents(account.Credit + p.Credit)
+		}
+	}
+	for _, account := range accounts {
+		account.Balance = roundCents(account.Debit - account.Credit)
+		trial.Accounts = append(trial.Accounts, *account)
+		trial.Debit = roundCents(trial.Debit + account.Debit)
+		trial.Credit = roundCents(trial.Credit + account.Credit)
+	}
+	sort.Slice(trial.Accounts, func(i, j int) bool {
+		return trial.Accounts[i].Account < trial.Accounts[j].Account
+	})
+	trial.Balanced = trial.Debit == trial.Credit
+	return trial
+}
+
+// TrialBalance returns the balance of every ledger account as of the given date.
+func (c *MongoConnection) TrialBalance(asOf time.Time) (trial *TrialBalance, err error) {
+	entries, err := c.ListJournal(time.Time{}, asOf)
+	if err != nil {
+		return
+	}
+	return Balances(entries, asOf), nil
+}
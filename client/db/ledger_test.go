@@ -0,0 +1,98 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestLedgerEntries(t *testing.T) {
+	day := time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local)
+	client := &Client{Id: bson.NewObjectId(), Guardians: []*Guardian{
+		&Guardian{Parent: Parent{FirstName: "Ann", LastName: "Lee"}, Role: PrimaryGuardian},
+	}}
+	invoice := &SchoolInvoice{Id: bson.NewObjectId(), Number: "201703-1", School: "Acton", Issued: day, Total: 400, Voided: day}
+
+	entries := []JournalEntry{
+		familyBillingEntry(client, "Concord", day, 220),
+		familyPaymentEntry(client, "Concord", &Payment{Method: CreditCard, Date: day, Amount: 120}),
+		familyPaymentEntry(client, "Concord", &Payment{Method: Cash, Date: day, Amount: 100}),
+		familyPaymentEntry(client, "Concord", &Payment{Method: CreditCard, Date: day.Add(time.Hour), Amount: -20}),
+		schoolInvoiceEntry(invoice),
+		schoolPaymentEntry(invoice, &Payment{Method: Check, Date: day, Amount: 250}),
+		payoutEntry(&Payout{Id: bson.NewObjectId(), School: "Concord", Amount: 30, Updated: day}),
+	}
+	for _, e := range entries {
+		if err := e.Validate(); err != nil {
+			t.Error(err.Error())
+		}
+	}
+	if entries[0].Postings[0].Account != AccountsReceivableAccount || entries[0].Postings[1].Account != RevenueAccount("Concord") {
+		t.Error("Expected billing owed by the family as revenue of their school, got ", entries[0])
+	}
+	if entries[1].Name != "Ann Lee" || entries[1].Postings[0].Account != CardClearingAccount || entries[1].Postings[1].Account != AccountsReceivableAccount {
+		t.Error("Expected a card payment from Ann Lee into card clearing against what the family owes, got ", entries[1])
+	}
+	if entries[1].Id == entries[3].Id {
+		t.Error("Expected each payment to have its own entry")
+	}
+
+	trial := Balances(entries, day)
+	if !trial.Balanced {
+		t.Error("Expected the trial balance to balance, got ", trial.Debit, trial.Credit)
+	}
+	expected := map[string]float64{
+		CashAccount:               100 + 250 - 30,
+		CardClearingAccount:       120 - 20,
+		AccountsReceivableAccount: 400 - 250 + 220 - 220,
+		RefundsAccount:            20,
+		RevenueAccount("Concord"): -220,
+		RevenueAccount("Acton"):   -400,
+		RevenueShareAccount:       30,
+	}
+	if len(trial.Accounts) != len(expected) {
+		t.Error("Expected balances for ", len(expected), " accounts, got ", trial.Accounts)
+	}
+	for _, account := range trial.Accounts {
+		if account.Balance != expected[account.Account] {
+			t.Errorf("Expected %s to have a balance of %v, got %v", account.Account, expected[account.Account], account.Balance)
+		}
+	}
+
+	voided := Balances(append(entries, voidInvoiceEntry(invoice)), day)
+	for _, account := range voided.Accounts {
+		if account.Account == RevenueAccount("Acton") && account.Balance != 0 {
+			t.Error("Expected voiding the invoice to reverse its revenue, got ", account.Balance)
+		}
+	}
+
+	bad := JournalEntry{Id: "bad", Postings: []Posting{{Account: CashAccount, Debit: 10}, {Account: RefundsAccount, Credit: 5}}}
+	if bad.Validate() == nil {
+		t.Error("Expected an unbalanced entry to be rejected")
+	}
+}
+
+func TestLedgerPaymentIdsSurviveStorage(t *testing.T) {
+	client := &Client{Id: bson.NewObjectId()}
+	invoice := &SchoolInvoice{Id: bson.NewObjectId(), Number: "201703-1", School: "Acton"}
+	paid := &Payment{Method: CreditCard, Date: time.Date(2017, time.March, 1, 9, 30, 0, 123456789, time.Local), Amount: 120, Reference: "ch_1"}
+
+	// Rebuilding the ledger reads the payment back from the database, which keeps times to the millisecond
+	data, err := bson.Marshal(paid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := new(Payment)
+	if err = bson.Unmarshal(data, stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Date.Equal(paid.Date) {
+		t.Fatal("Expected the stored date to lose its nanoseconds")
+	}
+	if posted, rebuilt := familyPaymentEntry(client, "Acton", paid), familyPaymentEntry(client, "Acton", stored); posted.Id != rebuilt.Id {
+		t.Errorf("Expected the family payment posted as made and rebuilt from storage to share an id, got %s and %s", posted.Id, rebuilt.Id)
+	}
+	if posted, rebuilt := schoolPaymentEntry(invoice, paid), schoolPaymentEntry(invoice, stored); posted.Id != rebuilt.Id {
+		t.Errorf("Expected the school payment posted as made and rebuilt from storage to share an id, got %s and %s", posted.Id, rebuilt.Id)
+	}
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// EnrollmentState is the stage of the lifecycle an enrollment is in.
+type EnrollmentState string
+
+const (
+	Inquiry             EnrollmentState = "inquiry"
+	Registered          EnrollmentState = "registered"
+	Active              EnrollmentState = "active"
+	Paused              EnrollmentState = "paused"
+	Withdrawn           EnrollmentState = "withdrawn"
+	Graduated           EnrollmentState = "graduated"
+	PendingReenrollment EnrollmentState = "pending-reenrollment"
+)
+
+// transitions lists the states each state is allowed to move to.
+var transitions = map[EnrollmentState][]EnrollmentState{
+	Inquiry:             {Registered, Withdrawn},
+	Registered:          {Active, Withdrawn},
+	Active:              {Paused, Withdrawn, Graduated},
+	Paused:              {Active, Withdrawn},
+	Withdrawn:           {Registered},
+	Graduated:           {},
+	PendingReenrollment: {Registered, Withdrawn},
+}
+
+// StateChange records when an enrollment moved between states.
+type StateChange struct {
+	From EnrollmentState `bson:"from" json:"from"`
+	To   EnrollmentState `bson:"to" json:"to"`
+	At   time.Time       `bson:"at" json:"at"`
+	Note string          `bson:"note" json:"note"`
+}
+
+// Valid reports whether s is a known enrollment state.
+func (s EnrollmentState) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// CanTransition reports whether an enrollment is allowed to move from one state to another.
+func (s EnrollmentState) CanTransition(to EnrollmentState) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// seatHoldingStates are the states of enrollments that take a place in the class. See holdsSeat.
+var seatHoldingStates = []EnrollmentState{Registered, Active, Paused, PendingReenrollment}
+
+// holdsSeat reports whether enrollments in the state take a place in the class. Returning families keep
+// their place while they decide whether to re-enroll.
+func (s EnrollmentState) holdsSeat() bool {
+	return s == Registered || s == Active || s == Paused || s == PendingReenrollment
+}
+
+// EnrollmentFilter selects enrollments. Empty fields match every enrollment.
+type EnrollmentFilter struct {
+	ClientId string
+	School   string
+	Season   string
+	Class    string
+	State    EnrollmentState
+}
+
+// enrollmentQuery builds the mongo query for the filter.
+func (c *MongoConnection) enrollmentQuery(filter EnrollmentFilter) (query bson.M, err error) {
+	query = bson.M{}
+	if filter.ClientId != "" {
+		query["clientid"] = filter.ClientId
+	}
+	if filter.School != "" {
+		school, schoolErr := c.FindSchoolByName(filter.School)
+		if schoolErr != nil {
+			return nil, schoolErr
+		}
+		query["schoolid"] = school.Id.Hex()
+	}
+	if filter.Season != "" {
+		query["season"] = filter.Season
+	}
+	if filter.Class != "" {
+		query["class"] = filter.Class
+	}
+	if filter.State != "" {
+		if !filter.State.Valid() {
+			return nil, fmt.Errorf("Unknown enrollment state %q", filter.State)
+		}
+		query["state"] = filter.State
+	}
+	return
+}
+
+// TransitionEnrollment moves an enrollment to a new state. Only the transitions allowed by the lifecycle are
+// accepted and each one is recorded in the history of the enrollment. Registering takes a place in the class,
+// or joins the waitlist, while withdrawing or graduating hands the place to the waitlist.
+func (c *MongoConnection) TransitionEnrollment(id string, to EnrollmentState, note string) (enrollment *Enrollment, err error) {
+	enrollment, err = c.GetEnrollment(id)
+	if err != nil {
+		return
+	}
+	from := enrollment.State
+	if !from.CanTransition(to) {
+		return nil, fmt.Errorf("An enrollment can't move from %s to %s", from, to)
+	}
+	if to == Active && enrollment.Waitlisted {
+		return nil, fmt.Errorf("%s is still on the waitlist", enrollment.ChildName)
+	}
+
+	set := bson.M{"state": to, "updated": time.Now()}
+	heldSeat := from.holdsSeat() && !enrollment.Waitlisted
+	tookSeat, waitlisted := false, false
+	if !from.holdsSeat() && to.holdsSeat() {
+		school, schoolErr := c.GetSchoolById(bson.ObjectIdHex(enrollment.SchoolId))
+		if schoolErr != nil {
+			return nil, schoolErr
+		}
+		if capacity := school.ClassCapacity(enrollment.Season, enrollment.Class); capacity > 0 {
+			if tookSeat, err = c.takeSeat(enrollment.SchoolId, enrollment.Season, enrollment.Class, capacity); err != nil {
+				return nil, err
+			}
+			waitlisted = !tookSeat
+			set["queued"] = time.Now()
+		}
+	}
+	if to.holdsSeat() != from.holdsSeat() {
+		set["waitlisted"] = waitlisted
+	}
+
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	change := &StateChange{From: from, To: to, At: time.Now(), Note: note}
+	err = enrollmentCollection.Update(
+		bson.M{"_id": enrollment.Id, "state": from},
+		bson.M{"$set": set, "$push": bson.M{"history": change}},
+	)
+	if err == mgo.ErrNotFound {
+		err = fmt.Errorf("Enrollment %s was changed by someone else, please try again", id)
+	}
+	if err != nil {
+		if tookSeat {
+			c.releaseSeat(enrollment.SchoolId, enrollment.Season, enrollment.Class)
+		}
+		return nil, err
+	}
+
+	if heldSeat && !to.holdsSeat() {
+		if err = c.releaseSeat(enrollment.SchoolId, enrollment.Season, enrollment.Class); err != nil {
+			return
+		}
+	} else if waitlisted {
+		// A seat may have been released between taking a seat and joining the waitlist
+		if err = c.promote(enrollment.SchoolId, enrollment.Season, enrollment.Class); err != nil {
+			return
+		}
+	}
+	return c.GetEnrollment(id)
+}
+
+// ListEnrollments returns the enrollments matching the filter.
+func (c *MongoConnection) ListEnrollments(filter EnrollmentFilter) (enrollments []Enrollment, err error) {
+	query, err := c.enrollmentQuery(filter)
+	if err != nil {
+		return
+	}
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = enrollmentCollection.Find(query).Sort("created", "_id").All(&enrollments)
+	return
+}
+
+// ListClientsByState returns the clients with at least one enrollment in the given state.
+func (c *MongoConnection) ListClientsByState(state EnrollmentState) (clients []Client, err error) {
+	query, err := c.enrollmentQuery(EnrollmentFilter{State: state})
+	if err != nil {
+		return
+	}
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var ids []string
+	if err = session.DB(databaseName).C(enrollmentCollectionName).Find(query).Distinct("clientid", &ids); err != nil {
+		return
+	}
+	oids := make([]bson.ObjectId, 0, len(ids))
+	for _, id := range ids {
+		if bson.IsObjectIdHex(id) {
+			oids = append(oids, bson.ObjectIdHex(id))
+		}
+	}
+	err = clientCollection.Find(bson.M{"_id": bson.M{"$in": oids}}).All(&clients)
+	return
+}
@@ -0,0 +1,527 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// mergeUndoWindow is how long a merge of two clients can be undone.
+const mergeUndoWindow = 30 * 24 * time.Hour
+
+// clientCollections are the collections whose documents belong to a client through their clientid.
+var clientCollections = []string{
+	enrollmentCollectionName,
+	healthCollectionName,
+	notificationCollectionName,
+	assessmentCollectionName,
+	certificateCollectionName,
+	chargeCollectionName,
+}
+
+// childCollections are the collections whose documents belong to a child through their childid.
+var childCollections = []string{
+	enrollmentCollectionName,
+	assessmentCollectionName,
+	certificateCollectionName,
+}
+
+// uniqueChildFields are the fields, besides the child, that a child can only have one document for in the
+// child collections with a unique index.
+var uniqueChildFields = map[string][]string{
+	enrollmentCollectionName:  {"schoolid", "season", "class"},
+	certificateCollectionName: {"level"},
+}
+
+// MovedDocuments holds the documents of a collection as they were before a merge changed them.
+type MovedDocuments struct {
+	Collection string   `bson:"collection" json:"collection"`
+	Documents  []bson.M `bson:"documents" json:"-"`
+	Count      int      `bson:"count" json:"count"`
+}
+
+// CreatedDocument is a document a merge added, which undoing the merge removes.
+type CreatedDocument struct {
+	Collection string `bson:"collection" json:"collection"`
+	Id         string `bson:"id" json:"id"`
+}
+
+// MergeRecord is the audit record of merging one client into another. It keeps both clients as they were so
+// the merge can be undone within the undo window.
+type MergeRecord struct {
+	Id       bson.ObjectId     `bson:"_id" json:"id"`
+	KeptId   string            `bson:"keptid" json:"keptid"`
+	MergedId string            `bson:"mergedid" json:"mergedid"`
+	Score    float64           `bson:"score" json:"score"`
+	Reasons  []string          `bson:"reasons" json:"reasons"`
+	Kept     Client            `bson:"kept" json:"kept"`
+	Merged   Client            `bson:"merged" json:"merged"`
+	Result   Client            `bson:"result" json:"result"`
+	ChildIds map[string]string `bson:"childids" json:"childids"`
+	Moved    []MovedDocuments  `bson:"moved" json:"moved"`
+	Created  []CreatedDocument `bson:"created" json:"created"`
+	// Duplicates are the enrollments and certificates both children had, of which the merge removed one
+	Duplicates []CreatedDocument `bson:"duplicates" json:"duplicates"`
+	// Waitlisted are the duplicate enrollments undoing the merge could not give their seat back
+	Waitlisted []string  `bson:"waitlisted,omitempty" json:"waitlisted,omitempty"`
+	Time       time.Time `bson:"time" json:"time"`
+	UndoBy     time.Time `bson:"undoby" json:"undoby"`
+	Undone     time.Time `bson:"undone,omitempty" json:"undone,omitempty"`
+}
+
+// movedDocument returns the document of the collection with the id as it was before the merge.
+func (r *MergeRecord) movedDocument(collection string, id interface{}) bson.M {
+	for _, moved := range r.Moved {
+		if moved.Collection != collection {
+			continue
+		}
+		for _, document := range moved.Documents {
+			if document["_id"] == id {
+				return document
+			}
+		}
+	}
+	return nil
+}
+
+// holdsSeat reports whether the stored enrollment takes a place in its class.
+func holdsSeat(enrollment bson.M) bool {
+	state, _ := enrollment["state"].(string)
+	waitlisted, _ := enrollment["waitlisted"].(bool)
+	return EnrollmentState(state).holdsSeat() && !waitlisted
+}
+
+// sameGuardian reports whether two guardians are the same person, by name or email.
+func sameGuardian(a, b *Guardian) bool {
+	if email := strings.TrimSpace(a.EmailAddress); email != "" && strings.EqualFold(email, strings.TrimSpace(b.EmailAddress)) {
+		return true
+	}
+	return letters(a.FirstName+a.LastName) == letters(b.FirstName+b.LastName)
+}
+
+// MergeClientRecords combines the merged client into the kept one. Guardians, emergency contacts and
+// children the kept client doesn't have are added, guardians as secondary guardians, and every payment is
+// kept. ChildIds maps the ids of children both clients had to the id the kept client knows them by. Neither
+// client is changed.
+func MergeClientRecords(kept, merged *Client) (result Client, childIds map[string]string) {
+	result = *kept
+	result.Guardians = append([]*Guardian{}, kept.Guardians...)
+	result.EmergencyContacts = append([]*EmergencyContact{}, kept.EmergencyContacts...)
+	result.Children = nil
+	for _, child := range kept.Children {
+		copied := *child
+		result.Children = append(result.Children, &copied)
+	}
+	result.Payments = []*Payment{}
+	for _, payments := range [][]*Payment{kept.Payments, merged.Payments} {
+		for _, payment := range payments {
+			if payment != nil {
+				result.Payments = append(result.Payments, payment)
+			}
+		}
+	}
+	childIds = make(map[string]string)
+
+	for _, g := range merged.Guardians {
+		duplicate := false
+		for _, other := range result.Guardians {
+			duplicate = duplicate || sameGuardian(g, other)
+		}
+		if !duplicate {
+			added := *g
+			if len(result.Guardians) > 0 {
+				added.Role = SecondaryGuardian
+			}
+			result.Guardians = append(result.Guardians, &added)
+		}
+	}
+	for _, contact := range merged.EmergencyContacts {
+		duplicate := false
+		for _, other := range result.EmergencyContacts {
+			duplicate = duplicate || letters(contact.Name) == letters(other.Name)
+		}
+		if !duplicate {
+			result.EmergencyContacts = append(result.EmergencyContacts, contact)
+		}
+	}
+	for _, child := range merged.Children {
+		if same := matchingChild(&result, child); same != nil {
+			childIds[child.Id.Hex()] = same.Id.Hex()
+			if same.DOB.IsZero() {
+				same.DOB = child.DOB
+			}
+			continue
+		}
+		result.Children = append(result.Children, child)
+	}
+	sort.SliceStable(result.Payments, func(i, j int) bool {
+		return result.Payments[i].Date.Before(result.Payments[j].Date)
+	})
+	if result.School == "" {
+		result.School = merged.School
+	}
+	if result.PaymentMethod == (PaymentMethod{}) {
+		result.PaymentMethod = merged.PaymentMethod
+	}
+	return
+}
+
+// MergeClients merges the client mergedId into keptId, moving its children, guardians, payments,
+// enrollments and history to the kept client and removing it. The merge is recorded and can be undone with
+// UndoMerge within the undo window.
+func (c *MongoConnection) MergeClients(keptId, mergedId string) (record *MergeRecord, err error) {
+	if keptId == mergedId {
+		return nil, errors.New("A client can't be merged into itself")
+	}
+	kept, err := c.GetClientById(keptId)
+	if err != nil {
+		return
+	}
+	merged, err := c.GetClientById(mergedId)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	record = &MergeRecord{
+		Id:       bson.NewObjectId(),
+		KeptId:   keptId,
+		MergedId: mergedId,
+		Kept:     *kept,
+		Merged:   *merged,
+		Time:     now,
+		UndoBy:   now.Add(mergeUndoWindow),
+	}
+	record.Score, record.Reasons = DuplicateScore(kept, merged)
+	record.Result, record.ChildIds = MergeClientRecords(kept, merged)
+
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	database := clientCollection.Database
+
+	// Everything the merge changes is saved in the record first
+	for _, name := range clientCollections {
+		var documents []bson.M
+		if err = database.C(name).Find(bson.M{"clientid": mergedId}).All(&documents); err != nil {
+			return
+		}
+		if len(documents) > 0 {
+			record.Moved = append(record.Moved, MovedDocuments{Collection: name, Documents: documents, Count: len(documents)})
+		}
+	}
+	var entries []bson.M
+	entryQuery := bson.M{"_id": bson.RegEx{Pattern: "^(" + FamilyPaymentSource + "|" + FamilyBillingSource + ")/" + regexp.QuoteMeta(mergedId) + "/"}}
+	if err = database.C(journalCollectionName).Find(entryQuery).All(&entries); err != nil {
+		return
+	}
+	var entryIds []string
+	for _, entry := range entries {
+		entryIds = append(entryIds, entry["_id"].(string))
+	}
+	if len(entries) > 0 {
+		var transactions []bson.M
+		if err = database.C(bankCollectionName).Find(bson.M{"entryid": bson.M{"$in": entryIds}}).All(&transactions); err != nil {
+			return
+		}
+		record.Moved = append(record.Moved, MovedDocuments{Collection: journalCollectionName, Documents: entries, Count: len(entries)})
+		if len(transactions) > 0 {
+			record.Moved = append(record.Moved, MovedDocuments{Collection: bankCollectionName, Documents: transactions, Count: len(transactions)})
+		}
+	}
+	// A child can hold only one enrollment in a class and one certificate of a level, so where both
+	// children have one, one is kept and the other removed
+	for from, to := range record.ChildIds {
+		for name, fields := range uniqueChildFields {
+			var keptDocuments []bson.M
+			if err = c.findDuplicates(database.C(name), record, from, to, fields, &keptDocuments); err != nil {
+				return
+			}
+			if len(keptDocuments) > 0 {
+				record.Moved = append(record.Moved, MovedDocuments{Collection: name, Documents: keptDocuments, Count: len(keptDocuments)})
+			}
+		}
+	}
+	// Health records both children have are combined into the kept child's
+	var keptHealth []bson.M
+	for from, to := range record.ChildIds {
+		var health bson.M
+		if n, _ := database.C(healthCollectionName).FindId(from).Count(); n == 0 {
+			continue
+		}
+		if err = database.C(healthCollectionName).FindId(to).One(&health); err == nil {
+			keptHealth = append(keptHealth, health)
+		} else if err != mgo.ErrNotFound {
+			return
+		}
+		err = nil
+	}
+	if len(keptHealth) > 0 {
+		record.Moved = append(record.Moved, MovedDocuments{Collection: healthCollectionName, Documents: keptHealth, Count: len(keptHealth)})
+	}
+	mergeCollection := database.C(mergeCollectionName)
+	if err = mergeCollection.Insert(record); err != nil {
+		return
+	}
+
+	// Anything failing part way is put back from the record, so a merge is never left half done
+	if err = applyMerge(database, record, entries); err != nil {
+		if restoreErr := restoreMerge(database, record); restoreErr != nil {
+			return nil, fmt.Errorf("Merge of %s into %s failed (%v) and couldn't be rolled back: %v", mergedId, keptId, err, restoreErr)
+		}
+		mergeCollection.RemoveId(record.Id)
+		return nil, err
+	}
+	for _, duplicate := range record.Duplicates {
+		if enrollment := record.movedDocument(duplicate.Collection, bson.ObjectIdHex(duplicate.Id)); duplicate.Collection == enrollmentCollectionName && holdsSeat(enrollment) {
+			c.releaseSeat(enrollment["schoolid"].(string), enrollment["season"].(string), enrollment["class"].(string))
+		}
+	}
+	err = mergeCollection.UpdateId(record.Id, bson.M{"$set": bson.M{"created": record.Created}})
+	return
+}
+
+// findDuplicates records in the merge the documents of the merged child that the kept child has one of
+// with the same fields. The kept child's document is kept unless only the other enrollment holds a seat.
+// The kept child's documents that lose are added to keptDocuments, so undoing the merge restores them.
+func (c *MongoConnection) findDuplicates(collection *mgo.Collection, record *MergeRecord, from, to string, fields []string, keptDocuments *[]bson.M) (err error) {
+	var documents []bson.M
+	if err = collection.Find(bson.M{"childid": from}).All(&documents); err != nil {
+		return
+	}
+	for _, document := range documents {
+		query := bson.M{"childid": to}
+		for _, field := range fields {
+			query[field] = document[field]
+		}
+		var other bson.M
+		if err = collection.Find(query).One(&other); err == mgo.ErrNotFound {
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		removed := document
+		if collection.Name == enrollmentCollectionName && holdsSeat(document) && !holdsSeat(other) {
+			removed = other
+			*keptDocuments = append(*keptDocuments, other)
+		}
+		record.Duplicates = append(record.Duplicates, CreatedDocument{Collection: collection.Name, Id: removed["_id"].(bson.ObjectId).Hex()})
+	}
+	return
+}
+
+// applyMerge makes the changes of a merge saved in its record, adding what it creates to the record.
+func applyMerge(database *mgo.Database, record *MergeRecord, entries []bson.M) (err error) {
+	keptId, mergedId := record.KeptId, record.MergedId
+	for _, duplicate := range record.Duplicates {
+		if err = database.C(duplicate.Collection).RemoveId(bson.ObjectIdHex(duplicate.Id)); err != nil {
+			return
+		}
+	}
+
+	// Move the history of the merged client over, then what belonged to its duplicate children
+	for _, name := range clientCollections {
+		if _, err = database.C(name).UpdateAll(bson.M{"clientid": mergedId}, bson.M{"$set": bson.M{"clientid": keptId}}); err != nil {
+			return
+		}
+	}
+	for from, to := range record.ChildIds {
+		for _, name := range childCollections {
+			if _, err = database.C(name).UpdateAll(bson.M{"childid": from}, bson.M{"$set": bson.M{"childid": to}}); err != nil {
+				return
+			}
+		}
+		// Health records are stored under the child id, so the merged child's is moved to the kept child, or
+		// combined with the kept child's when both have one
+		var health, keptHealth HealthRecord
+		if err = database.C(healthCollectionName).FindId(from).One(&health); err == mgo.ErrNotFound {
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		health.ChildId, health.ClientId = to, keptId
+		if err = database.C(healthCollectionName).FindId(to).One(&keptHealth); err == nil {
+			health = MergeHealthRecords(&keptHealth, &health)
+			err = database.C(healthCollectionName).UpdateId(to, &health)
+		} else if err == mgo.ErrNotFound {
+			if err = database.C(healthCollectionName).Insert(&health); err == nil {
+				record.Created = append(record.Created, CreatedDocument{Collection: healthCollectionName, Id: to})
+			}
+		}
+		if err != nil {
+			return
+		}
+		if err = database.C(healthCollectionName).RemoveId(from); err != nil {
+			return
+		}
+	}
+
+	// Journal entries of family payments and billing are keyed by client, so they are keyed again to keep
+	// the ledger from posting them twice when it is rebuilt
+	for _, entry := range entries {
+		oldId := entry["_id"].(string)
+		newId := strings.Replace(oldId, "/"+mergedId+"/", "/"+keptId+"/", 1)
+		rekeyed := bson.M{}
+		for k, v := range entry {
+			rekeyed[k] = v
+		}
+		rekeyed["_id"] = newId
+		if _, err = database.C(journalCollectionName).UpsertId(newId, rekeyed); err != nil {
+			return
+		}
+		record.Created = append(record.Created, CreatedDocument{Collection: journalCollectionName, Id: newId})
+		if err = database.C(journalCollectionName).RemoveId(oldId); err != nil {
+			return
+		}
+		if _, err = database.C(bankCollectionName).UpdateAll(bson.M{"entryid": oldId}, bson.M{"$set": bson.M{"entryid": newId}}); err != nil {
+			return
+		}
+	}
+
+	clientCollection := database.C(clientCollectionName)
+	if err = clientCollection.UpdateId(record.Kept.Id, &record.Result); err != nil {
+		return
+	}
+	err = clientCollection.RemoveId(record.Merged.Id)
+	return
+}
+
+// restoreMerge puts back everything a merge changed as saved in its record.
+func restoreMerge(database *mgo.Database, record *MergeRecord) (err error) {
+	for _, created := range record.Created {
+		if err = database.C(created.Collection).RemoveId(created.Id); err != nil && err != mgo.ErrNotFound {
+			return
+		}
+	}
+	for _, moved := range record.Moved {
+		for _, document := range moved.Documents {
+			if _, err = database.C(moved.Collection).UpsertId(document["_id"], document); err != nil {
+				return
+			}
+		}
+	}
+	clientCollection := database.C(clientCollectionName)
+	if _, err = clientCollection.UpsertId(record.Kept.Id, &record.Kept); err != nil {
+		return
+	}
+	_, err = clientCollection.UpsertId(record.Merged.Id, &record.Merged)
+	return
+}
+
+// GetMerge returns the record of a merge.
+func (c *MongoConnection) GetMerge(id string) (record *MergeRecord, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, fmt.Errorf("Invalid merge id %q", id)
+	}
+	session, mergeCollection, err := c.getCollection(mergeCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	if err = mergeCollection.FindId(bson.ObjectIdHex(id)).One(&record); err == mgo.ErrNotFound {
+		err = fmt.Errorf("Merge %s not found", id)
+	}
+	return
+}
+
+// ListMerges returns the merges made since the given time, newest first.
+func (c *MongoConnection) ListMerges(since time.Time) (records []MergeRecord, err error) {
+	session, mergeCollection, err := c.getCollection(mergeCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = mergeCollection.Find(bson.M{"time": bson.M{"$gte": since}}).Sort("-time").All(&records)
+	return
+}
+
+// UndoMerge restores both clients of a merge and everything the merge moved, as long as the undo window is
+// open and the kept client hasn't changed since, so nothing recorded after the merge is lost. Restored
+// enrollments whose class has filled up since are waitlisted and listed in the Waitlisted of the record.
+func (c *MongoConnection) UndoMerge(id string) (record *MergeRecord, err error) {
+	record, err = c.GetMerge(id)
+	if err != nil {
+		return
+	}
+	if !record.Undone.IsZero() {
+		return nil, fmt.Errorf("Merge %s has already been undone", id)
+	}
+	if time.Now().After(record.UndoBy) {
+		return nil, fmt.Errorf("Merge %s can no longer be undone, the undo window closed on %s", id, record.UndoBy.Format("January 2, 2006"))
+	}
+	current, err := c.GetClientById(record.KeptId)
+	if err != nil {
+		return
+	}
+	now, err := bson.Marshal(current)
+	if err != nil {
+		return
+	}
+	then, err := bson.Marshal(&record.Result)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(now, then) {
+		return nil, fmt.Errorf("Client %s has changed since the merge and it can't be undone", record.KeptId)
+	}
+
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	database := clientCollection.Database
+
+	if err = restoreMerge(database, record); err != nil {
+		return
+	}
+	// Duplicate enrollments that held a seat take it back, or wait for one if the class filled up since
+	for _, duplicate := range record.Duplicates {
+		enrollment := record.movedDocument(duplicate.Collection, bson.ObjectIdHex(duplicate.Id))
+		if duplicate.Collection != enrollmentCollectionName || !holdsSeat(enrollment) {
+			continue
+		}
+		var taken bool
+		taken, err = c.retakeSeat(enrollment["schoolid"].(string), enrollment["season"].(string), enrollment["class"].(string))
+		if err != nil {
+			return
+		}
+		if !taken {
+			if err = database.C(enrollmentCollectionName).UpdateId(enrollment["_id"], bson.M{"$set": bson.M{"waitlisted": true}}); err != nil {
+				return
+			}
+			record.Waitlisted = append(record.Waitlisted, duplicate.Id)
+		}
+	}
+	record.Undone = time.Now()
+	err = database.C(mergeCollectionName).UpdateId(record.Id, bson.M{"$set": bson.M{"undone": record.Undone, "waitlisted": record.Waitlisted}})
+	return
+}
+
+// retakeSeat takes a seat of the class back for an enrollment restored while holding one. Classes without
+// seats need none, the enrollment is counted when their seats are first created.
+func (c *MongoConnection) retakeSeat(schoolId, season, class string) (taken bool, err error) {
+	if taken, err = c.takeOpenSeat(schoolId, season, class); err != nil || taken {
+		return
+	}
+	session, seatCollection, err := c.getCollection(seatCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	n, err := seatCollection.FindId(seatKey(schoolId, season, class)).Count()
+	return n == 0, err
+}
@@ -0,0 +1,340 @@
+package db
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"regexp"
+	"strings"
+)
+
+// states maps the lower cased names of the US states, territories and military post offices to their codes.
+var states = map[string]string{
+	"alabama": "AL", "alaska": "AK", "arizona": "AZ", "arkansas": "AR", "california": "CA",
+	"colorado": "CO", "connecticut": "CT", "delaware": "DE", "district of columbia": "DC", "florida": "FL",
+	"georgia": "GA", "hawaii": "HI", "idaho": "ID", "illinois": "IL", "indiana": "IN",
+	"iowa": "IA", "kansas": "KS", "kentucky": "KY", "louisiana": "LA", "maine": "ME",
+	"maryland": "MD", "massachusetts": "MA", "michigan": "MI", "minnesota": "MN", "mississippi": "MS",
+	"missouri": "MO", "montana": "MT", "nebraska": "NE", "nevada": "NV", "new hampshire": "NH",
+	"new jersey": "NJ", "new mexico": "NM", "new york": "NY", "north carolina": "NC", "north dakota": "ND",
+	"ohio": "OH", "oklahoma": "OK", "oregon": "OR", "pennsylvania": "PA", "rhode island": "RI",
+	"south carolina": "SC", "south dakota": "SD", "tennessee": "TN", "texas": "TX", "utah": "UT",
+	"vermont": "VT", "virginia": "VA", "washington": "WA", "west virginia": "WV", "wisconsin": "WI",
+	"wyoming": "WY", "american samoa": "AS", "guam": "GU", "northern mariana islands": "MP",
+	"puerto rico": "PR", "virgin islands": "VI", "us virgin islands": "VI",
+	"armed forces americas": "AA", "armed forces europe": "AE", "armed forces pacific": "AP",
+}
+
+// stateCodes is the set of valid state codes.
+var stateCodes = make(map[string]bool)
+
+func init() {
+	for _, code := range states {
+		stateCodes[code] = true
+	}
+}
+
+// streetSuffixes maps the spellings of street suffixes to their standard postal abbreviations.
+var streetSuffixes = map[string]string{
+	"alley": "Aly", "aly": "Aly",
+	"avenue": "Ave", "av": "Ave", "ave": "Ave", "aven": "Ave",
+	"boulevard": "Blvd", "blvd": "Blvd", "boul": "Blvd",
+	"circle": "Cir", "cir": "Cir", "circ": "Cir",
+	"court": "Ct", "ct": "Ct",
+	"drive": "Dr", "dr": "Dr", "drv": "Dr",
+	"expressway": "Expy", "expy": "Expy",
+	"highway": "Hwy", "hwy": "Hwy",
+	"lane": "Ln", "ln": "Ln",
+	"parkway": "Pkwy", "pkwy": "Pkwy", "pky": "Pkwy",
+	"place": "Pl", "pl": "Pl",
+	"plaza": "Plz", "plz": "Plz",
+	"road": "Rd", "rd": "Rd",
+	"square": "Sq", "sq": "Sq",
+	"street": "St", "st": "St", "str": "St",
+	"terrace": "Ter", "ter": "Ter",
+	"trail": "Trl", "trl": "Trl",
+	"way": "Way",
+}
+
+// zipCode matches a five digit ZIP code, optionally followed by the four digits of a ZIP+4 code.
+var zipCode = regexp.MustCompile(`^(\d{5})(?:[- ]?(\d{4}))?$`)
+
+// phoneExtension matches the extension at the end of a phone number, written as "x12", "ext. 12",
+// "extension 12" or "#12".
+var phoneExtension = regexp.MustCompile(`(?i)[\s,]*(?:x|ext\.?|extension|#)\s*(\d{1,6})$`)
+
+// NormalizePhone returns the phone number in E.164 form, assuming North American numbers when there is no
+// country code, with any extension kept after it as " x12". It is false when the value isn't a phone
+// number; an empty value is left empty.
+func NormalizePhone(phone string) (string, bool) {
+	phone = strings.TrimSpace(phone)
+	if phone == "" {
+		return "", true
+	}
+	number, extension := phone, ""
+	if m := phoneExtension.FindStringSubmatchIndex(phone); m != nil && m[0] > 0 {
+		number, extension = phone[:m[0]], " x"+phone[m[2]:m[3]]
+	}
+	var digits []byte
+	for i, r := range number {
+		switch {
+		case r >= '0' && r <= '9':
+			digits = append(digits, byte(r))
+		case r == '+' && i == 0, strings.ContainsRune(" -.()/", r):
+		default:
+			return phone, false
+		}
+	}
+	switch n := len(digits); {
+	case number[0] == '+' && n >= 8 && n <= 15:
+		return "+" + string(digits) + extension, true
+	case n == 10:
+		return "+1" + string(digits) + extension, true
+	case n == 11 && digits[0] == '1':
+		return "+" + string(digits) + extension, true
+	}
+	return phone, false
+}
+
+// NormalizeState returns the two letter code of a state given by code or by name.
+func NormalizeState(state string) (string, bool) {
+	state = strings.Join(strings.Fields(state), " ")
+	if state == "" {
+		return "", true
+	}
+	if code := strings.ToUpper(state); stateCodes[code] {
+		return code, true
+	}
+	if code, ok := states[strings.ToLower(strings.Replace(state, ".", "", -1))]; ok {
+		return code, true
+	}
+	return state, false
+}
+
+// NormalizeZipCode returns a ZIP code as five digits, or as a ZIP+4 code with a dash.
+func NormalizeZipCode(zip string) (string, bool) {
+	zip = strings.TrimSpace(zip)
+	if zip == "" {
+		return "", true
+	}
+	m := zipCode.FindStringSubmatch(zip)
+	switch {
+	case m == nil:
+		return zip, false
+	case m[2] == "":
+		return m[1], true
+	}
+	return m[1] + "-" + m[2], true
+}
+
+// NormalizeEmail returns the email address trimmed and lower cased.
+func NormalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", true
+	}
+	at := strings.Index(email, "@")
+	domain := email[at+1:]
+	if at <= 0 || strings.ContainsAny(domain, "@ \t") || strings.ContainsAny(email[:at], " \t") ||
+		!strings.Contains(strings.Trim(domain, "."), ".") {
+		return email, false
+	}
+	return email, true
+}
+
+// NormalizeStreet returns the street address with its spacing tidied and its street suffix abbreviated the
+// standard way, so "12 Maple Street" becomes "12 Maple St". Only the last suffix is changed, so the street
+// name of "5 Court Street" is kept.
+func NormalizeStreet(address string) string {
+	words := strings.Fields(address)
+	for i := len(words) - 1; i > 0; i-- {
+		word := strings.TrimRight(words[i], ".,")
+		if suffix, ok := streetSuffixes[strings.ToLower(word)]; ok {
+			words[i] = suffix + strings.Replace(words[i][len(word):], ".", "", -1)
+			break
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// normalStreet is NormalizeStreet as a contact field normalizer; every street address can be normalized.
+func normalStreet(address string) (string, bool) {
+	return NormalizeStreet(address), true
+}
+
+// contactField is a field of an address or contact normalized on write: its stored name, its value, the
+// normal form and the message for a value that can't be normalized.
+type contactField struct {
+	name    string
+	value   *string
+	normal  func(string) (string, bool)
+	invalid string
+}
+
+// normalizeFields puts the fields in their normal form, keeping what was entered in original for every field
+// it changes. A field already in normal form keeps the original it was normalized from. Values that can't be
+// normalized are left as they are and reported as problems.
+func normalizeFields(original *map[string]string, fields []contactField) (changed bool, problems []string) {
+	for _, f := range fields {
+		entered := *f.value
+		normal, ok := f.normal(entered)
+		if !ok {
+			problems = append(problems, fmt.Sprintf(f.invalid, strings.TrimSpace(entered)))
+			continue
+		}
+		if normal != entered {
+			if *original == nil {
+				*original = make(map[string]string)
+			}
+			*f.value = normal
+			(*original)[f.name] = entered
+			changed = true
+		} else if before, ok := (*original)[f.name]; ok {
+			if again, _ := f.normal(before); again != normal {
+				delete(*original, f.name)
+				changed = true
+			}
+		}
+	}
+	if *original != nil && len(*original) == 0 {
+		*original = nil
+	}
+	return
+}
+
+// normalize puts the address, phones and email of the parent in their normal form. See normalizeFields.
+func (p *Parent) normalize() (changed bool, problems []string) {
+	return normalizeFields(&p.Original, []contactField{
+		{"address", &p.Address, normalStreet, ""},
+		{"state", &p.State, NormalizeState, "State %q is not a US state"},
+		{"zipcode", &p.ZipCode, NormalizeZipCode, "ZIP code %q is not a ZIP or ZIP+4 code"},
+		{"homephone", &p.HomePhone, NormalizePhone, "Home phone %q is not a phone number"},
+		{"mobilephone", &p.MobilePhone, NormalizePhone, "Mobile phone %q is not a phone number"},
+		{"emailaddress", &p.EmailAddress, NormalizeEmail, "Email %q is not an email address"},
+	})
+}
+
+// normalize puts the address and phone of the school in their normal form. See normalizeFields.
+func (s *School) normalize() (changed bool, problems []string) {
+	return normalizeFields(&s.Original, []contactField{
+		{"address", &s.Address, normalStreet, ""},
+		{"state", &s.State, NormalizeState, "State %q is not a US state"},
+		{"zipcode", &s.ZipCode, NormalizeZipCode, "ZIP code %q is not a ZIP or ZIP+4 code"},
+		{"mainphone", &s.MainPhone, NormalizePhone, "Phone %q is not a phone number"},
+	})
+}
+
+// Normalize puts the contact information of the parent in its normal form. Values that can't be normalized
+// are kept as entered and listed in Problems, which it returns.
+func (p *Parent) Normalize() []string {
+	_, p.Problems = p.normalize()
+	return p.Problems
+}
+
+// Normalize puts the contact information of the school in its normal form. Values that can't be normalized
+// are kept as entered and listed in Problems, which it returns.
+func (s *School) Normalize() []string {
+	_, s.Problems = s.normalize()
+	return s.Problems
+}
+
+// sameProblems is true when both lists hold the same problems in the same order.
+func sameProblems(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeProblem is a stored school or client with contact information that couldn't be normalized.
+type NormalizeProblem struct {
+	Kind     string   `json:"kind"`
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Problems []string `json:"problems"`
+}
+
+// NormalizeResult reports what normalizing the stored schools and clients changed, or would change on a
+// dry run.
+type NormalizeResult struct {
+	DryRun   bool               `json:"dryrun"`
+	Schools  int                `json:"schools"`
+	Clients  int                `json:"clients"`
+	Problems []NormalizeProblem `json:"problems"`
+}
+
+// NormalizeContacts puts the contact information of the schools and clients stored before it was
+// normalized on write in its normal form, keeping what was entered as the original. Values that can't be
+// normalized are left alone, reported and stored as the problems of their school or guardian. It is safe to
+// run more than once, and changes nothing on a dry run.
+func (c *MongoConnection) NormalizeContacts(dryRun bool) (result *NormalizeResult, err error) {
+	session, clientCollection, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	result = &NormalizeResult{DryRun: dryRun, Problems: []NormalizeProblem{}}
+	iter := schoolCollection.Find(nil).Iter()
+	var school School
+	for iter.Next(&school) {
+		changed, problems := school.normalize()
+		changed = changed || !sameProblems(school.Problems, problems)
+		if len(problems) > 0 {
+			result.Problems = append(result.Problems, NormalizeProblem{"school", school.Id.Hex(), school.Name, problems})
+		}
+		if changed {
+			result.Schools++
+			if !dryRun {
+				err = schoolCollection.UpdateId(school.Id, bson.M{"$set": bson.M{
+					"address":   school.Address,
+					"state":     school.State,
+					"zipcode":   school.ZipCode,
+					"mainphone": school.MainPhone,
+					"original":  school.Original,
+					"problems":  problems,
+				}})
+				if err != nil {
+					iter.Close()
+					return
+				}
+			}
+		}
+		school = School{}
+	}
+	if err = iter.Close(); err != nil {
+		return
+	}
+
+	iter = clientCollection.Find(nil).Iter()
+	var client Client
+	for iter.Next(&client) {
+		changed := false
+		var problems []string
+		for _, g := range client.Guardians {
+			guardianChanged, guardianProblems := g.normalize()
+			changed = changed || guardianChanged || !sameProblems(g.Problems, guardianProblems)
+			g.Problems = guardianProblems
+			problems = append(problems, guardianProblems...)
+		}
+		if len(problems) > 0 {
+			result.Problems = append(result.Problems, NormalizeProblem{"client", client.Id.Hex(), clientName(&client), problems})
+		}
+		if changed {
+			result.Clients++
+			if !dryRun {
+				if err = clientCollection.UpdateId(client.Id, bson.M{"$set": bson.M{"guardians": client.Guardians}}); err != nil {
+					iter.Close()
+					return
+				}
+			}
+		}
+		client = Client{}
+	}
+	err = iter.Close()
+	return
+}
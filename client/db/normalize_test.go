@@ -0,0 +1,79 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeValues(t *testing.T) {
+	for _, test := range []struct {
+		normalize func(string) (string, bool)
+		in, out   string
+		ok        bool
+	}{
+		{NormalizePhone, "(978) 234-1234", "+19782341234", true},
+		{NormalizePhone, "1-978-234-1234", "+19782341234", true},
+		{NormalizePhone, "+44 20 7946 0958", "+442079460958", true},
+		{NormalizePhone, "234-1234", "234-1234", false},
+		{NormalizePhone, "978-234-1234 x12", "+19782341234 x12", true},
+		{NormalizePhone, "(617) 555-0100, ext. 305", "+16175550100 x305", true},
+		{NormalizePhone, "234-1234 x12", "234-1234 x12", false},
+		{NormalizePhone, " ", "", true},
+		{NormalizeState, "ma", "MA", true},
+		{NormalizeState, " New  Hampshire ", "NH", true},
+		{NormalizeState, "Mass", "Mass", false},
+		{NormalizeZipCode, "01720", "01720", true},
+		{NormalizeZipCode, "017201234", "01720-1234", true},
+		{NormalizeZipCode, "01720 1234", "01720-1234", true},
+		{NormalizeZipCode, "1720", "1720", false},
+		{NormalizeEmail, " Ann.Smith@Example.COM ", "ann.smith@example.com", true},
+		{NormalizeEmail, "ann@example", "ann@example", false},
+		{NormalizeEmail, "@example.com", "@example.com", false},
+		{normalStreet, "12  Maple Street", "12 Maple St", true},
+		{normalStreet, "5 Court street, Apt 2", "5 Court St, Apt 2", true},
+		{normalStreet, "40 Elm Ave.", "40 Elm Ave", true},
+		{normalStreet, "Broadway", "Broadway", true},
+	} {
+		if out, ok := test.normalize(test.in); out != test.out || ok != test.ok {
+			t.Errorf("Expected %q to normalize to %q, %v, got %q, %v", test.in, test.out, test.ok, out, ok)
+		}
+	}
+}
+
+func TestNormalizeParent(t *testing.T) {
+	parent := Parent{Address: "12 Maple Street", State: "Massachusetts", ZipCode: "01720", MobilePhone: "978.234.1234", EmailAddress: "Ann@Example.com"}
+	if problems := parent.Normalize(); len(problems) != 0 {
+		t.Fatal(problems)
+	}
+	if parent.Address != "12 Maple St" || parent.State != "MA" || parent.MobilePhone != "+19782341234" || parent.EmailAddress != "ann@example.com" {
+		t.Error("Expected the contact information normalized, got ", parent)
+	}
+	if len(parent.Original) != 4 || parent.Original["state"] != "Massachusetts" || parent.Original["mobilephone"] != "978.234.1234" {
+		t.Error("Expected what was entered kept for the changed fields, got ", parent.Original)
+	}
+
+	// Normalizing again keeps the originals, and a changed field replaces its own
+	parent.MobilePhone = "617 555 0100"
+	if changed, problems := parent.normalize(); !changed || len(problems) != 0 {
+		t.Error("Expected the new phone normalized, got ", changed, problems)
+	}
+	if parent.Original["state"] != "Massachusetts" || parent.Original["mobilephone"] != "617 555 0100" {
+		t.Error("Expected the originals of the unchanged fields kept, got ", parent.Original)
+	}
+	if changed, _ := parent.normalize(); changed {
+		t.Error("Expected normalizing a normalized parent to change nothing")
+	}
+	parent.State = "NH"
+	if parent.normalize(); parent.Original["state"] != "" {
+		t.Error("Expected the original of a state entered as a code to be dropped, got ", parent.Original)
+	}
+
+	school := School{State: "Mass", ZipCode: "1720", MainPhone: "978-234-1234"}
+	problems := strings.Join(school.Normalize(), "; ")
+	if !strings.Contains(problems, `State "Mass"`) || !strings.Contains(problems, `ZIP code "1720"`) || len(school.Problems) != 2 {
+		t.Error("Expected the state and ZIP code reported as problems, got ", school.Problems)
+	}
+	if school.State != "Mass" || school.MainPhone != "+19782341234" {
+		t.Error("Expected values that can't be normalized left alone and the others normalized, got ", school)
+	}
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// Notification is a message sent to a family.
+type Notification struct {
+	Id       bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	ClientId string        `bson:"clientid" json:"clientid"`
+	To       string        `bson:"to" json:"to"`
+	Subject  string        `bson:"subject" json:"subject"`
+	Body     string        `bson:"body" json:"body"`
+	Sent     time.Time     `bson:"sent" json:"sent"`
+}
+
+// The Notifier interface delivers notifications to families, for example by email or text message.
+type Notifier interface {
+	Notify(n *Notification) (err error)
+}
+
+// LogNotifier writes notifications to standard output. It is the default Notifier.
+type LogNotifier struct{}
+
+// Notify prints the notification.
+func (LogNotifier) Notify(n *Notification) (err error) {
+	fmt.Printf("Notify %s <%s>: %s\n%s\n", n.ClientId, n.To, n.Subject, n.Body)
+	return
+}
+
+// SetNotifier replaces the Notifier used to contact families.
+func (c *MongoConnection) SetNotifier(notifier Notifier) {
+	c.notifier = notifier
+}
+
+// notify addresses the notification to the client, delivers it and records it in the notifications collection.
+func (c *MongoConnection) notify(clientId, subject, body string) (err error) {
+	n := &Notification{
+		Id:       bson.NewObjectId(),
+		ClientId: clientId,
+		Subject:  subject,
+		Body:     body,
+		Sent:     time.Now(),
+	}
+	if client, clientErr := c.GetClientById(clientId); clientErr == nil {
+		if g := client.PrimaryGuardian(); g != nil {
+			n.To = g.EmailAddress
+		}
+	}
+
+	notifier := c.notifier
+	if notifier == nil {
+		notifier = LogNotifier{}
+	}
+	if err = notifier.Notify(n); err != nil {
+		return
+	}
+
+	session, notificationCollection, err := c.getCollection(notificationCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = notificationCollection.Insert(n)
+	return
+}
+
+// ListNotifications returns the notifications sent to a client.
+func (c *MongoConnection) ListNotifications(clientId string) (notifications []Notification, err error) {
+	session, notificationCollection, err := c.getCollection(notificationCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = notificationCollection.Find(bson.M{"clientid": clientId}).Sort("sent").All(&notifications)
+	return
+}
@@ -0,0 +1,384 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Page sizes of list queries.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// ListOptions pages, sorts and filters a list of clients or schools. Cursor is the Next token of the
+// previous page, empty for the first page. Sort names a field, with a leading "-" to sort descending, and
+// the list is always ordered by id after it so pages never overlap. Zero filters don't filter; the age and
+// balance filters only apply to clients, and MaxAge and MaxOwed only apply when above zero.
+type ListOptions struct {
+	Cursor     string
+	Limit      int
+	Sort       string
+	School     string
+	City       string
+	State      string
+	ZipCode    string
+	Enrollment EnrollmentState
+	MinAge     int
+	MaxAge     int
+	MinOwed    float64
+	MaxOwed    float64
+	AsOf       time.Time
+}
+
+// ClientPage is a page of clients. Next is the cursor of the next page, empty on the last page.
+type ClientPage struct {
+	Clients []Client `json:"clients"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// SchoolPage is a page of schools. Next is the cursor of the next page, empty on the last page.
+type SchoolPage struct {
+	Schools []School `json:"schools"`
+	Next    string   `json:"next,omitempty"`
+}
+
+// clientSorts maps the fields clients can be sorted by to where they are stored. Clients sort by their
+// first guardian.
+var clientSorts = map[string]string{
+	"id":        "_id",
+	"lastname":  "guardians.0.lastname",
+	"firstname": "guardians.0.firstname",
+	"city":      "guardians.0.city",
+	"state":     "guardians.0.state",
+	"zipcode":   "guardians.0.zipcode",
+}
+
+// schoolSorts maps the fields schools can be sorted by to where they are stored.
+var schoolSorts = map[string]string{
+	"id":       "_id",
+	"name":     "name",
+	"city":     "city",
+	"state":    "state",
+	"zipcode":  "zipcode",
+	"capacity": "capacity",
+}
+
+// cursor is where a page ended: the sort it was in and the sort value and id of its last document.
+type cursor struct {
+	Sort  string        `json:"s"`
+	Value interface{}   `json:"v"`
+	Id    bson.ObjectId `json:"id"`
+}
+
+// encode turns the cursor into an opaque token.
+func (c *cursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor reads a token made by encode, checking it was made for the same sort.
+func decodeCursor(token, order string) (c *cursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		c = new(cursor)
+		err = json.Unmarshal(b, c)
+	}
+	if err != nil || !c.Id.Valid() {
+		return nil, errors.New("The page cursor is not valid")
+	}
+	if !strings.EqualFold(c.Sort, order) {
+		return nil, fmt.Errorf("The page cursor is for a list sorted by %q, not %q", c.Sort, order)
+	}
+	return
+}
+
+// parseSort returns the stored field and direction of a sort, defaulting to the id.
+func parseSort(order string, fields map[string]string) (field string, descending bool, err error) {
+	descending = strings.HasPrefix(order, "-")
+	name := strings.ToLower(strings.TrimPrefix(order, "-"))
+	if name == "" {
+		name = "id"
+	}
+	field, ok := fields[name]
+	if !ok {
+		var names []string
+		for n := range fields {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", false, fmt.Errorf("Can't sort by %q, choose one of %s", name, strings.Join(names, ", "))
+	}
+	return
+}
+
+// sortOrder returns the mgo sort of the field, always ending with the id.
+func sortOrder(field string, descending bool) []string {
+	prefix := ""
+	if descending {
+		prefix = "-"
+	}
+	if field == "_id" {
+		return []string{prefix + "_id"}
+	}
+	return []string{prefix + field, prefix + "_id"}
+}
+
+// afterCursor selects the documents that come after the cursor in the sort. Documents missing the field
+// sort before every value, so they come first ascending and last descending.
+func afterCursor(field string, descending bool, c *cursor) bson.M {
+	after := "$gt"
+	if descending {
+		after = "$lt"
+	}
+	if field == "_id" {
+		return bson.M{"_id": bson.M{after: c.Id}}
+	}
+	switch {
+	case c.Value == nil && !descending:
+		return bson.M{"$or": []bson.M{{field: nil, "_id": bson.M{"$gt": c.Id}}, {field: bson.M{"$ne": nil}}}}
+	case c.Value == nil:
+		return bson.M{field: nil, "_id": bson.M{"$lt": c.Id}}
+	case !descending:
+		return bson.M{"$or": []bson.M{{field: bson.M{"$gt": c.Value}}, {field: c.Value, "_id": bson.M{"$gt": c.Id}}}}
+	}
+	return bson.M{"$or": []bson.M{{field: bson.M{"$lt": c.Value}}, {field: c.Value, "_id": bson.M{"$lt": c.Id}}, {field: nil}}}
+}
+
+// clientSortValue returns the value the client is sorted by.
+func clientSortValue(client *Client, field string) interface{} {
+	if len(client.Guardians) == 0 {
+		return nil
+	}
+	g := client.Guardians[0]
+	switch field {
+	case "guardians.0.lastname":
+		return g.LastName
+	case "guardians.0.firstname":
+		return g.FirstName
+	case "guardians.0.city":
+		return g.City
+	case "guardians.0.state":
+		return g.State
+	case "guardians.0.zipcode":
+		return g.ZipCode
+	}
+	return nil
+}
+
+// schoolSortValue returns the value the school is sorted by.
+func schoolSortValue(school *School, field string) interface{} {
+	switch field {
+	case "name":
+		return school.Name
+	case "city":
+		return school.City
+	case "state":
+		return school.State
+	case "zipcode":
+		return school.ZipCode
+	case "capacity":
+		return school.Capacity
+	}
+	return nil
+}
+
+// pageSize returns the number of documents a page holds.
+func (o *ListOptions) pageSize() int {
+	switch {
+	case o.Limit <= 0:
+		return defaultPageSize
+	case o.Limit > maxPageSize:
+		return maxPageSize
+	}
+	return o.Limit
+}
+
+// owes reports whether what the client owes is within the balance filters.
+func (o *ListOptions) owes(client *Client, day time.Time) bool {
+	if o.MinOwed == 0 && o.MaxOwed == 0 {
+		return true
+	}
+	owed := client.BalanceOwed(day)
+	return owed >= o.MinOwed && (o.MaxOwed <= 0 || owed <= o.MaxOwed)
+}
+
+// address returns the conditions of the address filters, each matching ignoring case.
+func (o *ListOptions) address() bson.M {
+	conditions := bson.M{}
+	for field, value := range map[string]string{"city": o.City, "state": o.State, "zipcode": o.ZipCode} {
+		if value != "" {
+			conditions[field] = exactly(value)
+		}
+	}
+	return conditions
+}
+
+// ListClientsPage returns a page of the clients matching the options.
+func (c *MongoConnection) ListClientsPage(opts ListOptions) (page *ClientPage, err error) {
+	field, descending, err := parseSort(opts.Sort, clientSorts)
+	if err != nil {
+		return
+	}
+	query := bson.M{}
+	conditions := []bson.M{query}
+	if opts.Cursor != "" {
+		after, cursorErr := decodeCursor(opts.Cursor, opts.Sort)
+		if cursorErr != nil {
+			return nil, cursorErr
+		}
+		conditions = append(conditions, afterCursor(field, descending, after))
+	}
+	if opts.School != "" {
+		school, schoolErr := c.FindSchoolByName(opts.School)
+		if schoolErr != nil {
+			return nil, fmt.Errorf("School %s not found", opts.School)
+		}
+		query["schoolid"] = school.Id.Hex()
+	}
+	// The address filters have to match the same guardian
+	if address := opts.address(); len(address) > 0 {
+		query["guardians"] = bson.M{"$elemMatch": address}
+	}
+	if opts.AsOf.IsZero() {
+		opts.AsOf = time.Now()
+	}
+	if opts.MinAge > 0 || opts.MaxAge > 0 {
+		maxAge := opts.MaxAge
+		if maxAge <= 0 {
+			maxAge = 200
+		}
+		earliest, latest := bornBetween(opts.MinAge, maxAge, opts.AsOf)
+		query["children"] = bson.M{"$elemMatch": bson.M{"dob": bson.M{"$gt": earliest, "$lte": latest}}}
+	}
+	if opts.Enrollment != "" {
+		enrollments, queryErr := c.enrollmentQuery(EnrollmentFilter{State: opts.Enrollment})
+		if queryErr != nil {
+			return nil, queryErr
+		}
+		session, enrollmentCollection, sessionErr := c.getCollection(enrollmentCollectionName)
+		if sessionErr != nil {
+			return nil, sessionErr
+		}
+		var ids []string
+		err = enrollmentCollection.Find(enrollments).Distinct("clientid", &ids)
+		session.Close()
+		if err != nil {
+			return
+		}
+		oids := make([]bson.ObjectId, 0, len(ids))
+		for _, id := range ids {
+			if bson.IsObjectIdHex(id) {
+				oids = append(oids, bson.ObjectIdHex(id))
+			}
+		}
+		query["_id"] = bson.M{"$in": oids}
+	}
+
+	session, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	// Balances aren't stored, so clients are read in order until the page is full
+	size := opts.pageSize()
+	page = &ClientPage{Clients: []Client{}}
+	iter := clientCollection.Find(bson.M{"$and": conditions}).Sort(sortOrder(field, descending)...).Iter()
+	var client Client
+	for iter.Next(&client) {
+		if opts.owes(&client, opts.AsOf) {
+			if len(page.Clients) == size {
+				last := &page.Clients[size-1]
+				page.Next = (&cursor{Sort: opts.Sort, Value: clientSortValue(last, field), Id: last.Id}).encode()
+				break
+			}
+			page.Clients = append(page.Clients, client)
+		}
+		client = Client{}
+	}
+	err = iter.Close()
+	return
+}
+
+// ListSchoolsPage returns a page of the schools matching the options.
+func (c *MongoConnection) ListSchoolsPage(opts ListOptions) (page *SchoolPage, err error) {
+	field, descending, err := parseSort(opts.Sort, schoolSorts)
+	if err != nil {
+		return
+	}
+	query := bson.M{}
+	conditions := []bson.M{query}
+	if opts.Cursor != "" {
+		after, cursorErr := decodeCursor(opts.Cursor, opts.Sort)
+		if cursorErr != nil {
+			return nil, cursorErr
+		}
+		conditions = append(conditions, afterCursor(field, descending, after))
+	}
+	if opts.School != "" {
+		query["name"] = exactly(opts.School)
+	}
+	for field, condition := range opts.address() {
+		query[field] = condition
+	}
+
+	session, _, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	// One more school than the page holds shows whether there is a next page
+	size := opts.pageSize()
+	page = &SchoolPage{Schools: []School{}}
+	if err = schoolCollection.Find(bson.M{"$and": conditions}).Sort(sortOrder(field, descending)...).Limit(size + 1).All(&page.Schools); err != nil {
+		return
+	}
+	if len(page.Schools) > size {
+		page.Schools = page.Schools[:size]
+		last := &page.Schools[size-1]
+		page.Next = (&cursor{Sort: opts.Sort, Value: schoolSortValue(last, field), Id: last.Id}).encode()
+	}
+	return
+}
+
+// ListAllClients returns every client matching the options, reading them a page at a time from the cursor.
+func (c *MongoConnection) ListAllClients(opts ListOptions) (clients []Client, err error) {
+	clients = []Client{}
+	opts.Limit = maxPageSize
+	for {
+		page, pageErr := c.ListClientsPage(opts)
+		if pageErr != nil {
+			return nil, pageErr
+		}
+		clients = append(clients, page.Clients...)
+		if page.Next == "" {
+			return
+		}
+		opts.Cursor = page.Next
+	}
+}
+
+// ListAllSchools returns every school matching the options, reading them a page at a time from the cursor.
+func (c *MongoConnection) ListAllSchools(opts ListOptions) (schools []School, err error) {
+	schools = []School{}
+	opts.Limit = maxPageSize
+	for {
+		page, pageErr := c.ListSchoolsPage(opts)
+		if pageErr != nil {
+			return nil, pageErr
+		}
+		schools = append(schools, page.Schools...)
+		if page.Next == "" {
+			return
+		}
+		opts.Cursor = page.Next
+	}
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestPageCursor(t *testing.T) {
+	id := bson.NewObjectId()
+	token := (&cursor{Sort: "-lastname", Value: "Smith", Id: id}).encode()
+	c, err := decodeCursor(token, "-LastName")
+	if err != nil || c.Value != "Smith" || c.Id != id {
+		t.Error("Expected the cursor to come back as it was encoded, got ", c, err)
+	}
+	if _, err = decodeCursor(token, "lastname"); err == nil {
+		t.Error("Expected a cursor of another sort to be refused")
+	}
+	if _, err = decodeCursor("not a cursor", ""); err == nil {
+		t.Error("Expected a malformed cursor to be refused")
+	}
+
+	if field, descending, err := parseSort("-City", clientSorts); err != nil || field != "guardians.0.city" || !descending {
+		t.Error("Expected a descending sort by the city of the first guardian, got ", field, descending, err)
+	}
+	if field, _, _ := parseSort("", schoolSorts); field != "_id" {
+		t.Error("Expected the id to be the default sort, got ", field)
+	}
+	if _, _, err := parseSort("shoesize", schoolSorts); err == nil {
+		t.Error("Expected an unknown sort to be refused")
+	}
+	if order := sortOrder("name", true); len(order) != 2 || order[0] != "-name" || order[1] != "-_id" {
+		t.Error("Expected the id to break ties in the same direction, got ", order)
+	}
+
+	after := afterCursor("name", false, &cursor{Value: "Maple", Id: id})
+	or, ok := after["$or"].([]bson.M)
+	if !ok || len(or) != 2 || or[1]["name"] != "Maple" || or[1]["_id"].(bson.M)["$gt"] != id {
+		t.Error("Expected later names or the same name with a later id, got ", after)
+	}
+	if after = afterCursor("_id", true, &cursor{Id: id}); after["_id"].(bson.M)["$lt"] != id {
+		t.Error("Expected earlier ids when sorting by descending id, got ", after)
+	}
+	if (&ListOptions{}).pageSize() != defaultPageSize || (&ListOptions{Limit: 5000}).pageSize() != maxPageSize {
+		t.Error("Expected the page size defaulted and capped")
+	}
+}
+
+func TestBalanceOwed(t *testing.T) {
+	start := time.Date(2017, time.January, 2, 0, 0, 0, 0, time.Local)
+	client := family("Ann", "Smith", "", "")
+	client.PaymentMethod = PaymentMethod{Frequency: Weekly, UnitCost: 25, StartDate: start}
+	client.Payments = []*Payment{{Date: start, Amount: 50}}
+
+	if billed := client.Billed(start.AddDate(0, 0, 20)); billed != 75 {
+		t.Error("Expected three weeks billed, got ", billed)
+	}
+	if owed := client.BalanceOwed(start.AddDate(0, 0, 20)); owed != 25 {
+		t.Error("Expected a week owed, got ", owed)
+	}
+	if owed := client.BalanceOwed(start.AddDate(0, 0, -1)); owed != -50 {
+		t.Error("Expected a family that paid ahead to owe less than nothing, got ", owed)
+	}
+	client.PaymentMethod.EndDate = start.AddDate(0, 0, 10)
+	if billed := client.Billed(start.AddDate(1, 0, 0)); billed != 50 {
+		t.Error("Expected billing to stop on the end date, got ", billed)
+	}
+	client.PaymentMethod = PaymentMethod{Frequency: Monthly, UnitCost: 100, StartDate: start}
+	if billed := client.Billed(time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local)); billed != 200 {
+		t.Error("Expected two months billed, got ", billed)
+	}
+
+	opts := ListOptions{MinOwed: 200}
+	if opts.owes(&client, time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local)) {
+		t.Error("Expected 150 owed to be too little for the filter")
+	}
+	if opts.MaxOwed = 300; !opts.owes(&client, time.Date(2017, time.April, 1, 0, 0, 0, 0, time.Local)) {
+		t.Error("Expected 250 owed to be within the filter")
+	}
+}
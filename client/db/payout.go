@@ -0,0 +1,291 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// PayoutStatus is where a revenue share payout to a school is in its life.
+type PayoutStatus string
+
+const (
+	PayoutPending   PayoutStatus = "pending"
+	PayoutApproved  PayoutStatus = "approved"
+	PayoutPaid      PayoutStatus = "paid"
+	PayoutCancelled PayoutStatus = "cancelled"
+)
+
+// payoutTransitions lists the statuses a payout can move to from each status.
+var payoutTransitions = map[PayoutStatus][]PayoutStatus{
+	PayoutPending:  {PayoutApproved, PayoutCancelled},
+	PayoutApproved: {PayoutPaid, PayoutCancelled},
+}
+
+// PayoutLine is what families of a school paid towards one season and the share of it owed to the school.
+type PayoutLine struct {
+	Season    string  `bson:"season" json:"season"`
+	Families  int     `bson:"families" json:"families"`
+	Payments  int     `bson:"payments" json:"payments"`
+	Collected float64 `bson:"collected" json:"collected"`
+	Share     float64 `bson:"share" json:"share"`
+}
+
+// Payout is the revenue share owed to a host school for what its families paid over a period.
+type Payout struct {
+	Id        bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	Period    string        `bson:"period,omitempty" json:"-"`
+	SchoolId  string        `bson:"schoolid" json:"schoolid"`
+	School    string        `bson:"school" json:"school"`
+	From      time.Time     `bson:"from" json:"from"`
+	To        time.Time     `bson:"to" json:"to"`
+	Percent   float64       `bson:"percent" json:"percent"`
+	Lines     []PayoutLine  `bson:"lines" json:"lines"`
+	Collected float64       `bson:"collected" json:"collected"`
+	Amount    float64       `bson:"amount" json:"amount"`
+	Status    PayoutStatus  `bson:"status" json:"status"`
+	Created   time.Time     `bson:"created" json:"created"`
+	Updated   time.Time     `bson:"updated" json:"updated"`
+	Reference string        `bson:"reference" json:"reference"`
+}
+
+// betweenSeasons labels payments that don't fall in any season of the school.
+const betweenSeasons = "Between seasons"
+
+// seasonOn returns the name of the season of the school that the day falls in.
+func (s *School) seasonOn(day time.Time) string {
+	for _, season := range s.Seasons {
+		if !day.Before(season.Start) && !day.After(season.End) {
+			return season.Name
+		}
+	}
+	return betweenSeasons
+}
+
+// SharePayments works out the share owed to the school of the payments its families made between from and to,
+// broken down by the season each payment was made in.
+func SharePayments(school *School, clients []Client, percent float64, from, to time.Time) *Payout {
+	payout := &Payout{
+		SchoolId: school.Id.Hex(),
+		School:   school.Name,
+		From:     from,
+		To:       to,
+		Percent:  percent,
+		Status:   PayoutPending,
+	}
+	lines := make(map[string]*PayoutLine)
+	var order []string
+	for _, client := range clients {
+		if client.School != school.Id.Hex() {
+			continue
+		}
+		counted := make(map[string]bool)
+		for _, payment := range client.Payments {
+			if payment == nil || payment.Date.Before(from) || payment.Date.After(to) {
+				continue
+			}
+			season := school.seasonOn(payment.Date)
+			line, ok := lines[season]
+			if !ok {
+				line = &PayoutLine{Season: season}
+				lines[season] = line
+				order = append(order, season)
+			}
+			if !counted[season] {
+				counted[season] = true
+				line.Families++
+			}
+			line.Payments++
+			line.Collected = roundCents(line.Collected + payment.Amount)
+		}
+	}
+	for _, season := range order {
+		line := lines[season]
+		line.Share = roundCents(line.Collected * percent / 100)
+		payout.Lines = append(payout.Lines, *line)
+		payout.Collected = roundCents(payout.Collected + line.Collected)
+		payout.Amount = roundCents(payout.Amount + line.Share)
+	}
+	return payout
+}
+
+// revenueShare works out the payout of a school on a revenue share contract without recording it.
+func (c *MongoConnection) revenueShare(schoolName string, from, to time.Time) (payout *Payout, err error) {
+	if !to.After(from) {
+		return nil, errors.New("The payout period must end after it starts")
+	}
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	if school.Contract == nil || school.Contract.Type != RevenueShare {
+		return nil, fmt.Errorf("%s is not on a revenue share contract", schoolName)
+	}
+	clients, err := c.FindClinentBySchool(schoolName)
+	if err != nil {
+		return
+	}
+	return SharePayments(school, clients, school.Contract.RevenueSharePercent, from, to), nil
+}
+
+// PreviewPayout shows the revenue share a school would be paid for the period without recording a payout.
+func (c *MongoConnection) PreviewPayout(schoolName string, from, to time.Time) (payout *Payout, err error) {
+	return c.revenueShare(schoolName, from, to)
+}
+
+// CreatePayout records the revenue share owed to a school for the period as a pending payout. A period that
+// overlaps one already paid out, and not cancelled, is refused.
+func (c *MongoConnection) CreatePayout(schoolName string, from, to time.Time) (payout *Payout, err error) {
+	payout, err = c.revenueShare(schoolName, from, to)
+	if err != nil {
+		return
+	}
+	session, payoutCollection, err := c.getCollection(payoutCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var existing Payout
+	overlap := bson.M{"schoolid": payout.SchoolId, "status": bson.M{"$ne": PayoutCancelled}, "from": bson.M{"$lt": to}, "to": bson.M{"$gt": from}}
+	if err = payoutCollection.Find(overlap).One(&existing); err == nil {
+		return nil, fmt.Errorf("%s already has a payout from %s to %s", schoolName,
+			existing.From.Format("January 2, 2006"), existing.To.Format("January 2, 2006"))
+	} else if err != mgo.ErrNotFound {
+		return nil, err
+	}
+
+	payout.Id = bson.NewObjectId()
+	payout.Period = fmt.Sprintf("%s/%s/%s", payout.SchoolId, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	payout.Created = time.Now()
+	payout.Updated = payout.Created
+	if err = payoutCollection.Insert(payout); err != nil {
+		if mgo.IsDup(err) {
+			err = fmt.Errorf("%s already has a payout for this period", schoolName)
+		}
+		return nil, err
+	}
+	return
+}
+
+// GetPayout returns the payout with the given id.
+func (c *MongoConnection) GetPayout(id string) (payout *Payout, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, fmt.Errorf("Invalid payout id %q", id)
+	}
+	session, payoutCollection, err := c.getCollection(payoutCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = payoutCollection.FindId(bson.ObjectIdHex(id)).One(&payout)
+	return
+}
+
+// ListPayouts returns the payouts of a school, or of every school when the name is empty, optionally only
+// those with the given status, oldest first.
+func (c *MongoConnection) ListPayouts(schoolName string, status PayoutStatus) (payouts []Payout, err error) {
+	query := bson.M{}
+	if schoolName != "" {
+		school, schoolErr := c.FindSchoolByName(schoolName)
+		if schoolErr != nil {
+			return nil, schoolErr
+		}
+		query["schoolid"] = school.Id.Hex()
+	}
+	if status != "" {
+		query["status"] = status
+	}
+	session, payoutCollection, err := c.getCollection(payoutCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = payoutCollection.Find(query).Sort("from", "school").All(&payouts)
+	return
+}
+
+// SetPayoutStatus moves a payout on to approved, paid or cancelled. The reference, such as a check number,
+// is recorded with the payout. Cancelling a payout releases its period so it can be paid out again.
+func (c *MongoConnection) SetPayoutStatus(id string, status PayoutStatus, reference string) (payout *Payout, err error) {
+	payout, err = c.GetPayout(id)
+	if err != nil {
+		return
+	}
+	allowed := false
+	for _, next := range payoutTransitions[payout.Status] {
+		allowed = allowed || next == status
+	}
+	if !allowed {
+		return nil, fmt.Errorf("A %s payout can't be marked %s", payout.Status, status)
+	}
+
+	session, payoutCollection, err := c.getCollection(payoutCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	update := bson.M{"$set": bson.M{"status": status, "updated": time.Now(), "reference": reference}}
+	if status == PayoutCancelled {
+		update["$unset"] = bson.M{"period": ""}
+	}
+	// Only move the payout on if nobody else has in the meantime
+	change := mgo.Change{Update: update, ReturnNew: true}
+	if _, err = payoutCollection.Find(bson.M{"_id": payout.Id, "status": payout.Status}).Apply(change, payout); err != nil {
+		if err == mgo.ErrNotFound {
+			err = fmt.Errorf("The payout was changed by someone else, please try again")
+		}
+		return nil, err
+	}
+	if status == PayoutPaid {
+		err = c.post(payoutEntry(payout))
+	}
+	return
+}
+
+// payoutPDF lays out the statement sent to a school with its payout.
+func payoutPDF(payout *Payout) []byte {
+	lines := []pdfLine{
+		{Text: "Revenue Share Statement", Size: 28, Bold: true, X: 60, Y: 540},
+		{Text: payout.School, Size: 18, X: 60, Y: 505},
+		{Text: fmt.Sprintf("%s to %s", payout.From.Format("January 2, 2006"), payout.To.Format("January 2, 2006")), Size: 14, X: 60, Y: 482},
+		{Text: fmt.Sprintf("Status: %s %s", payout.Status, payout.Reference), Size: 12, X: 560, Y: 505},
+		{Text: "Season", Size: 12, Bold: true, X: 60, Y: 440},
+		{Text: "Families", Size: 12, Bold: true, X: 300, Y: 440},
+		{Text: "Payments", Size: 12, Bold: true, X: 390, Y: 440},
+		{Text: "Collected", Size: 12, Bold: true, X: 490, Y: 440},
+		{Text: fmt.Sprintf("Share at %g%%", payout.Percent), Size: 12, Bold: true, X: 610, Y: 440},
+	}
+	y := 418.0
+	for _, line := range payout.Lines {
+		lines = append(lines,
+			pdfLine{Text: line.Season, Size: 12, X: 60, Y: y},
+			pdfLine{Text: fmt.Sprintf("%d", line.Families), Size: 12, X: 300, Y: y},
+			pdfLine{Text: fmt.Sprintf("%d", line.Payments), Size: 12, X: 390, Y: y},
+			pdfLine{Text: fmt.Sprintf("$%.2f", line.Collected), Size: 12, X: 490, Y: y},
+			pdfLine{Text: fmt.Sprintf("$%.2f", line.Share), Size: 12, X: 610, Y: y},
+		)
+		y -= 18
+	}
+	lines = append(lines,
+		pdfLine{Text: "Total", Size: 12, Bold: true, X: 60, Y: y - 10},
+		pdfLine{Text: fmt.Sprintf("$%.2f", payout.Collected), Size: 12, Bold: true, X: 490, Y: y - 10},
+		pdfLine{Text: fmt.Sprintf("$%.2f", payout.Amount), Size: 12, Bold: true, X: 610, Y: y - 10},
+		pdfLine{Text: "TumbleBus", Size: 12, X: 60, Y: 60},
+	)
+	return renderPDF(payout.School+" revenue share", lines, false)
+}
+
+// PayoutStatement returns the statement of the payout as a PDF.
+func (c *MongoConnection) PayoutStatement(id string) (pdf []byte, err error) {
+	payout, err := c.GetPayout(id)
+	if err != nil {
+		return
+	}
+	return payoutPDF(payout), nil
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestRevenueShare(t *testing.T) {
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2017, month, d, 0, 0, 0, 0, time.Local)
+	}
+	school := &School{Id: bson.NewObjectId(), Name: "Acton", Seasons: []*Season{
+		&Season{Name: "Winter", Start: day(time.January, 1), End: day(time.March, 15)},
+		&Season{Name: "Spring", Start: day(time.April, 1), End: day(time.June, 15)},
+	}}
+	clients := []Client{
+		Client{School: school.Id.Hex(), Payments: []*Payment{
+			&Payment{Date: day(time.January, 5), Amount: 100},
+			&Payment{Date: day(time.February, 5), Amount: 100},
+			&Payment{Date: day(time.April, 5), Amount: 120},
+		}},
+		Client{School: school.Id.Hex(), Payments: []*Payment{
+			&Payment{Date: day(time.March, 20), Amount: 50},
+			&Payment{Date: day(time.July, 1), Amount: 500},
+		}},
+		Client{School: bson.NewObjectId().Hex(), Payments: []*Payment{
+			&Payment{Date: day(time.January, 5), Amount: 1000},
+		}},
+	}
+
+	payout := SharePayments(school, clients, 15, day(time.January, 1), day(time.June, 30))
+	if payout.Collected != 370 || payout.Amount != 55.5 {
+		t.Error("Expected a 15% share of 370 collected, got ", payout.Collected, payout.Amount)
+	}
+	if len(payout.Lines) != 3 {
+		t.Fatal("Expected lines for winter, spring and between seasons, got ", payout.Lines)
+	}
+	winter := payout.Lines[0]
+	if winter.Season != "Winter" || winter.Families != 1 || winter.Payments != 2 || winter.Share != 30 {
+		t.Error("Expected one family paying twice in winter, got ", winter)
+	}
+	if payout.Lines[2].Season != betweenSeasons || payout.Lines[2].Collected != 50 {
+		t.Error("Expected the March payment between seasons, got ", payout.Lines[2])
+	}
+
+	pdf := payoutPDF(payout)
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) || !bytes.Contains(pdf, []byte("$55.50")) {
+		t.Error("Expected a PDF statement showing the share")
+	}
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"time"
+)
+
+// PayRate is what an instructor is paid for each session taught and each mile driven between schools.
+type PayRate struct {
+	PerSession float64 `bson:"persession" json:"persession"`
+	PerMile    float64 `bson:"permile" json:"permile"`
+}
+
+// PayrollDay is the pay an instructor earned on one day. When the route of the day can't be worked out the
+// miles are unknown, the problem says why and only the sessions are paid.
+type PayrollDay struct {
+	Date         time.Time `json:"date"`
+	Sessions     int       `json:"sessions"`
+	SessionPay   float64   `json:"sessionpay"`
+	Miles        float64   `json:"miles"`
+	MilesUnknown bool      `json:"milesunknown,omitempty"`
+	MileagePay   float64   `json:"mileagepay"`
+	Total        float64   `json:"total"`
+	Problem      string    `json:"problem,omitempty"`
+}
+
+// Earnings is the pay an instructor earned over a pay period. Problems lists what kept mileage, or the
+// earnings as a whole, from being worked out.
+type Earnings struct {
+	InstructorId   string       `json:"instructorid"`
+	InstructorName string       `json:"instructorname"`
+	From           time.Time    `json:"from"`
+	To             time.Time    `json:"to"`
+	Rate           PayRate      `json:"rate"`
+	Sessions       int          `json:"sessions"`
+	SessionPay     float64      `json:"sessionpay"`
+	Miles          float64      `json:"miles"`
+	MileagePay     float64      `json:"mileagepay"`
+	Total          float64      `json:"total"`
+	MilesUnknown   bool         `json:"milesunknown,omitempty"`
+	Days           []PayrollDay `json:"days"`
+	Problems       []string     `json:"problems,omitempty"`
+}
+
+// roundCents rounds an amount of money to whole cents.
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// add adds the pay of a day to the earnings.
+func (e *Earnings) add(day PayrollDay) {
+	e.Days = append(e.Days, day)
+	e.Sessions += day.Sessions
+	e.Miles = math.Round((e.Miles+day.Miles)*10) / 10
+	e.SessionPay = roundCents(e.SessionPay + day.SessionPay)
+	e.MileagePay = roundCents(e.MileagePay + day.MileagePay)
+	e.Total = roundCents(e.Total + day.Total)
+	if day.MilesUnknown {
+		e.MilesUnknown = true
+		e.Problems = append(e.Problems, day.Problem)
+	}
+}
+
+// SetPayRate sets the pay rate of an instructor.
+func (c *MongoConnection) SetPayRate(instructorId string, rate *PayRate) (err error) {
+	if rate.PerSession < 0 || rate.PerMile < 0 {
+		return errors.New("Pay rates can't be negative")
+	}
+	instructor, err := c.GetInstructor(instructorId)
+	if err != nil {
+		return
+	}
+
+	session, instructorCollection, err := c.getCollection(instructorCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = instructorCollection.UpdateId(instructor.Id, bson.M{"$set": bson.M{"payrate": rate}})
+	return
+}
+
+// InstructorEarnings works out the pay of an instructor for the sessions delivered between from and to.
+// Cancelled sessions and sessions that have not happened yet are not paid. Mileage is the length of the route
+// the instructor drove each day, starting and ending at their home when it can be placed. Schools and homes
+// are placed with the Geocoder of the connection unless the options give one.
+func (c *MongoConnection) InstructorEarnings(instructorId string, from, to time.Time, opts RouteOptions) (earnings *Earnings, err error) {
+	instructor, err := c.GetInstructor(instructorId)
+	if err != nil {
+		return
+	}
+	if !to.After(from) {
+		return nil, errors.New("The pay period must end after it starts")
+	}
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+	sessions, err := c.InstructorSessions(instructorId, from, to)
+	if err != nil {
+		return
+	}
+
+	earnings = &Earnings{
+		InstructorId:   instructorId,
+		InstructorName: instructor.FirstName + " " + instructor.LastName,
+		From:           from,
+		To:             to,
+		Rate:           instructor.PayRate,
+	}
+	opts = c.routeOptions(opts)
+	if opts.Depot == nil {
+		home, homeErr := opts.Geocoder.Geocode(instructor.Address, instructor.City, instructor.State, instructor.ZipCode)
+		if homeErr == nil && home != nil {
+			opts.Depot = home
+		}
+	}
+
+	schools := make(map[string]*School)
+	var delivered []Session
+	for _, session := range sessions {
+		if session.Cancelled || session.End.After(to) {
+			continue
+		}
+		if _, ok := schools[session.SchoolId]; !ok {
+			school, schoolErr := c.FindSchoolByName(session.School)
+			if schoolErr != nil {
+				return nil, schoolErr
+			}
+			schools[session.SchoolId] = school
+		}
+		delivered = append(delivered, session)
+	}
+
+	// Sessions are in chronological order so each day is a run of sessions
+	for start := 0; start < len(delivered); {
+		end := start + 1
+		for end < len(delivered) && sameDay(delivered[end].Start, delivered[start].Start) {
+			end++
+		}
+		earnings.add(payDay(delivered[start:end], schools, instructor.PayRate, opts))
+		start = end
+	}
+	return
+}
+
+// payDay works out the pay for the sessions an instructor taught on a single day. The sessions are paid even
+// when the mileage can't be worked out.
+func payDay(sessions []Session, schools map[string]*School, rate PayRate, opts RouteOptions) (day PayrollDay) {
+	first := sessions[0].Start
+	day.Date = time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, first.Location())
+	day.Sessions = len(sessions)
+	day.SessionPay = roundCents(float64(day.Sessions) * rate.PerSession)
+
+	itinerary, err := PlanRoute(sessions, schools, opts)
+	if err != nil {
+		day.MilesUnknown = true
+		day.Problem = fmt.Sprintf("Could not work out the mileage for %s: %s", day.Date.Format("January 2, 2006"), err.Error())
+		day.Total = day.SessionPay
+		return
+	}
+	day.Miles = itinerary.TotalMiles
+	day.MileagePay = roundCents(day.Miles * rate.PerMile)
+	day.Total = roundCents(day.SessionPay + day.MileagePay)
+	return
+}
+
+// Payroll works out the earnings of every active instructor over the pay period. An instructor whose earnings
+// can't be worked out is listed with the problem rather than holding up everyone else's pay.
+func (c *MongoConnection) Payroll(from, to time.Time, opts RouteOptions) (payroll []Earnings, err error) {
+	instructors, err := c.ListInstructors()
+	if err != nil {
+		return
+	}
+	for _, instructor := range instructors {
+		if !instructor.Active {
+			continue
+		}
+		earnings, earningsErr := c.InstructorEarnings(instructor.Id.Hex(), from, to, opts)
+		if earningsErr != nil {
+			earnings = &Earnings{
+				InstructorId:   instructor.Id.Hex(),
+				InstructorName: instructor.FirstName + " " + instructor.LastName,
+				From:           from,
+				To:             to,
+				Rate:           instructor.PayRate,
+				Problems:       []string{earningsErr.Error()},
+			}
+		}
+		payroll = append(payroll, *earnings)
+	}
+	return
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestPayDay(t *testing.T) {
+	acton := &School{Id: bson.NewObjectId(), Name: "Acton", ZipCode: "01720"}
+	concord := &School{Id: bson.NewObjectId(), Name: "Concord", ZipCode: "01742"}
+	schools := map[string]*School{acton.Id.Hex(): acton, concord.Id.Hex(): concord}
+
+	day := time.Date(2017, time.March, 7, 0, 0, 0, 0, time.Local)
+	sessions := []Session{
+		Session{SchoolId: acton.Id.Hex(), School: "Acton", Class: "Tumble",
+			Start: day.Add(9 * time.Hour), End: day.Add(9*time.Hour + 45*time.Minute)},
+		Session{SchoolId: concord.Id.Hex(), School: "Concord", Class: "Ninja",
+			Start: day.Add(11 * time.Hour), End: day.Add(11*time.Hour + 45*time.Minute)},
+	}
+	rate := PayRate{PerSession: 35, PerMile: 0.5}
+
+	paid := payDay(sessions, schools, rate, RouteOptions{})
+	if paid.Sessions != 2 || paid.SessionPay != 70 || paid.MilesUnknown {
+		t.Error("Expected two sessions paid at 35, got ", paid)
+	}
+	if paid.Miles <= 0 {
+		t.Error("Expected miles driven between the schools, got ", paid.Miles)
+	}
+	if paid.MileagePay != roundCents(paid.Miles*0.5) || paid.Total != roundCents(paid.SessionPay+paid.MileagePay) {
+		t.Error("Mileage pay should be the miles at the mileage rate: ", paid)
+	}
+
+	earnings := Earnings{}
+	earnings.add(paid)
+	earnings.add(paid)
+	if earnings.Sessions != 4 || earnings.Total != roundCents(2*paid.Total) || len(earnings.Days) != 2 {
+		t.Error("Expected the earnings of both days to be added up: ", earnings)
+	}
+
+	unrouted := payDay(sessions, map[string]*School{acton.Id.Hex(): acton}, rate, RouteOptions{})
+	if !unrouted.MilesUnknown || unrouted.Problem == "" || unrouted.Total != 70 {
+		t.Error("Expected the sessions paid with the miles unknown when the route can't be planned, got ", unrouted)
+	}
+	earnings.add(unrouted)
+	if !earnings.MilesUnknown || len(earnings.Problems) != 1 || earnings.Total != roundCents(2*paid.Total+70) {
+		t.Error("Expected the earnings to report the unknown mileage, got ", earnings)
+	}
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// pdfLine is a line of text placed on a PDF page. X and Y are in points from the bottom left corner and
+// Center places the line around X instead of starting at it.
+type pdfLine struct {
+	Text   string
+	Size   int
+	Bold   bool
+	X, Y   float64
+	Center bool
+}
+
+// pdfEscape escapes the characters that are special inside a PDF string and drops anything outside of the
+// standard fonts.
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// pdfTextWidth estimates the width of the text in the Helvetica fonts, which is enough to center a line.
+func pdfTextWidth(text string, size int) float64 {
+	return float64(len(text)*size) * 0.52
+}
+
+// renderPDF writes a single landscape letter page holding the lines of text and an optional border. It only
+// uses the fonts every PDF reader has built in, so no font files or external tools are needed.
+func renderPDF(title string, lines []pdfLine, border bool) []byte {
+	const width, height = 792.0, 612.0
+
+	var content bytes.Buffer
+	if border {
+		fmt.Fprintf(&content, "4 w 36 36 %.0f %.0f re S\n1 w 46 46 %.0f %.0f re S\n", width-72, height-72, width-92, height-92)
+	}
+	for _, line := range lines {
+		font := "F1"
+		if line.Bold {
+			font = "F2"
+		}
+		x := line.X
+		if line.Center {
+			x -= pdfTextWidth(line.Text, line.Size) / 2
+		}
+		fmt.Fprintf(&content, "BT /%s %d Tf %.1f %.1f Td (%s) Tj ET\n", font, line.Size, x, line.Y, pdfEscape(line.Text))
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 4 0 R /F2 5 0 R >> >> /Contents 6 0 R >>", width, height),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		fmt.Sprintf("<< /Title (%s) /Producer (TumbleBus) >>", pdfEscape(title)),
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, len(objects), xref)
+	return out.Bytes()
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Program is an age banded offering of a school, for example toddler tumble for two and three year olds.
+// Children must be between MinAge and MaxAge years old on the cutoff date of the season to join one of
+// its classes. Without a cutoff month ages are measured on the first day of the season.
+type Program struct {
+	Name        string     `bson:"name" json:"name"`
+	Description string     `bson:"description" json:"description"`
+	MinAge      int        `bson:"minage" json:"minage"`
+	MaxAge      int        `bson:"maxage" json:"maxage"`
+	CutoffMonth time.Month `bson:"cutoffmonth" json:"cutoffmonth"`
+	CutoffDay   int        `bson:"cutoffday" json:"cutoffday"`
+}
+
+// AgeOut is a child who will be too old for the program of their class once the next season starts.
+type AgeOut struct {
+	EnrollmentId     string    `json:"enrollmentid"`
+	ClientId         string    `json:"clientid"`
+	ChildId          string    `json:"childid"`
+	ChildName        string    `json:"childname"`
+	DOB              time.Time `json:"dob"`
+	Class            string    `json:"class"`
+	Program          string    `json:"program"`
+	NextSeason       string    `json:"nextseason"`
+	Cutoff           time.Time `json:"cutoff"`
+	AgeAtCutoff      int       `json:"ageatcutoff"`
+	SuggestedProgram string    `json:"suggestedprogram"`
+}
+
+// Validate checks that the program has a name and a sensible age band and cutoff date.
+func (p *Program) Validate() (err error) {
+	if p.Name == "" {
+		return errors.New("Program requires a name")
+	}
+	if p.MinAge < 0 || p.MaxAge < p.MinAge {
+		return fmt.Errorf("Invalid age range %d to %d for program %s", p.MinAge, p.MaxAge, p.Name)
+	}
+	if p.CutoffMonth != 0 {
+		if p.CutoffMonth < time.January || p.CutoffMonth > time.December {
+			return fmt.Errorf("Invalid cutoff month %d for program %s", p.CutoffMonth, p.Name)
+		}
+		if p.CutoffDay < 1 || p.CutoffDay > 31 {
+			return fmt.Errorf("Invalid cutoff day %d for program %s", p.CutoffDay, p.Name)
+		}
+	}
+	return
+}
+
+// Cutoff returns the day ages are measured on for the season: the cutoff month and day in the year the
+// season starts, or the start of the season.
+func (p *Program) Cutoff(season *Season) time.Time {
+	start := AgeReference(season)
+	if p.CutoffMonth == 0 {
+		return start
+	}
+	return time.Date(start.Year(), p.CutoffMonth, p.CutoffDay, 0, 0, 0, 0, start.Location())
+}
+
+// Eligible returns an error unless the child is old enough and young enough for the program in the season.
+func (p *Program) Eligible(child *Child, season *Season) (err error) {
+	cutoff := p.Cutoff(season)
+	if age := child.AgeOn(cutoff); age < p.MinAge || age > p.MaxAge {
+		return fmt.Errorf("%s %s is %d on %s, %s is for ages %d to %d", child.FirstName, child.LastName, age,
+			cutoff.Format("January 2, 2006"), p.Name, p.MinAge, p.MaxAge)
+	}
+	return
+}
+
+// FindProgram returns the program of the school with the given name, ignoring case.
+func (s *School) FindProgram(name string) *Program {
+	for _, program := range s.Programs {
+		if strings.EqualFold(program.Name, name) {
+			return program
+		}
+	}
+	return nil
+}
+
+// ClassProgram returns the program the class belongs to in the season, if any.
+func (s *School) ClassProgram(seasonName, class string) *Program {
+	season := s.FindSeason(seasonName)
+	if season == nil {
+		return nil
+	}
+	if schedule := season.FindSchedule(class); schedule != nil && schedule.Program != "" {
+		return s.FindProgram(schedule.Program)
+	}
+	return nil
+}
+
+// checkProgram makes sure the program of a schedule is offered by the school.
+func (s *School) checkProgram(schedule *Schedule) (err error) {
+	if schedule.Program != "" && s.FindProgram(schedule.Program) == nil {
+		return fmt.Errorf("Program %s of class %s is not offered by %s", schedule.Program, schedule.Class, s.Name)
+	}
+	return
+}
+
+// NextSeason returns the first season of the school starting after the given season. When none is planned
+// yet the season is assumed to run again a year later.
+func (s *School) NextSeason(current *Season) *Season {
+	var next *Season
+	for _, season := range s.Seasons {
+		if season.Start.After(current.Start) && (next == nil || season.Start.Before(next.Start)) {
+			next = season
+		}
+	}
+	if next == nil {
+		next = &Season{Name: current.Name, Start: current.Start.AddDate(1, 0, 0), End: current.End.AddDate(1, 0, 0)}
+	}
+	return next
+}
+
+// EligiblePrograms returns the programs of the school the child may join in the season.
+func (s *School) EligiblePrograms(child *Child, season *Season) (programs []*Program) {
+	for _, program := range s.Programs {
+		if program.Eligible(child, season) == nil {
+			programs = append(programs, program)
+		}
+	}
+	return
+}
+
+// setPrograms stores the programs of the school.
+func (c *MongoConnection) setPrograms(school *School) (err error) {
+	session, _, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = schoolCollection.UpdateId(school.Id, bson.M{"$set": bson.M{"programs": school.Programs}})
+	return
+}
+
+// SetProgram adds a program to the school, replacing the program with the same name.
+func (c *MongoConnection) SetProgram(schoolName string, program *Program) (err error) {
+	if err = program.Validate(); err != nil {
+		return
+	}
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+
+	if existing := school.FindProgram(program.Name); existing != nil {
+		*existing = *program
+	} else {
+		school.Programs = append(school.Programs, program)
+	}
+	sort.SliceStable(school.Programs, func(i, j int) bool {
+		return school.Programs[i].MinAge < school.Programs[j].MinAge
+	})
+	return c.setPrograms(school)
+}
+
+// RemoveProgram removes a program from the school. Programs still used by a class can't be removed.
+func (c *MongoConnection) RemoveProgram(schoolName, programName string) (err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	for _, season := range school.Seasons {
+		for _, schedule := range season.Schedules {
+			if strings.EqualFold(schedule.Program, programName) {
+				return fmt.Errorf("Program %s is used by class %s in %s", programName, schedule.Class, season.Name)
+			}
+		}
+	}
+	for i, program := range school.Programs {
+		if strings.EqualFold(program.Name, programName) {
+			school.Programs = append(school.Programs[:i], school.Programs[i+1:]...)
+			return c.setPrograms(school)
+		}
+	}
+	return fmt.Errorf("Program %s not found for %s", programName, schoolName)
+}
+
+// ListAgeOuts returns the children enrolled in a season of the school who will be too old for the program
+// of their class at the cutoff date of the next season, together with a program they could move up to.
+// An empty season uses the current season of the school.
+func (c *MongoConnection) ListAgeOuts(schoolName, seasonName string) (ageOuts []AgeOut, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	season := school.FindSeason(seasonName)
+	if seasonName == "" {
+		season = school.CurrentSeason(time.Now())
+	}
+	if season == nil {
+		return nil, fmt.Errorf("Season %s not found for %s", seasonName, schoolName)
+	}
+	next := school.NextSeason(season)
+
+	enrollments, err := c.ListEnrollments(EnrollmentFilter{School: schoolName, Season: season.Name})
+	if err != nil {
+		return
+	}
+	clients := make(map[string]*Client)
+	for _, e := range enrollments {
+		if !e.State.holdsSeat() {
+			continue
+		}
+		program := school.ClassProgram(season.Name, e.Class)
+		if program == nil {
+			continue
+		}
+		client, ok := clients[e.ClientId]
+		if !ok {
+			if client, err = c.GetClientById(e.ClientId); err != nil {
+				return nil, err
+			}
+			clients[e.ClientId] = client
+		}
+		for _, child := range client.Children {
+			if child.Id.Hex() != e.ChildId {
+				continue
+			}
+			cutoff := program.Cutoff(next)
+			age := child.AgeOn(cutoff)
+			if age <= program.MaxAge {
+				continue
+			}
+			ageOut := AgeOut{
+				EnrollmentId: e.Id.Hex(),
+				ClientId:     e.ClientId,
+				ChildId:      e.ChildId,
+				ChildName:    e.ChildName,
+				DOB:          child.DOB,
+				Class:        e.Class,
+				Program:      program.Name,
+				NextSeason:   next.Name,
+				Cutoff:       cutoff,
+				AgeAtCutoff:  age,
+			}
+			if programs := school.EligiblePrograms(child, next); len(programs) > 0 {
+				ageOut.SuggestedProgram = programs[0].Name
+			}
+			ageOuts = append(ageOuts, ageOut)
+		}
+	}
+	return ageOuts, nil
+}
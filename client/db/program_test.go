@@ -0,0 +1,66 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgramEligibility(t *testing.T) {
+	fall := &Season{
+		Name:  "Fall",
+		Start: time.Date(2017, time.September, 12, 0, 0, 0, 0, time.Local),
+		End:   time.Date(2017, time.December, 15, 0, 0, 0, 0, time.Local),
+		Schedules: []*Schedule{
+			&Schedule{Class: "Tiny Tumblers", Program: "Toddler Tumble"},
+			&Schedule{Class: "Open Gym"},
+		},
+	}
+	school := School{
+		Name:    "Eligible Elementary",
+		Seasons: []*Season{fall},
+		Programs: []*Program{
+			&Program{Name: "Toddler Tumble", MinAge: 2, MaxAge: 3, CutoffMonth: time.September, CutoffDay: 1},
+			&Program{Name: "Preschool Gymnastics", MinAge: 4, MaxAge: 5, CutoffMonth: time.September, CutoffDay: 1},
+		},
+	}
+
+	program := school.ClassProgram("Fall", "Tiny Tumblers")
+	if program == nil || program.Name != "Toddler Tumble" {
+		t.Fatal("Expected Tiny Tumblers to be part of Toddler Tumble: ", program)
+	}
+	if school.ClassProgram("Fall", "Open Gym") != nil {
+		t.Error("Classes without a program should not be age restricted")
+	}
+	if cutoff := program.Cutoff(fall); !cutoff.Equal(time.Date(2017, time.September, 1, 0, 0, 0, 0, time.Local)) {
+		t.Error("Expected the cutoff on September 1st, got ", cutoff)
+	}
+
+	// Turning four after the cutoff still counts as three for the season
+	late := &Child{FirstName: "Late", LastName: "Birthday", DOB: time.Date(2013, time.September, 5, 0, 0, 0, 0, time.Local)}
+	if err := program.Eligible(late, fall); err != nil {
+		t.Error("A child who is three on the cutoff date should be eligible: ", err)
+	}
+	early := &Child{FirstName: "Early", LastName: "Birthday", DOB: time.Date(2013, time.August, 20, 0, 0, 0, 0, time.Local)}
+	if err := program.Eligible(early, fall); err == nil {
+		t.Error("A child who is four on the cutoff date should not be eligible")
+	}
+	if programs := school.EligiblePrograms(early, fall); len(programs) != 1 || programs[0].Name != "Preschool Gymnastics" {
+		t.Error("Expected the older child to fit Preschool Gymnastics: ", programs)
+	}
+
+	// Without a next season planned the season is assumed to run again a year later
+	next := school.NextSeason(fall)
+	if next.Start.Year() != 2018 {
+		t.Error("Expected the next season to start in 2018, got ", next.Start)
+	}
+	if late.AgeOn(program.Cutoff(next)) <= program.MaxAge {
+		t.Error("Expected the younger child to age out of Toddler Tumble next season")
+	}
+
+	if err := (&Program{Name: "Backwards", MinAge: 5, MaxAge: 3}).Validate(); err == nil {
+		t.Error("A program with an inverted age range should be rejected")
+	}
+	if err := school.checkProgram(&Schedule{Class: "Ninjas", Program: "Kindergarten Ninja"}); err == nil {
+		t.Error("Classes should only use programs the school offers")
+	}
+}
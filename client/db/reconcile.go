@@ -0,0 +1,370 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BankMatch is how far a bank transaction has been reconciled with the ledger.
+type BankMatch string
+
+const (
+	Unmatched     BankMatch = "unmatched"
+	AutoMatched   BankMatch = "auto"
+	ManualMatched BankMatch = "manual"
+	Ignored       BankMatch = "ignored"
+)
+
+// matchWindow is how far apart the date of a deposit and the payment it is for can be.
+const matchWindow = 14 * 24 * time.Hour
+
+// autoMatchConfidence is the confidence a match needs to be made without anyone checking it.
+const autoMatchConfidence = 0.8
+
+// Match is a journal entry that may be what a bank transaction is for.
+type Match struct {
+	EntryId    string    `bson:"entryid" json:"entryid"`
+	Date       time.Time `bson:"date" json:"date"`
+	Amount     float64   `bson:"amount" json:"amount"`
+	Name       string    `bson:"name" json:"name"`
+	Memo       string    `bson:"memo" json:"memo"`
+	Confidence float64   `bson:"confidence" json:"confidence"`
+}
+
+// ImportSummary reports what happened to the transactions of an imported bank statement.
+type ImportSummary struct {
+	Imported   int `json:"imported"`
+	Duplicates int `json:"duplicates"`
+	Matched    int `json:"matched"`
+}
+
+// UnreconciledReport lists the bank transactions not matched to the ledger and the cash the ledger holds that
+// no bank transaction accounts for.
+type UnreconciledReport struct {
+	From         time.Time         `json:"from"`
+	To           time.Time         `json:"to"`
+	Transactions []BankTransaction `json:"transactions"`
+	Entries      []Match           `json:"entries"`
+	BankTotal    float64           `json:"banktotal"`
+	LedgerTotal  float64           `json:"ledgertotal"`
+}
+
+// cashAmount is what the entry moved in or out of the cash account, which is what shows up at the bank.
+func cashAmount(entry *JournalEntry) (amount float64, ok bool) {
+	for _, p := range entry.Postings {
+		if p.Account == CashAccount {
+			amount += p.Debit - p.Credit
+			ok = true
+		}
+	}
+	return roundCents(amount), ok
+}
+
+// matchConfidence scores how likely the entry is what the bank transaction is for, from 0 to 1. The amount
+// has to agree, then the closer the dates the better, and a check number or payer named in the bank
+// description makes it near certain.
+func matchConfidence(t *BankTransaction, entry *JournalEntry) float64 {
+	amount, ok := cashAmount(entry)
+	if !ok || amount != t.Amount {
+		return 0
+	}
+	gap := math.Abs(t.Date.Sub(entry.Date).Hours() / 24)
+	if gap > matchWindow.Hours()/24 {
+		return 0
+	}
+	confidence := 0.5
+	switch {
+	case gap < 1:
+		confidence += 0.3
+	case gap <= 3:
+		confidence += 0.2
+	case gap <= 7:
+		confidence += 0.1
+	}
+	description := strings.ToLower(t.Description + " " + t.Reference)
+	if entry.Reference != "" && (t.Reference == entry.Reference || strings.Contains(description, strings.ToLower(entry.Reference))) {
+		confidence += 0.3
+	} else if entry.Name != "" {
+		for _, word := range strings.Fields(strings.ToLower(entry.Name)) {
+			if len(word) > 2 && strings.Contains(description, word) {
+				confidence += 0.1
+				break
+			}
+		}
+	}
+	return math.Min(1, math.Round(confidence*100)/100)
+}
+
+// rankMatches returns the unmatched entries that could be the transaction, most likely first.
+func rankMatches(t *BankTransaction, entries []JournalEntry, taken map[string]bool) (matches []Match) {
+	for i := range entries {
+		entry := &entries[i]
+		if taken[entry.Id] {
+			continue
+		}
+		if confidence := matchConfidence(t, entry); confidence > 0 {
+			amount, _ := cashAmount(entry)
+			matches = append(matches, Match{
+				EntryId:    entry.Id,
+				Date:       entry.Date,
+				Amount:     amount,
+				Name:       entry.Name,
+				Memo:       entry.Memo,
+				Confidence: confidence,
+			})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Confidence > matches[j].Confidence
+	})
+	return
+}
+
+// AutoMatch matches the transactions to entries where one entry stands out with enough confidence. The
+// others are left unmatched with their best candidates as suggestions. Entries in taken are already matched
+// and are not considered; entries matched here are added to it.
+func AutoMatch(transactions []BankTransaction, entries []JournalEntry, taken map[string]bool) (matched int) {
+	for i := range transactions {
+		t := &transactions[i]
+		if t.Status != Unmatched && t.Status != "" {
+			continue
+		}
+		t.Status = Unmatched
+		matches := rankMatches(t, entries, taken)
+		if len(matches) > 0 && matches[0].Confidence >= autoMatchConfidence &&
+			(len(matches) == 1 || matches[1].Confidence < matches[0].Confidence) {
+			t.Status = AutoMatched
+			t.EntryId = matches[0].EntryId
+			t.Confidence = matches[0].Confidence
+			t.Suggestions = nil
+			taken[t.EntryId] = true
+			matched++
+			continue
+		}
+		if len(matches) > 3 {
+			matches = matches[:3]
+		}
+		t.Suggestions = matches
+	}
+	return
+}
+
+// matchedEntries returns the ids of the journal entries already matched to bank transactions.
+func (c *MongoConnection) matchedEntries() (taken map[string]bool, err error) {
+	session, bankCollection, err := c.getCollection(bankCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var ids []string
+	if err = bankCollection.Find(bson.M{"entryid": bson.M{"$exists": true}}).Distinct("entryid", &ids); err != nil {
+		return
+	}
+	taken = make(map[string]bool)
+	for _, id := range ids {
+		taken[id] = true
+	}
+	return
+}
+
+// ImportBankTransactions stores the transactions of a bank statement, skipping any already imported, then
+// tries to match every unmatched transaction to the ledger.
+func (c *MongoConnection) ImportBankTransactions(transactions []BankTransaction) (summary *ImportSummary, err error) {
+	session, bankCollection, err := c.getCollection(bankCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	summary = &ImportSummary{}
+	now := time.Now()
+	for _, t := range transactions {
+		t.Imported = now
+		t.Status = Unmatched
+		if err = bankCollection.Insert(&t); err != nil {
+			if !mgo.IsDup(err) {
+				return
+			}
+			err = nil
+			summary.Duplicates++
+			continue
+		}
+		summary.Imported++
+	}
+	summary.Matched, err = c.AutoReconcile()
+	return
+}
+
+// AutoReconcile matches unmatched bank transactions to the ledger and refreshes the suggestions of those it
+// can't match.
+func (c *MongoConnection) AutoReconcile() (matched int, err error) {
+	taken, err := c.matchedEntries()
+	if err != nil {
+		return
+	}
+	session, bankCollection, err := c.getCollection(bankCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var transactions []BankTransaction
+	if err = bankCollection.Find(bson.M{"status": Unmatched}).Sort("date").All(&transactions); err != nil || len(transactions) == 0 {
+		return
+	}
+	entries, err := c.ListJournal(transactions[0].Date.Add(-matchWindow), transactions[len(transactions)-1].Date.Add(matchWindow))
+	if err != nil {
+		return
+	}
+	matched = AutoMatch(transactions, entries, taken)
+	for _, t := range transactions {
+		update := bson.M{"status": t.Status, "suggestions": t.Suggestions}
+		if t.Status == AutoMatched {
+			update["entryid"] = t.EntryId
+			update["confidence"] = t.Confidence
+		}
+		if err = bankCollection.UpdateId(t.Id, bson.M{"$set": update}); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// getJournalEntry returns the journal entry with the given id.
+func (c *MongoConnection) getJournalEntry(id string) (entry *JournalEntry, err error) {
+	session, journalCollection, err := c.getCollection(journalCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	if err = journalCollection.FindId(id).One(&entry); err == mgo.ErrNotFound {
+		err = fmt.Errorf("Journal entry %s not found", id)
+	}
+	return
+}
+
+// MatchBankTransaction matches a bank transaction to a journal entry by hand, replacing any automatic match.
+func (c *MongoConnection) MatchBankTransaction(transactionId, entryId string) (err error) {
+	taken, err := c.matchedEntries()
+	if err != nil {
+		return
+	}
+	session, bankCollection, err := c.getCollection(bankCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	var t BankTransaction
+	if err = bankCollection.FindId(transactionId).One(&t); err != nil {
+		return fmt.Errorf("Bank transaction %s not found", transactionId)
+	}
+	if taken[entryId] && t.EntryId != entryId {
+		return fmt.Errorf("Journal entry %s is already matched to another bank transaction", entryId)
+	}
+	entry, err := c.getJournalEntry(entryId)
+	if err != nil {
+		return
+	}
+	if amount, ok := cashAmount(entry); !ok || (amount > 0) != (t.Amount > 0) {
+		return errors.New("A deposit can only be matched to money coming in, and a withdrawal to money going out")
+	}
+	err = bankCollection.UpdateId(t.Id, bson.M{
+		"$set":   bson.M{"status": ManualMatched, "entryid": entryId, "confidence": matchConfidence(&t, entry)},
+		"$unset": bson.M{"suggestions": ""},
+	})
+	return
+}
+
+// UnmatchBankTransaction undoes the match of a bank transaction, or stops ignoring it.
+func (c *MongoConnection) UnmatchBankTransaction(transactionId string) (err error) {
+	session, bankCollection, err := c.getCollection(bankCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = bankCollection.UpdateId(transactionId, bson.M{
+		"$set":   bson.M{"status": Unmatched, "confidence": 0},
+		"$unset": bson.M{"entryid": ""},
+	})
+	if err == mgo.ErrNotFound {
+		err = fmt.Errorf("Bank transaction %s not found", transactionId)
+	}
+	return
+}
+
+// IgnoreBankTransaction marks a bank transaction, such as a bank fee, as having no entry to match.
+func (c *MongoConnection) IgnoreBankTransaction(transactionId string) (err error) {
+	session, bankCollection, err := c.getCollection(bankCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = bankCollection.UpdateId(transactionId, bson.M{
+		"$set":   bson.M{"status": Ignored},
+		"$unset": bson.M{"entryid": "", "suggestions": ""},
+	})
+	if err == mgo.ErrNotFound {
+		err = fmt.Errorf("Bank transaction %s not found", transactionId)
+	}
+	return
+}
+
+// ListBankTransactions returns the bank transactions dated between from and to, optionally only those with
+// the given status.
+func (c *MongoConnection) ListBankTransactions(from, to time.Time, status BankMatch) (transactions []BankTransaction, err error) {
+	session, bankCollection, err := c.getCollection(bankCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	query := bson.M{"date": bson.M{"$gte": from, "$lte": to}}
+	if status != "" {
+		query["status"] = status
+	}
+	err = bankCollection.Find(query).Sort("date").All(&transactions)
+	return
+}
+
+// Unreconciled reports the bank transactions between from and to that aren't matched to the ledger, and the
+// cash entries of the ledger in the same period that no bank transaction is matched to.
+func (c *MongoConnection) Unreconciled(from, to time.Time) (report *UnreconciledReport, err error) {
+	transactions, err := c.ListBankTransactions(from, to, Unmatched)
+	if err != nil {
+		return
+	}
+	taken, err := c.matchedEntries()
+	if err != nil {
+		return
+	}
+	entries, err := c.ListJournal(from, to)
+	if err != nil {
+		return
+	}
+
+	report = &UnreconciledReport{From: from, To: to, Transactions: transactions}
+	for _, t := range transactions {
+		report.BankTotal = roundCents(report.BankTotal + t.Amount)
+	}
+	for i := range entries {
+		entry := &entries[i]
+		amount, ok := cashAmount(entry)
+		if !ok || taken[entry.Id] {
+			continue
+		}
+		report.Entries = append(report.Entries, Match{EntryId: entry.Id, Date: entry.Date, Amount: amount, Name: entry.Name, Memo: entry.Memo})
+		report.LedgerTotal = roundCents(report.LedgerTotal + amount)
+	}
+	return
+}
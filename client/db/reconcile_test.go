@@ -0,0 +1,96 @@
+package db
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBankStatements(t *testing.T) {
+	statement := `Date,Description,Check Number,Debit,Credit
+03/02/2017,DEPOSIT CHECK,1042,,"1,250.00"
+03/03/2017,SERVICE FEE,,12.50,
+
+2017-03-06,CARD SETTLEMENT,,,400
+`
+	transactions, err := ParseBankCSV(strings.NewReader(statement))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(transactions) != 3 {
+		t.Fatal("Expected three transactions, got ", transactions)
+	}
+	if transactions[0].Amount != 1250 || transactions[0].Reference != "1042" || transactions[1].Amount != -12.5 {
+		t.Error("Expected a deposit of 1250 by check 1042 and a fee of 12.50, got ", transactions[:2])
+	}
+	again, _ := ParseBankCSV(strings.NewReader(statement))
+	if transactions[0].Id != again[0].Id || transactions[0].Id == transactions[1].Id {
+		t.Error("Expected transactions to keep their ids when imported again")
+	}
+	repeated := "Date,Description,Amount\n03/02/2017,DEPOSIT,40.00\n03/02/2017,DEPOSIT,40.00\n"
+	deposits, _ := ParseBankCSV(strings.NewReader(repeated))
+	again, _ = ParseBankCSV(strings.NewReader(repeated))
+	if len(deposits) != 2 || deposits[0].Id == deposits[1].Id || deposits[0].Id != again[0].Id || deposits[1].Id != again[1].Id {
+		t.Error("Expected two identical deposits to keep their own ids when imported again, got ", deposits)
+	}
+	if _, err = ParseBankCSV(strings.NewReader("Payee,Total\nAcme,10\n")); err == nil {
+		t.Error("Expected a statement with no date or amount to be rejected")
+	}
+
+	ofx := `OFXHEADER:100
+<OFX><BANKMSGSRSV1><STMTTRNRS><STMTRS><BANKTRANLIST>
+<STMTTRN><TRNTYPE>CHECK<DTPOSTED>20170302120000[-5:EST]<TRNAMT>250.00<FITID>9001<CHECKNUM>318<NAME>LEE &amp; SONS
+</STMTTRN>
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20170303<TRNAMT>-30.00<FITID>9002<MEMO>Revenue share
+</STMTTRN>
+</BANKTRANLIST></STMTRS></STMTTRNRS></BANKMSGSRSV1></OFX>`
+	transactions, err = ParseOFX(strings.NewReader(ofx))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(transactions) != 2 {
+		t.Fatal("Expected two transactions, got ", transactions)
+	}
+	first := transactions[0]
+	if first.Id != "ofx-9001" || first.Amount != 250 || first.Reference != "318" || first.Description != "LEE & SONS" ||
+		!first.Date.Equal(time.Date(2017, time.March, 2, 0, 0, 0, 0, time.Local)) {
+		t.Error("Expected check 318 from Lee & Sons for 250, got ", first)
+	}
+	if transactions[1].Amount != -30 {
+		t.Error("Expected a withdrawal of 30, got ", transactions[1].Amount)
+	}
+}
+
+func TestAutoMatch(t *testing.T) {
+	day := time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local)
+	entries := []JournalEntry{
+		{Id: "check", Date: day, Name: "Ann Lee", Reference: "318", Postings: transfer(CashAccount, RevenueAccount("Acton"), 250)},
+		{Id: "cash-1", Date: day, Name: "Bob Ray", Postings: transfer(CashAccount, RevenueAccount("Acton"), 100)},
+		{Id: "cash-2", Date: day, Name: "Cal Day", Postings: transfer(CashAccount, RevenueAccount("Acton"), 100)},
+		{Id: "card", Date: day, Postings: transfer(CardClearingAccount, RevenueAccount("Acton"), 75)},
+		{Id: "taken", Date: day, Postings: transfer(CashAccount, RevenueAccount("Acton"), 60)},
+	}
+	transactions := []BankTransaction{
+		{Id: "a", Date: day.AddDate(0, 0, 4), Amount: 250, Reference: "318"},
+		{Id: "b", Date: day.AddDate(0, 0, 1), Amount: 100, Description: "DEPOSIT"},
+		{Id: "c", Date: day, Amount: 75},
+		{Id: "d", Date: day, Amount: 60},
+	}
+	taken := map[string]bool{"taken": true}
+
+	if matched := AutoMatch(transactions, entries, taken); matched != 1 {
+		t.Error("Expected only the check to be matched, got ", matched)
+	}
+	if transactions[0].Status != AutoMatched || transactions[0].EntryId != "check" || transactions[0].Confidence < autoMatchConfidence {
+		t.Error("Expected the check to match on its number despite the date, got ", transactions[0])
+	}
+	if transactions[1].Status != Unmatched || len(transactions[1].Suggestions) != 2 {
+		t.Error("Expected two equally likely cash payments to be left as suggestions, got ", transactions[1])
+	}
+	if transactions[2].Status != Unmatched || len(transactions[2].Suggestions) != 0 {
+		t.Error("Expected card payments not to match a bank deposit until settled, got ", transactions[2])
+	}
+	if len(transactions[3].Suggestions) != 0 {
+		t.Error("Expected entries already matched not to be suggested, got ", transactions[3].Suggestions)
+	}
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RolloverSkip is an active enrollment that could not be carried forward into the next season.
+type RolloverSkip struct {
+	EnrollmentId string `json:"enrollmentid"`
+	ClientId     string `json:"clientid"`
+	ChildName    string `json:"childname"`
+	Class        string `json:"class"`
+	Reason       string `json:"reason"`
+}
+
+// RolloverSummary reports what a season rollover did.
+type RolloverSummary struct {
+	School         string         `json:"school"`
+	ClosedSeason   string         `json:"closedseason"`
+	NextSeason     string         `json:"nextseason"`
+	Deadline       time.Time      `json:"deadline"`
+	CarriedForward []Enrollment   `json:"carriedforward"`
+	Skipped        []RolloverSkip `json:"skipped"`
+	Invited        int            `json:"invited"`
+}
+
+// ReenrollmentSummary reports which of the families carried forward into a season have returned, which
+// lapsed and which have yet to answer.
+type ReenrollmentSummary struct {
+	School   string       `json:"school"`
+	Season   string       `json:"season"`
+	Returned []Enrollment `json:"returned"`
+	Lapsed   []Enrollment `json:"lapsed"`
+	Pending  []Enrollment `json:"pending"`
+}
+
+// nextSeasonFor fills in the parts of the next season left out by the caller from the season it follows:
+// the dates move on by a year and the weekly schedules are copied without their exceptions.
+func nextSeasonFor(current, next *Season) *Season {
+	if next == nil {
+		next = &Season{}
+	}
+	if next.Start.IsZero() {
+		next.Start = current.Start.AddDate(1, 0, 0)
+		next.End = current.End.AddDate(1, 0, 0)
+	}
+	if next.Name == "" {
+		next.Name = fmt.Sprintf("%s %d", strings.TrimSpace(strings.TrimRight(current.Name, "0123456789")), next.Start.Year())
+	}
+	if len(next.Schedules) == 0 {
+		for _, schedule := range current.Schedules {
+			copied := *schedule
+			copied.Exceptions = nil
+			next.Schedules = append(next.Schedules, &copied)
+		}
+	}
+	next.Closed = false
+	next.YearToDateTotal = 0
+	return next
+}
+
+// RolloverSeason closes a season of the school and opens the next one. Every active enrollment of the closed
+// season is carried forward into the same class of the next season as pending re-enrollment, holding the place
+// of the child until the deadline, and each family is invited to confirm. Children who no longer fit the
+// program of their class, or whose class is not offered any more, are reported as skipped. Parts of the next
+// season that are left out are copied from the closed season a year later. The season is closed once every
+// family has been invited, so a rollover that fails part way can be run again to carry forward and invite
+// those it missed.
+func (c *MongoConnection) RolloverSeason(schoolName, seasonName string, next *Season, deadline time.Time) (summary *RolloverSummary, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	current := school.FindSeason(seasonName)
+	if current == nil {
+		return nil, fmt.Errorf("Season %s not found for %s", seasonName, schoolName)
+	}
+	if current.Closed {
+		return nil, fmt.Errorf("Season %s of %s has already been rolled over", seasonName, schoolName)
+	}
+	next = nextSeasonFor(current, next)
+	if deadline.IsZero() {
+		deadline = next.Start.AddDate(0, 0, -7)
+	}
+	if deadline.After(next.Start) {
+		return nil, errors.New("The re-enrollment deadline must be before the next season starts")
+	}
+
+	// A rollover that failed part way through carries on with the season it already created, inviting the
+	// families of the enrollments it carried forward but didn't invite
+	carried := make(map[string]bool)
+	invitations := make(map[string][]*Enrollment)
+	if existing := school.FindSeason(next.Name); existing != nil {
+		next = existing
+		previous, listErr := c.ListEnrollments(EnrollmentFilter{School: schoolName, Season: next.Name})
+		if listErr != nil {
+			return nil, listErr
+		}
+		for i := range previous {
+			e := &previous[i]
+			carried[e.Previous] = e.Previous != ""
+			if e.Previous != "" && e.State == PendingReenrollment && e.Invited.IsZero() {
+				invitations[e.ClientId] = append(invitations[e.ClientId], e)
+			}
+		}
+	} else if err = c.AddSeason(schoolName, next); err != nil {
+		return
+	}
+
+	summary = &RolloverSummary{School: schoolName, ClosedSeason: current.Name, NextSeason: next.Name, Deadline: deadline}
+	active, err := c.ListEnrollments(EnrollmentFilter{School: schoolName, Season: current.Name, State: Active})
+	if err != nil {
+		return nil, err
+	}
+
+	session, enrollmentCollection, err := c.getCollection(enrollmentCollectionName)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	for _, previous := range active {
+		if carried[previous.Id.Hex()] {
+			continue
+		}
+		enrollment, enrollErr := c.enroll(previous.ClientId, previous.ChildId, schoolName, next.Name, previous.Class, PendingReenrollment)
+		if enrollErr != nil {
+			summary.Skipped = append(summary.Skipped, RolloverSkip{
+				EnrollmentId: previous.Id.Hex(),
+				ClientId:     previous.ClientId,
+				ChildName:    previous.ChildName,
+				Class:        previous.Class,
+				Reason:       enrollErr.Error(),
+			})
+			continue
+		}
+		enrollment.Previous = previous.Id.Hex()
+		enrollment.ReenrollBy = deadline
+		err = enrollmentCollection.UpdateId(enrollment.Id, bson.M{"$set": bson.M{
+			"previous": enrollment.Previous, "reenrollby": enrollment.ReenrollBy,
+		}})
+		if err != nil {
+			return nil, err
+		}
+		summary.CarriedForward = append(summary.CarriedForward, *enrollment)
+		invitations[enrollment.ClientId] = append(invitations[enrollment.ClientId], enrollment)
+	}
+
+	clientIds := make([]string, 0, len(invitations))
+	for clientId := range invitations {
+		clientIds = append(clientIds, clientId)
+	}
+	sort.Strings(clientIds)
+	for _, clientId := range clientIds {
+		if err = c.inviteToReenroll(clientId, schoolName, next, deadline, invitations[clientId]); err != nil {
+			return nil, err
+		}
+		var ids []bson.ObjectId
+		for _, e := range invitations[clientId] {
+			ids = append(ids, e.Id)
+		}
+		if _, err = enrollmentCollection.UpdateAll(bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$set": bson.M{"invited": time.Now()}}); err != nil {
+			return nil, err
+		}
+		summary.Invited++
+	}
+
+	// Close the old season once everyone has been carried forward and invited so a failed rollover can be
+	// retried
+	if school, err = c.FindSchoolByName(schoolName); err != nil {
+		return nil, err
+	}
+	school.FindSeason(current.Name).Closed = true
+	if err = c.setSeasons(school); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// inviteToReenroll asks a family to confirm the places held for their children in the next season.
+func (c *MongoConnection) inviteToReenroll(clientId, schoolName string, next *Season, deadline time.Time, enrollments []*Enrollment) (err error) {
+	var places []string
+	for _, e := range enrollments {
+		class := e.Class
+		if class == "" {
+			class = schoolName
+		}
+		places = append(places, fmt.Sprintf("%s in %s (enrollment %s)", e.ChildName, class, e.Id.Hex()))
+	}
+	return c.notify(clientId, "Re-enroll for "+next.Name+" at "+schoolName,
+		fmt.Sprintf("We have held a place in %s, starting %s, for:\n%s\nPlease confirm by %s to keep your place. "+
+			"Places that are not confirmed by then will be offered to the waitlist.", next.Name,
+			next.Start.Format("January 2, 2006"), strings.Join(places, "\n"), deadline.Format("January 2, 2006")))
+}
+
+// ReenrollmentSummary lists the enrollments carried forward into a season by a rollover. Families who
+// registered are returned, those who withdrew lapsed and the rest are still pending.
+func (c *MongoConnection) ReenrollmentSummary(schoolName, seasonName string) (summary *ReenrollmentSummary, err error) {
+	enrollments, err := c.ListEnrollments(EnrollmentFilter{School: schoolName, Season: seasonName})
+	if err != nil {
+		return
+	}
+
+	summary = &ReenrollmentSummary{School: schoolName, Season: seasonName}
+	for _, e := range enrollments {
+		if e.Previous == "" {
+			continue
+		}
+		switch {
+		case e.State == PendingReenrollment:
+			summary.Pending = append(summary.Pending, e)
+		case e.State.holdsSeat() || e.State == Graduated:
+			summary.Returned = append(summary.Returned, e)
+		default:
+			summary.Lapsed = append(summary.Lapsed, e)
+		}
+	}
+	return
+}
+
+// LapseReenrollments withdraws the pending re-enrollments of a season whose deadline passed before the given
+// day, offering their places to the waitlist.
+func (c *MongoConnection) LapseReenrollments(schoolName, seasonName string, day time.Time) (lapsed []Enrollment, err error) {
+	pending, err := c.ListEnrollments(EnrollmentFilter{School: schoolName, Season: seasonName, State: PendingReenrollment})
+	if err != nil {
+		return
+	}
+	for _, e := range pending {
+		if e.ReenrollBy.IsZero() || !e.ReenrollBy.Before(day) {
+			continue
+		}
+		enrollment, transitionErr := c.TransitionEnrollment(e.Id.Hex(), Withdrawn, "Re-enrollment deadline passed")
+		if transitionErr != nil {
+			return lapsed, transitionErr
+		}
+		lapsed = append(lapsed, *enrollment)
+	}
+	return
+}
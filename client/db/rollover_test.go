@@ -0,0 +1,136 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextSeason(t *testing.T) {
+	fall := &Season{
+		Name:  "Fall 2016",
+		Start: time.Date(2016, time.September, 6, 0, 0, 0, 0, time.Local),
+		End:   time.Date(2016, time.December, 16, 0, 0, 0, 0, time.Local),
+		Schedules: []*Schedule{&Schedule{
+			Class:      "Tumble",
+			Weekday:    time.Tuesday,
+			StartTime:  "15:30",
+			Duration:   45,
+			Exceptions: []*ScheduleException{&ScheduleException{Date: time.Date(2016, time.November, 22, 0, 0, 0, 0, time.Local), Cancelled: true}},
+		}},
+		Closed: true,
+	}
+
+	next := nextSeasonFor(fall, nil)
+	if next.Name != "Fall 2017" {
+		t.Error("Expected the next season to be named Fall 2017, got ", next.Name)
+	}
+	if next.Start.Year() != 2017 || next.End.Year() != 2017 {
+		t.Error("Expected the next season a year later: ", next.Start, next.End)
+	}
+	if len(next.Schedules) != 1 || len(next.Schedules[0].Exceptions) != 0 || len(fall.Schedules[0].Exceptions) != 1 {
+		t.Error("Schedules should be copied without their exceptions")
+	}
+	if next.Closed {
+		t.Error("The next season should be open")
+	}
+
+	spring := nextSeasonFor(fall, &Season{Name: "Spring", Start: time.Date(2017, time.March, 1, 0, 0, 0, 0, time.Local),
+		End: time.Date(2017, time.June, 1, 0, 0, 0, 0, time.Local)})
+	if spring.Name != "Spring" || spring.Start.Month() != time.March {
+		t.Error("Given parts of the next season should be kept: ", spring)
+	}
+
+	if !PendingReenrollment.CanTransition(Registered) || !PendingReenrollment.CanTransition(Withdrawn) {
+		t.Error("Families should be able to confirm or decline a re-enrollment")
+	}
+	if PendingReenrollment.CanTransition(Active) {
+		t.Error("A re-enrollment should be confirmed before the child becomes active")
+	}
+	if !PendingReenrollment.holdsSeat() {
+		t.Error("A pending re-enrollment should hold the place of the child")
+	}
+}
+
+func TestRolloverSeason(t *testing.T) {
+	isDrop = false
+	t.Log("Connecting to mongodb...")
+	c := NewConnection()
+
+	defer c.CloseConnection()
+
+	start := time.Now().AddDate(0, -3, 0)
+	school := School{
+		Name:    "Rollover Academy",
+		Address: "2 Season Street",
+		City:    "Acton",
+		State:   "MA",
+		ZipCode: "01720",
+		Seasons: []*Season{&Season{
+			Name:  "Current",
+			Start: start,
+			End:   start.AddDate(0, 3, 0),
+			Schedules: []*Schedule{
+				&Schedule{Class: "Tumble", Weekday: time.Wednesday, StartTime: "15:30", Duration: 45},
+			},
+		}},
+	}
+	if err := c.AddSchool(&school); err != nil {
+		t.Fatal("Failed to add school: ", err.Error())
+	}
+
+	parent := Parent{FirstName: "Roll", LastName: "Over", EmailAddress: "rollover@someemail.com"}
+	children := []Child{
+		Child{FirstName: "Stays", LastName: "Over", DOB: time.Date(2012, time.May, 1, 0, 0, 0, 0, time.Local)},
+		Child{FirstName: "Leaves", LastName: "Over", DOB: time.Date(2011, time.May, 1, 0, 0, 0, 0, time.Local)},
+	}
+	if err := c.AddClient("Rollover Academy", &parent, children, &PaymentMethod{}); err != nil {
+		t.Fatal("Failed to insert client info: ", err.Error())
+	}
+	client, err := c.FindClient("Roll", "Over")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, child := range client.Children {
+		enrollment, enrollErr := c.Enroll(client.Id.Hex(), child.Id.Hex(), "Rollover Academy", "Current", "Tumble")
+		if enrollErr != nil {
+			t.Fatal(enrollErr.Error())
+		}
+		if _, err = c.TransitionEnrollment(enrollment.Id.Hex(), Active, ""); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	deadline := time.Now().AddDate(0, 0, -1)
+	summary, err := c.RolloverSeason("Rollover Academy", "Current", &Season{Name: "Next"}, deadline)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(summary.CarriedForward) != 2 || summary.Invited != 1 {
+		t.Fatal("Expected both children carried forward with one invitation: ", summary)
+	}
+	if _, err = c.RolloverSeason("Rollover Academy", "Current", nil, time.Time{}); err == nil {
+		t.Error("A closed season should not be rolled over twice")
+	}
+	if _, err = c.Enroll(client.Id.Hex(), client.Children[0].Id.Hex(), "Rollover Academy", "Current", ""); err == nil {
+		t.Error("Enrolling in a closed season should be rejected")
+	}
+
+	if _, err = c.TransitionEnrollment(summary.CarriedForward[0].Id.Hex(), Registered, "See you next season"); err != nil {
+		t.Fatal(err.Error())
+	}
+	lapsed, err := c.LapseReenrollments("Rollover Academy", "Next", time.Now())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(lapsed) != 1 {
+		t.Error("Expected the unconfirmed re-enrollment to lapse: ", lapsed)
+	}
+
+	status, err := c.ReenrollmentSummary("Rollover Academy", "Next")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(status.Returned) != 1 || len(status.Lapsed) != 1 || len(status.Pending) != 0 {
+		t.Error("Expected one returned and one lapsed family: ", status)
+	}
+}
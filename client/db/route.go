@@ -0,0 +1,280 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"sort"
+	"time"
+)
+
+// maxExactStops is the largest number of stops that are ordered by an exhaustive search.
+// Larger days fall back to visiting the sessions in order of their start time.
+const maxExactStops = 9
+
+// RouteOptions configures the route planner. Zero values are replaced with sensible defaults.
+type RouteOptions struct {
+	// Depot is where the bus starts and ends the day. When nil the day starts at the first school.
+	Depot *Coordinates `json:"depot"`
+	// AverageSpeed is the expected driving speed in miles per hour.
+	AverageSpeed float64 `json:"averagespeed"`
+	// RoadFactor scales straight line distances to approximate road distances.
+	RoadFactor float64 `json:"roadfactor"`
+	// Setup is the number of minutes needed on site before a session starts.
+	Setup int `json:"setup"`
+	// Flex is the number of minutes a session is allowed to start late.
+	Flex int `json:"flex"`
+	// Geocoder places schools without configured coordinates. Routes planned through a connection use its
+	// Geocoder.
+	Geocoder Geocoder `json:"-"`
+}
+
+func (o *RouteOptions) defaults() {
+	if o.AverageSpeed <= 0 {
+		o.AverageSpeed = 25
+	}
+	if o.RoadFactor <= 0 {
+		o.RoadFactor = 1.3
+	}
+	if o.Setup < 0 {
+		o.Setup = 0
+	}
+	if o.Flex < 0 {
+		o.Flex = 0
+	}
+	if o.Geocoder == nil {
+		o.Geocoder = DefaultZipCentroids
+	}
+}
+
+// locate returns the configured coordinates of the school, falling back to where the Geocoder places it.
+func (o *RouteOptions) locate(school *School) (Coordinates, error) {
+	if school.Location != nil && !school.Location.IsZero() {
+		return *school.Location, nil
+	}
+	if location, err := o.Geocoder.Geocode(school.Address, school.City, school.State, school.ZipCode); err == nil && location != nil {
+		return *location, nil
+	}
+	return Coordinates{}, fmt.Errorf("No coordinates known for %s (ZIP %s)", school.Name, school.ZipCode)
+}
+
+// RouteStop is a single visit of the itinerary.
+type RouteStop struct {
+	Session Session       `json:"session"`
+	Miles   float64       `json:"miles"`
+	Drive   time.Duration `json:"drive"`
+	Arrive  time.Time     `json:"arrive"`
+	Start   time.Time     `json:"start"`
+	Depart  time.Time     `json:"depart"`
+	Wait    time.Duration `json:"wait"`
+	Late    time.Duration `json:"late"`
+}
+
+// Itinerary is the ordered plan for a day of driving.
+type Itinerary struct {
+	Date        time.Time     `json:"date"`
+	Stops       []RouteStop   `json:"stops"`
+	Leave       time.Time     `json:"leave"`
+	Return      time.Time     `json:"return"`
+	ReturnMiles float64       `json:"returnmiles"`
+	TotalMiles  float64       `json:"totalmiles"`
+	TotalDrive  time.Duration `json:"totaldrive"`
+	Feasible    bool          `json:"feasible"`
+}
+
+// routeStop pairs a session with the location of its school.
+type routeStop struct {
+	session  Session
+	location Coordinates
+}
+
+// drive returns the estimated road miles and driving time between two points.
+func (o *RouteOptions) drive(from, to Coordinates) (float64, time.Duration) {
+	miles := Distance(from, to) * o.RoadFactor
+	return miles, time.Duration(miles / o.AverageSpeed * float64(time.Hour))
+}
+
+// simulate computes the itinerary for visiting the stops in the given order.
+func (o *RouteOptions) simulate(stops []routeStop, order []int) *Itinerary {
+	it := &Itinerary{Feasible: true}
+	setup := time.Duration(o.Setup) * time.Minute
+	flex := time.Duration(o.Flex) * time.Minute
+
+	var at time.Time
+	var here *Coordinates
+	if o.Depot != nil {
+		here = o.Depot
+	}
+	for n, i := range order {
+		stop := RouteStop{Session: stops[i].session}
+		if here != nil {
+			stop.Miles, stop.Drive = o.drive(*here, stops[i].location)
+		}
+		if n == 0 {
+			// Leave just in time to be set up for the first session
+			stop.Arrive = stop.Session.Start.Add(-setup)
+			it.Leave = stop.Arrive.Add(-stop.Drive)
+		} else {
+			stop.Arrive = at.Add(stop.Drive)
+		}
+		stop.Start = stop.Arrive.Add(setup)
+		if stop.Start.Before(stop.Session.Start) {
+			stop.Wait = stop.Session.Start.Sub(stop.Start)
+			stop.Start = stop.Session.Start
+		}
+		if late := stop.Start.Sub(stop.Session.Start.Add(flex)); late > 0 {
+			stop.Late = late
+			it.Feasible = false
+		}
+		stop.Depart = stop.Start.Add(stop.Session.End.Sub(stop.Session.Start))
+
+		it.TotalMiles += stop.Miles
+		it.TotalDrive += stop.Drive
+		it.Stops = append(it.Stops, stop)
+		at = stop.Depart
+		here = &stops[i].location
+	}
+	it.Return = at
+	if o.Depot != nil && here != nil {
+		miles, drive := o.drive(*here, *o.Depot)
+		it.ReturnMiles = miles
+		it.TotalMiles += miles
+		it.TotalDrive += drive
+		it.Return = at.Add(drive)
+	}
+	return it
+}
+
+// lateness sums how late every session of the itinerary starts.
+func (it *Itinerary) lateness() (late time.Duration) {
+	for _, stop := range it.Stops {
+		late += stop.Late
+	}
+	return
+}
+
+// better reports whether a is a better itinerary than b: less lateness first and then fewer miles.
+func better(a, b *Itinerary) bool {
+	if b == nil {
+		return true
+	}
+	if a.lateness() != b.lateness() {
+		return a.lateness() < b.lateness()
+	}
+	return a.TotalMiles < b.TotalMiles-1e-9
+}
+
+// PlanRoute orders the sessions of a day into an itinerary that respects the session start times,
+// minimising lateness and then the miles driven. Cancelled sessions are skipped.
+func PlanRoute(sessions []Session, schools map[string]*School, opts RouteOptions) (*Itinerary, error) {
+	opts.defaults()
+
+	var stops []routeStop
+	for _, session := range sessions {
+		if session.Cancelled {
+			continue
+		}
+		school, ok := schools[session.SchoolId]
+		if !ok {
+			return nil, fmt.Errorf("School %s of session %s is unknown", session.School, session.Class)
+		}
+		location, err := opts.locate(school)
+		if err != nil {
+			return nil, err
+		}
+		stops = append(stops, routeStop{session: session, location: location})
+	}
+	if len(stops) == 0 {
+		return nil, errors.New("No sessions to plan a route for")
+	}
+
+	chronological := make([]int, len(stops))
+	for i := range chronological {
+		chronological[i] = i
+	}
+	sortStops(stops, chronological)
+	best := opts.simulate(stops, chronological)
+
+	if len(stops) <= maxExactStops {
+		used := make([]bool, len(stops))
+		order := make([]int, 0, len(stops))
+		var search func()
+		search = func() {
+			if len(order) == len(stops) {
+				if it := opts.simulate(stops, order); better(it, best) {
+					best = it
+				}
+				return
+			}
+			// Prune orders that are already worse than the best itinerary found
+			if len(order) > 0 {
+				partial := opts.simulate(stops, order)
+				if partial.lateness() > best.lateness() ||
+					(partial.lateness() == best.lateness() && partial.TotalMiles-partial.ReturnMiles > best.TotalMiles) {
+					return
+				}
+			}
+			for i := range stops {
+				if used[i] {
+					continue
+				}
+				used[i] = true
+				order = append(order, i)
+				search()
+				order = order[:len(order)-1]
+				used[i] = false
+			}
+		}
+		search()
+	}
+
+	best.Date = best.Stops[0].Session.Start
+	best.TotalMiles = math.Round(best.TotalMiles*10) / 10
+	return best, nil
+}
+
+// sortStops orders the indexes by the start time of their sessions.
+func sortStops(stops []routeStop, order []int) {
+	sort.SliceStable(order, func(i, j int) bool {
+		return stops[order[i]].session.Start.Before(stops[order[j]].session.Start)
+	})
+}
+
+// PlanDayRoute plans the itinerary across every school with sessions on the given day, placing schools
+// without configured coordinates with the Geocoder of the connection unless the options give one.
+func (c *MongoConnection) PlanDayRoute(day time.Time, opts RouteOptions) (*Itinerary, error) {
+	schools, err := c.ListSchools()
+	if err != nil {
+		return nil, err
+	}
+	opts = c.routeOptions(opts)
+
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	to := from.AddDate(0, 0, 1).Add(-time.Nanosecond)
+
+	bySchool := make(map[string]*School)
+	var sessions []Session
+	for i := range schools {
+		school := &schools[i]
+		schoolSessions, err := school.Sessions(from, to)
+		if err != nil {
+			return nil, err
+		}
+		bySchool[school.Id.Hex()] = school
+		sessions = append(sessions, schoolSessions...)
+	}
+	return PlanRoute(sessions, bySchool, opts)
+}
+
+// SetSchoolLocation configures the coordinates of the school used in place of where it is geocoded.
+func (c *MongoConnection) SetSchoolLocation(schoolName string, location *Coordinates) (err error) {
+	session, _, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = schoolCollection.Update(bson.M{"name": schoolName}, bson.M{"$set": bson.M{"location": location}})
+	return
+}
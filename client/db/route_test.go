@@ -0,0 +1,89 @@
+package db
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2/bson"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDistance(t *testing.T) {
+	// Acton to Concord is roughly five miles in a straight line
+	d := Distance(DefaultZipCentroids["01720"], DefaultZipCentroids["01742"])
+	if d < 4 || d > 7 {
+		t.Error("Unexpected distance between Acton and Concord: ", d)
+	}
+	if Distance(DefaultZipCentroids["01720"], DefaultZipCentroids["01720"]) != 0 {
+		t.Error("Distance to the same point should be zero")
+	}
+}
+
+func TestLoadZipCentroids(t *testing.T) {
+	zips, err := LoadZipCentroids(bytes.NewBufferString("zip,lat,lng\n01720,42.48,-71.45\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	c, ok := zips.Lookup("01720-1234")
+	if !ok || c.Latitude != 42.48 {
+		t.Error("Failed to look up ZIP+4 code: ", c)
+	}
+}
+
+func TestPlanRoute(t *testing.T) {
+	acton := &School{Id: bson.NewObjectId(), Name: "Acton", ZipCode: "01720"}
+	concord := &School{Id: bson.NewObjectId(), Name: "Concord", ZipCode: "01742"}
+	boxborough := &School{Id: bson.NewObjectId(), Name: "Boxborough", ZipCode: "01719",
+		Location: &Coordinates{Latitude: 42.49, Longitude: -71.52}}
+	schools := map[string]*School{
+		acton.Id.Hex():      acton,
+		concord.Id.Hex():    concord,
+		boxborough.Id.Hex(): boxborough,
+	}
+
+	day := time.Date(2016, time.September, 6, 0, 0, 0, 0, time.Local)
+	session := func(school *School, hour int) Session {
+		start := day.Add(time.Duration(hour) * time.Hour)
+		return Session{SchoolId: school.Id.Hex(), School: school.Name, Class: "Tumble", Start: start, End: start.Add(45 * time.Minute)}
+	}
+	cancelled := session(concord, 8)
+	cancelled.Cancelled = true
+	sessions := []Session{session(concord, 13), session(acton, 9), session(boxborough, 11), cancelled}
+
+	opts := RouteOptions{Depot: &Coordinates{Latitude: 42.48, Longitude: -71.45}, Setup: 10}
+	it, err := PlanRoute(sessions, schools, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(it.Stops) != 3 {
+		t.Fatal("Expected three stops, found ", len(it.Stops))
+	}
+	if !it.Feasible {
+		t.Error("Itinerary should be feasible")
+	}
+	if it.Stops[0].Session.School != "Acton" || it.Stops[1].Session.School != "Boxborough" || it.Stops[2].Session.School != "Concord" {
+		t.Error("Stops should follow the session times: ", it.Stops)
+	}
+	if it.Stops[1].Miles <= 0 || it.Stops[1].Drive <= 0 {
+		t.Error("Expected a drive between Acton and Boxborough")
+	}
+	if math.Abs(it.Leave.Sub(day.Add(9*time.Hour-10*time.Minute)).Minutes()) > 1 {
+		t.Error("Should leave the depot in time to set up in Acton: ", it.Leave)
+	}
+
+	// Two sessions at the same time can't both be reached on time
+	sessions = []Session{session(acton, 9), session(concord, 9)}
+	it, err = PlanRoute(sessions, schools, opts)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if it.Feasible {
+		t.Error("Overlapping sessions should not be feasible")
+	}
+
+	unknown := &School{Id: bson.NewObjectId(), Name: "Nowhere", ZipCode: "99999"}
+	schools[unknown.Id.Hex()] = unknown
+	if _, err = PlanRoute([]Session{session(unknown, 9)}, schools, opts); err == nil {
+		t.Error("Expected an error for a school without coordinates")
+	}
+}
@@ -0,0 +1,370 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"time"
+)
+
+// Schedule describes a recurring weekly class that TumbleBus runs at a school during a Season,
+// for example Tuesdays at 15:30 for 45 minutes.
+type Schedule struct {
+	Class      string               `bson:"class" json:"class"`
+	Program    string               `bson:"program,omitempty" json:"program"`
+	Weekday    time.Weekday         `bson:"weekday" json:"weekday"`
+	StartTime  string               `bson:"starttime" json:"starttime"`
+	Duration   int                  `bson:"duration" json:"duration"`
+	Capacity   int                  `bson:"capacity" json:"capacity"`
+	Exceptions []*ScheduleException `bson:"exceptions" json:"exceptions"`
+}
+
+// ScheduleException cancels or moves a single occurrence of a Schedule.
+// If Rescheduled is set the occurrence is moved to that time instead of being cancelled.
+type ScheduleException struct {
+	Date        time.Time `bson:"date" json:"date"`
+	Cancelled   bool      `bson:"cancelled" json:"cancelled"`
+	Reason      string    `bson:"reason" json:"reason"`
+	Rescheduled time.Time `bson:"rescheduled" json:"rescheduled"`
+}
+
+// Session is a single concrete occurrence of a Schedule.
+type Session struct {
+	SchoolId  string    `bson:"schoolid" json:"schoolid"`
+	School    string    `bson:"school" json:"school"`
+	Season    string    `bson:"season" json:"season"`
+	Class     string    `bson:"class" json:"class"`
+	Start     time.Time `bson:"start" json:"start"`
+	End       time.Time `bson:"end" json:"end"`
+	Cancelled bool      `bson:"cancelled" json:"cancelled"`
+	Reason    string    `bson:"reason" json:"reason"`
+	// Occurrence is when the session was scheduled to start before any rescheduling, so it identifies the
+	// session wherever it is moved
+	Occurrence time.Time `bson:"occurrence" json:"occurrence"`
+}
+
+// clock parses the StartTime of the schedule which is expressed as a 24 hour "15:04" time.
+func (s *Schedule) clock() (hour, minute int, err error) {
+	t, err := time.Parse("15:04", s.StartTime)
+	if err != nil {
+		err = fmt.Errorf("Invalid start time %q for class %s, expected HH:MM", s.StartTime, s.Class)
+		return
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+// Validate checks that the schedule can be expanded into sessions.
+func (s *Schedule) Validate() (err error) {
+	if s.Class == "" {
+		return errors.New("Schedule requires a class name")
+	}
+	if s.Weekday < time.Sunday || s.Weekday > time.Saturday {
+		return fmt.Errorf("Invalid weekday %d for class %s", s.Weekday, s.Class)
+	}
+	if s.Duration <= 0 {
+		return fmt.Errorf("Invalid duration %d for class %s", s.Duration, s.Class)
+	}
+	_, _, err = s.clock()
+	return
+}
+
+// exception returns the exception recorded for the day, if any.
+func (s *Schedule) exception(day time.Time) *ScheduleException {
+	for _, e := range s.Exceptions {
+		if sameDay(e.Date, day) {
+			return e
+		}
+	}
+	return nil
+}
+
+// FindSchedule returns the schedule of the season for the given class.
+func (s *Season) FindSchedule(class string) *Schedule {
+	for _, schedule := range s.Schedules {
+		if schedule.Class == class {
+			return schedule
+		}
+	}
+	return nil
+}
+
+// isHoliday reports whether the day is listed as a holiday for the season.
+func (s *Season) isHoliday(day time.Time) bool {
+	for _, h := range s.Holidays {
+		if sameDay(h, day) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sessions expands the schedules of the season into the concrete sessions that start between from and to.
+// A zero from or to is bounded by the season itself. Cancelled sessions are returned flagged as such so
+// calendars can show the cancellation.
+func (s *Season) Sessions(from, to time.Time) (sessions []Session, err error) {
+	loc := s.Start.Location()
+	first := s.Start
+	if !from.IsZero() && from.After(first) {
+		first = from
+	}
+	last := s.End
+	if !to.IsZero() && to.Before(last) {
+		last = to
+	}
+
+	for _, schedule := range s.Schedules {
+		hour, minute, clockErr := schedule.clock()
+		if clockErr != nil {
+			return nil, clockErr
+		}
+		duration := time.Duration(schedule.Duration) * time.Minute
+
+		// Find the first matching weekday on or after the start of the season
+		day := time.Date(s.Start.Year(), s.Start.Month(), s.Start.Day(), 0, 0, 0, 0, loc)
+		day = day.AddDate(0, 0, (int(schedule.Weekday)-int(day.Weekday())+7)%7)
+
+		for ; !day.After(s.End); day = day.AddDate(0, 0, 7) {
+			session := Session{
+				Season: s.Name,
+				Class:  schedule.Class,
+				Start:  time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, loc),
+			}
+			session.Occurrence = session.Start
+			if s.isHoliday(day) {
+				session.Cancelled = true
+				session.Reason = "Holiday"
+			}
+			if e := schedule.exception(day); e != nil {
+				switch {
+				case !e.Rescheduled.IsZero():
+					session.Start = e.Rescheduled
+					session.Cancelled = false
+					session.Reason = ""
+				case e.Cancelled:
+					session.Cancelled = true
+				}
+				if e.Reason != "" {
+					session.Reason = e.Reason
+				}
+			}
+			session.End = session.Start.Add(duration)
+
+			if session.Start.Before(first) || session.Start.After(last) {
+				continue
+			}
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+	return
+}
+
+// Sessions expands every season of the school into concrete sessions between from and to.
+func (s *School) Sessions(from, to time.Time) (sessions []Session, err error) {
+	for _, season := range s.Seasons {
+		seasonSessions, seasonErr := season.Sessions(from, to)
+		if seasonErr != nil {
+			return nil, seasonErr
+		}
+		for i := range seasonSessions {
+			seasonSessions[i].SchoolId = s.Id.Hex()
+			seasonSessions[i].School = s.Name
+		}
+		sessions = append(sessions, seasonSessions...)
+	}
+	sortSessions(sessions)
+	return
+}
+
+// FindSeason returns the season of the school with the given name.
+func (s *School) FindSeason(name string) *Season {
+	for _, season := range s.Seasons {
+		if season.Name == name {
+			return season
+		}
+	}
+	return nil
+}
+
+// sortSessions orders sessions chronologically.
+func sortSessions(sessions []Session) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		return sessions[i].Start.Before(sessions[j].Start)
+	})
+}
+
+// sameDay reports whether a and b fall on the same calendar day in the location of b.
+func sameDay(a, b time.Time) bool {
+	a = a.In(b.Location())
+	return a.Year() == b.Year() && a.Month() == b.Month() && a.Day() == b.Day()
+}
+
+// setSeasons stores the seasons of the school.
+func (c *MongoConnection) setSeasons(school *School) (err error) {
+	session, _, schoolCollection, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = schoolCollection.Update(bson.M{"_id": school.Id}, bson.M{"$set": bson.M{"seasons": school.Seasons}})
+	return
+}
+
+// AddSeason adds a new season to the school.
+func (c *MongoConnection) AddSeason(schoolName string, season *Season) (err error) {
+	if season.Name == "" {
+		return errors.New("Season requires a name")
+	}
+	if !season.End.After(season.Start) {
+		return fmt.Errorf("Season %s must end after it starts", season.Name)
+	}
+	for _, schedule := range season.Schedules {
+		if err = schedule.Validate(); err != nil {
+			return
+		}
+	}
+
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	for _, schedule := range season.Schedules {
+		if err = school.checkProgram(schedule); err != nil {
+			return
+		}
+	}
+	if school.FindSeason(season.Name) != nil {
+		return fmt.Errorf("Season %s already exists for %s", season.Name, schoolName)
+	}
+
+	school.Seasons = append(school.Seasons, season)
+	err = c.setSeasons(school)
+	return
+}
+
+// AddSchedule adds a recurring class schedule to a season of the school.
+func (c *MongoConnection) AddSchedule(schoolName, seasonName string, schedule *Schedule) (err error) {
+	if err = schedule.Validate(); err != nil {
+		return
+	}
+
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	if err = school.checkProgram(schedule); err != nil {
+		return
+	}
+	season := school.FindSeason(seasonName)
+	if season == nil {
+		return fmt.Errorf("Season %s not found for %s", seasonName, schoolName)
+	}
+	if season.FindSchedule(schedule.Class) != nil {
+		return fmt.Errorf("Class %s is already scheduled in %s", schedule.Class, seasonName)
+	}
+
+	season.Schedules = append(season.Schedules, schedule)
+	err = c.setSeasons(school)
+	return
+}
+
+// AddScheduleException cancels or reschedules a single occurrence of a class.
+// An exception for a day that already has one replaces it.
+func (c *MongoConnection) AddScheduleException(schoolName, seasonName, class string, exception *ScheduleException) (err error) {
+	if exception.Date.IsZero() {
+		return errors.New("Schedule exception requires a date")
+	}
+	if !exception.Cancelled && exception.Rescheduled.IsZero() {
+		return errors.New("Schedule exception must either cancel or reschedule the session")
+	}
+
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	season := school.FindSeason(seasonName)
+	if season == nil {
+		return fmt.Errorf("Season %s not found for %s", seasonName, schoolName)
+	}
+	schedule := season.FindSchedule(class)
+	if schedule == nil {
+		return fmt.Errorf("Class %s is not scheduled in %s", class, seasonName)
+	}
+
+	if e := schedule.exception(exception.Date); e != nil {
+		*e = *exception
+	} else {
+		schedule.Exceptions = append(schedule.Exceptions, exception)
+	}
+	err = c.setSeasons(school)
+	return
+}
+
+// ListSessions returns the sessions of the school between from and to.
+func (c *MongoConnection) ListSessions(schoolName string, from, to time.Time) (sessions []Session, err error) {
+	school, err := c.FindSchoolByName(schoolName)
+	if err != nil {
+		return
+	}
+	return school.Sessions(from, to)
+}
+
+// EnrolledSessions returns the sessions between from and to of the classes the enrollments hold a seat in,
+// each session once however many children take it. An enrollment without a class takes every class of its
+// season. Schools maps school ids to the schools of the enrollments.
+func EnrolledSessions(enrollments []Enrollment, schools map[string]*School, from, to time.Time) (sessions []Session, err error) {
+	seen := make(map[string]bool)
+	for _, e := range enrollments {
+		if !e.State.holdsSeat() || e.Waitlisted {
+			continue
+		}
+		school := schools[e.SchoolId]
+		if school == nil {
+			return nil, fmt.Errorf("School %s of enrollment %s not found", e.SchoolId, e.Id.Hex())
+		}
+		season := school.FindSeason(e.Season)
+		if season == nil {
+			continue
+		}
+		seasonSessions, sessionErr := season.Sessions(from, to)
+		if sessionErr != nil {
+			return nil, sessionErr
+		}
+		for _, session := range seasonSessions {
+			key := e.SchoolId + "/" + session.Class + "/" + session.Start.String()
+			if (e.Class != "" && session.Class != e.Class) || seen[key] {
+				continue
+			}
+			seen[key] = true
+			session.SchoolId = school.Id.Hex()
+			session.School = school.Name
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+	return
+}
+
+// ListClientSessions returns the sessions between from and to of the classes the children of the client
+// hold a seat in.
+func (c *MongoConnection) ListClientSessions(clientId string, from, to time.Time) (sessions []Session, err error) {
+	if _, err = c.GetClientById(clientId); err != nil {
+		return
+	}
+	enrollments, err := c.ListEnrollments(EnrollmentFilter{ClientId: clientId})
+	if err != nil {
+		return
+	}
+	schools := make(map[string]*School)
+	for _, e := range enrollments {
+		if _, ok := schools[e.SchoolId]; ok || !bson.IsObjectIdHex(e.SchoolId) {
+			continue
+		}
+		if schools[e.SchoolId], err = c.GetSchoolById(bson.ObjectIdHex(e.SchoolId)); err != nil {
+			return
+		}
+	}
+	return EnrolledSessions(enrollments, schools, from, to)
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestSeasonSessions(t *testing.T) {
+	season := Season{
+		Name:     "Fall",
+		Start:    time.Date(2016, time.September, 1, 0, 0, 0, 0, time.Local),
+		End:      time.Date(2016, time.September, 30, 0, 0, 0, 0, time.Local),
+		Holidays: []time.Time{time.Date(2016, time.September, 13, 0, 0, 0, 0, time.Local)},
+		Schedules: []*Schedule{
+			&Schedule{
+				Class:     "Preschool",
+				Weekday:   time.Tuesday,
+				StartTime: "15:30",
+				Duration:  45,
+				Exceptions: []*ScheduleException{
+					&ScheduleException{
+						Date:      time.Date(2016, time.September, 20, 0, 0, 0, 0, time.Local),
+						Cancelled: true,
+						Reason:    "Picture day",
+					},
+					&ScheduleException{
+						Date:        time.Date(2016, time.September, 27, 0, 0, 0, 0, time.Local),
+						Rescheduled: time.Date(2016, time.September, 28, 10, 0, 0, 0, time.Local),
+					},
+				},
+			},
+		},
+	}
+
+	sessions, err := season.Sessions(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Tuesdays in September 2016 are the 6th, 13th, 20th and 27th
+	if len(sessions) != 4 {
+		t.Fatal("Expected 4 sessions, found ", len(sessions))
+	}
+	first := time.Date(2016, time.September, 6, 15, 30, 0, 0, time.Local)
+	if !sessions[0].Start.Equal(first) || !sessions[0].End.Equal(first.Add(45*time.Minute)) {
+		t.Error("Unexpected first session: ", sessions[0])
+	}
+	if !sessions[1].Cancelled || sessions[1].Reason != "Holiday" {
+		t.Error("Holiday session should be cancelled: ", sessions[1])
+	}
+	if !sessions[2].Cancelled || sessions[2].Reason != "Picture day" {
+		t.Error("Session should be cancelled by the exception: ", sessions[2])
+	}
+	if sessions[3].Cancelled || sessions[3].Start.Day() != 28 || sessions[3].Start.Hour() != 10 {
+		t.Error("Session should be rescheduled: ", sessions[3])
+	}
+
+	sessions, err = season.Sessions(time.Date(2016, time.September, 10, 0, 0, 0, 0, time.Local),
+		time.Date(2016, time.September, 21, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(sessions) != 2 {
+		t.Error("Expected 2 sessions within the range, found ", len(sessions))
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	schedule := Schedule{Class: "Ninja", Weekday: time.Monday, StartTime: "3pm", Duration: 30}
+	if schedule.Validate() == nil {
+		t.Error("Start time 3pm should not be accepted")
+	}
+	schedule.StartTime = "15:00"
+	if err := schedule.Validate(); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestEnrolledSessions(t *testing.T) {
+	school := &School{Id: bson.NewObjectId(), Name: "Acton", Seasons: []*Season{{
+		Name:  "Fall",
+		Start: time.Date(2016, time.September, 1, 0, 0, 0, 0, time.Local),
+		End:   time.Date(2016, time.September, 30, 0, 0, 0, 0, time.Local),
+		Schedules: []*Schedule{
+			{Class: "Preschool", Weekday: time.Tuesday, StartTime: "15:30", Duration: 45},
+			{Class: "Ninja", Weekday: time.Thursday, StartTime: "16:00", Duration: 60},
+		},
+	}}}
+	schools := map[string]*School{school.Id.Hex(): school}
+	enrollment := func(childId, class string, state EnrollmentState, waitlisted bool) Enrollment {
+		return Enrollment{Id: bson.NewObjectId(), ChildId: childId, SchoolId: school.Id.Hex(), Season: "Fall", Class: class, State: state, Waitlisted: waitlisted}
+	}
+
+	sessions, err := EnrolledSessions([]Enrollment{
+		enrollment("a", "Preschool", Active, false),
+		enrollment("b", "Preschool", Registered, false),
+		enrollment("c", "Ninja", Registered, true),
+		enrollment("d", "Ninja", Withdrawn, false),
+	}, schools, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// Tuesdays in September 2016 are the 6th, 13th, 20th and 27th
+	if len(sessions) != 4 || sessions[0].Class != "Preschool" || sessions[0].School != "Acton" {
+		t.Error("Expected the Preschool sessions once each and none of the Ninja class, got ", sessions)
+	}
+	if sessions, _ = EnrolledSessions([]Enrollment{enrollment("a", "", Active, false)}, schools, time.Time{}, time.Time{}); len(sessions) != 9 {
+		t.Error("Expected an enrollment without a class to take every class of the season, got ", len(sessions))
+	}
+}
@@ -0,0 +1,341 @@
+package db
+
+import (
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// defaultSearchLimit is how many results a search returns when no limit is given.
+const defaultSearchLimit = 25
+
+// Kinds of search result.
+const (
+	ParentResult = "parent"
+	ChildResult  = "child"
+	SchoolResult = "school"
+)
+
+// How well a word of the query matched a word of a field, best first.
+const (
+	exactMatch    = 1.0
+	prefixMatch   = 0.9
+	typoMatch     = 0.7
+	phoneticMatch = 0.6
+)
+
+// SearchResult is a parent, child or school matching a search. Highlights holds the fields that matched with
+// the matching parts wrapped in <mark> tags.
+type SearchResult struct {
+	Kind       string            `json:"kind"`
+	Id         string            `json:"id"`
+	ClientId   string            `json:"clientid,omitempty"`
+	Name       string            `json:"name"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+// searchField is a field of a searchable record.
+type searchField struct {
+	name   string
+	value  string
+	weight float64
+	phone  bool
+}
+
+// searchRecord is a parent, child or school as the search sees it.
+type searchRecord struct {
+	result SearchResult
+	fields []searchField
+}
+
+// span is where a word starts and ends in a string, in bytes.
+type span struct {
+	start, end int
+}
+
+// words splits the string into lower cased words of letters and digits, with where each one is.
+func words(s string) (tokens []string, spans []span) {
+	start := -1
+	for i, r := range s {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if inWord && start < 0 {
+			start = i
+		}
+		if !inWord && start >= 0 {
+			tokens = append(tokens, strings.ToLower(s[start:i]))
+			spans = append(spans, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, strings.ToLower(s[start:]))
+		spans = append(spans, span{start, len(s)})
+	}
+	return
+}
+
+// soundex codes a word by how it sounds, so Smith and Smyth or Catherine and Kathryn share a code. Words
+// that don't start with a letter have none.
+func soundex(word string) string {
+	codes := map[rune]byte{
+		'b': '1', 'f': '1', 'p': '1', 'v': '1',
+		'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+		'd': '3', 't': '3', 'l': '4', 'm': '5', 'n': '5', 'r': '6',
+	}
+	var code []byte
+	var last byte
+	for i, r := range strings.ToLower(word) {
+		if r < 'a' || r > 'z' {
+			if i == 0 {
+				return ""
+			}
+			continue
+		}
+		digit := codes[r]
+		if i == 0 {
+			code = append(code, byte(unicode.ToUpper(r)))
+		} else if digit != 0 && digit != last {
+			code = append(code, digit)
+		}
+		// H and W don't separate letters with the same code, vowels do
+		if r != 'h' && r != 'w' {
+			last = digit
+		}
+		if len(code) == 4 {
+			break
+		}
+	}
+	if len(code) == 0 {
+		return ""
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+// maxTypos is how many letters a word of the query may get wrong and still match, more for longer words.
+func maxTypos(term string) int {
+	switch n := len([]rune(term)); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// matchWord scores how well a word of the query matches a word of a field.
+func matchWord(term, word string) float64 {
+	switch {
+	case term == word:
+		return exactMatch
+	case len(term) >= 2 && strings.HasPrefix(word, term):
+		return prefixMatch
+	}
+	if typos := maxTypos(term); typos > 0 {
+		// A word is compared with its start too, so a misspelt beginning still finds longer words
+		candidate := word
+		if n := len([]rune(term)); len([]rune(word)) > n+typos {
+			candidate = string([]rune(word)[:n])
+		}
+		if d := levenshtein(term, candidate); d <= typos {
+			return typoMatch - 0.1*float64(d-1)
+		}
+	}
+	if len(term) >= 3 && unicode.IsLetter([]rune(term)[0]) && soundex(term) == soundex(word) {
+		return phoneticMatch
+	}
+	return 0
+}
+
+// matchPhone finds the digits of the query in a phone number, however either is punctuated, and returns
+// where they are in the phone number.
+func matchPhone(digits, phone string) (found span, ok bool) {
+	var positions []int
+	var phoneDigits []byte
+	for i := 0; i < len(phone); i++ {
+		if phone[i] >= '0' && phone[i] <= '9' {
+			positions = append(positions, i)
+			phoneDigits = append(phoneDigits, phone[i])
+		}
+	}
+	at := strings.Index(string(phoneDigits), digits)
+	if at < 0 {
+		return
+	}
+	return span{positions[at], positions[at+len(digits)-1] + 1}, true
+}
+
+// highlight wraps the spans of the string in <mark> tags, escaping the rest so the result is safe to show
+// as HTML.
+func highlight(s string, spans []span) string {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var b strings.Builder
+	at := 0
+	for _, sp := range spans {
+		if sp.start < at {
+			continue
+		}
+		b.WriteString(html.EscapeString(s[at:sp.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(s[sp.start:sp.end]))
+		b.WriteString("</mark>")
+		at = sp.end
+	}
+	b.WriteString(html.EscapeString(s[at:]))
+	return b.String()
+}
+
+// queryDigits returns the digits of a query that looks like part of a phone number.
+func queryDigits(query string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, query)
+	if len(digits) < 4 || strings.IndexFunc(query, unicode.IsLetter) >= 0 {
+		return ""
+	}
+	return digits
+}
+
+// match scores the record against the words of the query. Every word has to match a field; the score is
+// the average of how well each matched, weighted by the field. A query of phone digits matches phones only.
+func (record *searchRecord) match(terms []string, digits string) (score float64, highlights map[string]string) {
+	marks := make(map[int][]span)
+	if digits != "" {
+		for i, f := range record.fields {
+			if !f.phone {
+				continue
+			}
+			if found, ok := matchPhone(digits, f.value); ok && f.weight > score {
+				score = f.weight
+				marks = map[int][]span{i: {found}}
+			}
+		}
+	} else {
+		for _, term := range terms {
+			best, bestField, bestSpan := 0.0, -1, span{}
+			for i, f := range record.fields {
+				if f.phone {
+					continue
+				}
+				tokens, spans := words(f.value)
+				for j, word := range tokens {
+					m := matchWord(term, word)
+					if s := m * f.weight; s > best {
+						best, bestField, bestSpan = s, i, spans[j]
+						// Only the start of a word matched by its start is marked
+						if m == prefixMatch {
+							bestSpan.end = bestSpan.start + len(term)
+						}
+					}
+				}
+			}
+			if bestField < 0 {
+				return 0, nil
+			}
+			score += best / float64(len(terms))
+			marks[bestField] = append(marks[bestField], bestSpan)
+		}
+	}
+	if score == 0 {
+		return 0, nil
+	}
+	highlights = make(map[string]string)
+	for i, spans := range marks {
+		highlights[record.fields[i].name] = highlight(record.fields[i].value, spans)
+	}
+	return score, highlights
+}
+
+// searchRecords turns clients and schools into the parents, children and schools a search looks through.
+func searchRecords(clients []Client, schools []School) (records []searchRecord) {
+	for i := range clients {
+		client := &clients[i]
+		clientId := client.Id.Hex()
+		for _, g := range client.Guardians {
+			records = append(records, searchRecord{
+				result: SearchResult{Kind: ParentResult, Id: g.Id.Hex(), ClientId: clientId, Name: strings.TrimSpace(g.FirstName + " " + g.LastName)},
+				fields: []searchField{
+					{name: "firstname", value: g.FirstName, weight: 1},
+					{name: "lastname", value: g.LastName, weight: 1},
+					{name: "emailaddress", value: g.EmailAddress, weight: 0.9},
+					{name: "homephone", value: g.HomePhone, weight: 0.9, phone: true},
+					{name: "mobilephone", value: g.MobilePhone, weight: 0.9, phone: true},
+				},
+			})
+		}
+		for _, child := range client.Children {
+			records = append(records, searchRecord{
+				result: SearchResult{Kind: ChildResult, Id: child.Id.Hex(), ClientId: clientId, Name: strings.TrimSpace(child.FirstName + " " + child.LastName)},
+				fields: []searchField{
+					{name: "firstname", value: child.FirstName, weight: 1},
+					{name: "lastname", value: child.LastName, weight: 1},
+				},
+			})
+		}
+	}
+	for _, school := range schools {
+		records = append(records, searchRecord{
+			result: SearchResult{Kind: SchoolResult, Id: school.Id.Hex(), Name: school.Name},
+			fields: []searchField{
+				{name: "name", value: school.Name, weight: 0.95},
+				{name: "city", value: school.City, weight: 0.5},
+				{name: "mainphone", value: school.MainPhone, weight: 0.8, phone: true},
+			},
+		})
+	}
+	return
+}
+
+// SearchRecords searches the parents and children of the clients, and the schools, for the query, matching
+// whole words, the start of words, words with a typo or two and words that sound alike. The best matches
+// come first, at most limit of them. It works on records already in memory, so any store can search with it.
+func SearchRecords(query string, clients []Client, schools []School, limit int) (results []SearchResult) {
+	terms, _ := words(query)
+	digits := queryDigits(query)
+	if len(terms) == 0 {
+		return
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	for _, record := range searchRecords(clients, schools) {
+		score, highlights := record.match(terms, digits)
+		if score == 0 {
+			continue
+		}
+		result := record.result
+		result.Score = float64(int(score*1000+0.5)) / 1000
+		result.Highlights = highlights
+		results = append(results, result)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return
+}
+
+// Search finds parents, children and schools matching the query, best matches first.
+func (c *MongoConnection) Search(query string, limit int) (results []SearchResult, err error) {
+	clients, err := c.ListClients()
+	if err != nil {
+		return
+	}
+	schools, err := c.ListSchools()
+	if err != nil {
+		return
+	}
+	return SearchRecords(query, clients, schools, limit), nil
+}
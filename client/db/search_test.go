@@ -0,0 +1,62 @@
+package db
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+)
+
+func TestSearchRecords(t *testing.T) {
+	if soundex("Smith") != "S530" || soundex("Smyth") != "S530" || soundex("Ashcraft") != "A261" || soundex("Tymczak") != "T522" {
+		t.Error("Expected the standard soundex codes, got ", soundex("Smith"), soundex("Smyth"), soundex("Ashcraft"), soundex("Tymczak"))
+	}
+	clients := []Client{
+		family("Catherine", "Smith", "cathy@example.com", "(555) 010-1234",
+			&Child{Id: bson.NewObjectId(), FirstName: "Oliver", LastName: "Smith"}),
+		family("Bob", "Brown", "bob@example.com", "555-020-0000",
+			&Child{Id: bson.NewObjectId(), FirstName: "Olivia", LastName: "Brown"}),
+	}
+	schools := []School{{Id: bson.NewObjectId(), Name: "Maple Elementary", City: "Springfield", MainPhone: "555-030-0000"}}
+
+	results := SearchRecords("cath smith", clients, schools, 0)
+	if len(results) != 1 || results[0].Kind != ParentResult || results[0].Name != "Catherine Smith" {
+		t.Fatal("Expected only Catherine for a prefix of the name, got ", results)
+	}
+	if results[0].Highlights["firstname"] != "<mark>Cath</mark>erine" || results[0].Highlights["lastname"] != "<mark>Smith</mark>" {
+		t.Error("Expected the matching parts of the name highlighted, got ", results[0].Highlights)
+	}
+	if results[0].ClientId != clients[0].Id.Hex() {
+		t.Error("Expected the parent to carry the id of the client")
+	}
+	if results = SearchRecords("smith", clients, schools, 0); len(results) != 2 || results[1].Kind != ChildResult || results[1].Name != "Oliver Smith" {
+		t.Error("Expected Oliver to match on the family last name, got ", results)
+	}
+
+	if results = SearchRecords("Smyth", clients, schools, 0); len(results) != 2 || results[0].Score != typoMatch {
+		t.Error("Expected Smyth to find the Smiths despite the typo, got ", results)
+	}
+	if results = SearchRecords("Smeeth", clients, schools, 0); len(results) != 2 || results[0].Score != phoneticMatch {
+		t.Error("Expected Smeeth to find the Smiths by sound, got ", results)
+	}
+	if results = SearchRecords("Olivr", clients, schools, 0); len(results) != 1 || results[0].Name != "Oliver Smith" {
+		t.Error("Expected a typo to find Oliver and not Olivia, got ", results)
+	}
+	if results = SearchRecords("mapel elementary", clients, schools, 0); len(results) != 1 || results[0].Kind != SchoolResult ||
+		results[0].Highlights["name"] != "<mark>Maple</mark> <mark>Elementary</mark>" {
+		t.Error("Expected the school found despite the typo, got ", results)
+	}
+	if results = SearchRecords("010 1234", clients, schools, 0); len(results) != 1 || results[0].Highlights["mobilephone"] != "(555) <mark>010-1234</mark>" {
+		t.Error("Expected the phone found however it is punctuated, got ", results)
+	}
+	if results = SearchRecords("cathy@example", clients, schools, 0); len(results) != 1 || results[0].Highlights["emailaddress"] != "<mark>cathy</mark>@<mark>example</mark>.com" {
+		t.Error("Expected the email found, got ", results)
+	}
+	if got := highlight("<b>Tom & Jerry</b>", []span{{3, 6}}); got != "&lt;b&gt;<mark>Tom</mark> &amp; Jerry&lt;/b&gt;" {
+		t.Error("Expected the text around the highlights escaped, got ", got)
+	}
+	if results = SearchRecords("o", clients, schools, 1); len(results) != 0 {
+		t.Error("Expected a single letter to only match whole words, got ", results)
+	}
+	if results = SearchRecords("oli", clients, schools, 1); len(results) != 1 {
+		t.Error("Expected the limit to cap the results, got ", results)
+	}
+}
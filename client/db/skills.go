@@ -0,0 +1,437 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"time"
+)
+
+// Rating is how far a child has come with a skill.
+type Rating string
+
+const (
+	Introduced Rating = "introduced"
+	Developing Rating = "developing"
+	Mastered   Rating = "mastered"
+)
+
+// Skill is a tumbling skill instructors assess, for example a forward roll or a cartwheel.
+type Skill struct {
+	Code        string `bson:"code" json:"code"`
+	Name        string `bson:"name" json:"name"`
+	Description string `bson:"description" json:"description"`
+}
+
+// SkillLevel is a level of the skills catalogue. A child completes the level, and is awarded a certificate,
+// once every skill of the level is mastered.
+type SkillLevel struct {
+	Level  int      `bson:"_id" json:"level"`
+	Name   string   `bson:"name" json:"name"`
+	Skills []*Skill `bson:"skills" json:"skills"`
+}
+
+// Assessment records how a child performed a skill when an instructor assessed it.
+type Assessment struct {
+	Id         bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	ClientId   string        `bson:"clientid" json:"clientid"`
+	ChildId    string        `bson:"childid" json:"childid"`
+	SkillCode  string        `bson:"skillcode" json:"skillcode"`
+	Rating     Rating        `bson:"rating" json:"rating"`
+	Instructor string        `bson:"instructor" json:"instructor"`
+	Notes      string        `bson:"notes" json:"notes"`
+	Assessed   time.Time     `bson:"assessed" json:"assessed"`
+}
+
+// SkillProgress is the latest assessment of a skill for a child.
+type SkillProgress struct {
+	Level    int       `json:"level"`
+	Code     string    `json:"code"`
+	Name     string    `json:"name"`
+	Rating   Rating    `json:"rating"`
+	Assessed time.Time `json:"assessed"`
+}
+
+// ProgressReport shows where a child is with every skill of the catalogue.
+type ProgressReport struct {
+	ClientId        string          `json:"clientid"`
+	ChildId         string          `json:"childid"`
+	ChildName       string          `json:"childname"`
+	Class           string          `json:"class,omitempty"`
+	Skills          []SkillProgress `json:"skills"`
+	LevelsCompleted []int           `json:"levelscompleted"`
+	CurrentLevel    int             `json:"currentlevel"`
+	Certificates    []Certificate   `json:"certificates"`
+}
+
+// Certificate is awarded to a child for completing a level of the skills catalogue. The PDF is generated
+// when the level is completed and kept with the certificate.
+type Certificate struct {
+	Id        bson.ObjectId `bson:"_id,omitempty" json:"id"`
+	ClientId  string        `bson:"clientid" json:"clientid"`
+	ChildId   string        `bson:"childid" json:"childid"`
+	ChildName string        `bson:"childname" json:"childname"`
+	Level     int           `bson:"level" json:"level"`
+	LevelName string        `bson:"levelname" json:"levelname"`
+	Awarded   time.Time     `bson:"awarded" json:"awarded"`
+	PDF       []byte        `bson:"pdf" json:"-"`
+}
+
+// Valid reports whether r is a known rating.
+func (r Rating) Valid() bool {
+	return r == Introduced || r == Developing || r == Mastered
+}
+
+// Validate checks that the level has a name and skills with unique codes.
+func (l *SkillLevel) Validate() (err error) {
+	if l.Level <= 0 {
+		return fmt.Errorf("Invalid skill level %d", l.Level)
+	}
+	if l.Name == "" || len(l.Skills) == 0 {
+		return fmt.Errorf("Skill level %d requires a name and at least one skill", l.Level)
+	}
+	codes := make(map[string]bool)
+	for _, skill := range l.Skills {
+		if skill.Code == "" || skill.Name == "" {
+			return fmt.Errorf("Skills of level %d require a code and a name", l.Level)
+		}
+		if codes[skill.Code] {
+			return fmt.Errorf("Skill %s is listed twice in level %d", skill.Code, l.Level)
+		}
+		codes[skill.Code] = true
+	}
+	return
+}
+
+// findSkill returns the level and skill of the catalogue with the given code.
+func findSkill(levels []SkillLevel, code string) (*SkillLevel, *Skill) {
+	for i := range levels {
+		for _, skill := range levels[i].Skills {
+			if skill.Code == code {
+				return &levels[i], skill
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Progress works out the latest rating of each skill of the catalogue from the assessments of a child and
+// the levels the child has completed.
+func Progress(levels []SkillLevel, assessments []Assessment) (skills []SkillProgress, completed []int) {
+	latest := make(map[string]Assessment)
+	for _, a := range assessments {
+		if previous, ok := latest[a.SkillCode]; !ok || !a.Assessed.Before(previous.Assessed) {
+			latest[a.SkillCode] = a
+		}
+	}
+	for _, level := range levels {
+		complete := true
+		for _, skill := range level.Skills {
+			progress := SkillProgress{Level: level.Level, Code: skill.Code, Name: skill.Name}
+			if a, ok := latest[skill.Code]; ok {
+				progress.Rating = a.Rating
+				progress.Assessed = a.Assessed
+			}
+			complete = complete && progress.Rating == Mastered
+			skills = append(skills, progress)
+		}
+		if complete {
+			completed = append(completed, level.Level)
+		}
+	}
+	return
+}
+
+// SetSkillLevel adds a level to the skills catalogue or replaces the level with the same number.
+func (c *MongoConnection) SetSkillLevel(level *SkillLevel) (err error) {
+	if err = level.Validate(); err != nil {
+		return
+	}
+	levels, err := c.ListSkillLevels()
+	if err != nil {
+		return
+	}
+	for _, skill := range level.Skills {
+		if other, _ := findSkill(levels, skill.Code); other != nil && other.Level != level.Level {
+			return fmt.Errorf("Skill %s is already part of level %d", skill.Code, other.Level)
+		}
+	}
+
+	session, skillCollection, err := c.getCollection(skillCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	_, err = skillCollection.UpsertId(level.Level, level)
+	return
+}
+
+// ListSkillLevels returns the skills catalogue in level order.
+func (c *MongoConnection) ListSkillLevels() (levels []SkillLevel, err error) {
+	session, skillCollection, err := c.getCollection(skillCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = skillCollection.Find(nil).Sort("_id").All(&levels)
+	return
+}
+
+// AddAssessment records an assessment of a skill of a child of the client. When the assessment completes a
+// level a certificate is generated and attached to the child.
+func (c *MongoConnection) AddAssessment(clientId, childId string, assessment *Assessment) (certificate *Certificate, err error) {
+	if !assessment.Rating.Valid() {
+		return nil, fmt.Errorf("Unknown rating %q, expected %s, %s or %s", assessment.Rating, Introduced, Developing, Mastered)
+	}
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+	child := client.findChild(childId)
+	if child == nil {
+		return nil, fmt.Errorf("Child %s not found for client %s", childId, clientId)
+	}
+	levels, err := c.ListSkillLevels()
+	if err != nil {
+		return
+	}
+	level, _ := findSkill(levels, assessment.SkillCode)
+	if level == nil {
+		return nil, fmt.Errorf("Skill %s is not in the skills catalogue", assessment.SkillCode)
+	}
+
+	session, assessmentCollection, err := c.getCollection(assessmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	assessment.Id = bson.NewObjectId()
+	assessment.ClientId = clientId
+	assessment.ChildId = childId
+	if assessment.Assessed.IsZero() {
+		assessment.Assessed = time.Now()
+	}
+	if err = assessmentCollection.Insert(assessment); err != nil {
+		return
+	}
+	if assessment.Rating != Mastered {
+		return
+	}
+
+	assessments, err := c.ListAssessments(childId)
+	if err != nil {
+		return
+	}
+	_, completed := Progress([]SkillLevel{*level}, assessments)
+	if len(completed) == 0 {
+		return
+	}
+	return c.awardCertificate(client, child, level)
+}
+
+// ListAssessments returns every assessment of a child in the order they were made.
+func (c *MongoConnection) ListAssessments(childId string) (assessments []Assessment, err error) {
+	session, assessmentCollection, err := c.getCollection(assessmentCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = assessmentCollection.Find(bson.M{"childid": childId}).Sort("assessed", "_id").All(&assessments)
+	return
+}
+
+// awardCertificate generates the certificate of the level for the child and attaches it to the child.
+// A level is only ever certified once, so mastering a skill again returns no new certificate.
+func (c *MongoConnection) awardCertificate(client *Client, child *Child, level *SkillLevel) (certificate *Certificate, err error) {
+	session, certificateCollection, err := c.getCollection(certificateCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	schoolName := ""
+	if bson.IsObjectIdHex(client.School) {
+		if school, schoolErr := c.GetSchoolById(bson.ObjectIdHex(client.School)); schoolErr == nil {
+			schoolName = school.Name
+		}
+	}
+	certificate = &Certificate{
+		Id:        bson.NewObjectId(),
+		ClientId:  client.Id.Hex(),
+		ChildId:   child.Id.Hex(),
+		ChildName: child.FirstName + " " + child.LastName,
+		Level:     level.Level,
+		LevelName: level.Name,
+		Awarded:   time.Now(),
+	}
+	certificate.PDF = certificatePDF(certificate, level, schoolName)
+	if err = certificateCollection.Insert(certificate); err != nil {
+		if mgo.IsDup(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	clientSession, clientCollection, _, err := c.getSessionAndCollection()
+	if err != nil {
+		return
+	}
+	defer clientSession.Close()
+
+	err = clientCollection.Update(
+		bson.M{"_id": client.Id, "children._id": child.Id},
+		bson.M{"$addToSet": bson.M{"children.$.certificates": certificate.Id.Hex()}},
+	)
+	return
+}
+
+// certificatePDF lays out the certificate for a completed level.
+func certificatePDF(certificate *Certificate, level *SkillLevel, schoolName string) []byte {
+	const middle = 396.0
+	lines := []pdfLine{
+		{Text: "Certificate of Achievement", Size: 36, Bold: true, X: middle, Y: 470, Center: true},
+		{Text: "This certifies that", Size: 16, X: middle, Y: 410, Center: true},
+		{Text: certificate.ChildName, Size: 32, Bold: true, X: middle, Y: 360, Center: true},
+		{Text: fmt.Sprintf("has completed level %d, %s", level.Level, level.Name), Size: 18, X: middle, Y: 310, Center: true},
+	}
+	y := 275.0
+	for _, skill := range level.Skills {
+		lines = append(lines, pdfLine{Text: skill.Name, Size: 12, X: middle, Y: y, Center: true})
+		y -= 16
+	}
+	if schoolName != "" {
+		lines = append(lines, pdfLine{Text: "TumbleBus at " + schoolName, Size: 14, X: 90, Y: 80})
+	} else {
+		lines = append(lines, pdfLine{Text: "TumbleBus", Size: 14, X: 90, Y: 80})
+	}
+	lines = append(lines, pdfLine{Text: certificate.Awarded.Format("January 2, 2006"), Size: 14, X: 560, Y: 80})
+	return renderPDF(certificate.ChildName+" - "+level.Name, lines, true)
+}
+
+// ListCertificates returns the certificates awarded to a child of the client, without their PDFs.
+func (c *MongoConnection) ListCertificates(clientId, childId string) (certificates []Certificate, err error) {
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+	if client.findChild(childId) == nil {
+		return nil, fmt.Errorf("Child %s not found for client %s", childId, clientId)
+	}
+	return c.certificates(clientId, childId)
+}
+
+// certificates returns the certificates awarded to the child of the client, without their PDFs.
+func (c *MongoConnection) certificates(clientId, childId string) (certificates []Certificate, err error) {
+	session, certificateCollection, err := c.getCollection(certificateCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	query := bson.M{"clientid": clientId, "childid": childId}
+	err = certificateCollection.Find(query).Select(bson.M{"pdf": 0}).Sort("level").All(&certificates)
+	return
+}
+
+// GetCertificate returns a certificate together with its PDF.
+func (c *MongoConnection) GetCertificate(id string) (certificate *Certificate, err error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, fmt.Errorf("Invalid certificate id %q", id)
+	}
+	session, certificateCollection, err := c.getCollection(certificateCollectionName)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	err = certificateCollection.FindId(bson.ObjectIdHex(id)).One(&certificate)
+	return
+}
+
+// ChildProgress returns the progress report of a child of the client.
+func (c *MongoConnection) ChildProgress(clientId, childId string) (report *ProgressReport, err error) {
+	client, err := c.GetClientById(clientId)
+	if err != nil {
+		return
+	}
+	child := client.findChild(childId)
+	if child == nil {
+		return nil, fmt.Errorf("Child %s not found for client %s", childId, clientId)
+	}
+	levels, err := c.ListSkillLevels()
+	if err != nil {
+		return
+	}
+	return c.progressReport(levels, client, child)
+}
+
+// progressReport builds the progress report of a child against the skills catalogue.
+func (c *MongoConnection) progressReport(levels []SkillLevel, client *Client, child *Child) (report *ProgressReport, err error) {
+	assessments, err := c.ListAssessments(child.Id.Hex())
+	if err != nil {
+		return
+	}
+	certificates, err := c.certificates(client.Id.Hex(), child.Id.Hex())
+	if err != nil {
+		return
+	}
+	report = &ProgressReport{
+		ClientId:     client.Id.Hex(),
+		ChildId:      child.Id.Hex(),
+		ChildName:    child.FirstName + " " + child.LastName,
+		Certificates: certificates,
+	}
+	report.Skills, report.LevelsCompleted = Progress(levels, assessments)
+
+	// The current level is the first one not completed yet
+	done := make(map[int]bool)
+	for _, level := range report.LevelsCompleted {
+		done[level] = true
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Level < levels[j].Level })
+	for _, level := range levels {
+		if !done[level.Level] {
+			report.CurrentLevel = level.Level
+			break
+		}
+	}
+	return
+}
+
+// ClassProgress returns the progress reports of the children on the roster of a class.
+func (c *MongoConnection) ClassProgress(schoolName, season, class string) (reports []ProgressReport, err error) {
+	if class == "" {
+		return nil, errors.New("A class is required for a class progress report")
+	}
+	roster, err := c.ListRoster(schoolName, season, class)
+	if err != nil {
+		return
+	}
+	levels, err := c.ListSkillLevels()
+	if err != nil {
+		return
+	}
+	for _, entry := range roster {
+		client, clientErr := c.GetClientById(entry.ClientId)
+		if clientErr != nil {
+			return nil, clientErr
+		}
+		child := client.findChild(entry.ChildId)
+		if child == nil {
+			continue
+		}
+		report, reportErr := c.progressReport(levels, client, child)
+		if reportErr != nil {
+			return nil, reportErr
+		}
+		report.Class = entry.Class
+		reports = append(reports, *report)
+	}
+	return
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSkillProgress(t *testing.T) {
+	levels := []SkillLevel{
+		SkillLevel{Level: 1, Name: "Rollers", Skills: []*Skill{
+			&Skill{Code: "forward-roll", Name: "Forward roll"},
+			&Skill{Code: "log-roll", Name: "Log roll"},
+		}},
+		SkillLevel{Level: 2, Name: "Wheelers", Skills: []*Skill{
+			&Skill{Code: "cartwheel", Name: "Cartwheel"},
+		}},
+	}
+	for _, level := range levels {
+		if err := level.Validate(); err != nil {
+			t.Error(err.Error())
+		}
+	}
+
+	day := time.Date(2017, time.March, 1, 16, 0, 0, 0, time.Local)
+	assessments := []Assessment{
+		Assessment{SkillCode: "forward-roll", Rating: Developing, Assessed: day},
+		Assessment{SkillCode: "forward-roll", Rating: Mastered, Assessed: day.AddDate(0, 0, 7)},
+		Assessment{SkillCode: "log-roll", Rating: Mastered, Assessed: day},
+		Assessment{SkillCode: "cartwheel", Rating: Mastered, Assessed: day},
+		Assessment{SkillCode: "cartwheel", Rating: Developing, Assessed: day.AddDate(0, 0, 14)},
+	}
+	skills, completed := Progress(levels, assessments)
+	if len(skills) != 3 {
+		t.Fatal("Expected progress for every skill of the catalogue: ", skills)
+	}
+	if skills[0].Rating != Mastered || skills[2].Rating != Developing {
+		t.Error("The latest assessment of each skill should count: ", skills)
+	}
+	if len(completed) != 1 || completed[0] != 1 {
+		t.Error("Expected only level 1 to be completed: ", completed)
+	}
+
+	if err := (&SkillLevel{Level: 3, Name: "Twice", Skills: []*Skill{
+		&Skill{Code: "handstand", Name: "Handstand"}, &Skill{Code: "handstand", Name: "Handstand"},
+	}}).Validate(); err == nil {
+		t.Error("A skill should only be listed once in a level")
+	}
+}
+
+func TestCertificatePDF(t *testing.T) {
+	certificate := &Certificate{ChildName: "Anna (Annie) Smith", Awarded: time.Date(2017, time.March, 8, 0, 0, 0, 0, time.Local)}
+	level := &SkillLevel{Level: 1, Name: "Rollers", Skills: []*Skill{&Skill{Code: "forward-roll", Name: "Forward roll"}}}
+	pdf := certificatePDF(certificate, level, "Acton Elementary")
+
+	if !bytes.HasPrefix(pdf, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(pdf, []byte("%%EOF\n")) {
+		t.Fatal("Expected a PDF header and trailer")
+	}
+	if !bytes.Contains(pdf, []byte(`(Anna \(Annie\) Smith)`)) {
+		t.Error("Parentheses in names should be escaped")
+	}
+
+	// Every entry of the cross reference table should point at its object
+	startxref := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)
+	if startxref == nil {
+		t.Fatal("Missing startxref")
+	}
+	xref, _ := strconv.Atoi(string(startxref[1]))
+	if !bytes.HasPrefix(pdf[xref:], []byte("xref\n")) {
+		t.Fatal("startxref does not point at the cross reference table")
+	}
+	offsets := regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf[xref:], -1)
+	for i, offset := range offsets {
+		at, _ := strconv.Atoi(string(offset[1]))
+		if !bytes.HasPrefix(pdf[at:], []byte(fmt.Sprintf("%d 0 obj\n", i+1))) {
+			t.Errorf("Object %d is not at offset %d", i+1, at)
+		}
+	}
+}
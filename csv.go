@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/csv"
+	"github.com/jrjsb4/tumblebus/client/db"
+	"io"
+	"strconv"
+)
+
+// money formats an amount of money with two decimals.
+func money(amount float64) string {
+	return strconv.FormatFloat(amount, 'f', 2, 64)
+}
+
+// mileage formats a distance in miles with one decimal, or as unknown when it couldn't be worked out.
+func mileage(miles float64, unknown bool) string {
+	if unknown {
+		return "unknown"
+	}
+	return strconv.FormatFloat(miles, 'f', 1, 64)
+}
+
+// WritePayrollCSV writes the payroll as CSV with one row per instructor per day worked and a total row for
+// each instructor, ready to import into a spreadsheet or payroll service.
+func WritePayrollCSV(out io.Writer, payroll []db.Earnings) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"instructorid", "instructor", "date", "sessions", "sessionpay", "miles", "mileagepay", "total"})
+	for _, e := range payroll {
+		for _, day := range e.Days {
+			w.Write([]string{
+				e.InstructorId,
+				e.InstructorName,
+				day.Date.Format(dateFormat),
+				strconv.Itoa(day.Sessions),
+				money(day.SessionPay),
+				mileage(day.Miles, day.MilesUnknown),
+				money(day.MileagePay),
+				money(day.Total),
+			})
+		}
+		w.Write([]string{
+			e.InstructorId,
+			e.InstructorName,
+			"total",
+			strconv.Itoa(e.Sessions),
+			money(e.SessionPay),
+			mileage(e.Miles, e.MilesUnknown),
+			money(e.MileagePay),
+			money(e.Total),
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// WritePayoutsCSV writes one row per season of each payout, for reconciling revenue share payouts to host
+// schools in a spreadsheet.
+func WritePayoutsCSV(out io.Writer, payouts []db.Payout) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"payoutid", "school", "from", "to", "status", "reference", "season", "families", "payments", "collected", "percent", "share"})
+	for _, p := range payouts {
+		for _, line := range p.Lines {
+			w.Write([]string{
+				p.Id.Hex(),
+				p.School,
+				p.From.Format(dateFormat),
+				p.To.Format(dateFormat),
+				string(p.Status),
+				p.Reference,
+				line.Season,
+				strconv.Itoa(line.Families),
+				strconv.Itoa(line.Payments),
+				money(line.Collected),
+				strconv.FormatFloat(p.Percent, 'f', -1, 64),
+				money(line.Share),
+			})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// WriteJournalCSV writes the journal with one row per posting. Rows of the same entry share its id, so the
+// file imports as a general journal into most accounting packages.
+func WriteJournalCSV(out io.Writer, entries []db.JournalEntry) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"entryid", "date", "source", "name", "memo", "account", "debit", "credit"})
+	for _, e := range entries {
+		for _, p := range e.Postings {
+			debit, credit := "", ""
+			if p.Debit != 0 {
+				debit = money(p.Debit)
+			}
+			if p.Credit != 0 {
+				credit = money(p.Credit)
+			}
+			w.Write([]string{e.Id, e.Date.Format(dateFormat), e.Source, e.Name, e.Memo, p.Account, debit, credit})
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/jrjsb4/tumblebus/client/db"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Export formats.
+const (
+	CSVExport   = "csv"
+	JSONLExport = "jsonl"
+	ExcelExport = "xlsx"
+)
+
+// flushRows is how many rows are written between flushes of an export to the client.
+const flushRows = 500
+
+// flusher is satisfied by response writers that can send what has been written so far.
+type flusher interface {
+	Flush()
+}
+
+// csvExport writes an export as CSV. Text that a spreadsheet would run as a formula is quoted with an
+// apostrophe. For Excel the file starts with a byte order mark so accents survive, lines end in CRLF, and
+// phone numbers are written as text so they aren't turned into numbers such as 1.6E+10.
+type csvExport struct {
+	out    io.Writer
+	w      *csv.Writer
+	excel  bool
+	phones map[int]bool
+	rows   int
+}
+
+func newCSVExport(out io.Writer, excel bool) *csvExport {
+	w := csv.NewWriter(out)
+	w.UseCRLF = excel
+	return &csvExport{out: out, w: w, excel: excel}
+}
+
+// Columns writes the heading row, noting which columns hold phone numbers.
+func (e *csvExport) Columns(columns []string) error {
+	e.phones = make(map[int]bool)
+	for i, column := range columns {
+		if strings.HasSuffix(column, "phone") {
+			e.phones[i] = true
+		}
+	}
+	if e.excel {
+		if _, err := io.WriteString(e.out, "\ufeff"); err != nil {
+			return err
+		}
+	}
+	return e.w.Write(columns)
+}
+
+// Row writes a row, flushing every so often.
+func (e *csvExport) Row(values []string) error {
+	for i, v := range values {
+		if e.excel && e.phones[i] {
+			values[i] = excelText(v)
+		} else {
+			values[i] = formulaSafe(v)
+		}
+	}
+	if err := e.w.Write(values); err != nil {
+		return err
+	}
+	if e.rows++; e.rows%flushRows == 0 {
+		return e.Flush()
+	}
+	return nil
+}
+
+// Flush sends the rows written so far.
+func (e *csvExport) Flush() error {
+	e.w.Flush()
+	if f, ok := e.out.(flusher); ok {
+		f.Flush()
+	}
+	return e.w.Error()
+}
+
+// excelText makes Excel keep the value as text, as a formula that is only a quoted string.
+func excelText(v string) string {
+	if v == "" {
+		return v
+	}
+	return `="` + strings.Replace(v, `"`, `""`, -1) + `"`
+}
+
+// formulaSafe stops a spreadsheet treating text such as =SUM(A1) or @cmd as a formula. Numbers are left
+// alone.
+func formulaSafe(v string) string {
+	if v == "" || !strings.ContainsAny(v[:1], "=+-@\t\r") {
+		return v
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return v
+	}
+	return "'" + v
+}
+
+// jsonlExport writes an export as JSON Lines, one object per row keyed by the column names.
+type jsonlExport struct {
+	out     io.Writer
+	w       *bufio.Writer
+	columns []string
+	rows    int
+}
+
+func newJSONLExport(out io.Writer) *jsonlExport {
+	return &jsonlExport{out: out, w: bufio.NewWriter(out)}
+}
+
+// Columns keeps the column names for the rows.
+func (e *jsonlExport) Columns(columns []string) error {
+	e.columns = columns
+	return nil
+}
+
+// Row writes a row as an object, flushing every so often.
+func (e *jsonlExport) Row(values []string) error {
+	object := make(map[string]string, len(values))
+	for i, column := range e.columns {
+		if i < len(values) {
+			object[column] = values[i]
+		}
+	}
+	line, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	e.w.Write(line)
+	if err = e.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	if e.rows++; e.rows%flushRows == 0 {
+		return e.Flush()
+	}
+	return nil
+}
+
+// Flush sends the rows written so far.
+func (e *jsonlExport) Flush() error {
+	err := e.w.Flush()
+	if f, ok := e.out.(flusher); ok {
+		f.Flush()
+	}
+	return err
+}
+
+// exportWriter is an export format that can be flushed once the export is done.
+type exportWriter interface {
+	db.ExportWriter
+	Flush() error
+}
+
+// newExportWriter returns the writer for the format and the content type and file extension it is served as.
+func newExportWriter(format string, out io.Writer) (e exportWriter, contentType, extension string, err error) {
+	switch strings.ToLower(format) {
+	case "", CSVExport:
+		return newCSVExport(out, false), "text/csv", "csv", nil
+	case ExcelExport, "excel":
+		return newCSVExport(out, true), "text/csv; charset=utf-8", "csv", nil
+	case JSONLExport, "ndjson":
+		return newJSONLExport(out), "application/x-ndjson", "jsonl", nil
+	}
+	return nil, "", "", fmt.Errorf("Unknown export format %q, choose csv, xlsx or jsonl", format)
+}
+
+// startedWriter notes whether anything has been written to the response, after which errors can no longer
+// change its status.
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, if the response can.
+func (w *startedWriter) Flush() {
+	if f, ok := w.ResponseWriter.(flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jrjsb4/tumblebus/client/db"
+	"os"
+)
+
+// loadGeocoder makes the connection geocode with the ZIP table in the file, a CSV of zip,latitude,longitude
+// rows. Without a file the bundled table is kept.
+func loadGeocoder(c *db.MongoConnection, file string) error {
+	if file == "" {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zips, err := db.LoadZipCentroids(f)
+	if err != nil {
+		return err
+	}
+	c.SetGeocoder(zips)
+	return nil
+}
+
+// geocodeCommand geocodes the addresses of the stored schools and guardians from the command line. It exits
+// with 1 if any address couldn't be placed and 2 if geocoding could not run.
+func geocodeCommand(args []string) int {
+	flags := flag.NewFlagSet("geocode", flag.ContinueOnError)
+	zipTable := flags.String("zips", os.Getenv("TUMBLEBUS_ZIP_TABLE"), "CSV of zip,latitude,longitude rows to geocode with")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tumblebus geocode [-zips FILE]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	c := db.OpenConnection()
+	if err := loadGeocoder(c, *zipTable); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	result, err := c.GeocodeAddresses()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("Placed %d schools and %d guardians, %d could not be placed\n", result.Schools, result.Guardians, result.Unlocated)
+	if result.Unlocated > 0 {
+		return 1
+	}
+	return 0
+}
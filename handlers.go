@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
-	//"github.com/gorilla/mux"
+	"github.com/gorilla/mux"
 	"github.com/jrjsb4/tumblebus/client/db"
+	"gopkg.in/mgo.v2/bson"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type TumbleBusAPI struct {
 	myconnection *db.MongoConnection
+	tokens       map[Role]string
+	feedSecret   string
 }
 
 type ClientForm struct {
@@ -44,6 +54,80 @@ type SchoolForm struct {
 	Url         string `json:url`
 }
 
+type EnrollmentForm struct {
+	ClientId string             `json:"clientid"`
+	ChildId  string             `json:"childid"`
+	School   string             `json:"school"`
+	Season   string             `json:"season"`
+	Class    string             `json:"class"`
+	State    db.EnrollmentState `json:"state"`
+}
+
+type StateForm struct {
+	State db.EnrollmentState `json:"state"`
+	Note  string             `json:"note"`
+}
+
+type CapacityForm struct {
+	Season   string `json:"season"`
+	Class    string `json:"class"`
+	Capacity int    `json:"capacity"`
+}
+
+type RolloverForm struct {
+	Next     *db.Season `json:"next"`
+	Deadline time.Time  `json:"deadline"`
+}
+
+type AssessmentResult struct {
+	Assessment  *db.Assessment  `json:"assessment"`
+	Certificate *db.Certificate `json:"certificate,omitempty"`
+}
+
+type AssignmentForm struct {
+	School string `json:"school"`
+	Season string `json:"season"`
+	Class  string `json:"class"`
+}
+
+type AttendanceForm struct {
+	Season  string   `json:"season"`
+	Class   string   `json:"class"`
+	Date    string   `json:"date"`
+	Present []string `json:"present"`
+}
+
+type PayoutStatusForm struct {
+	Status    db.PayoutStatus `json:"status"`
+	Reference string          `json:"reference"`
+}
+
+type SettlementForm struct {
+	Reference string  `json:"reference"`
+	Date      string  `json:"date"`
+	Amount    float64 `json:"amount"`
+}
+
+type MatchForm struct {
+	EntryId string `json:"entryid"`
+}
+
+type ChargeForm struct {
+	Amount      float64 `json:"amount"`
+	Key         string  `json:"key"`
+	Description string  `json:"description"`
+}
+
+type RefundForm struct {
+	Amount float64 `json:"amount"`
+	Key    string  `json:"key"`
+}
+
+type MergeForm struct {
+	KeptId   string `json:"keptid"`
+	MergedId string `json:"mergedid"`
+}
+
 type APIResponse struct {
 	StatusMessage string `json:statusmessage`
 	StatusId      string `json:statusid`
@@ -52,6 +136,15 @@ type APIResponse struct {
 func NewTumbleBusAPI() *TumbleBusAPI {
 	TB := &TumbleBusAPI{
 		myconnection: db.NewConnection(),
+		tokens:       loadTokens(),
+		feedSecret:   os.Getenv("TUMBLEBUS_FEED_SECRET"),
+	}
+	// Charges only go through the in-memory fake gateway when asked for, in development
+	if os.Getenv("TUMBLEBUS_FAKE_GATEWAY") != "" {
+		TB.myconnection.SetGateway(db.NewFakeGateway())
+	}
+	if err := loadGeocoder(TB.myconnection, os.Getenv("TUMBLEBUS_ZIP_TABLE")); err != nil {
+		panic(err)
 	}
 	return TB
 }
@@ -144,6 +237,1808 @@ func (Tb *TumbleBusAPI) AddChild(w http.ResponseWriter, r *http.Request) {
 	responseEncoder.Encode(&APIResponse{StatusMessage: "Ok", StatusId: clientId})
 }
 
+// dateFormat is the format of dates passed as query parameters.
+const dateFormat = "2006-01-02"
+
+// writeError encodes an APIResponse carrying the error with the given status code.
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&APIResponse{StatusMessage: err.Error(), StatusId: ""}); err != nil {
+		fmt.Fprintf(w, "Error %s occured while processing the request \n", err.Error())
+	}
+}
+
+// writeJSON encodes the value as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintf(w, "Error %s occured while encoding the response \n", err.Error())
+	}
+}
+
+// writeJSONStatus encodes the value as the JSON body of a response with the given status code. Headers can't
+// be set once the status is written, so the content type is set first.
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintf(w, "Error %s occured while encoding the response \n", err.Error())
+	}
+}
+
+// dateRange reads the optional from and to query parameters of the request.
+func dateRange(r *http.Request) (from, to time.Time, err error) {
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.ParseInLocation(dateFormat, v, time.Local); err != nil {
+			return
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.ParseInLocation(dateFormat, v, time.Local); err != nil {
+			return
+		}
+		// Include the whole of the last day
+		to = to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return
+}
+
+// AddSeason is a POST request API interface to add a season to a school.
+func (Tb *TumbleBusAPI) AddSeason(w http.ResponseWriter, r *http.Request) {
+	season := new(db.Season)
+	if err := json.NewDecoder(r.Body).Decode(season); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.AddSeason(mux.Vars(r)["school"], season); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: season.Name})
+}
+
+// AddSchedule is a POST request API interface to add a recurring class schedule to a season of a school.
+func (Tb *TumbleBusAPI) AddSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	schedule := new(db.Schedule)
+	if err := json.NewDecoder(r.Body).Decode(schedule); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.AddSchedule(vars["school"], vars["season"], schedule); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: schedule.Class})
+}
+
+// AddScheduleException is a POST request API interface to cancel or reschedule a single session of a class.
+func (Tb *TumbleBusAPI) AddScheduleException(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	exception := new(db.ScheduleException)
+	if err := json.NewDecoder(r.Body).Decode(exception); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.AddScheduleException(vars["school"], vars["season"], vars["class"], exception); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: vars["class"]})
+}
+
+// RolloverSeason is a POST request API interface that closes a season of a school, opens the next one and
+// invites the families of active children to re-enroll by the deadline. It is restricted to administrators.
+func (Tb *TumbleBusAPI) RolloverSeason(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	form := new(RolloverForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	summary, err := Tb.myconnection.RolloverSeason(vars["school"], vars["season"], form.Next, form.Deadline)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, summary)
+}
+
+// ReenrollmentSummary is a GET request API interface that lists who returned, who lapsed and who has yet to
+// answer among the families carried forward into a season. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ReenrollmentSummary(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	summary, err := Tb.myconnection.ReenrollmentSummary(vars["school"], vars["season"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, summary)
+}
+
+// LapseReenrollments is a POST request API interface that withdraws the re-enrollments of a season that were
+// not confirmed by their deadline. It is restricted to administrators.
+func (Tb *TumbleBusAPI) LapseReenrollments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	lapsed, err := Tb.myconnection.LapseReenrollments(vars["school"], vars["season"], time.Now())
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, lapsed)
+}
+
+// SetProgram is a POST request API interface to add an age banded program to a school or replace the
+// program with the same name.
+func (Tb *TumbleBusAPI) SetProgram(w http.ResponseWriter, r *http.Request) {
+	program := new(db.Program)
+	if err := json.NewDecoder(r.Body).Decode(program); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.SetProgram(mux.Vars(r)["school"], program); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: program.Name})
+}
+
+// ListPrograms is a GET request API interface that lists the programs of a school.
+func (Tb *TumbleBusAPI) ListPrograms(w http.ResponseWriter, r *http.Request) {
+	school, err := Tb.myconnection.FindSchoolByName(mux.Vars(r)["school"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, school.Programs)
+}
+
+// RemoveProgram is a DELETE request API interface to remove a program no class uses from a school.
+func (Tb *TumbleBusAPI) RemoveProgram(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := Tb.myconnection.RemoveProgram(vars["school"], vars["program"]); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: vars["program"]})
+}
+
+// ListAgeOuts is a GET request API interface that lists the children who will be too old for their program
+// when the season given by the season query parameter rolls over.
+func (Tb *TumbleBusAPI) ListAgeOuts(w http.ResponseWriter, r *http.Request) {
+	ageOuts, err := Tb.myconnection.ListAgeOuts(mux.Vars(r)["school"], r.URL.Query().Get("season"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, ageOuts)
+}
+
+// ListSessions is a GET request API interface that lists the sessions of a school within an optional date range.
+func (Tb *TumbleBusAPI) ListSessions(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	sessions, err := Tb.myconnection.ListSessions(mux.Vars(r)["school"], from, to)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, sessions)
+}
+
+// SchoolCalendar is a GET request API interface that serves the sessions of a school as an iCalendar feed.
+func (Tb *TumbleBusAPI) SchoolCalendar(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["school"]
+	sessions, err := Tb.myconnection.ListSessions(name, time.Time{}, time.Time{})
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	WriteICalendar(w, "TumbleBus at "+name, sessions)
+}
+
+// ClientCalendar is a GET request API interface that serves the sessions of the classes the children of a
+// family hold a seat in as an iCalendar feed. It is restricted to instructors and administrators, and to
+// families subscribing with the feed token of the client, see ClientCalendarFeed.
+func (Tb *TumbleBusAPI) ClientCalendar(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !Tb.feedAllowed(r, id) {
+		writeError(w, http.StatusForbidden, errors.New("You are not allowed to access this information"))
+		return
+	}
+	sessions, err := Tb.myconnection.ListClientSessions(id, time.Time{}, time.Time{})
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	WriteICalendar(w, "TumbleBus", sessions)
+}
+
+// ClientCalendarFeed is a GET request API interface that returns the address a family subscribes to for the
+// calendar of their children, carrying the feed token of the client. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ClientCalendarFeed(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	token := Tb.feedToken(id)
+	if token == "" {
+		writeError(w, http.StatusConflict, errors.New("No calendar feed secret is configured"))
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "/Client/" + id + "/calendar.ics?token=" + token, StatusId: id})
+}
+
+// SetSchoolLocation is a PUT request API interface to configure the coordinates of a school. It is restricted
+// to administrators.
+func (Tb *TumbleBusAPI) SetSchoolLocation(w http.ResponseWriter, r *http.Request) {
+	location := new(db.Coordinates)
+	if err := json.NewDecoder(r.Body).Decode(location); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.SetSchoolLocation(mux.Vars(r)["school"], location); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: mux.Vars(r)["school"]})
+}
+
+// PlanRoute is a GET request API interface that plans the driving order across the schools visited on a day.
+// The optional depot query parameter is given as "latitude,longitude" and speed, setup and flex tune the planner.
+func (Tb *TumbleBusAPI) PlanRoute(w http.ResponseWriter, r *http.Request) {
+	day, err := time.ParseInLocation(dateFormat, mux.Vars(r)["date"], time.Local)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := db.RouteOptions{}
+	if v := query.Get("depot"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != 2 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid depot %q, expected latitude,longitude", v))
+			return
+		}
+		lat, latErr := strconv.ParseFloat(parts[0], 64)
+		lon, lonErr := strconv.ParseFloat(parts[1], 64)
+		if latErr != nil || lonErr != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid depot %q, expected latitude,longitude", v))
+			return
+		}
+		opts.Depot = &db.Coordinates{Latitude: lat, Longitude: lon}
+	}
+	if v := query.Get("speed"); v != "" {
+		if opts.AverageSpeed, err = strconv.ParseFloat(v, 64); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if v := query.Get("setup"); v != "" {
+		if opts.Setup, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if v := query.Get("flex"); v != "" {
+		if opts.Flex, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	itinerary, err := Tb.myconnection.PlanDayRoute(day, opts)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, itinerary)
+}
+
+// Enroll is a POST request API interface to enroll a child in a class. When the class is full the child is
+// waitlisted, which is reported in the returned enrollment. Passing the inquiry state records an inquiry that
+// does not take a place yet. It is restricted to administrators.
+func (Tb *TumbleBusAPI) Enroll(w http.ResponseWriter, r *http.Request) {
+	form := new(EnrollmentForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var enrollment *db.Enrollment
+	var err error
+	switch form.State {
+	case "", db.Registered:
+		enrollment, err = Tb.myconnection.Enroll(form.ClientId, form.ChildId, form.School, form.Season, form.Class)
+	case db.Inquiry:
+		enrollment, err = Tb.myconnection.AddInquiry(form.ClientId, form.ChildId, form.School, form.Season, form.Class)
+	default:
+		err = fmt.Errorf("New enrollments must start as %s or %s", db.Inquiry, db.Registered)
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, enrollment)
+}
+
+// GetEnrollment is a GET request API interface to show an enrollment. It is restricted to instructors and
+// administrators.
+func (Tb *TumbleBusAPI) GetEnrollment(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := Tb.myconnection.GetEnrollment(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, enrollment)
+}
+
+// WithdrawEnrollment is a DELETE request API interface to withdraw an enrollment, offering its place to the
+// waitlist. It is restricted to administrators.
+func (Tb *TumbleBusAPI) WithdrawEnrollment(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := Tb.myconnection.WithdrawEnrollment(id); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: id})
+}
+
+// TransitionEnrollment is a PUT request API interface to move an enrollment to a new lifecycle state. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) TransitionEnrollment(w http.ResponseWriter, r *http.Request) {
+	form := new(StateForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	enrollment, err := Tb.myconnection.TransitionEnrollment(mux.Vars(r)["id"], form.State, form.Note)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, enrollment)
+}
+
+// ListEnrollments is a GET request API interface that lists enrollments filtered by the client, school,
+// season, class and state query parameters. It is restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) ListEnrollments(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	enrollments, err := Tb.myconnection.ListEnrollments(db.EnrollmentFilter{
+		ClientId: query.Get("client"),
+		School:   query.Get("school"),
+		Season:   query.Get("season"),
+		Class:    query.Get("class"),
+		State:    db.EnrollmentState(query.Get("state")),
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, enrollments)
+}
+
+// listOptions reads the paging, sorting and filtering query parameters of a list request: cursor, limit,
+// sort, school, city, addressstate, zipcode, minage, maxage, asof, minowed and maxowed. Only clients are
+// filtered by age and balance.
+func listOptions(r *http.Request) (opts db.ListOptions, err error) {
+	query := r.URL.Query()
+	opts = db.ListOptions{
+		Cursor:  query.Get("cursor"),
+		Sort:    query.Get("sort"),
+		School:  query.Get("school"),
+		City:    query.Get("city"),
+		State:   query.Get("addressstate"),
+		ZipCode: query.Get("zipcode"),
+	}
+	if v := query.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+	if query.Get("minage") != "" || query.Get("maxage") != "" || query.Get("asof") != "" {
+		if opts.MinAge, opts.MaxAge, opts.AsOf, err = ageRange(r); err != nil {
+			return
+		}
+	}
+	for name, value := range map[string]*float64{"minowed": &opts.MinOwed, "maxowed": &opts.MaxOwed} {
+		if v := query.Get(name); v != "" {
+			if *value, err = strconv.ParseFloat(v, 64); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// paged reports whether a list request asks for a page, with a cursor or a limit. Other requests get the
+// whole list as an array, as they always have.
+func paged(r *http.Request) bool {
+	query := r.URL.Query()
+	return query.Get("cursor") != "" || query.Get("limit") != ""
+}
+
+// ListClients is a GET request API interface that lists the clients, optionally only those with an enrollment
+// in the state given by the state query parameter. With a cursor or limit it returns a page, sorted by ?sort=
+// and continuing from the ?cursor= the previous page returned as next. See listOptions for the other filters.
+func (Tb *TumbleBusAPI) ListClients(w http.ResponseWriter, r *http.Request) {
+	opts, err := listOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	opts.Enrollment = db.EnrollmentState(r.URL.Query().Get("state"))
+	var result interface{}
+	if paged(r) {
+		result, err = Tb.myconnection.ListClientsPage(opts)
+	} else {
+		result, err = Tb.myconnection.ListAllClients(opts)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// ListSchools is a GET request API interface that lists the schools. With a cursor or limit it returns a
+// page, sorted by ?sort= and continuing from the ?cursor= the previous page returned as next.
+func (Tb *TumbleBusAPI) ListSchools(w http.ResponseWriter, r *http.Request) {
+	opts, err := listOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var result interface{}
+	if paged(r) {
+		result, err = Tb.myconnection.ListSchoolsPage(opts)
+	} else {
+		result, err = Tb.myconnection.ListAllSchools(opts)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// ageRange reads the minage, maxage and asof query parameters of the request. Without a maximum age any
+// age from the minimum up qualifies, and ages are measured today unless asof gives a date.
+func ageRange(r *http.Request) (minAge, maxAge int, asOf time.Time, err error) {
+	query := r.URL.Query()
+	maxAge = 200
+	asOf = time.Now()
+	if v := query.Get("minage"); v != "" {
+		if minAge, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+	if v := query.Get("maxage"); v != "" {
+		if maxAge, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+	if v := query.Get("asof"); v != "" {
+		if asOf, err = time.ParseInLocation(dateFormat, v, time.Local); err != nil {
+			return
+		}
+	}
+	if minAge > maxAge {
+		err = fmt.Errorf("The minimum age %d is above the maximum age %d", minAge, maxAge)
+	}
+	return
+}
+
+// ListWaitlist is a GET request API interface that lists the waitlist of a class in promotion order. It is
+// restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) ListWaitlist(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	enrollments, err := Tb.myconnection.ListWaitlist(mux.Vars(r)["school"], query.Get("season"), query.Get("class"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, enrollments)
+}
+
+// SetCapacity is a PUT request API interface to change the capacity of a school or of one of its classes. It
+// is restricted to administrators.
+func (Tb *TumbleBusAPI) SetCapacity(w http.ResponseWriter, r *http.Request) {
+	form := new(CapacityForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	school := mux.Vars(r)["school"]
+	if err := Tb.myconnection.SetCapacity(school, form.Season, form.Class, form.Capacity); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: school})
+}
+
+// GetClient is a GET request API interface to show a client.
+func (Tb *TumbleBusAPI) GetClient(w http.ResponseWriter, r *http.Request) {
+	client, err := Tb.myconnection.GetClientById(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, client)
+}
+
+// FindClientsByGuardian is a GET request API interface that finds the clients with a guardian matching the
+// name, phone and email query parameters.
+func (Tb *TumbleBusAPI) FindClientsByGuardian(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	clients, err := Tb.myconnection.FindClientsByGuardian(query.Get("name"), query.Get("phone"), query.Get("email"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, clients)
+}
+
+// AddGuardian is a POST request API interface to add a guardian to a client. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) AddGuardian(w http.ResponseWriter, r *http.Request) {
+	guardian := new(db.Guardian)
+	if err := json.NewDecoder(r.Body).Decode(guardian); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.AddGuardian(mux.Vars(r)["id"], guardian); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: guardian.Id.Hex()})
+}
+
+// UpdateGuardian is a PUT request API interface to update a guardian of a client. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) UpdateGuardian(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !bson.IsObjectIdHex(vars["guardian"]) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid guardian id %q", vars["guardian"]))
+		return
+	}
+	guardian := new(db.Guardian)
+	if err := json.NewDecoder(r.Body).Decode(guardian); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	guardian.Id = bson.ObjectIdHex(vars["guardian"])
+	if err := Tb.myconnection.UpdateGuardian(vars["id"], guardian); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: guardian.Id.Hex()})
+}
+
+// RemoveGuardian is a DELETE request API interface to remove a guardian from a client. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) RemoveGuardian(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := Tb.myconnection.RemoveGuardian(vars["id"], vars["guardian"]); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: vars["guardian"]})
+}
+
+// AddEmergencyContact is a POST request API interface to add an emergency contact to a client. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) AddEmergencyContact(w http.ResponseWriter, r *http.Request) {
+	contact := new(db.EmergencyContact)
+	if err := json.NewDecoder(r.Body).Decode(contact); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.AddEmergencyContact(mux.Vars(r)["id"], contact); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: contact.Id.Hex()})
+}
+
+// UpdateEmergencyContact is a PUT request API interface to update an emergency contact of a client. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) UpdateEmergencyContact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !bson.IsObjectIdHex(vars["contact"]) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid emergency contact id %q", vars["contact"]))
+		return
+	}
+	contact := new(db.EmergencyContact)
+	if err := json.NewDecoder(r.Body).Decode(contact); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	contact.Id = bson.ObjectIdHex(vars["contact"])
+	if err := Tb.myconnection.UpdateEmergencyContact(vars["id"], contact); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: contact.Id.Hex()})
+}
+
+// RemoveEmergencyContact is a DELETE request API interface to remove an emergency contact from a client. It
+// is restricted to administrators.
+func (Tb *TumbleBusAPI) RemoveEmergencyContact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := Tb.myconnection.RemoveEmergencyContact(vars["id"], vars["contact"]); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: vars["contact"]})
+}
+
+// GetHealthRecord is a GET request API interface to show the health and consent record of a child.
+// It is restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) GetHealthRecord(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	record, err := Tb.myconnection.GetHealthRecord(vars["id"], vars["child"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, record)
+}
+
+// SetHealthRecord is a PUT request API interface to store the health and consent record of a child.
+// It is restricted to administrators.
+func (Tb *TumbleBusAPI) SetHealthRecord(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	record := new(db.HealthRecord)
+	if err := json.NewDecoder(r.Body).Decode(record); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.SetHealthRecord(vars["id"], vars["child"], record); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: vars["child"]})
+}
+
+// ListRoster is a GET request API interface that lists the children of a class with their allergies,
+// medical conditions and photo consent. It is restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) ListRoster(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	roster, err := Tb.myconnection.ListRoster(mux.Vars(r)["school"], query.Get("season"), query.Get("class"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, roster)
+}
+
+// days reads the days query parameter of the request, defaulting to 30.
+func days(r *http.Request) (int, error) {
+	if v := r.URL.Query().Get("days"); v != "" {
+		return strconv.Atoi(v)
+	}
+	return 30, nil
+}
+
+// ListExpiringConsents is a GET request API interface that lists consent forms expiring within the given
+// number of days. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ListExpiringConsents(w http.ResponseWriter, r *http.Request) {
+	n, err := days(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	records, err := Tb.myconnection.ListExpiringConsents(n)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, records)
+}
+
+// SendConsentReminders is a POST request API interface that asks families to renew consent forms expiring
+// within the given number of days. It is restricted to administrators.
+func (Tb *TumbleBusAPI) SendConsentReminders(w http.ResponseWriter, r *http.Request) {
+	n, err := days(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	reminded, err := Tb.myconnection.SendConsentReminders(n)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, reminded)
+}
+
+// SetSkillLevel is a PUT request API interface to add or replace a level of the skills catalogue. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) SetSkillLevel(w http.ResponseWriter, r *http.Request) {
+	level := new(db.SkillLevel)
+	if err := json.NewDecoder(r.Body).Decode(level); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.SetSkillLevel(level); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: strconv.Itoa(level.Level)})
+}
+
+// ListSkillLevels is a GET request API interface that lists the skills catalogue.
+func (Tb *TumbleBusAPI) ListSkillLevels(w http.ResponseWriter, r *http.Request) {
+	levels, err := Tb.myconnection.ListSkillLevels()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, levels)
+}
+
+// AddAssessment is a POST request API interface to record the assessment of a skill of a child. The
+// certificate is returned when the assessment completes a level. It is restricted to instructors and
+// administrators.
+func (Tb *TumbleBusAPI) AddAssessment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	assessment := new(db.Assessment)
+	if err := json.NewDecoder(r.Body).Decode(assessment); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	certificate, err := Tb.myconnection.AddAssessment(vars["id"], vars["child"], assessment)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, &AssessmentResult{Assessment: assessment, Certificate: certificate})
+}
+
+// ChildProgress is a GET request API interface that shows the progress report of a child. It is restricted to
+// instructors and administrators.
+func (Tb *TumbleBusAPI) ChildProgress(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	report, err := Tb.myconnection.ChildProgress(vars["id"], vars["child"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// ClassProgress is a GET request API interface that lists the progress reports of the children of a class.
+// It is restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) ClassProgress(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	reports, err := Tb.myconnection.ClassProgress(mux.Vars(r)["school"], query.Get("season"), query.Get("class"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, reports)
+}
+
+// ListCertificates is a GET request API interface that lists the certificates awarded to a child. It is
+// restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) ListCertificates(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	certificates, err := Tb.myconnection.ListCertificates(vars["id"], vars["child"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, certificates)
+}
+
+// GetCertificate is a GET request API interface that downloads the PDF of a certificate. It is restricted to
+// instructors and administrators.
+func (Tb *TumbleBusAPI) GetCertificate(w http.ResponseWriter, r *http.Request) {
+	certificate, err := Tb.myconnection.GetCertificate(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"certificate-%s.pdf\"", certificate.Id.Hex()))
+	w.Write(certificate.PDF)
+}
+
+// AddInstructor is a POST request API interface to add an instructor to the staff. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) AddInstructor(w http.ResponseWriter, r *http.Request) {
+	instructor := new(db.Instructor)
+	if err := json.NewDecoder(r.Body).Decode(instructor); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.AddInstructor(instructor); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, &APIResponse{StatusMessage: "Ok", StatusId: instructor.Id.Hex()})
+}
+
+// UpdateInstructor is a PUT request API interface to update the details of an instructor. It is restricted
+// to administrators.
+func (Tb *TumbleBusAPI) UpdateInstructor(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	instructor := new(db.Instructor)
+	if err := json.NewDecoder(r.Body).Decode(instructor); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !bson.IsObjectIdHex(id) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid instructor id %q", id))
+		return
+	}
+	instructor.Id = bson.ObjectIdHex(id)
+	if err := Tb.myconnection.UpdateInstructor(instructor); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: id})
+}
+
+// GetInstructor is a GET request API interface to show an instructor. It is restricted to instructors and
+// administrators.
+func (Tb *TumbleBusAPI) GetInstructor(w http.ResponseWriter, r *http.Request) {
+	instructor, err := Tb.myconnection.GetInstructor(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, instructor)
+}
+
+// ListInstructors is a GET request API interface that lists the staff. It is restricted to instructors and
+// administrators.
+func (Tb *TumbleBusAPI) ListInstructors(w http.ResponseWriter, r *http.Request) {
+	instructors, err := Tb.myconnection.ListInstructors()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, instructors)
+}
+
+// AssignInstructor is a POST request API interface to put an instructor in charge of a class. Double
+// bookings and classes outside the availability of the instructor are refused. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) AssignInstructor(w http.ResponseWriter, r *http.Request) {
+	form := new(AssignmentForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	assignment, err := Tb.myconnection.AssignInstructor(mux.Vars(r)["id"], form.School, form.Season, form.Class)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, assignment)
+}
+
+// ListAssignments is a GET request API interface that lists the classes an instructor is assigned to. It is
+// restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) ListAssignments(w http.ResponseWriter, r *http.Request) {
+	assignments, err := Tb.myconnection.ListAssignments(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, assignments)
+}
+
+// UnassignInstructor is a DELETE request API interface to remove an assignment. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) UnassignInstructor(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["assignment"]
+	if err := Tb.myconnection.UnassignInstructor(id); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: id})
+}
+
+// WeeklySchedule is a GET request API interface that lists the sessions an instructor teaches in the week of
+// the week query parameter, this week by default. It is restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) WeeklySchedule(w http.ResponseWriter, r *http.Request) {
+	day := time.Now()
+	if v := r.URL.Query().Get("week"); v != "" {
+		var err error
+		if day, err = time.ParseInLocation(dateFormat, v, time.Local); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	sessions, err := Tb.myconnection.WeeklySchedule(mux.Vars(r)["id"], day)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, sessions)
+}
+
+// ListConflicts is a GET request API interface that lists double booked instructors within an optional date
+// range. It is restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) ListConflicts(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	conflicts, err := Tb.myconnection.ListConflicts(from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, conflicts)
+}
+
+// ListExpiringCertifications is a GET request API interface that lists instructor certifications expiring
+// within the given number of days. It is restricted to instructors and administrators.
+func (Tb *TumbleBusAPI) ListExpiringCertifications(w http.ResponseWriter, r *http.Request) {
+	n, err := days(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	expiring, err := Tb.myconnection.ListExpiringCertifications(n)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, expiring)
+}
+
+// SetPayRate is a PUT request API interface to set the per session and per mile pay of an instructor. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) SetPayRate(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rate := new(db.PayRate)
+	if err := json.NewDecoder(r.Body).Decode(rate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.SetPayRate(id, rate); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: id})
+}
+
+// payPeriod reads the from and to query parameters of the request, which are both required.
+func payPeriod(r *http.Request) (from, to time.Time, err error) {
+	if from, to, err = dateRange(r); err != nil {
+		return
+	}
+	if from.IsZero() || to.IsZero() {
+		err = fmt.Errorf("A pay period requires from and to dates")
+	}
+	return
+}
+
+// InstructorEarnings is a GET request API interface that shows the earnings of an instructor over the pay
+// period. It is restricted to administrators.
+func (Tb *TumbleBusAPI) InstructorEarnings(w http.ResponseWriter, r *http.Request) {
+	from, to, err := payPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	earnings, err := Tb.myconnection.InstructorEarnings(mux.Vars(r)["id"], from, to, db.RouteOptions{})
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, earnings)
+}
+
+// Payroll is a GET request API interface that exports the earnings of every instructor over the pay period
+// as JSON, or as CSV when the format query parameter is csv. It is restricted to administrators.
+func (Tb *TumbleBusAPI) Payroll(w http.ResponseWriter, r *http.Request) {
+	from, to, err := payPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	payroll, err := Tb.myconnection.Payroll(from, to, db.RouteOptions{})
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"payroll-%s.csv\"", from.Format(dateFormat)))
+		if err = WritePayrollCSV(w, payroll); err != nil {
+			fmt.Fprintf(w, "Error %s occured while encoding the response \n", err.Error())
+		}
+		return
+	}
+	writeJSON(w, payroll)
+}
+
+// SetContract is a PUT request API interface to set the billing terms agreed with a school. It is restricted
+// to administrators.
+func (Tb *TumbleBusAPI) SetContract(w http.ResponseWriter, r *http.Request) {
+	school := mux.Vars(r)["school"]
+	contract := new(db.Contract)
+	if err := json.NewDecoder(r.Body).Decode(contract); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.SetContract(school, contract); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: school})
+}
+
+// GetContract is a GET request API interface that shows the billing terms agreed with a school.
+func (Tb *TumbleBusAPI) GetContract(w http.ResponseWriter, r *http.Request) {
+	school, err := Tb.myconnection.FindSchoolByName(mux.Vars(r)["school"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if school.Contract == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s has no contract", school.Name))
+		return
+	}
+	writeJSON(w, school.Contract)
+}
+
+// RecordAttendance is a POST request API interface for instructors to record the children present at a
+// session of a class.
+func (Tb *TumbleBusAPI) RecordAttendance(w http.ResponseWriter, r *http.Request) {
+	form := new(AttendanceForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	day, err := time.ParseInLocation(dateFormat, form.Date, time.Local)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	attendance, err := Tb.myconnection.RecordAttendance(mux.Vars(r)["school"], form.Season, form.Class, day, form.Present)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, attendance)
+}
+
+// ListAttendance is a GET request API interface that lists the attendance recorded at a school between the
+// from and to query parameters.
+func (Tb *TumbleBusAPI) ListAttendance(w http.ResponseWriter, r *http.Request) {
+	from, to, err := payPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	attendance, err := Tb.myconnection.ListAttendance(mux.Vars(r)["school"], from, to)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, attendance)
+}
+
+// GenerateSchoolInvoice is a POST request API interface that invoices a school under its contract for the
+// period given by the from and to query parameters. It is restricted to administrators.
+func (Tb *TumbleBusAPI) GenerateSchoolInvoice(w http.ResponseWriter, r *http.Request) {
+	from, to, err := payPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	invoice, err := Tb.myconnection.GenerateSchoolInvoice(mux.Vars(r)["school"], from, to)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, invoice)
+}
+
+// ListSchoolInvoices is a GET request API interface that lists the invoices of a school.
+func (Tb *TumbleBusAPI) ListSchoolInvoices(w http.ResponseWriter, r *http.Request) {
+	invoices, err := Tb.myconnection.ListSchoolInvoices(mux.Vars(r)["school"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, invoices)
+}
+
+// GetSchoolInvoice is a GET request API interface that shows a school invoice.
+func (Tb *TumbleBusAPI) GetSchoolInvoice(w http.ResponseWriter, r *http.Request) {
+	invoice, err := Tb.myconnection.GetSchoolInvoice(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, invoice)
+}
+
+// AddSchoolPayment is a POST request API interface to record a payment from a school against an invoice. It
+// is restricted to administrators.
+func (Tb *TumbleBusAPI) AddSchoolPayment(w http.ResponseWriter, r *http.Request) {
+	payment := new(db.Payment)
+	if err := json.NewDecoder(r.Body).Decode(payment); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	invoice, err := Tb.myconnection.AddSchoolPayment(mux.Vars(r)["id"], payment)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, invoice)
+}
+
+// VoidSchoolInvoice is a DELETE request API interface that voids a school invoice issued in error. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) VoidSchoolInvoice(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := Tb.myconnection.VoidSchoolInvoice(id); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: id})
+}
+
+// SchoolStatement is a GET request API interface that shows the statement of account of a school. The
+// period defaults to the year to date.
+func (Tb *TumbleBusAPI) SchoolStatement(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	now := time.Now()
+	if from.IsZero() {
+		from = time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.Local)
+	}
+	if to.IsZero() {
+		to = now
+	}
+	statement, err := Tb.myconnection.SchoolStatement(mux.Vars(r)["school"], from, to)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, statement)
+}
+
+// CreatePayout is a POST request API interface that records the revenue share owed to a school for the
+// period given by the from and to query parameters. With preview=true the payout is worked out but not
+// recorded. It is restricted to administrators.
+func (Tb *TumbleBusAPI) CreatePayout(w http.ResponseWriter, r *http.Request) {
+	from, to, err := payPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	school := mux.Vars(r)["school"]
+	if r.URL.Query().Get("preview") == "true" {
+		payout, err := Tb.myconnection.PreviewPayout(school, from, to)
+		if err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, payout)
+		return
+	}
+	payout, err := Tb.myconnection.CreatePayout(school, from, to)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSONStatus(w, http.StatusCreated, payout)
+}
+
+// ListPayouts is a GET request API interface that lists revenue share payouts, optionally only those of the
+// school or with the status given as query parameters. With format=csv the payouts are exported as CSV. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) ListPayouts(w http.ResponseWriter, r *http.Request) {
+	school := r.URL.Query().Get("school")
+	if s, ok := mux.Vars(r)["school"]; ok {
+		school = s
+	}
+	payouts, err := Tb.myconnection.ListPayouts(school, db.PayoutStatus(r.URL.Query().Get("status")))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"payouts.csv\"")
+		if err = WritePayoutsCSV(w, payouts); err != nil {
+			fmt.Fprintf(w, "Error %s occured while encoding the response \n", err.Error())
+		}
+		return
+	}
+	writeJSON(w, payouts)
+}
+
+// GetPayout is a GET request API interface that shows a revenue share payout. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) GetPayout(w http.ResponseWriter, r *http.Request) {
+	payout, err := Tb.myconnection.GetPayout(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, payout)
+}
+
+// SetPayoutStatus is a PUT request API interface to approve, pay or cancel a revenue share payout. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) SetPayoutStatus(w http.ResponseWriter, r *http.Request) {
+	form := new(PayoutStatusForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	payout, err := Tb.myconnection.SetPayoutStatus(mux.Vars(r)["id"], form.Status, form.Reference)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, payout)
+}
+
+// PayoutStatement is a GET request API interface that returns the statement of a revenue share payout as a
+// PDF to send to the school. It is restricted to administrators.
+func (Tb *TumbleBusAPI) PayoutStatement(w http.ResponseWriter, r *http.Request) {
+	pdf, err := Tb.myconnection.PayoutStatement(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"payout-%s.pdf\"", mux.Vars(r)["id"]))
+	w.Write(pdf)
+}
+
+// ListJournal is a GET request API interface that exports the general journal between the from and to query
+// parameters as JSON, or as a CSV journal, QIF or IIF file when the format query parameter is csv, qif or
+// iif. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ListJournal(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries, err := Tb.myconnection.ListJournal(from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var write func(io.Writer, []db.JournalEntry) error
+	contentType := "text/plain"
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		writeJSON(w, entries)
+		return
+	case "csv":
+		write, contentType = WriteJournalCSV, "text/csv"
+	case "qif":
+		write = WriteQIF
+	case "iif":
+		write = WriteIIF
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Unknown export format %q", format))
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"journal.%s\"", r.URL.Query().Get("format")))
+	if err = write(w, entries); err != nil {
+		fmt.Fprintf(w, "Error %s occured while encoding the response \n", err.Error())
+	}
+}
+
+// TrialBalance is a GET request API interface that shows the balance of every ledger account as of the asof
+// query parameter, today by default. It is restricted to administrators.
+func (Tb *TumbleBusAPI) TrialBalance(w http.ResponseWriter, r *http.Request) {
+	asOf := time.Now()
+	if v := r.URL.Query().Get("asof"); v != "" {
+		day, err := time.ParseInLocation(dateFormat, v, time.Local)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		asOf = day.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	trial, err := Tb.myconnection.TrialBalance(asOf)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, trial)
+}
+
+// PostCardSettlement is a POST request API interface to record card payments deposited in the bank. It is
+// restricted to administrators.
+func (Tb *TumbleBusAPI) PostCardSettlement(w http.ResponseWriter, r *http.Request) {
+	form := new(SettlementForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	date, err := time.ParseInLocation(dateFormat, form.Date, time.Local)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entry, err := Tb.myconnection.PostCardSettlement(form.Reference, date, form.Amount)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, entry)
+}
+
+// RebuildLedger is a POST request API interface that posts payments, invoices and payouts recorded before
+// the ledger existed. It is restricted to administrators.
+func (Tb *TumbleBusAPI) RebuildLedger(w http.ResponseWriter, r *http.Request) {
+	posted, err := Tb.myconnection.RebuildLedger()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: fmt.Sprintf("Posted %d entries", posted), StatusId: ""})
+}
+
+// ImportBankStatement is a POST request API interface to import a bank statement sent as the body of the
+// request, then match its transactions to the ledger. The format query parameter is csv or ofx; without it
+// OFX files are recognised by their content. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ImportBankStatement(w http.ResponseWriter, r *http.Request) {
+	body := bufio.NewReader(r.Body)
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" {
+		format = "csv"
+		if start, _ := body.Peek(512); strings.Contains(strings.ToUpper(string(start)), "OFX") {
+			format = "ofx"
+		}
+	}
+	var transactions []db.BankTransaction
+	var err error
+	switch format {
+	case "csv":
+		transactions, err = db.ParseBankCSV(body)
+	case "ofx", "qfx":
+		transactions, err = db.ParseOFX(body)
+	default:
+		err = fmt.Errorf("Unknown statement format %q", format)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	summary, err := Tb.myconnection.ImportBankTransactions(transactions)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, summary)
+}
+
+// AutoReconcile is a POST request API interface that matches unmatched bank transactions to the ledger again,
+// for example after payments recorded late have been posted. It is restricted to administrators.
+func (Tb *TumbleBusAPI) AutoReconcile(w http.ResponseWriter, r *http.Request) {
+	matched, err := Tb.myconnection.AutoReconcile()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: fmt.Sprintf("Matched %d transactions", matched), StatusId: ""})
+}
+
+// ListBankTransactions is a GET request API interface that lists the bank transactions between the from and
+// to query parameters, optionally only those with the given status. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ListBankTransactions(w http.ResponseWriter, r *http.Request) {
+	from, to, err := payPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	transactions, err := Tb.myconnection.ListBankTransactions(from, to, db.BankMatch(r.URL.Query().Get("status")))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, transactions)
+}
+
+// MatchBankTransaction is a PUT request API interface to match a bank transaction to a journal entry by hand.
+// It is restricted to administrators.
+func (Tb *TumbleBusAPI) MatchBankTransaction(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	form := new(MatchForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := Tb.myconnection.MatchBankTransaction(id, form.EntryId); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: id})
+}
+
+// UnmatchBankTransaction is a DELETE request API interface that undoes the match of a bank transaction. It
+// is restricted to administrators.
+func (Tb *TumbleBusAPI) UnmatchBankTransaction(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := Tb.myconnection.UnmatchBankTransaction(id); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: id})
+}
+
+// IgnoreBankTransaction is a PUT request API interface that marks a bank transaction as having nothing in the
+// ledger to match. It is restricted to administrators.
+func (Tb *TumbleBusAPI) IgnoreBankTransaction(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := Tb.myconnection.IgnoreBankTransaction(id); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, &APIResponse{StatusMessage: "Ok", StatusId: id})
+}
+
+// Unreconciled is a GET request API interface that reports the bank transactions and ledger cash entries
+// between the from and to query parameters that haven't been matched. It is restricted to administrators.
+func (Tb *TumbleBusAPI) Unreconciled(w http.ResponseWriter, r *http.Request) {
+	from, to, err := payPeriod(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	report, err := Tb.myconnection.Unreconciled(from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// ChargeClient is a POST request API interface to charge the card of a client. The idempotency key comes from
+// the Idempotency-Key header or the key of the form, and sending the same request again returns the original
+// charge instead of charging the card twice. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ChargeClient(w http.ResponseWriter, r *http.Request) {
+	form := new(ChargeForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		form.Key = key
+	}
+	attempt, err := Tb.myconnection.ChargeClient(mux.Vars(r)["id"], form.Amount, form.Key, form.Description)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	status := http.StatusOK
+	switch attempt.Status {
+	case db.ChargeDeclined:
+		status = http.StatusPaymentRequired
+	case db.ChargeFailed:
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONStatus(w, status, attempt)
+}
+
+// ListChargeAttempts is a GET request API interface that lists the attempts to charge the card of a client.
+// It is restricted to administrators.
+func (Tb *TumbleBusAPI) ListChargeAttempts(w http.ResponseWriter, r *http.Request) {
+	attempts, err := Tb.myconnection.ListChargeAttempts(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, attempts)
+}
+
+// GetChargeAttempt is a GET request API interface that shows a charge attempt. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) GetChargeAttempt(w http.ResponseWriter, r *http.Request) {
+	attempt, err := Tb.myconnection.GetChargeAttempt(mux.Vars(r)["key"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, attempt)
+}
+
+// RefundCharge is a POST request API interface to refund some or all of a charge to the card. The idempotency
+// key of the refund comes from the Idempotency-Key header or the key of the form, and a refund that failed is
+// tried again by sending the same request. It is restricted to administrators.
+func (Tb *TumbleBusAPI) RefundCharge(w http.ResponseWriter, r *http.Request) {
+	form := new(RefundForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		form.Key = key
+	}
+	attempt, err := Tb.myconnection.RefundCharge(mux.Vars(r)["key"], form.Amount, form.Key)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, attempt)
+}
+
+// ListExpiringCards is a GET request API interface that reports the clients whose cards expire within the
+// given number of days or already have, so they aren't billed. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ListExpiringCards(w http.ResponseWriter, r *http.Request) {
+	n, err := days(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	expiring, err := Tb.myconnection.ListExpiringCards(n)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, expiring)
+}
+
+// SendCardUpdateRequests is a POST request API interface that asks families with expiring or expired cards to
+// update them. It is meant to be run daily and is restricted to administrators.
+func (Tb *TumbleBusAPI) SendCardUpdateRequests(w http.ResponseWriter, r *http.Request) {
+	n, err := days(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	requested, err := Tb.myconnection.SendCardUpdateRequests(n)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, requested)
+}
+
+// Import is a POST request API interface that adds the schools or families of a CSV roster in the request
+// body, reporting what happened to every row. With ?dryrun=true the roster is only checked. It is restricted
+// to administrators.
+func (Tb *TumbleBusAPI) Import(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryrun"))
+	result, err := Tb.myconnection.Import(mux.Vars(r)["kind"], r.Body, dryRun)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// Export is a GET request API interface that streams every school, client, roster entry or payment matching
+// the filters as ?format=csv, xlsx (CSV for Excel) or jsonl. The school, season, state, from and to query
+// parameters filter the export. It is restricted to administrators.
+func (Tb *TumbleBusAPI) Export(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := db.ExportFilter{
+		School: query.Get("school"),
+		Season: query.Get("season"),
+		State:  db.EnrollmentState(query.Get("state")),
+	}
+	var err error
+	if filter.From, filter.To, err = dateRange(r); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	response := &startedWriter{ResponseWriter: w}
+	out, contentType, extension, err := newExportWriter(query.Get("format"), response)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	kind := strings.ToLower(mux.Vars(r)["kind"])
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", kind+"."+extension))
+	if err = Tb.myconnection.Export(kind, filter, out); err == nil {
+		err = out.Flush()
+	}
+	// Once rows have been sent the status can't change, and the client sees the export end early
+	if err != nil && !response.started {
+		w.Header().Del("Content-Disposition")
+		w.Header().Set("Content-Type", "application/json")
+		writeError(w, http.StatusBadRequest, err)
+	}
+}
+
+// ListDuplicates is a GET request API interface that lists pairs of clients that are likely the same family,
+// most likely first. ?threshold= sets the lowest score listed, from 0 to 1. It is restricted to administrators.
+func (Tb *TumbleBusAPI) ListDuplicates(w http.ResponseWriter, r *http.Request) {
+	threshold := 0.0
+	if v := r.URL.Query().Get("threshold"); v != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(v, 64); err != nil || threshold < 0 || threshold > 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("The threshold must be between 0 and 1, not %q", v))
+			return
+		}
+	}
+	pairs, err := Tb.myconnection.ListDuplicates(threshold)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, pairs)
+}
+
+// MergeClients is a POST request API interface that merges one client into another and returns the audit
+// record of the merge. It is restricted to administrators.
+func (Tb *TumbleBusAPI) MergeClients(w http.ResponseWriter, r *http.Request) {
+	form := new(MergeForm)
+	if err := json.NewDecoder(r.Body).Decode(form); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	record, err := Tb.myconnection.MergeClients(form.KeptId, form.MergedId)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, record)
+}
+
+// ListMerges is a GET request API interface that lists the merges of the last ?days= days, 30 by default.
+// It is restricted to administrators.
+func (Tb *TumbleBusAPI) ListMerges(w http.ResponseWriter, r *http.Request) {
+	n, err := days(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	records, err := Tb.myconnection.ListMerges(time.Now().AddDate(0, 0, -n))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, records)
+}
+
+// GetMerge is a GET request API interface that shows the audit record of a merge. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) GetMerge(w http.ResponseWriter, r *http.Request) {
+	record, err := Tb.myconnection.GetMerge(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, record)
+}
+
+// UndoMerge is a POST request API interface that undoes a merge within its undo window. It is restricted to
+// administrators.
+func (Tb *TumbleBusAPI) UndoMerge(w http.ResponseWriter, r *http.Request) {
+	record, err := Tb.myconnection.UndoMerge(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, record)
+}
+
+// Search is a GET request API interface that finds parents, children and schools matching ?q=, tolerating
+// typos and spellings that sound alike, best matches first. ?limit= caps the number of results. It is
+// restricted to instructors.
+func (Tb *TumbleBusAPI) Search(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("A search needs a query in q"))
+		return
+	}
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	results, err := Tb.myconnection.Search(query, limit)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, results)
+}
+
+// miles reads the miles query parameter of the request, defaulting to 10.
+func miles(r *http.Request) (float64, error) {
+	if v := r.URL.Query().Get("miles"); v != "" {
+		return strconv.ParseFloat(v, 64)
+	}
+	return 10, nil
+}
+
+// SchoolsNear is a GET request API interface that lists the schools within ?miles= of a ZIP code, 10 by
+// default, nearest first.
+func (Tb *TumbleBusAPI) SchoolsNear(w http.ResponseWriter, r *http.Request) {
+	n, err := miles(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	nearby, err := Tb.myconnection.SchoolsNear(mux.Vars(r)["zip"], n)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, nearby)
+}
+
+// FamiliesNear is a GET request API interface that lists the families living within ?miles= of a school, 10
+// by default, nearest first. It is restricted to administrators.
+func (Tb *TumbleBusAPI) FamiliesNear(w http.ResponseWriter, r *http.Request) {
+	n, err := miles(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	nearby, err := Tb.myconnection.FamiliesNear(mux.Vars(r)["school"], n)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, nearby)
+}
+
+// GeocodeAddresses is a POST request API interface that geocodes the stored schools without coordinates and
+// the guardians. It is safe to run more than once and is restricted to administrators.
+func (Tb *TumbleBusAPI) GeocodeAddresses(w http.ResponseWriter, r *http.Request) {
+	result, err := Tb.myconnection.GeocodeAddresses()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// MigrationResult reports how many client and school documents each data migration updated.
+type MigrationResult struct {
+	ParentsMigrated   int `json:"parentsmigrated"`
+	AgesRemoved       int `json:"agesremoved"`
+	SchoolsNormalized int `json:"schoolsnormalized"`
+	ClientsNormalized int `json:"clientsnormalized"`
+}
+
+// Migrate is a POST request API interface that brings client and school documents stored by earlier
+// versions up to date. It is safe to run more than once and is restricted to administrators.
+func (Tb *TumbleBusAPI) Migrate(w http.ResponseWriter, r *http.Request) {
+	result := MigrationResult{}
+	var err error
+	if result.ParentsMigrated, err = Tb.myconnection.MigrateParents(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if result.AgesRemoved, err = Tb.myconnection.RemoveStoredAges(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	normalized, err := Tb.myconnection.NormalizeContacts(false)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	result.SchoolsNormalized, result.ClientsNormalized = normalized.Schools, normalized.Clients
+	writeJSON(w, result)
+}
+
 /*
 func (Ls *TumbleBusAPI) UrlShow(w http.ResponseWriter, r *http.Request) {
 	//retrieve the variable from the request
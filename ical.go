@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jrjsb4/tumblebus/client/db"
+	"io"
+	"strings"
+	"time"
+)
+
+const icalTimeFormat = "20060102T150405Z"
+
+// icalEscape escapes text values as required by RFC 5545.
+func icalEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// icalLine writes a content line folding it at 75 octets as required by RFC 5545.
+func icalLine(w *bufio.Writer, line string) {
+	for len(line) > 75 {
+		cut := 75
+		// Never split a multi-byte UTF-8 character
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+	}
+	w.WriteString(line + "\r\n")
+}
+
+// WriteICalendar writes the sessions as an iCalendar feed that calendar applications can subscribe to.
+func WriteICalendar(out io.Writer, name string, sessions []db.Session) error {
+	w := bufio.NewWriter(out)
+	stamp := time.Now().UTC().Format(icalTimeFormat)
+
+	icalLine(w, "BEGIN:VCALENDAR")
+	icalLine(w, "VERSION:2.0")
+	icalLine(w, "PRODID:-//TumbleBus//TumbleBus API//EN")
+	icalLine(w, "CALSCALE:GREGORIAN")
+	icalLine(w, "METHOD:PUBLISH")
+	icalLine(w, "X-WR-CALNAME:"+icalEscape(name))
+	for _, s := range sessions {
+		// The UID follows the occurrence, so subscribers see a rescheduled session as moved
+		occurrence := s.Occurrence
+		if occurrence.IsZero() {
+			occurrence = s.Start
+		}
+		icalLine(w, "BEGIN:VEVENT")
+		icalLine(w, fmt.Sprintf("UID:%s-%s-%d@tumblebus", s.SchoolId, strings.Replace(s.Class, " ", "-", -1), occurrence.Unix()))
+		icalLine(w, "DTSTAMP:"+stamp)
+		icalLine(w, "DTSTART:"+s.Start.UTC().Format(icalTimeFormat))
+		icalLine(w, "DTEND:"+s.End.UTC().Format(icalTimeFormat))
+		icalLine(w, "SUMMARY:"+icalEscape("TumbleBus "+s.Class))
+		icalLine(w, "LOCATION:"+icalEscape(s.School))
+		if s.Cancelled {
+			icalLine(w, "STATUS:CANCELLED")
+			if s.Reason != "" {
+				icalLine(w, "DESCRIPTION:"+icalEscape("Cancelled: "+s.Reason))
+			}
+		} else {
+			icalLine(w, "STATUS:CONFIRMED")
+		}
+		icalLine(w, "END:VEVENT")
+	}
+	icalLine(w, "END:VCALENDAR")
+	return w.Flush()
+}
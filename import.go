@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jrjsb4/tumblebus/client/db"
+	"os"
+	"strings"
+)
+
+// importCommand imports a CSV roster of schools or families from the command line and prints what happened
+// to every row. It exits with 1 if any row was invalid and 2 if the import could not run.
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "check the roster without importing anything")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tumblebus import [-dry-run] schools|families FILE")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	file, err := os.Open(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer file.Close()
+
+	result, err := db.OpenConnection().Import(flags.Arg(0), file, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, row := range result.Rows {
+		fmt.Printf("line %d\t%s\t%s", row.Line, row.Status, row.Name)
+		if len(row.Errors) > 0 {
+			fmt.Printf("\t%s", strings.Join(row.Errors, "; "))
+		}
+		fmt.Println()
+	}
+	verb := "Inserted"
+	if result.DryRun {
+		verb = "Would insert"
+	}
+	fmt.Printf("%s %d, %d already existed, %d invalid\n", verb, result.Inserted, result.Existing, result.Invalid)
+	if result.Invalid > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jrjsb4/tumblebus/client/db"
+	"os"
+	"strings"
+)
+
+// normalizeCommand normalizes the phones, addresses and emails of the schools and clients stored before they
+// were normalized on write, and prints the values it couldn't normalize. It exits with 1 if any value
+// couldn't be normalized and 2 if the backfill could not run.
+func normalizeCommand(args []string) int {
+	flags := flag.NewFlagSet("normalize", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would change without changing anything")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: tumblebus normalize [-dry-run]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return 2
+	}
+
+	result, err := db.OpenConnection().NormalizeContacts(*dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	for _, problem := range result.Problems {
+		fmt.Printf("%s %s\t%s\t%s\n", problem.Kind, problem.Id, problem.Name, strings.Join(problem.Problems, "; "))
+	}
+	verb := "Normalized"
+	if result.DryRun {
+		verb = "Would normalize"
+	}
+	fmt.Printf("%s %d schools and %d clients, %d with values that could not be normalized\n",
+		verb, result.Schools, result.Clients, len(result.Problems))
+	if len(result.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
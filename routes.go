@@ -36,6 +36,624 @@ func CreateRoutes(Tb *TumbleBusAPI) Routes {
 			"/Parent/",
 			Tb.AddParent,
 		},
+		Route{
+			"AddSeason",
+			"POST",
+			"/School/{school}/Season/",
+			Tb.AddSeason,
+		},
+		Route{
+			"AddSchedule",
+			"POST",
+			"/School/{school}/Season/{season}/Schedule/",
+			Tb.AddSchedule,
+		},
+		Route{
+			"RolloverSeason",
+			"POST",
+			"/School/{school}/Season/{season}/Rollover/",
+			Tb.restricted(AdminRole, Tb.RolloverSeason),
+		},
+		Route{
+			"ReenrollmentSummary",
+			"GET",
+			"/School/{school}/Season/{season}/Reenrollment/",
+			Tb.restricted(AdminRole, Tb.ReenrollmentSummary),
+		},
+		Route{
+			"LapseReenrollments",
+			"POST",
+			"/School/{school}/Season/{season}/Reenrollment/Lapse/",
+			Tb.restricted(AdminRole, Tb.LapseReenrollments),
+		},
+		Route{
+			"SetProgram",
+			"POST",
+			"/School/{school}/Program/",
+			Tb.SetProgram,
+		},
+		Route{
+			"ListPrograms",
+			"GET",
+			"/School/{school}/Program/",
+			Tb.ListPrograms,
+		},
+		Route{
+			"RemoveProgram",
+			"DELETE",
+			"/School/{school}/Program/{program}",
+			Tb.RemoveProgram,
+		},
+		Route{
+			"ListAgeOuts",
+			"GET",
+			"/School/{school}/AgeOuts/",
+			Tb.ListAgeOuts,
+		},
+		Route{
+			"AddScheduleException",
+			"POST",
+			"/School/{school}/Season/{season}/Schedule/{class}/Exception/",
+			Tb.AddScheduleException,
+		},
+		Route{
+			"ListSessions",
+			"GET",
+			"/School/{school}/Sessions/",
+			Tb.ListSessions,
+		},
+		Route{
+			"SchoolCalendar",
+			"GET",
+			"/School/{school}/calendar.ics",
+			Tb.SchoolCalendar,
+		},
+		Route{
+			"ClientCalendar",
+			"GET",
+			"/Client/{id}/calendar.ics",
+			Tb.ClientCalendar,
+		},
+		Route{
+			"ClientCalendarFeed",
+			"GET",
+			"/Client/{id}/calendar",
+			Tb.restricted(AdminRole, Tb.ClientCalendarFeed),
+		},
+		Route{
+			"SetSchoolLocation",
+			"PUT",
+			"/School/{school}/Location/",
+			Tb.restricted(AdminRole, Tb.SetSchoolLocation),
+		},
+		Route{
+			"PlanRoute",
+			"GET",
+			"/Route/{date}",
+			Tb.PlanRoute,
+		},
+		Route{
+			"Enroll",
+			"POST",
+			"/Enrollment/",
+			Tb.restricted(AdminRole, Tb.Enroll),
+		},
+		Route{
+			"ListEnrollments",
+			"GET",
+			"/Enrollment/",
+			Tb.restricted(InstructorRole, Tb.ListEnrollments),
+		},
+		Route{
+			"TransitionEnrollment",
+			"PUT",
+			"/Enrollment/{id}/State/",
+			Tb.restricted(AdminRole, Tb.TransitionEnrollment),
+		},
+		Route{
+			"ListSchools",
+			"GET",
+			"/School/",
+			Tb.ListSchools,
+		},
+		Route{
+			"ListClients",
+			"GET",
+			"/Client/",
+			Tb.restricted(AdminRole, Tb.ListClients),
+		},
+		Route{
+			"FindClientsByGuardian",
+			"GET",
+			"/Guardian/",
+			Tb.restricted(AdminRole, Tb.FindClientsByGuardian),
+		},
+		Route{
+			"GetClient",
+			"GET",
+			"/Client/{id}",
+			Tb.restricted(AdminRole, Tb.GetClient),
+		},
+		Route{
+			"AddGuardian",
+			"POST",
+			"/Client/{id}/Guardian/",
+			Tb.restricted(AdminRole, Tb.AddGuardian),
+		},
+		Route{
+			"UpdateGuardian",
+			"PUT",
+			"/Client/{id}/Guardian/{guardian}",
+			Tb.restricted(AdminRole, Tb.UpdateGuardian),
+		},
+		Route{
+			"RemoveGuardian",
+			"DELETE",
+			"/Client/{id}/Guardian/{guardian}",
+			Tb.restricted(AdminRole, Tb.RemoveGuardian),
+		},
+		Route{
+			"AddEmergencyContact",
+			"POST",
+			"/Client/{id}/EmergencyContact/",
+			Tb.restricted(AdminRole, Tb.AddEmergencyContact),
+		},
+		Route{
+			"UpdateEmergencyContact",
+			"PUT",
+			"/Client/{id}/EmergencyContact/{contact}",
+			Tb.restricted(AdminRole, Tb.UpdateEmergencyContact),
+		},
+		Route{
+			"RemoveEmergencyContact",
+			"DELETE",
+			"/Client/{id}/EmergencyContact/{contact}",
+			Tb.restricted(AdminRole, Tb.RemoveEmergencyContact),
+		},
+		Route{
+			"GetHealthRecord",
+			"GET",
+			"/Client/{id}/Child/{child}/Health/",
+			Tb.restricted(InstructorRole, Tb.GetHealthRecord),
+		},
+		Route{
+			"SetHealthRecord",
+			"PUT",
+			"/Client/{id}/Child/{child}/Health/",
+			Tb.restricted(AdminRole, Tb.SetHealthRecord),
+		},
+		Route{
+			"ListRoster",
+			"GET",
+			"/School/{school}/Roster/",
+			Tb.restricted(InstructorRole, Tb.ListRoster),
+		},
+		Route{
+			"ListExpiringConsents",
+			"GET",
+			"/Consent/Expiring/",
+			Tb.restricted(AdminRole, Tb.ListExpiringConsents),
+		},
+		Route{
+			"SendConsentReminders",
+			"POST",
+			"/Consent/Reminders/",
+			Tb.restricted(AdminRole, Tb.SendConsentReminders),
+		},
+		Route{
+			"SetSkillLevel",
+			"PUT",
+			"/Skills/",
+			Tb.restricted(AdminRole, Tb.SetSkillLevel),
+		},
+		Route{
+			"ListSkillLevels",
+			"GET",
+			"/Skills/",
+			Tb.ListSkillLevels,
+		},
+		Route{
+			"AddAssessment",
+			"POST",
+			"/Client/{id}/Child/{child}/Assessment/",
+			Tb.restricted(InstructorRole, Tb.AddAssessment),
+		},
+		Route{
+			"ChildProgress",
+			"GET",
+			"/Client/{id}/Child/{child}/Progress/",
+			Tb.restricted(InstructorRole, Tb.ChildProgress),
+		},
+		Route{
+			"ListCertificates",
+			"GET",
+			"/Client/{id}/Child/{child}/Certificate/",
+			Tb.restricted(InstructorRole, Tb.ListCertificates),
+		},
+		Route{
+			"GetCertificate",
+			"GET",
+			"/Certificate/{id}",
+			Tb.restricted(InstructorRole, Tb.GetCertificate),
+		},
+		Route{
+			"ClassProgress",
+			"GET",
+			"/School/{school}/Progress/",
+			Tb.restricted(InstructorRole, Tb.ClassProgress),
+		},
+		Route{
+			"AddInstructor",
+			"POST",
+			"/Instructor/",
+			Tb.restricted(AdminRole, Tb.AddInstructor),
+		},
+		Route{
+			"ListInstructors",
+			"GET",
+			"/Instructor/",
+			Tb.restricted(InstructorRole, Tb.ListInstructors),
+		},
+		Route{
+			"ListConflicts",
+			"GET",
+			"/Instructor/Conflicts/",
+			Tb.restricted(InstructorRole, Tb.ListConflicts),
+		},
+		Route{
+			"ListExpiringCertifications",
+			"GET",
+			"/Instructor/Certifications/Expiring/",
+			Tb.restricted(InstructorRole, Tb.ListExpiringCertifications),
+		},
+		Route{
+			"GetInstructor",
+			"GET",
+			"/Instructor/{id}",
+			Tb.restricted(InstructorRole, Tb.GetInstructor),
+		},
+		Route{
+			"UpdateInstructor",
+			"PUT",
+			"/Instructor/{id}",
+			Tb.restricted(AdminRole, Tb.UpdateInstructor),
+		},
+		Route{
+			"AssignInstructor",
+			"POST",
+			"/Instructor/{id}/Assignment/",
+			Tb.restricted(AdminRole, Tb.AssignInstructor),
+		},
+		Route{
+			"ListAssignments",
+			"GET",
+			"/Instructor/{id}/Assignment/",
+			Tb.restricted(InstructorRole, Tb.ListAssignments),
+		},
+		Route{
+			"UnassignInstructor",
+			"DELETE",
+			"/Instructor/{id}/Assignment/{assignment}",
+			Tb.restricted(AdminRole, Tb.UnassignInstructor),
+		},
+		Route{
+			"WeeklySchedule",
+			"GET",
+			"/Instructor/{id}/Schedule/",
+			Tb.restricted(InstructorRole, Tb.WeeklySchedule),
+		},
+		Route{
+			"SetPayRate",
+			"PUT",
+			"/Instructor/{id}/PayRate/",
+			Tb.restricted(AdminRole, Tb.SetPayRate),
+		},
+		Route{
+			"InstructorEarnings",
+			"GET",
+			"/Instructor/{id}/Earnings/",
+			Tb.restricted(AdminRole, Tb.InstructorEarnings),
+		},
+		Route{
+			"Payroll",
+			"GET",
+			"/Payroll/",
+			Tb.restricted(AdminRole, Tb.Payroll),
+		},
+		Route{
+			"SetContract",
+			"PUT",
+			"/School/{school}/Contract/",
+			Tb.restricted(AdminRole, Tb.SetContract),
+		},
+		Route{
+			"GetContract",
+			"GET",
+			"/School/{school}/Contract/",
+			Tb.restricted(AdminRole, Tb.GetContract),
+		},
+		Route{
+			"RecordAttendance",
+			"POST",
+			"/School/{school}/Attendance/",
+			Tb.restricted(InstructorRole, Tb.RecordAttendance),
+		},
+		Route{
+			"ListAttendance",
+			"GET",
+			"/School/{school}/Attendance/",
+			Tb.restricted(InstructorRole, Tb.ListAttendance),
+		},
+		Route{
+			"GenerateSchoolInvoice",
+			"POST",
+			"/School/{school}/Invoice/",
+			Tb.restricted(AdminRole, Tb.GenerateSchoolInvoice),
+		},
+		Route{
+			"ListSchoolInvoices",
+			"GET",
+			"/School/{school}/Invoice/",
+			Tb.restricted(AdminRole, Tb.ListSchoolInvoices),
+		},
+		Route{
+			"SchoolStatement",
+			"GET",
+			"/School/{school}/Statement/",
+			Tb.restricted(AdminRole, Tb.SchoolStatement),
+		},
+		Route{
+			"GetSchoolInvoice",
+			"GET",
+			"/Invoice/{id}",
+			Tb.restricted(AdminRole, Tb.GetSchoolInvoice),
+		},
+		Route{
+			"VoidSchoolInvoice",
+			"DELETE",
+			"/Invoice/{id}",
+			Tb.restricted(AdminRole, Tb.VoidSchoolInvoice),
+		},
+		Route{
+			"AddSchoolPayment",
+			"POST",
+			"/Invoice/{id}/Payment/",
+			Tb.restricted(AdminRole, Tb.AddSchoolPayment),
+		},
+		Route{
+			"CreatePayout",
+			"POST",
+			"/School/{school}/Payout/",
+			Tb.restricted(AdminRole, Tb.CreatePayout),
+		},
+		Route{
+			"ListSchoolPayouts",
+			"GET",
+			"/School/{school}/Payout/",
+			Tb.restricted(AdminRole, Tb.ListPayouts),
+		},
+		Route{
+			"ListPayouts",
+			"GET",
+			"/Payout/",
+			Tb.restricted(AdminRole, Tb.ListPayouts),
+		},
+		Route{
+			"GetPayout",
+			"GET",
+			"/Payout/{id}",
+			Tb.restricted(AdminRole, Tb.GetPayout),
+		},
+		Route{
+			"SetPayoutStatus",
+			"PUT",
+			"/Payout/{id}/Status/",
+			Tb.restricted(AdminRole, Tb.SetPayoutStatus),
+		},
+		Route{
+			"PayoutStatement",
+			"GET",
+			"/Payout/{id}/Statement/",
+			Tb.restricted(AdminRole, Tb.PayoutStatement),
+		},
+		Route{
+			"ListJournal",
+			"GET",
+			"/Ledger/Journal/",
+			Tb.restricted(AdminRole, Tb.ListJournal),
+		},
+		Route{
+			"TrialBalance",
+			"GET",
+			"/Ledger/TrialBalance/",
+			Tb.restricted(AdminRole, Tb.TrialBalance),
+		},
+		Route{
+			"PostCardSettlement",
+			"POST",
+			"/Ledger/Settlement/",
+			Tb.restricted(AdminRole, Tb.PostCardSettlement),
+		},
+		Route{
+			"RebuildLedger",
+			"POST",
+			"/Ledger/Rebuild/",
+			Tb.restricted(AdminRole, Tb.RebuildLedger),
+		},
+		Route{
+			"ImportBankStatement",
+			"POST",
+			"/Bank/Statement/",
+			Tb.restricted(AdminRole, Tb.ImportBankStatement),
+		},
+		Route{
+			"AutoReconcile",
+			"POST",
+			"/Bank/Reconcile/",
+			Tb.restricted(AdminRole, Tb.AutoReconcile),
+		},
+		Route{
+			"ListBankTransactions",
+			"GET",
+			"/Bank/Transaction/",
+			Tb.restricted(AdminRole, Tb.ListBankTransactions),
+		},
+		Route{
+			"MatchBankTransaction",
+			"PUT",
+			"/Bank/Transaction/{id}/Match/",
+			Tb.restricted(AdminRole, Tb.MatchBankTransaction),
+		},
+		Route{
+			"UnmatchBankTransaction",
+			"DELETE",
+			"/Bank/Transaction/{id}/Match/",
+			Tb.restricted(AdminRole, Tb.UnmatchBankTransaction),
+		},
+		Route{
+			"IgnoreBankTransaction",
+			"PUT",
+			"/Bank/Transaction/{id}/Ignore/",
+			Tb.restricted(AdminRole, Tb.IgnoreBankTransaction),
+		},
+		Route{
+			"Unreconciled",
+			"GET",
+			"/Bank/Unreconciled/",
+			Tb.restricted(AdminRole, Tb.Unreconciled),
+		},
+		Route{
+			"ChargeClient",
+			"POST",
+			"/Client/{id}/Charge/",
+			Tb.restricted(AdminRole, Tb.ChargeClient),
+		},
+		Route{
+			"ListChargeAttempts",
+			"GET",
+			"/Client/{id}/Charge/",
+			Tb.restricted(AdminRole, Tb.ListChargeAttempts),
+		},
+		Route{
+			"GetChargeAttempt",
+			"GET",
+			"/Charge/{key}",
+			Tb.restricted(AdminRole, Tb.GetChargeAttempt),
+		},
+		Route{
+			"RefundCharge",
+			"POST",
+			"/Charge/{key}/Refund/",
+			Tb.restricted(AdminRole, Tb.RefundCharge),
+		},
+		Route{
+			"ListExpiringCards",
+			"GET",
+			"/Cards/Expiring/",
+			Tb.restricted(AdminRole, Tb.ListExpiringCards),
+		},
+		Route{
+			"SendCardUpdateRequests",
+			"POST",
+			"/Cards/Reminders/",
+			Tb.restricted(AdminRole, Tb.SendCardUpdateRequests),
+		},
+		Route{
+			"Import",
+			"POST",
+			"/Import/{kind}/",
+			Tb.restricted(AdminRole, Tb.Import),
+		},
+		Route{
+			"Export",
+			"GET",
+			"/Export/{kind}/",
+			Tb.restricted(AdminRole, Tb.Export),
+		},
+		Route{
+			"ListDuplicates",
+			"GET",
+			"/Clients/Duplicates/",
+			Tb.restricted(AdminRole, Tb.ListDuplicates),
+		},
+		Route{
+			"MergeClients",
+			"POST",
+			"/Clients/Merge/",
+			Tb.restricted(AdminRole, Tb.MergeClients),
+		},
+		Route{
+			"ListMerges",
+			"GET",
+			"/Merge/",
+			Tb.restricted(AdminRole, Tb.ListMerges),
+		},
+		Route{
+			"GetMerge",
+			"GET",
+			"/Merge/{id}",
+			Tb.restricted(AdminRole, Tb.GetMerge),
+		},
+		Route{
+			"UndoMerge",
+			"POST",
+			"/Merge/{id}/Undo/",
+			Tb.restricted(AdminRole, Tb.UndoMerge),
+		},
+		Route{
+			"Search",
+			"GET",
+			"/search",
+			Tb.restricted(InstructorRole, Tb.Search),
+		},
+		Route{
+			"SchoolsNear",
+			"GET",
+			"/Schools/Near/{zip}/",
+			Tb.restricted(InstructorRole, Tb.SchoolsNear),
+		},
+		Route{
+			"FamiliesNear",
+			"GET",
+			"/School/{school}/Families/Near/",
+			Tb.restricted(AdminRole, Tb.FamiliesNear),
+		},
+		Route{
+			"GeocodeAddresses",
+			"POST",
+			"/Admin/Geocode/",
+			Tb.restricted(AdminRole, Tb.GeocodeAddresses),
+		},
+		Route{
+			"Migrate",
+			"POST",
+			"/Admin/Migrate/",
+			Tb.restricted(AdminRole, Tb.Migrate),
+		},
+		Route{
+			"GetEnrollment",
+			"GET",
+			"/Enrollment/{id}",
+			Tb.restricted(InstructorRole, Tb.GetEnrollment),
+		},
+		Route{
+			"WithdrawEnrollment",
+			"DELETE",
+			"/Enrollment/{id}",
+			Tb.restricted(AdminRole, Tb.WithdrawEnrollment),
+		},
+		Route{
+			"ListWaitlist",
+			"GET",
+			"/School/{school}/Waitlist/",
+			Tb.restricted(InstructorRole, Tb.ListWaitlist),
+		},
+		Route{
+			"SetCapacity",
+			"PUT",
+			"/School/{school}/Capacity/",
+			Tb.restricted(AdminRole, Tb.SetCapacity),
+		},
 		/*
 			Route{
 				"UrlShow",
@@ -1,14 +1,38 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"os"
+)
 
 /*
 	This is the entry point for the RESTful API.
 	The program makes use of the gorilla mux library for routing as well as
 	the mgo library to interface with mongo database backend.
+
+	Run as "tumblebus import [-dry-run] schools|families FILE" it imports a CSV
+	roster instead of serving the API, and as "tumblebus normalize [-dry-run]" it
+	normalizes the contact information of the stored schools and clients. As
+	"tumblebus geocode [-zips FILE]" it geocodes their addresses.
+
+	Set TUMBLEBUS_ZIP_TABLE to a CSV of zip,latitude,longitude rows to geocode
+	and plan routes with a complete ZIP table rather than the small bundled one.
+	No payment gateway is configured by default; set TUMBLEBUS_FAKE_GATEWAY in
+	development to charge cards through an in-memory fake. Set
+	TUMBLEBUS_FEED_SECRET to let families subscribe to the calendars of their
+	children with a per-family feed token.
 */
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "normalize" {
+		os.Exit(normalizeCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "geocode" {
+		os.Exit(geocodeCommand(os.Args[2:]))
+	}
 	//Create a new API shortner API
 	TumbleBus := NewTumbleBusAPI()
 	//Create the needed routes for the API